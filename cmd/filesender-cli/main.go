@@ -3,8 +3,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"mime/multipart"
@@ -20,6 +24,11 @@ const (
 	chunkSize = 1024 * 1024
 )
 
+// sha256Digest formats a SHA-256 as used in `Content-Digest` and `Repr-Digest` headers
+func sha256Digest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
 func uploadFile(data io.Reader) (string, error) {
 	uploadMethod := "POST"
 	uploadDesitionation := baseURL + "/upload"
@@ -60,7 +69,9 @@ func uploadFile(data io.Reader) (string, error) {
 			return "", fmt.Errorf("failed to prepare request: %w", err)
 		}
 
+		sum := sha256.Sum256(body.Bytes())
 		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Content-Digest", sha256Digest(sum[:]))
 		req.Header.Set("Upload-Complete", "0")
 
 		if isLastChunk {
@@ -124,6 +135,10 @@ func downloadFile(link string) (io.ReadCloser, error) {
 		var offset int64
 		tries := 0
 
+		// SHA-256 of the data so far, checked against the `Repr-Digest` of the server once complete
+		var digest hash.Hash
+		reprDigest := ""
+
 		for {
 			req, err := http.NewRequest("GET", link, nil)
 			if err != nil {
@@ -156,10 +171,16 @@ func downloadFile(link string) (io.ReadCloser, error) {
 			}
 			tries = 0
 
+			if offset == 0 {
+				digest = sha256.New()
+				reprDigest = resp.Header.Get("Repr-Digest")
+			}
+
 			buf := make([]byte, 32*1024)
 			for {
 				n, err := resp.Body.Read(buf)
 				if n > 0 {
+					digest.Write(buf[:n])
 					wn, werr := pw.Write(buf[:n])
 					if werr != nil {
 						err = resp.Body.Close()
@@ -179,6 +200,11 @@ func downloadFile(link string) (io.ReadCloser, error) {
 					}
 
 					if err == io.EOF {
+						if reprDigest != "" && reprDigest != sha256Digest(digest.Sum(nil)) {
+							pw.CloseWithError(errors.New("downloaded file does not match the digest of the server"))
+							return
+						}
+
 						err = pw.Close()
 						if err != nil {
 							fmt.Printf("Error: %s\n", err)
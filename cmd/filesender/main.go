@@ -3,17 +3,26 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/fs"
 	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"codeberg.org/filesender/filesender-next/internal/assets"
 	"codeberg.org/filesender/filesender-next/internal/auth"
+	"codeberg.org/filesender/filesender-next/internal/cleanup"
+	"codeberg.org/filesender/filesender-next/internal/diskspace"
 	"codeberg.org/filesender/filesender-next/internal/handlers"
 	"codeberg.org/filesender/filesender-next/internal/hash"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/quota"
+	"codeberg.org/filesender/filesender-next/internal/storage"
 )
 
 func maxUploadSize() int64 {
@@ -28,29 +37,308 @@ func maxUploadSize() int64 {
 	return int64(muInt)
 }
 
+func maxAppendSize(maxUploadSize int64) int64 {
+	// parse MAX_APPEND_SIZE environment variable as an unsigned integer. If
+	// not specified, or parsing fails, return the maximum upload size
+	maInt, err := strconv.ParseUint(os.Getenv("MAX_APPEND_SIZE"), 10, 0)
+	if err != nil || maInt == 0 {
+		return maxUploadSize
+	}
+
+	return min(int64(maInt), maxUploadSize)
+}
+
+func maxExpiry() time.Duration {
+	// parse MAX_EXPIRY_DAYS environment variable as an unsigned integer. If
+	// not specified, or parsing fails, return the default
+	days, err := strconv.ParseUint(os.Getenv("MAX_EXPIRY_DAYS"), 10, 0)
+	if err != nil || days == 0 {
+		// default = 30 days
+		return 30 * 24 * time.Hour
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func expiredRetention() time.Duration {
+	// parse EXPIRED_RETENTION_DAYS environment variable as an unsigned
+	// integer. If not specified, or parsing fails, return the default
+	days, err := strconv.ParseUint(os.Getenv("EXPIRED_RETENTION_DAYS"), 10, 0)
+	if err != nil {
+		// default = 30 days
+		return 30 * 24 * time.Hour
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func storageReserve() int64 {
+	// parse STORAGE_RESERVE environment variable as an unsigned integer. If
+	// not specified, or parsing fails, return the default
+	reserve, err := strconv.ParseUint(os.Getenv("STORAGE_RESERVE"), 10, 63)
+	if err != nil {
+		// default = 1 GiB
+		return 1024 * 1024 * 1024
+	}
+
+	return int64(reserve)
+}
+
+func storageRetryAfter() time.Duration {
+	// parse STORAGE_RETRY_AFTER environment variable as a duration, e.g.
+	// `10m`. If not specified, or parsing fails, return the default
+	retryAfter, err := time.ParseDuration(os.Getenv("STORAGE_RETRY_AFTER"))
+	if err != nil || retryAfter <= 0 {
+		return 5 * time.Minute
+	}
+
+	return retryAfter
+}
+
+func cleanupInterval() time.Duration {
+	// parse CLEANUP_INTERVAL environment variable as a duration, e.g. `30m`.
+	// If not specified, or parsing fails, return the default
+	interval, err := time.ParseDuration(os.Getenv("CLEANUP_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return time.Hour
+	}
+
+	return interval
+}
+
+func abandonedUploadIdle() time.Duration {
+	// parse ABANDONED_UPLOAD_IDLE environment variable as a duration, e.g.
+	// `12h`. If not specified, or parsing fails, return the default
+	idle, err := time.ParseDuration(os.Getenv("ABANDONED_UPLOAD_IDLE"))
+	if err != nil || idle <= 0 {
+		return 24 * time.Hour
+	}
+
+	return idle
+}
+
+// quotaLimits returns the storage quotas of users: QUOTA_DEFAULT bytes, replaced by the quotas of groups in
+// QUOTA_GROUPS or of users in QUOTA_USERS (e.g. `alice=1073741824,bob=0`). 0 or not specified means unlimited
+func quotaLimits() (quota.Limits, error) {
+	limits := quota.Limits{}
+	if value := os.Getenv("QUOTA_DEFAULT"); value != "" {
+		limit, err := strconv.ParseUint(value, 10, 63)
+		if err != nil {
+			return quota.Limits{}, fmt.Errorf("invalid QUOTA_DEFAULT: %w", err)
+		}
+		limits.Default = int64(limit)
+	}
+
+	var err error
+	limits.Users, err = quota.ParseOverrides(os.Getenv("QUOTA_USERS"))
+	if err != nil {
+		return quota.Limits{}, fmt.Errorf("invalid QUOTA_USERS: %w", err)
+	}
+
+	limits.Groups, err = quota.ParseOverrides(os.Getenv("QUOTA_GROUPS"))
+	if err != nil {
+		return quota.Limits{}, fmt.Errorf("invalid QUOTA_GROUPS: %w", err)
+	}
+
+	return limits, nil
+}
+
+// splitList splits a comma separated environment variable, ignoring empty values
+func splitList(s string) []string {
+	values := []string{}
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// sessionMaxAge parses the SESSION_MAX_AGE_HOURS environment variable, how long logins last. If not specified, or
+// parsing fails, return the default
+func sessionMaxAge() time.Duration {
+	hours, err := strconv.ParseUint(os.Getenv("SESSION_MAX_AGE_HOURS"), 10, 16)
+	if err != nil || hours == 0 {
+		return 8 * time.Hour
+	}
+
+	return time.Duration(hours) * time.Hour
+}
+
+// authMethod returns the authentication method selected with the FILESENDER_AUTH_METHOD environment variable,
+// defaults to trusting the headers set by a reverse proxy
+func authMethod(appRoot string) (auth.Auth, error) {
+	switch os.Getenv("FILESENDER_AUTH_METHOD") {
+	case "dummy":
+		slog.Info("Using `dummy` authentication method")
+		return &auth.DummyAuth{Identity: auth.Identity{
+			Subject:     os.Getenv("DUMMY_USER"),
+			DisplayName: os.Getenv("DUMMY_NAME"),
+			Emails:      splitList(os.Getenv("DUMMY_EMAIL")),
+			Groups:      splitList(os.Getenv("DUMMY_GROUPS")),
+			Admin:       os.Getenv("DUMMY_ADMIN") == "1",
+		}}, nil
+	case "oidc":
+		slog.Info("Using `oidc` authentication method", "issuer", os.Getenv("OIDC_ISSUER"))
+
+		sessionKey, err := hash.DeriveKey("session")
+		if err != nil {
+			return nil, err
+		}
+
+		scopes := strings.Fields(os.Getenv("OIDC_SCOPES"))
+
+		return auth.NewOIDC(auth.OIDCConfig{
+			Issuer:        os.Getenv("OIDC_ISSUER"),
+			ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+			AppRoot:       appRoot,
+			Scopes:        scopes,
+			SubjectClaim:  os.Getenv("OIDC_SUBJECT_CLAIM"),
+			NameClaim:     os.Getenv("OIDC_NAME_CLAIM"),
+			EmailClaim:    os.Getenv("OIDC_EMAIL_CLAIM"),
+			GroupsClaim:   os.Getenv("OIDC_GROUPS_CLAIM"),
+			AdminGroups:   splitList(os.Getenv("ADMIN_GROUPS")),
+			SessionKey:    sessionKey,
+			SessionMaxAge: sessionMaxAge(),
+		})
+	case "saml":
+		slog.Info("Using `saml` authentication method", "idp", os.Getenv("SAML_IDP_ENTITY_ID"))
+
+		certPEM, err := os.ReadFile(os.Getenv("SAML_IDP_CERTIFICATE"))
+		if err != nil {
+			return nil, fmt.Errorf("failed reading SAML_IDP_CERTIFICATE: %w", err)
+		}
+		certs, err := auth.ParseCertificates(certPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAML_IDP_CERTIFICATE: %w", err)
+		}
+
+		sessionKey, err := hash.DeriveKey("session")
+		if err != nil {
+			return nil, err
+		}
+
+		return auth.NewSAML(auth.SAMLConfig{
+			EntityID:         os.Getenv("SAML_ENTITY_ID"),
+			ACSURL:           os.Getenv("SAML_ACS_URL"),
+			AppRoot:          appRoot,
+			IdPEntityID:      os.Getenv("SAML_IDP_ENTITY_ID"),
+			IdPSSOURL:        os.Getenv("SAML_IDP_SSO_URL"),
+			IdPCertificates:  certs,
+			SubjectAttribute: os.Getenv("SAML_SUBJECT_ATTRIBUTE"),
+			NameAttribute:    os.Getenv("SAML_NAME_ATTRIBUTE"),
+			EmailAttribute:   os.Getenv("SAML_EMAIL_ATTRIBUTE"),
+			GroupsAttribute:  os.Getenv("SAML_GROUPS_ATTRIBUTE"),
+			AdminGroups:      splitList(os.Getenv("ADMIN_GROUPS")),
+			SessionKey:       sessionKey,
+			SessionMaxAge:    sessionMaxAge(),
+		})
+	}
+
+	trustedNetworks, err := auth.ParseNetworks(splitList(os.Getenv("PROXY_TRUSTED_NETWORKS")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY_TRUSTED_NETWORKS: %w", err)
+	}
+
+	return &auth.ProxyAuth{
+		TrustedNetworks: trustedNetworks,
+		Secret:          os.Getenv("PROXY_SECRET"),
+		SecretHeader:    os.Getenv("PROXY_SECRET_HEADER"),
+		UserHeader:      os.Getenv("PROXY_USER_HEADER"),
+		NameHeader:      os.Getenv("PROXY_NAME_HEADER"),
+		EmailHeader:     os.Getenv("PROXY_EMAIL_HEADER"),
+		GroupsHeader:    os.Getenv("PROXY_GROUPS_HEADER"),
+		AttributePrefix: os.Getenv("PROXY_ATTRIBUTE_PREFIX"),
+		AdminGroups:     splitList(os.Getenv("ADMIN_GROUPS")),
+	}, nil
+}
+
+// storageBackend returns the storage backend selected with the STORAGE_BACKEND environment variable, defaults to
+// storing files in the state directory
+func storageBackend(stateDir string) (storage.Backend, error) {
+	switch os.Getenv("STORAGE_BACKEND") {
+	case "", "filesystem":
+		slog.Info("Using `filesystem` storage backend")
+		return storage.NewFilesystem(stateDir), nil
+	case "s3":
+		slog.Info("Using `s3` storage backend", "endpoint", os.Getenv("S3_ENDPOINT"), "bucket", os.Getenv("S3_BUCKET"))
+
+		partSize, err := strconv.ParseInt(os.Getenv("S3_PART_SIZE"), 10, 64)
+		if err != nil {
+			partSize = storage.S3MinPartSize
+		}
+
+		return storage.NewS3(storage.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			Prefix:          os.Getenv("S3_PREFIX"),
+			PartSize:        max(partSize, storage.S3MinPartSize),
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", os.Getenv("STORAGE_BACKEND"))
+	}
+}
+
+// metadataStore returns the metadata store selected with the METADATA_BACKEND environment variable, defaults to JSON
+// files in the state directory
+func metadataStore(stateDir string) (meta.Store, error) {
+	switch os.Getenv("METADATA_BACKEND") {
+	case "", "file":
+		slog.Info("Using `file` metadata backend")
+		return meta.NewFileStore(filepath.Join(stateDir, "meta"))
+	case "bolt":
+		slog.Info("Using `bolt` metadata backend")
+		return meta.NewBoltStore(filepath.Join(stateDir, "meta.db"))
+	default:
+		return nil, fmt.Errorf("unknown metadata backend %q", os.Getenv("METADATA_BACKEND"))
+	}
+}
+
 func wrapHandlerWithTimeout(f func(http.ResponseWriter, *http.Request)) http.Handler {
 	hf := http.HandlerFunc(f)
 	return http.TimeoutHandler(hf, time.Second*10, "")
 }
 
+// wrapHandlerWithDeadline limits the time spent reading the request and writing the response
+// Unlike http.TimeoutHandler the response is not buffered, so interim (1xx) responses reach the client. Used for all
+// upload routes, so they behave the same whether an upload is resumed with the upload or the tus endpoints
+func wrapHandlerWithDeadline(f func(http.ResponseWriter, *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(time.Second * 10)
+		if err := rc.SetReadDeadline(deadline); err != nil {
+			slog.Debug("Failed setting read deadline", "error", err)
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			slog.Debug("Failed setting write deadline", "error", err)
+		}
+
+		f(w, r)
+	})
+}
+
 func main() {
 	addr := flag.String("listen", "127.0.0.1:8080", "specify the LISTEN address")
 	flag.Parse()
 
-	var authModule auth.Auth
-	authModule = &auth.ProxyAuth{}
-	if os.Getenv("FILESENDER_AUTH_METHOD") == "dummy" {
-		slog.Info("Using `dummy` authentication method")
-		authModule = &auth.DummyAuth{}
-	}
-
 	appRoot := os.Getenv("FILESENDER_APP_ROOT")
 	if appRoot == "" {
 		appRoot = "/"
 	}
 
-	maxUploadSize := maxUploadSize()
-	slog.Info("MAX_UPLOAD_SIZE", "bytes", maxUploadSize)
+	uploadLimits := handlers.UploadLimits{MaxSize: maxUploadSize()}
+	uploadLimits.MaxAppendSize = maxAppendSize(uploadLimits.MaxSize)
+	slog.Info("MAX_UPLOAD_SIZE", "bytes", uploadLimits.MaxSize)
+	slog.Info("MAX_APPEND_SIZE", "bytes", uploadLimits.MaxAppendSize)
+
+	maxExpiry := maxExpiry()
+	slog.Info("MAX_EXPIRY_DAYS", "days", maxExpiry.Hours()/24)
 
 	// Initialise database
 	stateDir := os.Getenv("STATE_DIRECTORY")
@@ -72,20 +360,171 @@ func main() {
 		os.Exit(1)
 	}
 
+	store, err := storageBackend(stateDir)
+	if err != nil {
+		slog.Error("Failed initialising storage backend", "error", err)
+		os.Exit(1)
+	}
+
+	metaStore, err := metadataStore(stateDir)
+	if err != nil {
+		slog.Error("Failed initialising metadata store", "error", err)
+		os.Exit(1)
+	}
+
+	limits, err := quotaLimits()
+	if err != nil {
+		slog.Error("Failed reading storage quotas", "error", err)
+		os.Exit(1)
+	}
+	quotas := quota.New(limits, store, quotaUsageTTL)
+	slog.Info("QUOTA_DEFAULT", "bytes", limits.Default, "users", len(limits.Users), "groups", len(limits.Groups))
+
+	// Uploads are rejected while the storage has less free space than the reserve, clients retry after a while as
+	// uploads finishing or being cancelled free space too, not only the cleanup
+	reserve := storageReserve()
+	retryAfter := storageRetryAfter()
+	space := diskspace.New(store, reserve, retryAfter)
+	slog.Info("STORAGE_RESERVE", "bytes", reserve, "retry after", retryAfter)
+
+	if flag.Arg(0) == "quota" {
+		err = quotaCommand(flag.Args()[1:], quotas, metaStore)
+		if err != nil {
+			slog.Error("Failed reporting storage quotas", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// the admin commands above don't need authentication, e.g. reaching the OpenID Connect provider
+	loginAuth, err := authMethod(appRoot)
+	if err != nil {
+		slog.Error("Failed initialising authentication method", "error", err)
+		os.Exit(1)
+	}
+
+	// API tokens are accepted in front of the authentication method, for scripted uploads
+	tokens, err := auth.NewTokenStore(filepath.Join(stateDir, "tokens"))
+	if err != nil {
+		slog.Error("Failed initialising API tokens", "error", err)
+		os.Exit(1)
+	}
+	authModule := auth.WithTokens(tokens, loginAuth)
+
+	locks, err := lock.NewFile(filepath.Join(stateDir, "locks"))
+	if err != nil {
+		slog.Error("Failed initialising upload locks", "error", err)
+		os.Exit(1)
+	}
+
+	// Chunks with a checksum are verified in the state directory before storage that can't discard them (S3) gets their
+	// data, copies left by a previous run are removed
+	spoolDir := filepath.Join(stateDir, "spool")
+	err = os.RemoveAll(spoolDir)
+	if err == nil {
+		err = os.MkdirAll(spoolDir, 0o700)
+	}
+	if err != nil {
+		slog.Error("Failed creating spool directory", "error", err)
+		os.Exit(1)
+	}
+
+	// Reconcile uploads that were in progress when the server stopped, before accepting new data
+	recovered, err := cleanup.RecoverStaged(store, metaStore, locks)
+	if err != nil {
+		slog.Error("Failed recovering staged uploads", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Recovered staged uploads", "count", recovered)
+
+	// Periodically delete expired transfers
+	cleanupInterval := cleanupInterval()
+	expiredRetention := expiredRetention()
+	slog.Info("Deleting expired transfers periodically", "interval", cleanupInterval, "metadata retention", expiredRetention)
+	go func() {
+		for range time.Tick(cleanupInterval) {
+			deleted, err := cleanup.DeleteExpired(store, metaStore, time.Now(), expiredRetention)
+			if err != nil {
+				slog.Error("Failed deleting expired transfers", "error", err)
+				continue
+			}
+
+			if deleted > 0 {
+				quotas.ForgetAll()
+			}
+			slog.Info("Deleted expired transfers", "count", deleted)
+		}
+	}()
+
+	// Periodically delete uploads that were never finished
+	abandonedUploadIdle := abandonedUploadIdle()
+	abandonedUploadDryRun := os.Getenv("ABANDONED_UPLOAD_DRY_RUN") == "1"
+	slog.Info("Deleting abandoned uploads periodically", "idle", abandonedUploadIdle, "dry run", abandonedUploadDryRun)
+	go func() {
+		for range time.Tick(cleanupInterval) {
+			deleted, err := cleanup.DeleteAbandoned(store, metaStore, locks, time.Now(), abandonedUploadIdle, abandonedUploadDryRun)
+			if err != nil {
+				slog.Error("Failed deleting abandoned uploads", "error", err)
+				continue
+			}
+
+			if deleted > 0 && !abandonedUploadDryRun {
+				quotas.ForgetAll()
+			}
+			slog.Info("Deleted abandoned uploads", "count", deleted, "dry run", abandonedUploadDryRun)
+		}
+	}()
+
 	// Initialise handler, pass embedded template files
 	handlers.Init(assets.EmbeddedTemplateFiles)
 
 	router := http.NewServeMux()
 	// API endpoints
-	router.Handle("POST /upload", wrapHandlerWithTimeout(handlers.UploadAPI(appRoot, authModule, stateDir, maxUploadSize)))
-	router.Handle("PATCH /upload/{fileID}", wrapHandlerWithTimeout(handlers.ChunkedUploadAPI(appRoot, authModule, stateDir, maxUploadSize)))
+	router.Handle("POST /upload", wrapHandlerWithDeadline(handlers.UploadAPI(appRoot, authModule, store, metaStore, quotas, space, locks, uploadLimits, maxExpiry)))
+	router.Handle("PATCH /upload/{fileID}", wrapHandlerWithDeadline(handlers.ChunkedUploadAPI(appRoot, authModule, store, metaStore, quotas, space, spoolDir, locks, uploadLimits)))
+	router.Handle("HEAD /upload/{fileID}", wrapHandlerWithDeadline(handlers.UploadOffsetAPI(authModule, store, metaStore, uploadLimits)))
+	router.Handle("DELETE /upload/{fileID}", wrapHandlerWithDeadline(handlers.CancelUploadAPI(authModule, store, metaStore, quotas, locks)))
+
+	// tus v1 endpoints
+	router.Handle("OPTIONS /tus/", wrapHandlerWithDeadline(handlers.TusOptionsAPI(uploadLimits)))
+	router.Handle("POST /tus/{$}", wrapHandlerWithDeadline(handlers.TusCreateAPI(appRoot, authModule, store, metaStore, quotas, space, locks, uploadLimits, maxExpiry, abandonedUploadIdle)))
+	router.Handle("HEAD /tus/{fileID}", wrapHandlerWithDeadline(handlers.TusHeadAPI(authModule, store, metaStore, abandonedUploadIdle)))
+	router.Handle("PATCH /tus/{fileID}", wrapHandlerWithDeadline(handlers.TusPatchAPI(appRoot, authModule, store, metaStore, quotas, space, spoolDir, locks, uploadLimits, abandonedUploadIdle)))
+	router.Handle("DELETE /tus/{fileID}", wrapHandlerWithDeadline(handlers.TusDeleteAPI(authModule, store, metaStore, quotas, locks)))
 
-	stateDirFS := http.FileServer(http.Dir(stateDir))
-	router.Handle("/download/{a}/{b}", http.StripPrefix("/download/", stateDirFS))
+	router.Handle("GET /api/transfers", wrapHandlerWithTimeout(handlers.TransfersAPI(authModule, store, metaStore)))
+	router.Handle("DELETE /api/transfers/{fileID}", wrapHandlerWithTimeout(handlers.RevokeTransferAPI(appRoot, authModule, store, metaStore, quotas, locks)))
+	router.Handle("POST /api/transfers/{fileID}/revoke", wrapHandlerWithTimeout(handlers.RevokeTransferAPI(appRoot, authModule, store, metaStore, quotas, locks)))
+	router.Handle("POST /api/transfers/{fileID}/expiry", wrapHandlerWithTimeout(handlers.ExtendTransferAPI(appRoot, authModule, store, metaStore, maxExpiry)))
+
+	router.Handle("GET /api/tokens", wrapHandlerWithTimeout(handlers.TokensAPI(authModule, tokens)))
+	router.Handle("POST /api/tokens", wrapHandlerWithTimeout(handlers.CreateTokenAPI(appRoot, authModule, tokens)))
+	router.Handle("DELETE /api/tokens/{tokenID}", wrapHandlerWithTimeout(handlers.RevokeTokenAPI(appRoot, authModule, tokens)))
+	router.Handle("POST /api/tokens/{tokenID}/revoke", wrapHandlerWithTimeout(handlers.RevokeTokenAPI(appRoot, authModule, tokens)))
+
+	router.Handle("GET /download/{publicID}", handlers.DownloadAPI(store, metaStore, locks))
+	router.Handle("GET /download/{userID}/{fileID}", handlers.DownloadAPI(store, metaStore, locks)) // links shared before public IDs existed
+
+	if oidc, ok := loginAuth.(*auth.OIDCAuth); ok {
+		router.Handle("GET /auth/login", wrapHandlerWithTimeout(oidc.LoginHandler()))
+		router.Handle("GET /auth/callback", wrapHandlerWithTimeout(oidc.CallbackHandler()))
+		router.Handle("POST /auth/logout", wrapHandlerWithTimeout(oidc.LogoutHandler()))
+	}
+	if saml, ok := loginAuth.(*auth.SAMLAuth); ok {
+		router.Handle("GET /saml/metadata", wrapHandlerWithTimeout(saml.MetadataHandler()))
+		router.Handle("GET /auth/login", wrapHandlerWithTimeout(saml.LoginHandler()))
+		router.Handle("POST /saml/acs", wrapHandlerWithTimeout(saml.ACSHandler()))
+		router.Handle("POST /auth/logout", wrapHandlerWithTimeout(saml.LogoutHandler()))
+	}
+
+	router.Handle("GET /health", wrapHandlerWithTimeout(handlers.HealthAPI(space)))
 
 	// Page handlers
-	router.Handle("GET /{$}", wrapHandlerWithTimeout(handlers.UploadTemplate(appRoot, authModule)))
-	router.Handle("GET /view/{userID}/{fileID}", wrapHandlerWithTimeout(handlers.GetDownloadTemplate(appRoot, stateDir)))
+	router.Handle("GET /{$}", wrapHandlerWithTimeout(handlers.UploadTemplate(appRoot, authModule, quotas, maxExpiry)))
+	router.Handle("GET /tokens", wrapHandlerWithTimeout(handlers.TokensTemplate(appRoot, authModule, tokens)))
+	router.Handle("GET /transfers", wrapHandlerWithTimeout(handlers.TransfersTemplate(appRoot, authModule, store, metaStore, maxExpiry)))
+	router.Handle("GET /view/{publicID}", wrapHandlerWithTimeout(handlers.GetDownloadTemplate(appRoot, store, metaStore)))
+	router.Handle("GET /view/{userID}/{fileID}", wrapHandlerWithTimeout(handlers.GetDownloadTemplate(appRoot, store, metaStore))) // links shared before public IDs existed
 
 	// Serve static files
 	subFS, err := fs.Sub(assets.EmbeddedPublicFiles, "public")
@@ -102,10 +541,15 @@ func main() {
 	})
 	router.Handle("/", http.StripPrefix("/", wrapHandlerWithTimeout(withHeaders)))
 
+	var handler http.Handler = router
+	if proxy, ok := loginAuth.(*auth.ProxyAuth); ok {
+		handler = proxy.StripHeaders(router)
+	}
+
 	// Setup server
 	s := &http.Server{
 		Addr:           *addr,
-		Handler:        router,
+		Handler:        handler,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   0,
 		MaxHeaderBytes: 1 << 20,
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/hash"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/quota"
+)
+
+// quotaUsageTTL is how long the storage used by a user is cached, before it is computed from storage again
+const quotaUsageTTL = time.Minute
+
+// quotaCommand prints the storage used by users, and their quota
+// `filesender quota [-groups <group>,...] [<user> ...]`, without users all users that have transfers are listed by
+// their hashed ID
+func quotaCommand(args []string, quotas *quota.Quotas, metaStore meta.Store) error {
+	flags := flag.NewFlagSet("quota", flag.ContinueOnError)
+	groupList := flags.String("groups", "", "comma separated groups of the users")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var groups []string
+	for _, group := range strings.Split(*groupList, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	type row struct{ user, userID, limit string }
+	rows := []row{}
+	if flags.NArg() == 0 {
+		transfers, err := metaStore.All()
+		if err != nil {
+			return err
+		}
+
+		seen := map[string]bool{}
+		for _, t := range transfers {
+			if !seen[t.UserID] {
+				seen[t.UserID] = true
+				rows = append(rows, row{user: "-", userID: t.UserID, limit: formatQuota(quotas.Limits.Default) + " (default)"})
+			}
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i].userID < rows[j].userID })
+	}
+
+	for _, user := range flags.Args() {
+		userID, err := hash.ToBase64(user)
+		if err != nil {
+			return err
+		}
+
+		rows = append(rows, row{user: user, userID: userID, limit: formatQuota(quotas.Limits.For(user, groups))})
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tUSER ID\tUSED (BYTES)\tQUOTA (BYTES)")
+	for _, r := range rows {
+		used, err := quotas.Usage(r.userID)
+		if err != nil {
+			return fmt.Errorf("usage of %s: %w", r.userID, err)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", r.user, r.userID, used, r.limit)
+	}
+
+	return tw.Flush()
+}
+
+func formatQuota(limit int64) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+
+	return fmt.Sprint(limit)
+}
@@ -1,3 +1,7 @@
 module codeberg.org/filesender/filesender-next
 
 go 1.23.4
+
+require go.etcd.io/bbolt v1.4.0
+
+require golang.org/x/sys v0.29.0 // indirect
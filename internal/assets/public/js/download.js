@@ -39,7 +39,7 @@ if (parseInt(progress.max) > 1024 * 1024 * 500 && !isSaveFilePickerSupported) {
         const parts = window.location.pathname.split("/view");
         parts.pop();
 
-        await navigator.serviceWorker.register("../../js/sw.js", { scope: `${parts.join("/view")}/` }).catch(err => {
+        await navigator.serviceWorker.register(`${parts.join("/view")}/js/sw.js`, { scope: `${parts.join("/view")}/` }).catch(err => {
             console.error(err);
             showError(`Failed registering service worker: ${err.message}`);
         });
@@ -24,7 +24,7 @@ const createServiceWorkerHandler = (ready, fileId, sw) => {
                 if (e.data.id === fileId) {
                     const iframe = document.createElement('iframe');
                     iframe.style.display = 'none';
-                    iframe.src = `../../dl/${fileId}`;
+                    iframe.src = `${window.location.pathname.split("/view/")[0]}/dl/${fileId}`;
                     document.body.appendChild(iframe);
 
                     ready();
@@ -18,7 +18,7 @@ class DownloadManager {
         this.downloadUrl = downloadUrl;
         this.totalFileSize = totalFileSize;
 
-        this.fileId = downloadUrl.pathname.split("download/")[1].split("/")[1];
+        this.fileId = downloadUrl.pathname.split("/").pop();
         this.fileName;
         this.decryptionStream;
         this.bytesDownloaded = 0;
@@ -205,6 +205,7 @@ class DownloadManager {
      */
     async resume() {
         if (this.bytesDownloaded === 0) throw new Error("Can't resume a download that has never started");
+        if (this.bytesDownloaded === this.totalFileSize) return; // the first chunk was the whole file
         let bytesDownloaded = this.bytesDownloaded.valueOf();
 
         while (true) {
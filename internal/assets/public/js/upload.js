@@ -44,6 +44,9 @@ form.addEventListener("submit", async e => {
         const fileName = sodium.crypto_secretbox_easy(sodium.from_string(file.name), nonce, key);
         manager.setFile(file, key, nonce, fileName);
     }
+    manager.setExpiryDate(formData.get("expiry_date"));
+    manager.setMessage(formData.get("message"));
+    manager.setMaxDownloads(formData.get("max_downloads"));
 
     (async () => {
         const max = file.size;
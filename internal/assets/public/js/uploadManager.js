@@ -14,6 +14,17 @@ class UploadManager {
         this.state;
         this.header;
         this.downloadLink;
+        this.expiryDate;
+        this.message;
+        this.maxDownloads;
+    }
+
+    /**
+     * Sets the date (YYYY-MM-DD) the upload expires at, sent along with the first chunk
+     * @param {string} expiryDate
+     */
+    setExpiryDate(expiryDate) {
+        this.expiryDate = expiryDate;
     }
 
     /**
@@ -37,6 +48,22 @@ class UploadManager {
         this.header = header;
     }
 
+    /**
+     * Sets the message for the recipient, sent along with the first chunk
+     * @param {string} message
+     */
+    setMessage(message) {
+        this.message = message;
+    }
+
+    /**
+     * Sets how many times the upload can be downloaded, sent along with the first chunk
+     * @param {string} maxDownloads
+     */
+    setMaxDownloads(maxDownloads) {
+        this.maxDownloads = maxDownloads;
+    }
+
     /**
      * Encrypts bytes using sodium
      * @param {Uint8Array} bytes 
@@ -59,6 +86,15 @@ class UploadManager {
      */
     async uploadFirstChunk(data, done) {
         const formData = new FormData();
+        if (this.expiryDate) {
+            formData.append("expiry_date", this.expiryDate);
+        }
+        if (this.message) {
+            formData.append("message", this.message);
+        }
+        if (this.maxDownloads) {
+            formData.append("max_downloads", this.maxDownloads);
+        }
         formData.append("file", new Blob([data]), "data.bin");
 
         var uploadComplete = "1";
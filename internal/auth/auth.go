@@ -1,9 +1,81 @@
 // Package auth contains authentication methods (as an interface) for the FileSender application
 package auth
 
-import "net/http"
+import (
+	"net/http"
+	"strings"
+)
+
+// Identity describes an authenticated user
+type Identity struct {
+	Subject     string              // stable, unique name of the user, the user ID is derived from it
+	DisplayName string              // name shown to the user, can be empty
+	Emails      []string            // email addresses of the user
+	Groups      []string            // groups and entitlements of the user
+	Admin       bool                // whether the user is an administrator
+	Method      string              // name of the authentication method, e.g. `proxy`
+	Attributes  map[string][]string // all attributes received from the identity provider, by name
+	Scopes      []string            // what the user may do with the API token they used, empty if they logged in
+}
+
+// Name returns the display name of the user, or the subject if there is none
+func (i Identity) Name() string {
+	if i.DisplayName != "" {
+		return i.DisplayName
+	}
+
+	return i.Subject
+}
+
+// Allows checks if the user may do things in `scope`, users that logged in may do everything
+func (i Identity) Allows(scope string) bool {
+	return len(i.Scopes) == 0 || containsString(i.Scopes, scope)
+}
 
 // Auth is an interface containing the authentication method
 type Auth interface {
-	UserAuth(r *http.Request) (string, error)
+	UserAuth(r *http.Request) (Identity, error)
+}
+
+// Interactive is implemented by authentication methods where users log in with their browser
+type Interactive interface {
+	Auth
+	// LoginURL returns the URL where users log in, they are sent back to `returnTo` afterwards
+	LoginURL(returnTo string) string
+}
+
+// splitValues splits an attribute holding multiple values, separated by `,` or `;`
+func splitValues(s string) []string {
+	values := []string{}
+	for _, value := range strings.FieldsFunc(s, func(c rune) bool { return c == ',' || c == ';' }) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// containsString checks if `s` is one of `values`
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAdmin checks if any of the groups of a user is one of the admin groups
+func isAdmin(groups []string, adminGroups []string) bool {
+	for _, group := range groups {
+		for _, adminGroup := range adminGroups {
+			if group == adminGroup {
+				return true
+			}
+		}
+	}
+
+	return false
 }
@@ -5,9 +5,18 @@ import (
 )
 
 // DummyAuth provides a hardcoded user for development/testing.
-type DummyAuth struct{}
+// Returns Identity, or user `dev` if it has no subject
+type DummyAuth struct {
+	Identity Identity
+}
 
 // UserAuth authenticates user
-func (s *DummyAuth) UserAuth(_ *http.Request) (string, error) {
-	return "dev", nil
+func (s *DummyAuth) UserAuth(_ *http.Request) (Identity, error) {
+	identity := s.Identity
+	if identity.Subject == "" {
+		identity.Subject = "dev"
+	}
+	identity.Method = "dummy"
+
+	return identity, nil
 }
@@ -9,13 +9,34 @@ import (
 
 func TestDummyAuth(t *testing.T) {
 	a := auth.DummyAuth{}
-	userID, err := a.UserAuth(&http.Request{})
+	identity, err := a.UserAuth(&http.Request{})
 
 	if err != nil {
 		t.Errorf("Expected no error, got: %v", err)
 	}
 
-	if userID != "dev" {
-		t.Errorf("Expected user ID \"dev\", got: \"%s\"", userID)
+	if identity.Subject != "dev" || identity.Method != "dummy" {
+		t.Errorf("Expected dummy user \"dev\", got: %+v", identity)
+	}
+	if identity.Name() != "dev" {
+		t.Errorf("Expected name \"dev\", got: \"%s\"", identity.Name())
+	}
+}
+
+func TestDummyAuthIdentity(t *testing.T) {
+	a := auth.DummyAuth{Identity: auth.Identity{
+		Subject:     "alice@example.org",
+		DisplayName: "Alice",
+		Groups:      []string{"staff"},
+		Admin:       true,
+	}}
+	identity, err := a.UserAuth(&http.Request{})
+
+	if err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	if identity.Subject != "alice@example.org" || identity.Name() != "Alice" || !identity.Admin || len(identity.Groups) != 1 {
+		t.Errorf("Expected the configured identity, got: %+v", identity)
 	}
 }
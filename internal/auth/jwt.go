@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	// hash functions used by the supported signature algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// ErrUnknownKey is returned when a token is signed with a key that is not in the key set
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// jwk is a public key in a JSON Web Key Set, see RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey returns the RSA or ECDSA public key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// signatureHash returns the hash function and key type of a JWS algorithm, see RFC 7518
+func signatureHash(alg string) (crypto.Hash, string, error) {
+	switch alg {
+	case "RS256", "PS256":
+		return crypto.SHA256, "RSA", nil
+	case "RS384", "PS384":
+		return crypto.SHA384, "RSA", nil
+	case "RS512", "PS512":
+		return crypto.SHA512, "RSA", nil
+	case "ES256":
+		return crypto.SHA256, "EC", nil
+	case "ES384":
+		return crypto.SHA384, "EC", nil
+	default:
+		return 0, "", fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+}
+
+// verifySignature checks the signature of `signed` with `key`
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hashFunc, _, err := signatureHash(alg)
+	if err != nil {
+		return err
+	}
+
+	h := hashFunc.New()
+	_, _ = h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(key, hashFunc, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(key, hashFunc, digest, signature)
+	case *ecdsa.PublicKey:
+		// JWS signatures are the concatenated r and s values
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported key")
+	}
+}
+
+// findKey returns the key a token header refers to, tokens without key ID use the only key of the right type
+func (s jwks) findKey(kid string, kty string) (jwk, error) {
+	var found []jwk
+	for _, k := range s.Keys {
+		if k.Kty != kty || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		if kid == "" || k.Kid == kid {
+			found = append(found, k)
+		}
+	}
+
+	if len(found) != 1 {
+		return jwk{}, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+
+	return found[0], nil
+}
+
+// verifyJWT checks the signature of a compact JWS with a key from `keys`, and returns its claims
+func verifyJWT(token string, keys jwks) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerData, &header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+
+	// also rejects `none`
+	_, kty, err := signatureHash(header.Alg)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := keys.findKey(header.Kid, kty)
+	if err != nil {
+		return nil, err
+	}
+	if k.Alg != "" && k.Alg != header.Alg {
+		return nil, fmt.Errorf("key %q is not used with %s", k.Kid, header.Alg)
+	}
+
+	key, err := k.publicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+
+	err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+
+	claims := map[string]any{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,522 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcLeeway is the clock skew allowed when checking the times in ID tokens
+const oidcLeeway = time.Minute
+
+// OIDCConfig contains the settings of the OpenID Connect authentication method
+type OIDCConfig struct {
+	Issuer       string // URL of the provider, its configuration is discovered from `<issuer>/.well-known/openid-configuration`
+	ClientID     string
+	ClientSecret string // empty for public clients, which only rely on PKCE
+	RedirectURL  string // the callback URL registered at the provider, e.g. `https://filesender.example.org/auth/callback`
+	AppRoot      string // path the login and logout endpoints are under, users are sent here after logging in
+	Scopes       []string
+
+	// claims mapped to the identity, the defaults are `sub`, `name`, `email` and `groups`
+	SubjectClaim string
+	NameClaim    string
+	EmailClaim   string
+	GroupsClaim  string
+	AdminGroups  []string // members of any of these groups are admins
+
+	SessionKey    []byte        // 32 bytes, encrypts the session cookies
+	SessionMaxAge time.Duration // defaults to 8 hours
+	Client        *http.Client
+}
+
+// oidcProvider is the configuration discovered from the provider
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcFlow is the state of a login in progress, kept in a cookie until the provider redirects back
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+}
+
+// OIDCAuth authenticates users with the OpenID Connect authorization code flow with PKCE
+// Once logged in, the identity of the user is kept in an encrypted session cookie
+type OIDCAuth struct {
+	cfg      OIDCConfig
+	client   *http.Client
+	provider oidcProvider
+	sessions *Sessions
+	flows    *Sessions
+
+	mu   sync.Mutex
+	keys jwks
+}
+
+// NewOIDC creates the OpenID Connect authentication method, discovering the configuration of the provider
+func NewOIDC(cfg OIDCConfig) (*OIDCAuth, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("OIDC issuer, client ID and redirect URL are required")
+	}
+
+	redirectURL, err := url.Parse(cfg.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OIDC redirect URL: %w", err)
+	}
+
+	if cfg.AppRoot == "" {
+		cfg.AppRoot = "/"
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if cfg.SessionMaxAge <= 0 {
+		cfg.SessionMaxAge = 8 * time.Hour
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	sessions, err := NewSessions("filesender_session", cfg.SessionKey, cfg.SessionMaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session key: %w", err)
+	}
+	flows, err := NewSessions("filesender_oidc_flow", cfg.SessionKey, 10*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session key: %w", err)
+	}
+	for _, s := range []*Sessions{sessions, flows} {
+		s.Path = cfg.AppRoot
+		s.Secure = redirectURL.Scheme == "https"
+	}
+
+	a := &OIDCAuth{cfg: cfg, client: client, sessions: sessions, flows: flows}
+
+	err = a.getJSON(strings.TrimSuffix(cfg.Issuer, "/")+"/.well-known/openid-configuration", &a.provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed discovering OIDC provider: %w", err)
+	}
+	if a.provider.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("OIDC provider has issuer %q, expected %q", a.provider.Issuer, cfg.Issuer)
+	}
+
+	err = a.refreshKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed getting OIDC provider keys: %w", err)
+	}
+
+	return a, nil
+}
+
+func (a *OIDCAuth) getJSON(u string, v any) error {
+	resp, err := a.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			slog.Error("Failed closing response body", "error", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (a *OIDCAuth) refreshKeys() error {
+	var keys jwks
+	err := a.getJSON(a.provider.JWKSURI, &keys)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+	return nil
+}
+
+// verifyIDToken checks the signature and claims of an ID token, and returns its claims
+// The keys are fetched again once if the token is signed with an unknown key, as providers rotate their keys
+func (a *OIDCAuth) verifyIDToken(token string, nonce string) (map[string]any, error) {
+	a.mu.Lock()
+	keys := a.keys
+	a.mu.Unlock()
+
+	claims, err := verifyJWT(token, keys)
+	if errors.Is(err, ErrUnknownKey) {
+		err = a.refreshKeys()
+		if err != nil {
+			return nil, err
+		}
+
+		a.mu.Lock()
+		keys = a.keys
+		a.mu.Unlock()
+		claims, err = verifyJWT(token, keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != a.provider.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", iss)
+	}
+	if !containsString(claimValues(claims["aud"]), a.cfg.ClientID) {
+		return nil, errors.New("ID token is not issued to this client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != a.cfg.ClientID {
+		return nil, fmt.Errorf("ID token authorized party is %q", azp)
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return nil, errors.New("ID token has expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(oidcLeeway)) {
+		return nil, errors.New("ID token is issued in the future")
+	}
+
+	return claims, nil
+}
+
+// claimValues returns the values of a claim that is a string or an array
+func claimValues(v any) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []any:
+		values := []string{}
+		for _, item := range v {
+			values = append(values, claimValues(item)...)
+		}
+		return values
+	case float64, bool:
+		return []string{fmt.Sprint(v)}
+	default:
+		data, _ := json.Marshal(v)
+		return []string{string(data)}
+	}
+}
+
+func claimOrDefault(claim string, fallback string) string {
+	if claim == "" {
+		return fallback
+	}
+
+	return claim
+}
+
+// identity maps the claims of a user to their identity
+func (a *OIDCAuth) identity(claims map[string]any) (Identity, error) {
+	subjects := claimValues(claims[claimOrDefault(a.cfg.SubjectClaim, "sub")])
+	if len(subjects) == 0 || subjects[0] == "" {
+		return Identity{}, fmt.Errorf("claim %q is missing", claimOrDefault(a.cfg.SubjectClaim, "sub"))
+	}
+
+	identity := Identity{
+		Subject:    subjects[0],
+		Emails:     claimValues(claims[claimOrDefault(a.cfg.EmailClaim, "email")]),
+		Groups:     claimValues(claims[claimOrDefault(a.cfg.GroupsClaim, "groups")]),
+		Method:     "oidc",
+		Attributes: map[string][]string{},
+	}
+	if names := claimValues(claims[claimOrDefault(a.cfg.NameClaim, "name")]); len(names) > 0 {
+		identity.DisplayName = names[0]
+	}
+	identity.Admin = isAdmin(identity.Groups, a.cfg.AdminGroups)
+
+	for name, value := range claims {
+		identity.Attributes[name] = claimValues(value)
+	}
+
+	return identity, nil
+}
+
+// UserAuth authenticates user from the session cookie
+func (a *OIDCAuth) UserAuth(r *http.Request) (Identity, error) {
+	var identity Identity
+	err := a.sessions.Load(r, &identity)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return identity, nil
+}
+
+// LoginURL returns the URL starting the login of the user
+func (a *OIDCAuth) LoginURL(returnTo string) string {
+	return a.cfg.AppRoot + "auth/login?" + url.Values{"return_to": {returnTo}}.Encode()
+}
+
+// safeReturnTo only allows returning to paths in the app after logging in, not to other sites
+func safeReturnTo(appRoot string, returnTo string) string {
+	if !strings.HasPrefix(returnTo, appRoot) || strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, "\\") {
+		return appRoot
+	}
+
+	return returnTo
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// LoginHandler handles GET /auth/login
+// Redirects to the provider, which redirects back to the callback once the user logged in
+func (a *OIDCAuth) LoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flow := oidcFlow{ReturnTo: safeReturnTo(a.cfg.AppRoot, r.URL.Query().Get("return_to"))}
+
+		var err error
+		for _, v := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+			*v, err = randomString()
+			if err != nil {
+				slog.Error("Failed creating login state", "error", err)
+				http.Error(w, "Failed starting login", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err = a.flows.Save(w, flow)
+		if err != nil {
+			slog.Error("Failed saving login state", "error", err)
+			http.Error(w, "Failed starting login", http.StatusInternalServerError)
+			return
+		}
+
+		challenge := sha256.Sum256([]byte(flow.Verifier))
+		query := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {a.cfg.ClientID},
+			"redirect_uri":          {a.cfg.RedirectURL},
+			"scope":                 {strings.Join(a.cfg.Scopes, " ")},
+			"state":                 {flow.State},
+			"nonce":                 {flow.Nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+
+		separator := "?"
+		if strings.Contains(a.provider.AuthorizationEndpoint, "?") {
+			separator = "&"
+		}
+		http.Redirect(w, r, a.provider.AuthorizationEndpoint+separator+query.Encode(), http.StatusSeeOther)
+	}
+}
+
+type oidcTokens struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+}
+
+// exchangeCode exchanges the authorization code for tokens at the token endpoint
+func (a *OIDCAuth) exchangeCode(code string, verifier string) (oidcTokens, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if a.cfg.ClientSecret == "" {
+		form.Set("client_id", a.cfg.ClientID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcTokens{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(a.cfg.ClientID), url.QueryEscape(a.cfg.ClientSecret))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return oidcTokens{}, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			slog.Error("Failed closing response body", "error", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return oidcTokens{}, fmt.Errorf("token endpoint: %s: %s", resp.Status, body)
+	}
+
+	var tokens oidcTokens
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens)
+	if err != nil {
+		return oidcTokens{}, err
+	}
+	if tokens.IDToken == "" {
+		return oidcTokens{}, errors.New("token endpoint did not return an ID token")
+	}
+
+	return tokens, nil
+}
+
+// userinfo adds the claims from the userinfo endpoint that are not in the ID token, e.g. groups
+func (a *OIDCAuth) userinfo(accessToken string, claims map[string]any) error {
+	if a.provider.UserinfoEndpoint == "" || accessToken == "" {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, a.provider.UserinfoEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			slog.Error("Failed closing response body", "error", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("userinfo endpoint: %s", resp.Status)
+	}
+
+	info := map[string]any{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&info)
+	if err != nil {
+		return err
+	}
+	if info["sub"] != claims["sub"] {
+		return errors.New("userinfo is about another user")
+	}
+
+	for name, value := range info {
+		if _, ok := claims[name]; !ok {
+			claims[name] = value
+		}
+	}
+
+	return nil
+}
+
+// CallbackHandler handles GET /auth/callback
+// Checks the state, exchanges the code for an ID token and starts the session of the user
+func (a *OIDCAuth) CallbackHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var flow oidcFlow
+		err := a.flows.Load(r, &flow)
+		if err != nil {
+			slog.Info("Login callback without login state", "error", err)
+			http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+			return
+		}
+		a.flows.Clear(w)
+
+		query := r.URL.Query()
+		if query.Get("state") != flow.State {
+			slog.Info("Login callback with wrong state")
+			http.Error(w, "Invalid login state", http.StatusBadRequest)
+			return
+		}
+		if e := query.Get("error"); e != "" {
+			slog.Info("Login failed at provider", "error", e, "description", query.Get("error_description"))
+			http.Error(w, "Login failed", http.StatusUnauthorized)
+			return
+		}
+
+		tokens, err := a.exchangeCode(query.Get("code"), flow.Verifier)
+		if err != nil {
+			slog.Error("Failed exchanging authorization code", "error", err)
+			http.Error(w, "Login failed", http.StatusBadGateway)
+			return
+		}
+
+		claims, err := a.verifyIDToken(tokens.IDToken, flow.Nonce)
+		if err != nil {
+			slog.Error("Invalid ID token", "error", err)
+			http.Error(w, "Login failed", http.StatusUnauthorized)
+			return
+		}
+
+		err = a.userinfo(tokens.AccessToken, claims)
+		if err != nil {
+			slog.Error("Failed getting userinfo", "error", err)
+		}
+
+		identity, err := a.identity(claims)
+		if err != nil {
+			slog.Error("Failed mapping claims", "error", err)
+			http.Error(w, "Login failed", http.StatusUnauthorized)
+			return
+		}
+
+		err = a.sessions.Save(w, identity)
+		if err != nil {
+			// large sets of claims don't fit in a cookie, the raw attributes are the least needed
+			slog.Info("Session too large, not keeping the attributes", "error", err)
+			identity.Attributes = nil
+			err = a.sessions.Save(w, identity)
+		}
+		if err != nil {
+			slog.Error("Failed saving session", "error", err)
+			http.Error(w, "Login failed", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("User logged in", "method", "oidc", "subject", identity.Subject)
+		http.Redirect(w, r, flow.ReturnTo, http.StatusSeeOther)
+	}
+}
+
+// LogoutHandler handles POST /auth/logout
+// Ends the session in the app, not at the provider
+func (a *OIDCAuth) LogoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !SameOrigin(r) {
+			http.Error(w, "Cross-site request rejected", http.StatusForbidden)
+			return
+		}
+
+		a.sessions.Clear(w)
+		http.Redirect(w, r, a.cfg.AppRoot, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,396 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/auth"
+)
+
+// mockProvider is an OpenID provider issuing ID tokens for the authorization requests it saw
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	// claims of the next ID token, `nonce` is added from the authorization request
+	claims map[string]any
+	// the authorization request, from the login redirect
+	authorize url.Values
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed generating key: %v", err)
+	}
+
+	p := &mockProvider{t: t, key: key, kid: "key-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": p.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "filesender" || password != "secret" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "the-code" ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != p.authorize.Get("code_challenge") {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		claims := map[string]any{"nonce": p.authorize.Get("nonce")}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(claims)})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	p.claims = map[string]any{
+		"iss":    p.server.URL,
+		"aud":    "filesender",
+		"sub":    "alice@example.org",
+		"name":   "Alice",
+		"email":  "alice@example.org",
+		"groups": []string{"staff", "admins"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"iat":    time.Now().Unix(),
+	}
+
+	return p
+}
+
+// sign returns an RS256 signed JWT with `claims`
+func (p *mockProvider) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": p.kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		p.t.Fatalf("Failed signing token: %v", err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newOIDC(t *testing.T, p *mockProvider) *auth.OIDCAuth {
+	a, err := auth.NewOIDC(auth.OIDCConfig{
+		Issuer:       p.server.URL,
+		ClientID:     "filesender",
+		ClientSecret: "secret",
+		RedirectURL:  "http://filesender.test/auth/callback",
+		AdminGroups:  []string{"admins"},
+		SessionKey:   make([]byte, 32),
+	})
+	if err != nil {
+		t.Fatalf("Failed creating OIDC auth: %v", err)
+	}
+
+	return a
+}
+
+// login goes through the login flow, and returns the response of the callback
+func login(t *testing.T, a *auth.OIDCAuth, p *mockProvider, returnTo string, callbackQuery func(url.Values)) *http.Response {
+	rr := httptest.NewRecorder()
+	a.LoginHandler()(rr, httptest.NewRequest(http.MethodGet, "/auth/login?return_to="+url.QueryEscape(returnTo), nil))
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected login to redirect, got %d", rr.Code)
+	}
+
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid login redirect: %v", err)
+	}
+	if !strings.HasPrefix(location.String(), p.server.URL+"/authorize?") {
+		t.Fatalf("Expected redirect to authorization endpoint, got %s", location)
+	}
+	p.authorize = location.Query()
+
+	query := url.Values{"code": {"the-code"}, "state": {p.authorize.Get("state")}}
+	if callbackQuery != nil {
+		callbackQuery(query)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/callback?"+query.Encode(), nil)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	rr = httptest.NewRecorder()
+	a.CallbackHandler()(rr, req)
+	return rr.Result()
+}
+
+func requestWithCookies(resp *http.Response) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range resp.Cookies() {
+		if c.MaxAge >= 0 {
+			req.AddCookie(c)
+		}
+	}
+
+	return req
+}
+
+func TestOIDCAuth(t *testing.T) {
+	p := newMockProvider(t)
+	a := newOIDC(t, p)
+
+	t.Run("Authorization request", func(t *testing.T) {
+		login(t, a, p, "/", nil)
+
+		if p.authorize.Get("client_id") != "filesender" || p.authorize.Get("response_type") != "code" {
+			t.Errorf("Unexpected authorization request: %v", p.authorize)
+		}
+		if p.authorize.Get("code_challenge_method") != "S256" || p.authorize.Get("code_challenge") == "" {
+			t.Errorf("Expected PKCE challenge, got: %v", p.authorize)
+		}
+		if !strings.Contains(p.authorize.Get("scope"), "openid") {
+			t.Errorf("Expected openid scope, got %q", p.authorize.Get("scope"))
+		}
+	})
+
+	t.Run("No session", func(t *testing.T) {
+		_, err := a.UserAuth(httptest.NewRequest(http.MethodGet, "/", nil))
+		if err == nil {
+			t.Errorf("Expected error, got nil")
+		}
+	})
+
+	t.Run("Login", func(t *testing.T) {
+		resp := login(t, a, p, "/transfers", nil)
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("Expected callback to redirect, got %d", resp.StatusCode)
+		}
+		if location := resp.Header.Get("Location"); location != "/transfers" {
+			t.Errorf("Expected redirect to /transfers, got %q", location)
+		}
+
+		identity, err := a.UserAuth(requestWithCookies(resp))
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if identity.Subject != "alice@example.org" || identity.DisplayName != "Alice" || identity.Method != "oidc" {
+			t.Errorf("Unexpected identity: %+v", identity)
+		}
+		if len(identity.Emails) != 1 || identity.Emails[0] != "alice@example.org" {
+			t.Errorf("Expected email alice@example.org, got %v", identity.Emails)
+		}
+		if len(identity.Groups) != 2 || !identity.Admin {
+			t.Errorf("Expected admin with 2 groups, got %v (admin %t)", identity.Groups, identity.Admin)
+		}
+	})
+
+	t.Run("Open redirect", func(t *testing.T) {
+		resp := login(t, a, p, "//evil.example.org/", nil)
+		if location := resp.Header.Get("Location"); location != "/" {
+			t.Errorf("Expected redirect to /, got %q", location)
+		}
+	})
+
+	t.Run("Wrong state", func(t *testing.T) {
+		resp := login(t, a, p, "/", func(q url.Values) { q.Set("state", "forged") })
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Wrong code", func(t *testing.T) {
+		resp := login(t, a, p, "/", func(q url.Values) { q.Set("code", "other") })
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected status 502, got %d", resp.StatusCode)
+		}
+	})
+
+	invalidTokens := map[string]func(claims map[string]any){
+		"Wrong audience": func(claims map[string]any) { claims["aud"] = "other" },
+		"Wrong issuer":   func(claims map[string]any) { claims["iss"] = "https://evil.example.org" },
+		"Expired":        func(claims map[string]any) { claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"Wrong nonce":    func(claims map[string]any) { claims["nonce"] = "other" },
+	}
+	for name, change := range invalidTokens {
+		t.Run(name, func(t *testing.T) {
+			original := p.claims
+			defer func() { p.claims = original }()
+
+			p.claims = map[string]any{}
+			for k, v := range original {
+				p.claims[k] = v
+			}
+			change(p.claims)
+
+			resp := login(t, a, p, "/", nil)
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("Expected status 401, got %d", resp.StatusCode)
+			}
+			if _, err := a.UserAuth(requestWithCookies(resp)); err == nil {
+				t.Errorf("Expected no session, got one")
+			}
+		})
+	}
+
+	t.Run("Rotated key", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("Failed generating key: %v", err)
+		}
+		p.key, p.kid = key, "key-2"
+
+		resp := login(t, a, p, "/", nil)
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Errorf("Expected callback to redirect, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		a.LogoutHandler()(rr, httptest.NewRequest(http.MethodPost, "/auth/logout", nil))
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+			t.Errorf("Expected session cookie to be removed, got %v", cookies)
+		}
+	})
+
+	t.Run("Cross-site logout", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+		req.Header.Set("Sec-Fetch-Site", "cross-site")
+
+		rr := httptest.NewRecorder()
+		a.LogoutHandler()(rr, req)
+		if rr.Code != http.StatusForbidden || len(rr.Result().Cookies()) != 0 {
+			t.Errorf("Expected cross-site logout to be rejected, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Login URL", func(t *testing.T) {
+		if u := a.LoginURL("/transfers"); u != "/auth/login?return_to=%2Ftransfers" {
+			t.Errorf("Unexpected login URL %q", u)
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	sessions, err := auth.NewSessions("session", make([]byte, 32), time.Hour)
+	if err != nil {
+		t.Fatalf("Failed creating sessions: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	err = sessions.Save(rr, map[string]string{"user": "alice"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	cookie := rr.Result().Cookies()[0]
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Expected HttpOnly, SameSite=Lax cookie, got %v", cookie)
+	}
+
+	t.Run("Load", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+
+		var value map[string]string
+		err := sessions.Load(req, &value)
+		if err != nil || value["user"] != "alice" {
+			t.Errorf("Expected alice, got %v (%v)", value, err)
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value[:len(cookie.Value)-2] + "AA"})
+
+		var value map[string]string
+		err := sessions.Load(req, &value)
+		if err != auth.ErrNoSession {
+			t.Errorf("Expected ErrNoSession, got %v", err)
+		}
+	})
+
+	t.Run("Other key", func(t *testing.T) {
+		key := make([]byte, 32)
+		key[0] = 1
+		other, err := auth.NewSessions("session", key, time.Hour)
+		if err != nil {
+			t.Fatalf("Failed creating sessions: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+
+		var value map[string]string
+		err = other.Load(req, &value)
+		if err != auth.ErrNoSession {
+			t.Errorf("Expected ErrNoSession, got %v", err)
+		}
+	})
+}
+
+func TestSameOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		method    string
+		fetchSite string
+		origin    string
+		expected  bool
+	}{
+		{method: http.MethodGet, fetchSite: "cross-site", expected: true},
+		{method: http.MethodPost, expected: true},
+		{method: http.MethodPost, fetchSite: "same-origin", expected: true},
+		{method: http.MethodPost, fetchSite: "none", expected: true},
+		{method: http.MethodPost, fetchSite: "same-site", expected: false},
+		{method: http.MethodPost, fetchSite: "cross-site", origin: "https://filesender.example.org", expected: false},
+		{method: http.MethodDelete, fetchSite: "cross-site", expected: false},
+		{method: http.MethodPost, origin: "https://filesender.example.org", expected: true},
+		{method: http.MethodPost, origin: "https://evil.example.org", expected: false},
+		{method: http.MethodPost, origin: "null", expected: false},
+	} {
+		req := httptest.NewRequest(tc.method, "https://filesender.example.org/api/tokens", nil)
+		if tc.fetchSite != "" {
+			req.Header.Set("Sec-Fetch-Site", tc.fetchSite)
+		}
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+
+		if same := auth.SameOrigin(req); same != tc.expected {
+			t.Errorf("Expected %t for %s with Sec-Fetch-Site %q and Origin %q, got %t", tc.expected, tc.method, tc.fetchSite, tc.origin, same)
+		}
+	}
+}
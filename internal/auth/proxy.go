@@ -1,27 +1,204 @@
 package auth
 
 import (
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
 )
 
-// ProxyAuth authenticates based on localhost check and X-Remote-User header.
-type ProxyAuth struct{}
+// Default names of the headers the reverse proxy passes the attributes of the user in
+const (
+	DefaultUserHeader      = "X-Remote-User"
+	DefaultNameHeader      = "X-Remote-Name"
+	DefaultEmailHeader     = "X-Remote-Email"
+	DefaultGroupsHeader    = "X-Remote-Groups"
+	DefaultAttributePrefix = "X-Remote-"
+	DefaultSecretHeader    = "X-Proxy-Secret"
+)
 
-// UserAuth authenticates user
-func (s *ProxyAuth) UserAuth(r *http.Request) (string, error) {
+// ProxyAuth authenticates based on the user header set by a trusted reverse proxy, by default X-Remote-User set by
+// a proxy on localhost. The other attributes of the user are read from headers as well, empty header names use the
+// defaults
+type ProxyAuth struct {
+	// networks of the trusted proxies, only loopback addresses are trusted if empty
+	TrustedNetworks []*net.IPNet
+	// if set, the proxy also has to send this secret in SecretHeader, e.g. when the network is shared
+	Secret       string
+	SecretHeader string
+
+	UserHeader   string
+	NameHeader   string
+	EmailHeader  string // multiple addresses are separated by `,` or `;`
+	GroupsHeader string // multiple groups are separated by `,` or `;`
+
+	// headers starting with AttributePrefix are passed on as the raw attributes of the user
+	AttributePrefix string
+	// members of any of these groups are admins
+	AdminGroups []string
+}
+
+func headerOrDefault(header string, fallback string) string {
+	if header == "" {
+		return fallback
+	}
+
+	return header
+}
+
+// ParseNetworks parses CIDRs like `10.0.0.0/8`, single addresses are networks of one address
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", value)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// normalizeHeader makes header names that proxies and CGI-style servers treat as the same equal, e.g.
+// `X-Remote-User`, `x_remote_user` and `X-REMOTE-USER`
+func normalizeHeader(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
+
+// isProxyHeader checks if a header is one the proxy passes the user in, or a look-alike of one
+func (s *ProxyAuth) isProxyHeader(name string) bool {
+	name = normalizeHeader(name)
+	for _, header := range []string{
+		headerOrDefault(s.UserHeader, DefaultUserHeader),
+		headerOrDefault(s.NameHeader, DefaultNameHeader),
+		headerOrDefault(s.EmailHeader, DefaultEmailHeader),
+		headerOrDefault(s.GroupsHeader, DefaultGroupsHeader),
+		headerOrDefault(s.SecretHeader, DefaultSecretHeader),
+	} {
+		if name == normalizeHeader(header) {
+			return true
+		}
+	}
+
+	return strings.HasPrefix(name, normalizeHeader(headerOrDefault(s.AttributePrefix, DefaultAttributePrefix)))
+}
+
+// trusted checks if the request is sent by a trusted proxy
+func (s *ProxyAuth) trusted(r *http.Request) error {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if !tcpAddr.IP.IsLoopback() {
-		return "", errors.New("REMOTE_ADDR is NOT `localhost`")
+
+	if len(s.TrustedNetworks) == 0 {
+		if !tcpAddr.IP.IsLoopback() {
+			return errors.New("REMOTE_ADDR is NOT `localhost`")
+		}
+	} else {
+		trusted := false
+		for _, network := range s.TrustedNetworks {
+			if network.Contains(tcpAddr.IP) {
+				trusted = true
+				break
+			}
+		}
+		if !trusted {
+			return fmt.Errorf("REMOTE_ADDR %s is NOT a trusted proxy", tcpAddr.IP)
+		}
+	}
+
+	if s.Secret != "" {
+		secret := r.Header.Get(headerOrDefault(s.SecretHeader, DefaultSecretHeader))
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(s.Secret)) != 1 {
+			return errors.New("proxy secret is missing or wrong")
+		}
+	}
+
+	return nil
+}
+
+// StripHeaders removes the headers the proxy passes the user in from requests that are not sent by a trusted
+// proxy, so handlers further on can't be fooled by them. From trusted proxies only look-alikes of the configured
+// headers are removed, e.g. `X_Remote_User` passed on next to `X-Remote-User`
+func (s *ProxyAuth) StripHeaders(next http.Handler) http.Handler {
+	exact := map[string]bool{}
+	for _, header := range []string{
+		headerOrDefault(s.UserHeader, DefaultUserHeader),
+		headerOrDefault(s.NameHeader, DefaultNameHeader),
+		headerOrDefault(s.EmailHeader, DefaultEmailHeader),
+		headerOrDefault(s.GroupsHeader, DefaultGroupsHeader),
+		headerOrDefault(s.SecretHeader, DefaultSecretHeader),
+	} {
+		exact[http.CanonicalHeaderKey(header)] = true
+	}
+	attributePrefix := http.CanonicalHeaderKey(headerOrDefault(s.AttributePrefix, DefaultAttributePrefix))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trusted := s.trusted(r) == nil
+		for name := range r.Header {
+			if !s.isProxyHeader(name) {
+				continue
+			}
+			if trusted && (exact[name] || strings.HasPrefix(name, attributePrefix)) {
+				continue
+			}
+			r.Header.Del(name)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UserAuth authenticates user
+func (s *ProxyAuth) UserAuth(r *http.Request) (Identity, error) {
+	err := s.trusted(r)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	userHeader := headerOrDefault(s.UserHeader, DefaultUserHeader)
+	remoteUsers := r.Header.Values(userHeader)
+	if len(remoteUsers) == 0 || remoteUsers[0] == "" {
+		return Identity{}, fmt.Errorf("HTTP header %s is NOT set", userHeader)
+	}
+	// a proxy appending instead of replacing the header would let clients pick the user
+	if len(remoteUsers) > 1 {
+		return Identity{}, fmt.Errorf("HTTP header %s is set multiple times", userHeader)
 	}
-	remoteUser := r.Header.Get("X-Remote-User")
-	if remoteUser == "" {
-		return "", errors.New("HTTP header X-Remote-User is NOT set")
+
+	identity := Identity{
+		Subject:     remoteUsers[0],
+		DisplayName: r.Header.Get(headerOrDefault(s.NameHeader, DefaultNameHeader)),
+		Emails:      splitValues(r.Header.Get(headerOrDefault(s.EmailHeader, DefaultEmailHeader))),
+		Groups:      splitValues(r.Header.Get(headerOrDefault(s.GroupsHeader, DefaultGroupsHeader))),
+		Method:      "proxy",
+		Attributes:  map[string][]string{},
+	}
+	identity.Admin = isAdmin(identity.Groups, s.AdminGroups)
+
+	prefix := http.CanonicalHeaderKey(headerOrDefault(s.AttributePrefix, DefaultAttributePrefix))
+	secretHeader := http.CanonicalHeaderKey(headerOrDefault(s.SecretHeader, DefaultSecretHeader))
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, prefix) && name != secretHeader {
+			identity.Attributes[name] = values
+		}
 	}
 
-	return remoteUser, nil
+	return identity, nil
 }
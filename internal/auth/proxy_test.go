@@ -2,6 +2,7 @@ package auth_test
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
@@ -12,7 +13,7 @@ func TestProxyAuth(t *testing.T) {
 	a := auth.ProxyAuth{}
 
 	t.Run("Invalid loopback", func(t *testing.T) {
-		userID, err := a.UserAuth(&http.Request{
+		identity, err := a.UserAuth(&http.Request{
 			RemoteAddr: "waow",
 		})
 
@@ -21,13 +22,13 @@ func TestProxyAuth(t *testing.T) {
 		} else if !strings.Contains(err.Error(), "missing port in address") {
 			t.Errorf("Expected error to be \"missing port in address\", got: \"%s\"", strings.Split(err.Error(), ": ")[1])
 		}
-		if userID != "" {
-			t.Errorf("Expected user ID to be empty, got: \"%s\"", userID)
+		if identity.Subject != "" {
+			t.Errorf("Expected subject to be empty, got: \"%s\"", identity.Subject)
 		}
 	})
 
 	t.Run("Not loopback", func(t *testing.T) {
-		userID, err := a.UserAuth(&http.Request{
+		identity, err := a.UserAuth(&http.Request{
 			RemoteAddr: "192.168.1.1:5678",
 		})
 
@@ -36,13 +37,13 @@ func TestProxyAuth(t *testing.T) {
 		} else if !strings.Contains(err.Error(), "REMOTE_ADDR is NOT `localhost`") {
 			t.Errorf("Expected error to be \"REMOTE_ADDR is NOT `localhost`\", got: \"%s\"", err.Error())
 		}
-		if userID != "" {
-			t.Errorf("Expected user ID to be empty, got: \"%s\"", userID)
+		if identity.Subject != "" {
+			t.Errorf("Expected subject to be empty, got: \"%s\"", identity.Subject)
 		}
 	})
 
 	t.Run("Remote user not set", func(t *testing.T) {
-		userID, err := a.UserAuth(&http.Request{
+		identity, err := a.UserAuth(&http.Request{
 			RemoteAddr: "127.0.0.1:5678",
 		})
 
@@ -51,13 +52,13 @@ func TestProxyAuth(t *testing.T) {
 		} else if !strings.Contains(err.Error(), "HTTP header X-Remote-User is NOT set") {
 			t.Errorf("Expected error to be \"HTTP header X-Remote-User is NOT set\", got: \"%s\"", err.Error())
 		}
-		if userID != "" {
-			t.Errorf("Expected user ID to be empty, got: \"%s\"", userID)
+		if identity.Subject != "" {
+			t.Errorf("Expected subject to be empty, got: \"%s\"", identity.Subject)
 		}
 	})
 
 	t.Run("Remote user empty", func(t *testing.T) {
-		userID, err := a.UserAuth(&http.Request{
+		identity, err := a.UserAuth(&http.Request{
 			RemoteAddr: "127.0.0.1:5678",
 			Header: map[string][]string{
 				"X-Remote-User": {""},
@@ -69,13 +70,13 @@ func TestProxyAuth(t *testing.T) {
 		} else if !strings.Contains(err.Error(), "HTTP header X-Remote-User is NOT set") {
 			t.Errorf("Expected error to be \"HTTP header X-Remote-User is NOT set\", got: \"%s\"", err.Error())
 		}
-		if userID != "" {
-			t.Errorf("Expected user ID to be empty, got: \"%s\"", userID)
+		if identity.Subject != "" {
+			t.Errorf("Expected subject to be empty, got: \"%s\"", identity.Subject)
 		}
 	})
 
 	t.Run("Success", func(t *testing.T) {
-		userID, err := a.UserAuth(&http.Request{
+		identity, err := a.UserAuth(&http.Request{
 			RemoteAddr: "127.0.0.1:5678",
 			Header: map[string][]string{
 				"X-Remote-User": {"dev"},
@@ -86,8 +87,227 @@ func TestProxyAuth(t *testing.T) {
 			t.Errorf("Expected no error, got: %v", err)
 		}
 
-		if userID != "dev" {
-			t.Errorf("Expected user ID to be \"dev\", got: \"%s\"", userID)
+		if identity.Subject != "dev" || identity.Method != "proxy" {
+			t.Errorf("Expected subject to be \"dev\", got: %+v", identity)
+		}
+	})
+}
+
+func TestProxyAuthAttributes(t *testing.T) {
+	t.Run("Default headers", func(t *testing.T) {
+		a := auth.ProxyAuth{AdminGroups: []string{"admins"}}
+		identity, err := a.UserAuth(&http.Request{
+			RemoteAddr: "127.0.0.1:5678",
+			Header: map[string][]string{
+				"X-Remote-User":        {"alice@example.org"},
+				"X-Remote-Name":        {"Alice"},
+				"X-Remote-Email":       {"alice@example.org;a@example.org"},
+				"X-Remote-Groups":      {"staff; students,, admins "},
+				"X-Remote-Affiliation": {"member@example.org"},
+				"Accept":               {"text/html"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if identity.DisplayName != "Alice" {
+			t.Errorf("Expected display name \"Alice\", got: \"%s\"", identity.DisplayName)
+		}
+		if strings.Join(identity.Emails, "|") != "alice@example.org|a@example.org" {
+			t.Errorf("Expected 2 email addresses, got: %q", identity.Emails)
+		}
+		if strings.Join(identity.Groups, "|") != "staff|students|admins" {
+			t.Errorf("Expected groups [staff students admins], got: %q", identity.Groups)
+		}
+		if !identity.Admin {
+			t.Errorf("Expected member of admins to be admin")
+		}
+		if identity.Attributes["X-Remote-Affiliation"][0] != "member@example.org" {
+			t.Errorf("Expected affiliation attribute, got: %v", identity.Attributes)
+		}
+		if _, ok := identity.Attributes["Accept"]; ok {
+			t.Errorf("Expected only attribute headers, got: %v", identity.Attributes)
+		}
+	})
+
+	t.Run("Configured headers", func(t *testing.T) {
+		a := auth.ProxyAuth{
+			UserHeader:      "Eppn",
+			NameHeader:      "Display-Name",
+			EmailHeader:     "Mail",
+			GroupsHeader:    "Entitlement",
+			AttributePrefix: "Shib-",
+		}
+		identity, err := a.UserAuth(&http.Request{
+			RemoteAddr: "127.0.0.1:5678",
+			Header: map[string][]string{
+				"Eppn":                   {"bob@example.org"},
+				"Display-Name":           {"Bob"},
+				"Mail":                   {"bob@example.org"},
+				"Entitlement":            {"urn:example:staff"},
+				"Shib-Identity-Provider": {"https://idp.example.org"},
+				"X-Remote-User":          {"mallory"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if identity.Subject != "bob@example.org" || identity.Name() != "Bob" || identity.Emails[0] != "bob@example.org" {
+			t.Errorf("Expected identity of bob, got: %+v", identity)
+		}
+		if strings.Join(identity.Groups, "|") != "urn:example:staff" || identity.Admin {
+			t.Errorf("Expected non-admin with entitlement, got: %+v", identity)
+		}
+		if len(identity.Attributes) != 1 || identity.Attributes["Shib-Identity-Provider"] == nil {
+			t.Errorf("Expected the Shib- attributes, got: %v", identity.Attributes)
+		}
+
+		_, err = a.UserAuth(&http.Request{
+			RemoteAddr: "127.0.0.1:5678",
+			Header:     map[string][]string{"X-Remote-User": {"mallory"}},
+		})
+		if err == nil || !strings.Contains(err.Error(), "Eppn") {
+			t.Errorf("Expected error about the missing Eppn header, got: %v", err)
+		}
+	})
+}
+
+func TestProxyAuthTrustedNetworks(t *testing.T) {
+	networks, err := auth.ParseNetworks([]string{"10.0.0.0/8", "fd00::/8", "192.168.1.5"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	a := auth.ProxyAuth{TrustedNetworks: networks, UserHeader: "X-Forwarded-User"}
+
+	tests := []struct {
+		remoteAddr string
+		trusted    bool
+	}{
+		{"10.1.2.3:5678", true},
+		{"[fd00::1]:5678", true},
+		{"192.168.1.5:5678", true},
+		{"192.168.1.6:5678", false},
+		{"127.0.0.1:5678", false},
+		{"[::1]:5678", false},
+	}
+	for _, test := range tests {
+		t.Run(test.remoteAddr, func(t *testing.T) {
+			identity, err := a.UserAuth(&http.Request{
+				RemoteAddr: test.remoteAddr,
+				Header:     map[string][]string{"X-Forwarded-User": {"alice"}},
+			})
+
+			if test.trusted && (err != nil || identity.Subject != "alice") {
+				t.Errorf("Expected alice, got: %+v (%v)", identity, err)
+			}
+			if !test.trusted && (err == nil || !strings.Contains(err.Error(), "is NOT a trusted proxy")) {
+				t.Errorf("Expected untrusted proxy error, got: %v", err)
+			}
+		})
+	}
+
+	t.Run("Invalid networks", func(t *testing.T) {
+		for _, value := range []string{"10.0.0.0/33", "localhost"} {
+			if _, err := auth.ParseNetworks([]string{value}); err == nil {
+				t.Errorf("Expected error for %q, got nil", value)
+			}
+		}
+	})
+}
+
+func TestProxyAuthSecret(t *testing.T) {
+	a := auth.ProxyAuth{Secret: "s3cret", SecretHeader: "X-Auth-Secret", AttributePrefix: "X-Auth-"}
+
+	t.Run("Missing secret", func(t *testing.T) {
+		_, err := a.UserAuth(&http.Request{
+			RemoteAddr: "127.0.0.1:5678",
+			Header:     map[string][]string{"X-Remote-User": {"alice"}},
+		})
+		if err == nil || !strings.Contains(err.Error(), "proxy secret is missing or wrong") {
+			t.Errorf("Expected secret error, got: %v", err)
+		}
+	})
+
+	t.Run("Wrong secret", func(t *testing.T) {
+		_, err := a.UserAuth(&http.Request{
+			RemoteAddr: "127.0.0.1:5678",
+			Header:     map[string][]string{"X-Remote-User": {"alice"}, "X-Auth-Secret": {"guess"}},
+		})
+		if err == nil {
+			t.Errorf("Expected error, got nil")
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		identity, err := a.UserAuth(&http.Request{
+			RemoteAddr: "127.0.0.1:5678",
+			Header:     map[string][]string{"X-Remote-User": {"alice"}, "X-Auth-Secret": {"s3cret"}},
+		})
+		if err != nil || identity.Subject != "alice" {
+			t.Errorf("Expected alice, got: %+v (%v)", identity, err)
+		}
+		if _, ok := identity.Attributes["X-Auth-Secret"]; ok {
+			t.Errorf("Expected secret not to be an attribute, got: %v", identity.Attributes)
+		}
+	})
+}
+
+func TestProxyAuthMultipleUsers(t *testing.T) {
+	a := auth.ProxyAuth{}
+	_, err := a.UserAuth(&http.Request{
+		RemoteAddr: "127.0.0.1:5678",
+		Header:     map[string][]string{"X-Remote-User": {"mallory", "alice"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "set multiple times") {
+		t.Errorf("Expected error about multiple users, got: %v", err)
+	}
+}
+
+func TestProxyAuthStripHeaders(t *testing.T) {
+	networks, err := auth.ParseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	a := auth.ProxyAuth{TrustedNetworks: networks, UserHeader: "Remote_User"}
+
+	var seen http.Header
+	handler := a.StripHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+	}))
+
+	request := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header["Remote_user"] = []string{"alice"}
+		req.Header["Remote-User"] = []string{"mallory"}
+		req.Header["X-Remote-Groups"] = []string{"admins"}
+		req.Header["X_remote_groups"] = []string{"admins"}
+		req.Header["X-Remote-Affiliation"] = []string{"staff"}
+		req.Header["Accept"] = []string{"text/html"}
+		return req
+	}
+
+	t.Run("Untrusted", func(t *testing.T) {
+		handler.ServeHTTP(httptest.NewRecorder(), request("192.168.1.1:5678"))
+
+		if len(seen) != 1 || seen.Get("Accept") != "text/html" {
+			t.Errorf("Expected only the Accept header, got: %v", seen)
+		}
+	})
+
+	t.Run("Trusted", func(t *testing.T) {
+		handler.ServeHTTP(httptest.NewRecorder(), request("10.0.0.1:5678"))
+
+		if seen.Get("Remote_User") != "alice" || seen.Get("X-Remote-Groups") != "admins" || seen.Get("X-Remote-Affiliation") != "staff" {
+			t.Errorf("Expected the headers of the proxy, got: %v", seen)
+		}
+		if _, ok := seen["Remote-User"]; ok {
+			t.Errorf("Expected look-alike of the user header to be removed, got: %v", seen)
+		}
+		if _, ok := seen["X_remote_groups"]; ok {
+			t.Errorf("Expected look-alike of the groups header to be removed, got: %v", seen)
 		}
 	})
 }
@@ -0,0 +1,543 @@
+package auth
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SAML namespaces, bindings and the OIDs of the attributes mapped by default
+const (
+	samlProtocolNS  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlPostBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlSuccess     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	AttributeEduPersonPrincipalName = "urn:oid:1.3.6.1.4.1.5923.1.1.1.6"
+	AttributeEduPersonEntitlement   = "urn:oid:1.3.6.1.4.1.5923.1.1.1.7"
+	AttributeMail                   = "urn:oid:0.9.2342.19200300.100.1.3"
+	AttributeDisplayName            = "urn:oid:2.16.840.1.113730.3.1.241"
+)
+
+// samlLeeway is the clock skew allowed when checking the times in assertions
+const samlLeeway = 3 * time.Minute
+
+// maxSAMLResponseSize limits the size of the form posted to the assertion consumer service
+const maxSAMLResponseSize = 1 << 20
+
+// SAMLConfig contains the settings of the SAML 2.0 service provider
+type SAMLConfig struct {
+	EntityID        string              // entity ID of FileSender, e.g. `https://filesender.example.org/saml/metadata`
+	ACSURL          string              // assertion consumer service URL, e.g. `https://filesender.example.org/saml/acs`
+	AppRoot         string              // path the login and logout endpoints are under, users are sent here after logging in
+	IdPEntityID     string              // entity ID of the identity provider, the issuer of the assertions
+	IdPSSOURL       string              // single sign-on URL of the identity provider, with the HTTP-Redirect binding
+	IdPCertificates []*x509.Certificate // certificates of the keys signing the assertions
+
+	// attributes mapped to the identity, by name or friendly name, the defaults are eduPersonPrincipalName,
+	// displayName, mail and eduPersonEntitlement
+	SubjectAttribute string
+	NameAttribute    string
+	EmailAttribute   string
+	GroupsAttribute  string
+	AdminGroups      []string // members of any of these groups are admins
+
+	SessionKey    []byte        // 32 bytes, encrypts the session cookies
+	SessionMaxAge time.Duration // defaults to 8 hours
+}
+
+// samlFlow is the state of a login in progress, kept in a cookie until the identity provider posts the response
+type samlFlow struct {
+	RequestID string `json:"request_id"`
+	State     string `json:"state"`
+	ReturnTo  string `json:"return_to"`
+}
+
+// SAMLAuth authenticates users as a SAML 2.0 service provider, with the HTTP-Redirect binding for requests and the
+// HTTP-POST binding for responses. Once logged in, the identity of the user is kept in an encrypted session cookie
+type SAMLAuth struct {
+	cfg      SAMLConfig
+	sessions *Sessions
+	flows    *Sessions
+}
+
+// ParseCertificates parses the PEM encoded certificates in `data`
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+
+	return certs, nil
+}
+
+// NewSAML creates the SAML 2.0 authentication method
+func NewSAML(cfg SAMLConfig) (*SAMLAuth, error) {
+	if cfg.EntityID == "" || cfg.ACSURL == "" || cfg.IdPEntityID == "" || cfg.IdPSSOURL == "" {
+		return nil, errors.New("SAML entity ID, ACS URL, IdP entity ID and IdP SSO URL are required")
+	}
+	if len(cfg.IdPCertificates) == 0 {
+		return nil, errors.New("SAML IdP certificate is required")
+	}
+
+	acsURL, err := url.Parse(cfg.ACSURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAML ACS URL: %w", err)
+	}
+	// the response is posted from the site of the identity provider, browsers only send the cookie with the state of
+	// the login along with it as a secure SameSite=None cookie
+	if acsURL.Scheme != "https" {
+		return nil, errors.New("SAML ACS URL must use https, logins can't be finished otherwise")
+	}
+
+	if cfg.AppRoot == "" {
+		cfg.AppRoot = "/"
+	}
+	if cfg.SessionMaxAge <= 0 {
+		cfg.SessionMaxAge = 8 * time.Hour
+	}
+	if cfg.SubjectAttribute == "" {
+		cfg.SubjectAttribute = AttributeEduPersonPrincipalName
+	}
+	if cfg.NameAttribute == "" {
+		cfg.NameAttribute = AttributeDisplayName
+	}
+	if cfg.EmailAttribute == "" {
+		cfg.EmailAttribute = AttributeMail
+	}
+	if cfg.GroupsAttribute == "" {
+		cfg.GroupsAttribute = AttributeEduPersonEntitlement
+	}
+
+	sessions, err := NewSessions("filesender_session", cfg.SessionKey, cfg.SessionMaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session key: %w", err)
+	}
+	flows, err := NewSessions("filesender_saml_flow", cfg.SessionKey, 10*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session key: %w", err)
+	}
+	for _, s := range []*Sessions{sessions, flows} {
+		s.Path = cfg.AppRoot
+		s.Secure = true
+	}
+	flows.SameSite = http.SameSiteNoneMode
+
+	return &SAMLAuth{cfg: cfg, sessions: sessions, flows: flows}, nil
+}
+
+// UserAuth authenticates user from the session cookie
+func (a *SAMLAuth) UserAuth(r *http.Request) (Identity, error) {
+	var identity Identity
+	err := a.sessions.Load(r, &identity)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return identity, nil
+}
+
+// LoginURL returns the URL starting the login of the user
+func (a *SAMLAuth) LoginURL(returnTo string) string {
+	return a.cfg.AppRoot + "auth/login?" + url.Values{"return_to": {returnTo}}.Encode()
+}
+
+type samlEndpoint struct {
+	Binding  string `xml:"Binding,attr"`
+	Location string `xml:"Location,attr"`
+	Index    int    `xml:"index,attr"`
+}
+
+type samlSPMetadata struct {
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID   string   `xml:"entityID,attr"`
+	Descriptor struct {
+		AuthnRequestsSigned        bool           `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned       bool           `xml:"WantAssertionsSigned,attr"`
+		ProtocolSupportEnumeration string         `xml:"protocolSupportEnumeration,attr"`
+		AssertionConsumerServices  []samlEndpoint `xml:"AssertionConsumerService"`
+	} `xml:"SPSSODescriptor"`
+}
+
+// MetadataHandler handles GET /saml/metadata
+// Returns the metadata to register FileSender at the identity provider or federation
+func (a *SAMLAuth) MetadataHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metadata := samlSPMetadata{EntityID: a.cfg.EntityID}
+		metadata.Descriptor.WantAssertionsSigned = true
+		metadata.Descriptor.ProtocolSupportEnumeration = samlProtocolNS
+		metadata.Descriptor.AssertionConsumerServices = []samlEndpoint{{Binding: samlPostBinding, Location: a.cfg.ACSURL}}
+
+		data, err := xml.MarshalIndent(metadata, "", "  ")
+		if err != nil {
+			slog.Error("Failed creating SAML metadata", "error", err)
+			http.Error(w, "Failed creating metadata", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		_, err = w.Write(append([]byte(xml.Header), data...))
+		if err != nil {
+			slog.Error("Failed writing response", "error", err)
+		}
+	}
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// authnRequest returns the AuthnRequest with `id`, deflated and base64 encoded for the HTTP-Redirect binding
+func (a *SAMLAuth) authnRequest(id string, now time.Time) (string, error) {
+	request := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" `+
+		`Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s">`+
+		`<saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`,
+		samlProtocolNS, samlAssertionNS, id, now.UTC().Format(time.RFC3339),
+		escapeXML(a.cfg.IdPSSOURL), escapeXML(a.cfg.ACSURL), samlPostBinding, escapeXML(a.cfg.EntityID))
+
+	var b bytes.Buffer
+	fw, err := flate.NewWriter(&b, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	_, err = fw.Write([]byte(request))
+	if err != nil {
+		return "", err
+	}
+	err = fw.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// samlID returns a random ID for a SAML message, which has to start with a letter or underscore
+func samlID() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return "_" + hex.EncodeToString(b), nil
+}
+
+// LoginHandler handles GET /auth/login
+// Redirects to the identity provider with an AuthnRequest, which posts the response to the ACS
+func (a *SAMLAuth) LoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flow := samlFlow{ReturnTo: safeReturnTo(a.cfg.AppRoot, r.URL.Query().Get("return_to"))}
+
+		var err error
+		flow.RequestID, err = samlID()
+		if err == nil {
+			flow.State, err = randomString()
+		}
+		if err != nil {
+			slog.Error("Failed creating login state", "error", err)
+			http.Error(w, "Failed starting login", http.StatusInternalServerError)
+			return
+		}
+
+		request, err := a.authnRequest(flow.RequestID, time.Now())
+		if err != nil {
+			slog.Error("Failed creating AuthnRequest", "error", err)
+			http.Error(w, "Failed starting login", http.StatusInternalServerError)
+			return
+		}
+
+		err = a.flows.Save(w, flow)
+		if err != nil {
+			slog.Error("Failed saving login state", "error", err)
+			http.Error(w, "Failed starting login", http.StatusInternalServerError)
+			return
+		}
+
+		separator := "?"
+		if strings.Contains(a.cfg.IdPSSOURL, "?") {
+			separator = "&"
+		}
+		query := url.Values{"SAMLRequest": {request}, "RelayState": {flow.State}}
+		http.Redirect(w, r, a.cfg.IdPSSOURL+separator+query.Encode(), http.StatusSeeOther)
+	}
+}
+
+// parseSAMLTime parses a SAML timestamp, an empty one is the zero time
+func parseSAMLTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// checkValidity checks NotBefore and NotOnOrAfter of an element, if set
+func checkValidity(e *xmlElement, now time.Time) error {
+	notBefore, err := parseSAMLTime(e.attr("NotBefore"))
+	if err != nil {
+		return err
+	}
+	if !notBefore.IsZero() && now.Add(samlLeeway).Before(notBefore) {
+		return fmt.Errorf("%s is not valid yet", e.Local)
+	}
+
+	notOnOrAfter, err := parseSAMLTime(e.attr("NotOnOrAfter"))
+	if err != nil {
+		return err
+	}
+	if !notOnOrAfter.IsZero() && !now.Add(-samlLeeway).Before(notOnOrAfter) {
+		return fmt.Errorf("%s has expired", e.Local)
+	}
+
+	return nil
+}
+
+// verifyResponse checks a SAML response to the request with `requestID`, and returns the verified assertion
+func (a *SAMLAuth) verifyResponse(data []byte, requestID string, now time.Time) (*xmlElement, error) {
+	response, err := parseXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAML response: %w", err)
+	}
+	if !response.is(samlProtocolNS, "Response") {
+		return nil, errors.New("not a SAML response")
+	}
+
+	if destination := response.attr("Destination"); destination != "" && destination != a.cfg.ACSURL {
+		return nil, fmt.Errorf("SAML response is sent to %q", destination)
+	}
+	if inResponseTo := response.attr("InResponseTo"); inResponseTo != "" && inResponseTo != requestID {
+		return nil, errors.New("SAML response is not for this login")
+	}
+	if issuer := response.child(samlAssertionNS, "Issuer"); issuer != nil && strings.TrimSpace(issuer.text()) != a.cfg.IdPEntityID {
+		return nil, fmt.Errorf("SAML response issued by %q", issuer.text())
+	}
+
+	status := response.child(samlProtocolNS, "Status").child(samlProtocolNS, "StatusCode").attr("Value")
+	if status != samlSuccess {
+		return nil, fmt.Errorf("SAML login failed with status %q", status)
+	}
+
+	if len(response.children(samlAssertionNS, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("encrypted SAML assertions are not supported")
+	}
+
+	// exactly one assertion in the whole response, so an unsigned one can't be slipped in next to the signed one, or
+	// nested deeper where it's covered by the signature of the response
+	assertions := response.descendants(samlAssertionNS, "Assertion")
+	if len(assertions) != 1 {
+		return nil, fmt.Errorf("SAML response has %d assertions, expected 1", len(assertions))
+	}
+	assertion := assertions[0]
+	if assertion.parent != response {
+		return nil, errors.New("SAML assertion is not part of the response itself")
+	}
+
+	responseErr := verifyXMLSignature(response, a.cfg.IdPCertificates)
+	if responseErr != nil && !errors.Is(responseErr, ErrNotSigned) {
+		return nil, fmt.Errorf("invalid SAML response signature: %w", responseErr)
+	}
+	assertionErr := verifyXMLSignature(assertion, a.cfg.IdPCertificates)
+	if assertionErr != nil && !errors.Is(assertionErr, ErrNotSigned) {
+		return nil, fmt.Errorf("invalid SAML assertion signature: %w", assertionErr)
+	}
+	if responseErr != nil && assertionErr != nil {
+		return nil, errors.New("SAML assertion is not signed")
+	}
+
+	if issuer := strings.TrimSpace(assertion.child(samlAssertionNS, "Issuer").text()); issuer != a.cfg.IdPEntityID {
+		return nil, fmt.Errorf("SAML assertion issued by %q", issuer)
+	}
+
+	confirmed := false
+	for _, confirmation := range assertion.child(samlAssertionNS, "Subject").children(samlAssertionNS, "SubjectConfirmation") {
+		data := confirmation.child(samlAssertionNS, "SubjectConfirmationData")
+		if confirmation.attr("Method") != samlBearer || data == nil {
+			continue
+		}
+		if data.attr("Recipient") != a.cfg.ACSURL || data.attr("InResponseTo") != requestID || data.attr("NotOnOrAfter") == "" {
+			continue
+		}
+		if checkValidity(data, now) == nil {
+			confirmed = true
+			break
+		}
+	}
+	if !confirmed {
+		return nil, errors.New("SAML assertion has no valid bearer subject confirmation")
+	}
+
+	conditions := assertion.child(samlAssertionNS, "Conditions")
+	if conditions != nil {
+		err = checkValidity(conditions, now)
+		if err != nil {
+			return nil, fmt.Errorf("SAML assertion: %w", err)
+		}
+
+		for _, restriction := range conditions.children(samlAssertionNS, "AudienceRestriction") {
+			audiences := []string{}
+			for _, audience := range restriction.children(samlAssertionNS, "Audience") {
+				audiences = append(audiences, strings.TrimSpace(audience.text()))
+			}
+			if !containsString(audiences, a.cfg.EntityID) {
+				return nil, errors.New("SAML assertion is not for this service provider")
+			}
+		}
+	}
+
+	return assertion, nil
+}
+
+// identity maps the attributes in a verified assertion to the identity of the user
+func (a *SAMLAuth) identity(assertion *xmlElement) (Identity, error) {
+	// attributes by name and by friendly name, so either can be configured
+	values := map[string][]string{}
+	attributes := map[string][]string{}
+	for _, statement := range assertion.children(samlAssertionNS, "AttributeStatement") {
+		for _, attribute := range statement.children(samlAssertionNS, "Attribute") {
+			var attributeValues []string
+			for _, value := range attribute.children(samlAssertionNS, "AttributeValue") {
+				if v := strings.TrimSpace(value.text()); v != "" {
+					attributeValues = append(attributeValues, v)
+				}
+			}
+
+			name, friendlyName := attribute.attr("Name"), attribute.attr("FriendlyName")
+			values[name] = append(values[name], attributeValues...)
+			if friendlyName != "" {
+				values[friendlyName] = append(values[friendlyName], attributeValues...)
+				name = friendlyName
+			}
+			attributes[name] = append(attributes[name], attributeValues...)
+		}
+	}
+
+	subjects := values[a.cfg.SubjectAttribute]
+	if len(subjects) == 0 {
+		return Identity{}, fmt.Errorf("attribute %q is missing", a.cfg.SubjectAttribute)
+	}
+
+	identity := Identity{
+		Subject:    subjects[0],
+		Emails:     values[a.cfg.EmailAttribute],
+		Groups:     values[a.cfg.GroupsAttribute],
+		Method:     "saml",
+		Attributes: attributes,
+	}
+	if names := values[a.cfg.NameAttribute]; len(names) > 0 {
+		identity.DisplayName = names[0]
+	}
+	identity.Admin = isAdmin(identity.Groups, a.cfg.AdminGroups)
+
+	return identity, nil
+}
+
+// ACSHandler handles POST /saml/acs
+// Verifies the response posted by the identity provider and starts the session of the user
+func (a *SAMLAuth) ACSHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var flow samlFlow
+		err := a.flows.Load(r, &flow)
+		if err != nil {
+			slog.Info("SAML response without login state", "error", err)
+			http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+			return
+		}
+		a.flows.Clear(w)
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxSAMLResponseSize)
+		err = r.ParseForm()
+		if err != nil {
+			http.Error(w, "Invalid SAML response", http.StatusBadRequest)
+			return
+		}
+		if r.PostForm.Get("RelayState") != flow.State {
+			slog.Info("SAML response with wrong relay state")
+			http.Error(w, "Invalid login state", http.StatusBadRequest)
+			return
+		}
+
+		data, err := decodeBase64(r.PostForm.Get("SAMLResponse"))
+		if err != nil {
+			http.Error(w, "Invalid SAML response", http.StatusBadRequest)
+			return
+		}
+
+		assertion, err := a.verifyResponse(data, flow.RequestID, time.Now())
+		if err != nil {
+			slog.Error("Invalid SAML response", "error", err)
+			http.Error(w, "Login failed", http.StatusUnauthorized)
+			return
+		}
+
+		identity, err := a.identity(assertion)
+		if err != nil {
+			slog.Error("Failed mapping SAML attributes", "error", err)
+			http.Error(w, "Login failed", http.StatusUnauthorized)
+			return
+		}
+
+		err = a.sessions.Save(w, identity)
+		if err != nil {
+			// large sets of attributes don't fit in a cookie, the raw attributes are the least needed
+			slog.Info("Session too large, not keeping the attributes", "error", err)
+			identity.Attributes = nil
+			err = a.sessions.Save(w, identity)
+		}
+		if err != nil {
+			slog.Error("Failed saving session", "error", err)
+			http.Error(w, "Login failed", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("User logged in", "method", "saml", "subject", identity.Subject)
+		http.Redirect(w, r, flow.ReturnTo, http.StatusSeeOther)
+	}
+}
+
+// LogoutHandler handles POST /auth/logout
+// Ends the session in the app, not at the identity provider
+func (a *SAMLAuth) LogoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !SameOrigin(r) {
+			http.Error(w, "Cross-site request rejected", http.StatusForbidden)
+			return
+		}
+
+		a.sessions.Clear(w)
+		http.Redirect(w, r, a.cfg.AppRoot, http.StatusSeeOther)
+	}
+}
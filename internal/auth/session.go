@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrNoSession is returned when a request has no valid session cookie
+var ErrNoSession = errors.New("no valid session")
+
+// maxCookieSize is the largest cookie value browsers are guaranteed to store
+const maxCookieSize = 4000
+
+// Sessions stores values in a cookie, encrypted and authenticated with AES-GCM so clients can neither read nor
+// change them
+type Sessions struct {
+	Name     string
+	Path     string
+	MaxAge   time.Duration
+	Secure   bool          // only send the cookie over HTTPS
+	SameSite http.SameSite // defaults to lax
+
+	aead cipher.AEAD
+}
+
+type sessionPayload struct {
+	Expires int64           `json:"exp"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// SameOrigin checks that a request changing state was sent by a page of the app itself, not by a form or script of
+// another site riding on the session cookie of the user. Safe methods, and requests of clients other than browsers,
+// which send neither `Sec-Fetch-Site` nor `Origin`, are allowed
+func SameOrigin(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+
+	// browsers that don't send Sec-Fetch-Site yet
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return u.Host == r.Host
+}
+
+// NewSessions creates sessions stored in cookie `name`, `key` has to be 32 bytes
+func NewSessions(name string, key []byte, maxAge time.Duration) (*Sessions, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sessions{Name: name, Path: "/", MaxAge: maxAge, aead: aead}, nil
+}
+
+func (s *Sessions) cookie(value string, maxAge int) *http.Cookie {
+	sameSite := s.SameSite
+	if sameSite == 0 {
+		sameSite = http.SameSiteLaxMode
+	}
+
+	return &http.Cookie{
+		Name:     s.Name,
+		Value:    value,
+		Path:     s.Path,
+		MaxAge:   maxAge,
+		Secure:   s.Secure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+}
+
+// Save stores `value` as JSON in the session cookie
+func (s *Sessions) Save(w http.ResponseWriter, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(sessionPayload{Expires: time.Now().Add(s.MaxAge).Unix(), Value: data})
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	// the cookie name is authenticated too, so a cookie can't be used as another one
+	sealed := s.aead.Seal(nonce, nonce, payload, []byte(s.Name))
+	encoded := base64.RawURLEncoding.EncodeToString(sealed)
+	if len(encoded) > maxCookieSize {
+		return fmt.Errorf("session of %d bytes is too large for a cookie", len(encoded))
+	}
+
+	http.SetCookie(w, s.cookie(encoded, int(s.MaxAge.Seconds())))
+	return nil
+}
+
+// Load reads the value stored in the session cookie into `value`
+// Returns ErrNoSession if there is no cookie, or it was changed or has expired
+func (s *Sessions) Load(r *http.Request, value any) error {
+	cookie, err := r.Cookie(s.Name)
+	if err != nil {
+		return ErrNoSession
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return ErrNoSession
+	}
+
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	data, err := s.aead.Open(nil, nonce, ciphertext, []byte(s.Name))
+	if err != nil {
+		return ErrNoSession
+	}
+
+	var payload sessionPayload
+	err = json.Unmarshal(data, &payload)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNoSession, err)
+	}
+	if time.Now().Unix() >= payload.Expires {
+		return fmt.Errorf("%w: session has expired", ErrNoSession)
+	}
+
+	return json.Unmarshal(payload.Value, value)
+}
+
+// Clear removes the session cookie
+func (s *Sessions) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, s.cookie("", -1))
+}
@@ -0,0 +1,455 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/hash"
+)
+
+// Scopes limit what can be done with an API token
+const (
+	ScopeUpload = "upload" // upload files
+	ScopeRead   = "read"   // list the transfers of the user
+	ScopeManage = "manage" // revoke transfers and change their expiry, never granted to API tokens
+	ScopeTokens = "tokens" // manage API tokens, never granted to API tokens
+)
+
+// TokenScopes are the scopes that can be granted to API tokens
+var TokenScopes = []string{ScopeUpload, ScopeRead}
+
+// tokenPrefix starts every API token, so leaked tokens are easy to recognise
+const tokenPrefix = "fsn_"
+
+// IdentityMaxAge is how long API tokens keep working after the user last logged in, as they are authenticated with
+// the groups and attributes the user had then
+const IdentityMaxAge = 30 * 24 * time.Hour
+
+// identityRefreshInterval limits how often the identity of a user is stored while it doesn't change
+const identityRefreshInterval = time.Hour
+
+var (
+	// ErrInvalidToken is returned for unknown, revoked and expired API tokens
+	ErrInvalidToken = errors.New("invalid API token")
+	// ErrTokenNotFound is returned when a user has no API token with an ID
+	ErrTokenNotFound = errors.New("API token not found")
+	// ErrIdentityOutdated is returned for API tokens of users that have not logged in for longer than IdentityMaxAge
+	ErrIdentityOutdated = errors.New("log in again to keep using API tokens")
+)
+
+// Token is a personal API token, the token itself is only stored as a hash
+type Token struct {
+	ID       string    `json:"id"`
+	UserID   string    `json:"user_id"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+	Hash     string    `json:"hash"`
+}
+
+// storedIdentity is the identity of a user the last time they logged in
+type storedIdentity struct {
+	Identity  Identity  `json:"identity"`
+	Refreshed time.Time `json:"refreshed"`
+}
+
+// Expired checks if the token has expired at the given time
+func (t Token) Expired(now time.Time) bool {
+	return !now.Before(t.Expires)
+}
+
+// TokenStore stores API tokens as JSON files: `<dir>/<tokenID>.json`, and the identities of their users as
+// `<dir>/users/<userID>.json`
+type TokenStore struct {
+	dir string
+	mu  sync.Mutex
+
+	// identities stored recently, by user ID
+	refreshed map[string]storedIdentity
+}
+
+// NewTokenStore creates a file based API token store in dir
+func NewTokenStore(dir string) (*TokenStore, error) {
+	err := os.MkdirAll(filepath.Join(dir, "users"), 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("create token directory: %w", err)
+	}
+
+	return &TokenStore{dir: dir, refreshed: map[string]storedIdentity{}}, nil
+}
+
+func (s *TokenStore) path(id string) (string, error) {
+	_, err := hex.DecodeString(id)
+	if err != nil || id == "" {
+		return "", fmt.Errorf("invalid token ID: %q", id)
+	}
+
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func (s *TokenStore) get(id string) (Token, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return Token{}, ErrTokenNotFound
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Token{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return Token{}, err
+	}
+
+	var t Token
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return Token{}, fmt.Errorf("invalid token %s: %w", path, err)
+	}
+
+	return t, nil
+}
+
+func (s *TokenStore) put(t Token) error {
+	path, err := s.path(t.ID)
+	if err != nil {
+		return err
+	}
+
+	return s.write(path, t)
+}
+
+func (s *TokenStore) identityPath(userID string) (string, error) {
+	if userID == "" || strings.ContainsAny(userID, `/\.`) {
+		return "", fmt.Errorf("invalid user ID: %q", userID)
+	}
+
+	return filepath.Join(s.dir, "users", userID+".json"), nil
+}
+
+// write stores v as JSON in path
+func (s *TokenStore) write(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so readers never see a half written token
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			slog.Error("Failed removing temporary token file", "error", err)
+		}
+	}()
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Refresh stores the identity of a user that logged in, their API tokens authenticate with it
+// While the identity doesn't change, it is stored at most once per identityRefreshInterval
+func (s *TokenStore) Refresh(userID string, identity Identity, now time.Time) error {
+	path, err := s.identityPath(userID)
+	if err != nil {
+		return err
+	}
+
+	// the raw attributes can be large, and are not needed by API clients
+	identity.Attributes = nil
+	identity.Scopes = nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, ok := s.refreshed[userID]
+	if ok && now.Sub(previous.Refreshed) < identityRefreshInterval && reflect.DeepEqual(previous.Identity, identity) {
+		return nil
+	}
+
+	stored := storedIdentity{Identity: identity, Refreshed: now}
+	err = s.write(path, stored)
+	if err != nil {
+		return err
+	}
+	s.refreshed[userID] = stored
+
+	return nil
+}
+
+// Identity returns the identity of a user the last time they logged in, and when that was
+func (s *TokenStore) Identity(userID string) (Identity, time.Time, error) {
+	path, err := s.identityPath(userID)
+	if err != nil {
+		return Identity{}, time.Time{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Identity{}, time.Time{}, err
+	}
+
+	var stored storedIdentity
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return Identity{}, time.Time{}, fmt.Errorf("invalid identity %s: %w", path, err)
+	}
+
+	return stored.Identity, stored.Refreshed, nil
+}
+
+// Create creates an API token for a user, and returns it with the secret token, which is not stored
+// The identity of the user is refreshed as well
+func (s *TokenStore) Create(identity Identity, userID string, name string, scopes []string, expires time.Time) (Token, string, error) {
+	for _, scope := range scopes {
+		if !containsString(TokenScopes, scope) {
+			return Token{}, "", fmt.Errorf("invalid scope %q", scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return Token{}, "", errors.New("API token has no scopes")
+	}
+
+	idBytes := make([]byte, 8)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secretBytes := make([]byte, 32)
+	_, err = rand.Read(secretBytes)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	t := Token{
+		ID:      hex.EncodeToString(idBytes),
+		UserID:  userID,
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now(),
+		Expires: expires,
+	}
+	secret := tokenPrefix + t.ID + "_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	t.Hash, err = hash.ToBase64(secret)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	err = s.Refresh(userID, identity, t.Created)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.put(t)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	return t, secret, nil
+}
+
+// List returns the API tokens of a user, newest first
+func (s *TokenStore) List(userID string) ([]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []Token{}
+	for _, path := range paths {
+		t, err := s.get(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			slog.Error("Failed reading token", "path", path, "error", err)
+			continue
+		}
+
+		if t.UserID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.After(tokens[j].Created)
+	})
+
+	return tokens, nil
+}
+
+// Revoke deletes an API token of a user
+func (s *TokenStore) Revoke(userID string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	if t.UserID != userID {
+		return ErrTokenNotFound
+	}
+
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Verify returns the API token belonging to the secret token
+func (s *TokenStore) Verify(secret string, now time.Time) (Token, error) {
+	id, _, found := strings.Cut(strings.TrimPrefix(secret, tokenPrefix), "_")
+	if !strings.HasPrefix(secret, tokenPrefix) || !found {
+		return Token{}, ErrInvalidToken
+	}
+
+	hashed, err := hash.ToBase64(secret)
+	if err != nil {
+		return Token{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.get(id)
+	if errors.Is(err, ErrTokenNotFound) {
+		return Token{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Token{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashed), []byte(t.Hash)) != 1 {
+		return Token{}, ErrInvalidToken
+	}
+	if t.Expired(now) {
+		return Token{}, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+
+	// only written once a minute, chunked uploads use the token for every chunk
+	if now.Sub(t.LastUsed) > time.Minute {
+		t.LastUsed = now
+		err = s.put(t)
+		if err != nil {
+			slog.Error("Failed updating token", "id", t.ID, "error", err)
+		}
+	}
+
+	return t, nil
+}
+
+// TokenAuth authenticates API clients with a personal API token in the `Authorization: Bearer` header, as the user
+// was the last time they logged in. Requests without one are authenticated by Next, refreshing the stored identity
+type TokenAuth struct {
+	Tokens *TokenStore
+	Next   Auth
+}
+
+// WithTokens puts API token authentication in front of `next`, still sending browsers to the login page if it is
+// interactive
+func WithTokens(tokens *TokenStore, next Auth) Auth {
+	a := &TokenAuth{Tokens: tokens, Next: next}
+	if interactive, ok := next.(Interactive); ok {
+		return &interactiveTokenAuth{TokenAuth: a, next: interactive}
+	}
+
+	return a
+}
+
+// UserAuth authenticates user
+func (a *TokenAuth) UserAuth(r *http.Request) (Identity, error) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		if a.Next == nil {
+			return Identity{}, errors.New("no API token")
+		}
+		return a.refresh(a.Next.UserAuth(r))
+	}
+
+	now := time.Now()
+	t, err := a.Tokens.Verify(strings.TrimSpace(token), now)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identity, refreshed, err := a.Tokens.Identity(t.UserID)
+	if os.IsNotExist(err) || (err == nil && now.Sub(refreshed) > IdentityMaxAge) {
+		return Identity{}, ErrIdentityOutdated
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identity.Method = "token"
+	identity.Scopes = t.Scopes
+	// admin rights are only used by logging in
+	identity.Admin = false
+	return identity, nil
+}
+
+// refresh stores the identity of a user authenticated by Next
+func (a *TokenAuth) refresh(identity Identity, err error) (Identity, error) {
+	if err != nil {
+		return identity, err
+	}
+
+	userID, err := hash.ToBase64(identity.Subject)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	err = a.Tokens.Refresh(userID, identity, time.Now())
+	if err != nil {
+		slog.Error("Failed storing identity for API tokens", "error", err)
+	}
+
+	return identity, nil
+}
+
+type interactiveTokenAuth struct {
+	*TokenAuth
+	next Interactive
+}
+
+// LoginURL returns the login URL of the interactive authentication method
+func (a *interactiveTokenAuth) LoginURL(returnTo string) string {
+	return a.next.LoginURL(returnTo)
+}
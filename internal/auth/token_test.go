@@ -0,0 +1,224 @@
+package auth_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/auth"
+	"codeberg.org/filesender/filesender-next/internal/hash"
+)
+
+func newTokenStore(t *testing.T, dir string) *auth.TokenStore {
+	err := hash.Init(t.TempDir())
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	tokens, err := auth.NewTokenStore(dir)
+	if err != nil {
+		t.Fatalf("Failed creating token store: %v", err)
+	}
+
+	return tokens
+}
+
+func TestTokenStore(t *testing.T) {
+	tokens := newTokenStore(t, t.TempDir())
+	alice := auth.Identity{Subject: "alice", Groups: []string{"staff"}, Attributes: map[string][]string{"a": {"b"}}}
+	now := time.Now()
+
+	token, secret, err := tokens.Create(alice, "alice-id", "laptop", []string{auth.ScopeUpload}, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !strings.HasPrefix(secret, "fsn_"+token.ID+"_") {
+		t.Errorf("Expected token to start with its ID, got %q", secret)
+	}
+	if token.Hash == "" || strings.Contains(token.Hash, secret) {
+		t.Errorf("Expected only the hash of the token to be stored, got %q", token.Hash)
+	}
+
+	t.Run("Verify", func(t *testing.T) {
+		verified, err := tokens.Verify(secret, now)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if verified.ID != token.ID || verified.UserID != "alice-id" {
+			t.Errorf("Unexpected token: %+v", verified)
+		}
+		if verified.LastUsed.IsZero() {
+			t.Errorf("Expected last use to be recorded")
+		}
+	})
+
+	t.Run("Identity", func(t *testing.T) {
+		identity, refreshed, err := tokens.Identity("alice-id")
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if identity.Subject != "alice" || identity.Groups[0] != "staff" || identity.Attributes != nil || refreshed.IsZero() {
+			t.Errorf("Unexpected identity refreshed at %v: %+v", refreshed, identity)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, s := range []string{"", "fsn_", "fsn_" + token.ID + "_wrong", secret[:len(secret)-1], "fsn_../../etc_x", strings.TrimPrefix(secret, "fsn_")} {
+			_, err := tokens.Verify(s, now)
+			if !errors.Is(err, auth.ErrInvalidToken) {
+				t.Errorf("Expected invalid token for %q, got: %v", s, err)
+			}
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		_, err := tokens.Verify(secret, now.Add(2*time.Hour))
+		if !errors.Is(err, auth.ErrInvalidToken) {
+			t.Errorf("Expected invalid token, got: %v", err)
+		}
+	})
+
+	t.Run("Invalid scope", func(t *testing.T) {
+		for _, scopes := range [][]string{nil, {auth.ScopeTokens}, {"admin"}} {
+			_, _, err := tokens.Create(alice, "alice-id", "laptop", scopes, now.Add(time.Hour))
+			if err == nil {
+				t.Errorf("Expected error for scopes %v, got nil", scopes)
+			}
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		_, _, err := tokens.Create(auth.Identity{Subject: "bob"}, "bob-id", "bob", []string{auth.ScopeRead}, now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		list, err := tokens.List("alice-id")
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if len(list) != 1 || list[0].ID != token.ID {
+			t.Errorf("Expected the token of alice, got %+v", list)
+		}
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		err := tokens.Revoke("bob-id", token.ID)
+		if !errors.Is(err, auth.ErrTokenNotFound) {
+			t.Errorf("Expected other users not to revoke the token, got: %v", err)
+		}
+
+		err = tokens.Revoke("alice-id", token.ID)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		_, err = tokens.Verify(secret, now)
+		if !errors.Is(err, auth.ErrInvalidToken) {
+			t.Errorf("Expected revoked token to be invalid, got: %v", err)
+		}
+	})
+}
+
+func TestTokenAuth(t *testing.T) {
+	dir := t.TempDir()
+	tokens := newTokenStore(t, dir)
+	aliceID, err := hash.ToBase64("alice")
+	if err != nil {
+		t.Fatalf("Failed hashing user ID: %v", err)
+	}
+
+	_, secret, err := tokens.Create(auth.Identity{Subject: "alice", Admin: true}, aliceID, "cli", []string{auth.ScopeRead}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed creating token: %v", err)
+	}
+
+	a := auth.WithTokens(tokens, &auth.DummyAuth{})
+	bearer := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "bearer "+secret)
+		return req
+	}
+
+	t.Run("Token", func(t *testing.T) {
+		identity, err := a.UserAuth(bearer())
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if identity.Subject != "alice" || identity.Method != "token" || identity.Admin {
+			t.Errorf("Expected non-admin alice authenticated with a token, got %+v", identity)
+		}
+		if !identity.Allows(auth.ScopeRead) || identity.Allows(auth.ScopeUpload) || identity.Allows(auth.ScopeTokens) {
+			t.Errorf("Expected only the read scope, got %v", identity.Scopes)
+		}
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer fsn_0011_wrong")
+
+		_, err := a.UserAuth(req)
+		if !errors.Is(err, auth.ErrInvalidToken) {
+			t.Errorf("Expected invalid token error instead of falling back, got: %v", err)
+		}
+	})
+
+	t.Run("No token", func(t *testing.T) {
+		identity, err := a.UserAuth(httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil || identity.Method != "dummy" || !identity.Allows(auth.ScopeTokens) {
+			t.Errorf("Expected the next method to authenticate, got %+v (%v)", identity, err)
+		}
+	})
+
+	t.Run("Refreshed identity", func(t *testing.T) {
+		// alice logs in after being added to a group
+		login := auth.WithTokens(tokens, &auth.DummyAuth{Identity: auth.Identity{Subject: "alice", Groups: []string{"staff"}}})
+		_, err := login.UserAuth(httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		identity, err := a.UserAuth(bearer())
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if len(identity.Groups) != 1 || identity.Groups[0] != "staff" {
+			t.Errorf("Expected the groups alice logged in with, got %v", identity.Groups)
+		}
+	})
+
+	t.Run("Outdated identity", func(t *testing.T) {
+		// another server sharing the state directory
+		other, err := auth.NewTokenStore(dir)
+		if err != nil {
+			t.Fatalf("Failed creating token store: %v", err)
+		}
+		err = other.Refresh(aliceID, auth.Identity{Subject: "alice"}, time.Now().Add(-auth.IdentityMaxAge-time.Minute))
+		if err != nil {
+			t.Fatalf("Failed refreshing identity: %v", err)
+		}
+
+		_, err = auth.WithTokens(other, &auth.DummyAuth{}).UserAuth(bearer())
+		if !errors.Is(err, auth.ErrIdentityOutdated) {
+			t.Errorf("Expected outdated identity error, got: %v", err)
+		}
+	})
+
+	t.Run("Interactive", func(t *testing.T) {
+		if _, ok := a.(auth.Interactive); ok {
+			t.Errorf("Expected no login URL in front of dummy authentication")
+		}
+
+		p := newMockProvider(t)
+		interactive, ok := auth.WithTokens(tokens, newOIDC(t, p)).(auth.Interactive)
+		if !ok {
+			t.Fatalf("Expected login URL in front of OIDC authentication")
+		}
+		if u := interactive.LoginURL("/"); !strings.HasPrefix(u, "/auth/login") {
+			t.Errorf("Expected login URL of OIDC, got %q", u)
+		}
+	})
+}
@@ -0,0 +1,410 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// XML namespaces and algorithms of XML signatures, see https://www.w3.org/TR/xmldsig-core1/
+const (
+	dsigNS         = "http://www.w3.org/2000/09/xmldsig#"
+	excC14N        = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSig   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	xmlNamespaceNS = "http://www.w3.org/XML/1998/namespace"
+)
+
+// signatureMethods are the supported signature algorithms, SHA-1 is not accepted
+var signatureMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha384": crypto.SHA384,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512": crypto.SHA512,
+}
+
+// digestMethods are the supported digest algorithms, SHA-1 is not accepted
+var digestMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmlenc#sha256":       crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#sha384": crypto.SHA384,
+	"http://www.w3.org/2001/04/xmlenc#sha512":       crypto.SHA512,
+}
+
+// ErrNotSigned is returned when an XML element has no signature
+var ErrNotSigned = errors.New("element is not signed")
+
+// xmlElement is an element of a parsed XML document, keeping the prefixes and namespace declarations needed to
+// canonicalize it
+type xmlElement struct {
+	Prefix   string
+	Local    string
+	Attrs    []xml.Attr // as written, `Name.Space` is the prefix, includes the namespace declarations
+	Children []any      // *xmlElement or string
+	parent   *xmlElement
+}
+
+// parseXML parses an XML document, documents with a DTD are rejected
+func parseXML(data []byte) (*xmlElement, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+
+	var root, current *xmlElement
+	for {
+		token, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			e := &xmlElement{Prefix: t.Name.Space, Local: t.Name.Local, Attrs: append([]xml.Attr{}, t.Attr...), parent: current}
+			if current != nil {
+				current.Children = append(current.Children, e)
+			} else if root == nil {
+				root = e
+			} else {
+				return nil, errors.New("XML document has multiple root elements")
+			}
+			current = e
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.Prefix || t.Name.Local != current.Local {
+				return nil, fmt.Errorf("unexpected end element %s", t.Name.Local)
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.Children = append(current.Children, string(t))
+			}
+		case xml.Directive:
+			return nil, errors.New("XML document type definitions are not allowed")
+		}
+	}
+
+	if root == nil || current != nil {
+		return nil, errors.New("incomplete XML document")
+	}
+
+	return root, nil
+}
+
+// namespace returns the namespace bound to `prefix` in the scope of the element
+func (e *xmlElement) namespace(prefix string) string {
+	if prefix == "xml" {
+		return xmlNamespaceNS
+	}
+
+	for el := e; el != nil; el = el.parent {
+		for _, a := range el.Attrs {
+			if (prefix == "" && a.Name.Space == "" && a.Name.Local == "xmlns") ||
+				(prefix != "" && a.Name.Space == "xmlns" && a.Name.Local == prefix) {
+				return a.Value
+			}
+		}
+	}
+
+	return ""
+}
+
+// is checks the namespace and local name of the element
+func (e *xmlElement) is(space string, local string) bool {
+	return e.Local == local && e.namespace(e.Prefix) == space
+}
+
+// children returns the child elements with a namespace and local name
+func (e *xmlElement) children(space string, local string) []*xmlElement {
+	var found []*xmlElement
+	for _, c := range e.Children {
+		if c, ok := c.(*xmlElement); ok && c.is(space, local) {
+			found = append(found, c)
+		}
+	}
+
+	return found
+}
+
+// descendants returns the elements with a namespace and local name at any depth below the element
+func (e *xmlElement) descendants(space string, local string) []*xmlElement {
+	var found []*xmlElement
+	for _, c := range e.Children {
+		if c, ok := c.(*xmlElement); ok {
+			if c.is(space, local) {
+				found = append(found, c)
+			}
+			found = append(found, c.descendants(space, local)...)
+		}
+	}
+
+	return found
+}
+
+// child returns the first child element with a namespace and local name, or nil
+func (e *xmlElement) child(space string, local string) *xmlElement {
+	if e == nil {
+		return nil
+	}
+
+	found := e.children(space, local)
+	if len(found) == 0 {
+		return nil
+	}
+
+	return found[0]
+}
+
+// attr returns the value of an attribute without namespace
+func (e *xmlElement) attr(local string) string {
+	if e == nil {
+		return ""
+	}
+
+	for _, a := range e.Attrs {
+		if a.Name.Space == "" && a.Name.Local == local {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+// text returns the text content of the element
+func (e *xmlElement) text() string {
+	if e == nil {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, c := range e.Children {
+		switch c := c.(type) {
+		case string:
+			b.WriteString(c)
+		case *xmlElement:
+			b.WriteString(c.text())
+		}
+	}
+
+	return b.String()
+}
+
+func qualifiedName(prefix string, local string) string {
+	if prefix == "" {
+		return local
+	}
+
+	return prefix + ":" + local
+}
+
+var (
+	c14nTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	c14nAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+// canonicalize writes the exclusive canonical form of the element without comments, leaving out `exclude`
+// `rendered` are the namespace declarations already written by ancestors, `inclusive` the prefixes of the
+// InclusiveNamespaces PrefixList, see https://www.w3.org/TR/xml-exc-c14n/
+func (e *xmlElement) canonicalize(w *bytes.Buffer, rendered map[string]string, inclusive map[string]bool, exclude *xmlElement) {
+	if e == exclude {
+		return
+	}
+
+	// the namespaces that are visibly utilized, and the inclusive ones in scope
+	used := map[string]bool{e.Prefix: true}
+	for _, a := range e.Attrs {
+		if a.Name.Space != "" && a.Name.Space != "xmlns" && a.Name.Space != "xml" {
+			used[a.Name.Space] = true
+		}
+	}
+	for prefix := range inclusive {
+		if e.namespace(prefix) != "" {
+			used[prefix] = true
+		}
+	}
+
+	scope := make(map[string]string, len(rendered)+len(used))
+	for prefix, uri := range rendered {
+		scope[prefix] = uri
+	}
+
+	var declarations []string
+	for prefix := range used {
+		uri := e.namespace(prefix)
+		if uri == rendered[prefix] || (prefix != "" && uri == "") {
+			continue
+		}
+		scope[prefix] = uri
+		declarations = append(declarations, prefix)
+	}
+	sort.Strings(declarations)
+
+	type attribute struct {
+		space string
+		local string
+		name  string
+		value string
+	}
+	var attrs []attribute
+	for _, a := range e.Attrs {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+
+		space := ""
+		if a.Name.Space != "" {
+			space = e.namespace(a.Name.Space)
+		}
+		attrs = append(attrs, attribute{space: space, local: a.Name.Local, name: qualifiedName(a.Name.Space, a.Name.Local), value: a.Value})
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].space != attrs[j].space {
+			return attrs[i].space < attrs[j].space
+		}
+		return attrs[i].local < attrs[j].local
+	})
+
+	name := qualifiedName(e.Prefix, e.Local)
+	w.WriteString("<" + name)
+	for _, prefix := range declarations {
+		declaration := "xmlns"
+		if prefix != "" {
+			declaration += ":" + prefix
+		}
+		w.WriteString(" " + declaration + `="` + c14nAttrEscaper.Replace(scope[prefix]) + `"`)
+	}
+	for _, a := range attrs {
+		w.WriteString(" " + a.name + `="` + c14nAttrEscaper.Replace(a.value) + `"`)
+	}
+	w.WriteString(">")
+
+	for _, c := range e.Children {
+		switch c := c.(type) {
+		case string:
+			w.WriteString(c14nTextEscaper.Replace(c))
+		case *xmlElement:
+			c.canonicalize(w, scope, inclusive, exclude)
+		}
+	}
+
+	w.WriteString("</" + name + ">")
+}
+
+// canonicalBytes returns the exclusive canonical form of the element
+func (e *xmlElement) canonicalBytes(inclusive map[string]bool, exclude *xmlElement) []byte {
+	var b bytes.Buffer
+	e.canonicalize(&b, map[string]string{"": ""}, inclusive, exclude)
+	return b.Bytes()
+}
+
+// inclusivePrefixes returns the InclusiveNamespaces PrefixList of a transform or canonicalization method
+func inclusivePrefixes(method *xmlElement) map[string]bool {
+	prefixes := map[string]bool{}
+	for _, prefix := range strings.Fields(method.child(excC14N, "InclusiveNamespaces").attr("PrefixList")) {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		prefixes[prefix] = true
+	}
+
+	return prefixes
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// verifyXMLSignature checks the enveloped signature of the element, made with the key of one of `certs`
+// Only a signature over the element itself is accepted, with exclusive canonicalization
+func verifyXMLSignature(e *xmlElement, certs []*x509.Certificate) error {
+	signatures := e.children(dsigNS, "Signature")
+	if len(signatures) == 0 {
+		return ErrNotSigned
+	}
+	if len(signatures) > 1 {
+		return errors.New("element has multiple signatures")
+	}
+	signature := signatures[0]
+
+	signedInfo := signature.child(dsigNS, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("signature has no SignedInfo")
+	}
+
+	c14nMethod := signedInfo.child(dsigNS, "CanonicalizationMethod")
+	if c14nMethod.attr("Algorithm") != excC14N {
+		return fmt.Errorf("unsupported canonicalization method %q", c14nMethod.attr("Algorithm"))
+	}
+
+	signatureHash, ok := signatureMethods[signedInfo.child(dsigNS, "SignatureMethod").attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("unsupported signature method %q", signedInfo.child(dsigNS, "SignatureMethod").attr("Algorithm"))
+	}
+
+	references := signedInfo.children(dsigNS, "Reference")
+	if len(references) != 1 {
+		return fmt.Errorf("signature has %d references, expected 1", len(references))
+	}
+	reference := references[0]
+
+	id := e.attr("ID")
+	if id == "" || reference.attr("URI") != "#"+id {
+		return errors.New("signature does not reference the signed element")
+	}
+
+	var inclusive map[string]bool
+	for _, transform := range reference.child(dsigNS, "Transforms").children(dsigNS, "Transform") {
+		switch transform.attr("Algorithm") {
+		case envelopedSig:
+		case excC14N:
+			inclusive = inclusivePrefixes(transform)
+		default:
+			return fmt.Errorf("unsupported transform %q", transform.attr("Algorithm"))
+		}
+	}
+	if inclusive == nil {
+		return errors.New("signature reference is not canonicalized")
+	}
+
+	digestHash, ok := digestMethods[reference.child(dsigNS, "DigestMethod").attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("unsupported digest method %q", reference.child(dsigNS, "DigestMethod").attr("Algorithm"))
+	}
+
+	digest, err := decodeBase64(reference.child(dsigNS, "DigestValue").text())
+	if err != nil {
+		return fmt.Errorf("invalid digest value: %w", err)
+	}
+
+	h := digestHash.New()
+	_, _ = h.Write(e.canonicalBytes(inclusive, signature))
+	if subtle.ConstantTimeCompare(h.Sum(nil), digest) != 1 {
+		return errors.New("digest of signed element does not match")
+	}
+
+	signatureValue, err := decodeBase64(signature.child(dsigNS, "SignatureValue").text())
+	if err != nil {
+		return fmt.Errorf("invalid signature value: %w", err)
+	}
+
+	h = signatureHash.New()
+	_, _ = h.Write(signedInfo.canonicalBytes(inclusivePrefixes(c14nMethod), nil))
+	hashed := h.Sum(nil)
+
+	for _, cert := range certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(key, signatureHash, hashed, signatureValue) == nil {
+			return nil
+		}
+	}
+
+	return errors.New("invalid signature")
+}
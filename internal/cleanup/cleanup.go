@@ -0,0 +1,145 @@
+// Package cleanup contains the routines removing transfers that should no longer be stored
+package cleanup
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+// deleteTransfer deletes the data & metadata of a transfer, missing data or metadata is not an error
+func deleteTransfer(store storage.Backend, metaStore meta.Store, t meta.Transfer) error {
+	err := store.Delete(t.UserID, t.FileID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	err = metaStore.Delete(t.UserID, t.FileID)
+	if err != nil && !errors.Is(err, meta.ErrNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteExpired deletes the data of all transfers that have expired at `now`, and keeps their metadata so their links
+// report that they expired. The metadata is deleted once the transfers have been expired for longer than `retention`
+// Returns the number of transfers whose data was deleted
+func DeleteExpired(store storage.Backend, metaStore meta.Store, now time.Time, retention time.Duration) (int, error) {
+	transfers, err := metaStore.All()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, t := range transfers {
+		if !t.Expired(now) {
+			continue
+		}
+
+		if now.Sub(t.Expiry) >= retention {
+			err := deleteTransfer(store, metaStore, t)
+			if err != nil {
+				slog.Error("Failed deleting expired transfer", "user id", t.UserID, "file id", t.FileID, "error", err)
+				continue
+			}
+
+			slog.Info("Deleted metadata of expired transfer", "user id", t.UserID, "file id", t.FileID, "expiry", t.Expiry)
+			if t.State != meta.StateExpired && t.State != meta.StateRevoked {
+				deleted++
+			}
+			continue
+		}
+
+		if t.State == meta.StateExpired || t.State == meta.StateRevoked {
+			// the data has already been deleted
+			continue
+		}
+
+		err := store.Delete(t.UserID, t.FileID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			slog.Error("Failed deleting expired transfer", "user id", t.UserID, "file id", t.FileID, "error", err)
+			continue
+		}
+
+		err = metaStore.Update(t.UserID, t.FileID, func(t *meta.Transfer) error {
+			t.State = meta.StateExpired
+			return nil
+		})
+		if err != nil && !errors.Is(err, meta.ErrNotFound) {
+			slog.Error("Failed marking transfer as expired", "user id", t.UserID, "file id", t.FileID, "error", err)
+			continue
+		}
+
+		slog.Info("Deleted expired transfer", "user id", t.UserID, "file id", t.FileID, "expiry", t.Expiry)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// abandoned returns true if the transfer is an unfinished upload that has not received data for longer than `idle`
+func abandoned(t meta.Transfer, now time.Time, idle time.Duration) bool {
+	return t.State != meta.StateComplete && t.State != meta.StateRevoked && t.State != meta.StateExpired && now.Sub(t.Updated) >= idle
+}
+
+// deleteAbandoned deletes an abandoned upload, unless it received data or finished since `t` was read. Returns true
+// if it was deleted
+// The caller holds the lock of the upload
+func deleteAbandoned(store storage.Backend, metaStore meta.Store, t meta.Transfer, now time.Time, idle time.Duration) (bool, error) {
+	t, ok, err := getMetadata(metaStore, t.UserID, t.FileID)
+	if err != nil || !ok || !abandoned(t, now, idle) {
+		return false, err
+	}
+
+	return true, deleteTransfer(store, metaStore, t)
+}
+
+// DeleteAbandoned deletes the data & metadata of all unfinished uploads that have not received data for longer
+// than `idle` at `now`
+// With `dryRun` nothing is deleted, the uploads that would be deleted are only logged
+// Uploads locked by a request are being written to, and are skipped
+// Returns the number of (would be) deleted uploads
+func DeleteAbandoned(store storage.Backend, metaStore meta.Store, locks lock.Locker, now time.Time, idle time.Duration, dryRun bool) (int, error) {
+	transfers, err := metaStore.All()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, t := range transfers {
+		if !abandoned(t, now, idle) {
+			continue
+		}
+
+		if dryRun {
+			slog.Info("Would delete abandoned upload", "user id", t.UserID, "file id", t.FileID, "state", t.State, "size", t.Size, "last update", t.Updated)
+			deleted++
+			continue
+		}
+
+		unlock, ok := lockUpload(locks, t.UserID, t.FileID)
+		if !ok {
+			continue
+		}
+		ok, err := deleteAbandoned(store, metaStore, t, now, idle)
+		unlock()
+		if err != nil {
+			slog.Error("Failed deleting abandoned upload", "user id", t.UserID, "file id", t.FileID, "error", err)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		slog.Info("Deleted abandoned upload", "user id", t.UserID, "file id", t.FileID, "state", t.State, "size", t.Size, "last update", t.Updated)
+		deleted++
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,196 @@
+package cleanup_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/cleanup"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+func TestDeleteExpired(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_cleanup")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed deleting temp dir: %v", err)
+		}
+	}()
+
+	store := storage.NewMemory()
+	metaStore, err := meta.NewFileStore(tempDir)
+	if err != nil {
+		t.Fatalf("Failed creating metadata store: %v", err)
+	}
+
+	now := time.Now()
+	for fileID, expiry := range map[string]time.Time{
+		"expired": now.Add(-time.Hour),
+		"old":     now.Add(-48 * time.Hour),
+		"valid":   now.Add(time.Hour),
+	} {
+		_, err = store.Create("user", fileID, strings.NewReader("data"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		err = metaStore.Put(meta.Transfer{UserID: "user", FileID: fileID, State: meta.StateComplete, Expiry: expiry})
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+	}
+
+	deleted, err := cleanup.DeleteExpired(store, metaStore, now, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expected 2 deleted transfers, got %d", deleted)
+	}
+
+	for _, fileID := range []string{"expired", "old"} {
+		_, err = store.Stat("user", fileID)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected %s file to be deleted, got %v", fileID, err)
+		}
+	}
+
+	transfer, err := metaStore.Get("user", "expired")
+	if err != nil {
+		t.Fatalf("Expected expired metadata to be kept, got %v", err)
+	}
+	if transfer.State != meta.StateExpired {
+		t.Errorf("Expected state %q, got %q", meta.StateExpired, transfer.State)
+	}
+
+	_, err = metaStore.Get("user", "old")
+	if !errors.Is(err, meta.ErrNotFound) {
+		t.Errorf("Expected metadata expired longer than the retention to be deleted, got %v", err)
+	}
+
+	_, err = store.Stat("user", "valid")
+	if err != nil {
+		t.Errorf("Expected valid file to still exist, got %v", err)
+	}
+
+	t.Run("Again", func(t *testing.T) {
+		deleted, err := cleanup.DeleteExpired(store, metaStore, now, 24*time.Hour)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if deleted != 0 {
+			t.Errorf("Expected no deleted transfers, got %d", deleted)
+		}
+
+		deleted, err = cleanup.DeleteExpired(store, metaStore, now.Add(48*time.Hour), 24*time.Hour)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if deleted != 1 {
+			t.Errorf("Expected only the valid transfer to be deleted, got %d", deleted)
+		}
+
+		_, err = metaStore.Get("user", "expired")
+		if !errors.Is(err, meta.ErrNotFound) {
+			t.Errorf("Expected expired metadata to be deleted after the retention, got %v", err)
+		}
+	})
+}
+
+func TestDeleteAbandoned(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_cleanup")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed deleting temp dir: %v", err)
+		}
+	}()
+
+	store := storage.NewMemory()
+	metaStore, err := meta.NewFileStore(tempDir)
+	if err != nil {
+		t.Fatalf("Failed creating metadata store: %v", err)
+	}
+
+	now := time.Now()
+	for _, transfer := range []meta.Transfer{
+		{UserID: "user", FileID: "abandoned", State: meta.StateInProgress, Updated: now.Add(-2 * time.Hour)},
+		{UserID: "user", FileID: "active", State: meta.StateInProgress, Updated: now.Add(-time.Minute)},
+		{UserID: "user", FileID: "complete", State: meta.StateComplete, Updated: now.Add(-2 * time.Hour)},
+		{UserID: "user", FileID: "revoked", State: meta.StateRevoked, Updated: now.Add(-2 * time.Hour)},
+		{UserID: "user", FileID: "locked", State: meta.StateInProgress, Updated: now.Add(-2 * time.Hour)},
+	} {
+		_, err = store.Create(transfer.UserID, transfer.FileID, strings.NewReader("data"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		err = metaStore.Put(transfer)
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+	}
+
+	// a request resuming the upload
+	locks := lock.NewMemory()
+	unlock, err := locks.TryLock("user/locked")
+	if err != nil {
+		t.Fatalf("Failed locking upload: %v", err)
+	}
+	defer unlock()
+
+	t.Run("Dry run", func(t *testing.T) {
+		deleted, err := cleanup.DeleteAbandoned(store, metaStore, locks, now, time.Hour, true)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if deleted != 2 {
+			t.Errorf("Expected 2 abandoned uploads, got %d", deleted)
+		}
+
+		_, err = store.Stat("user", "abandoned")
+		if err != nil {
+			t.Errorf("Expected abandoned file to still exist, got %v", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		deleted, err := cleanup.DeleteAbandoned(store, metaStore, locks, now, time.Hour, false)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if deleted != 1 {
+			t.Errorf("Expected 1 deleted upload, got %d", deleted)
+		}
+
+		_, err = store.Stat("user", "abandoned")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected abandoned file to be deleted, got %v", err)
+		}
+		_, err = metaStore.Get("user", "abandoned")
+		if !errors.Is(err, meta.ErrNotFound) {
+			t.Errorf("Expected abandoned metadata to be deleted, got %v", err)
+		}
+
+		for _, fileID := range []string{"active", "complete", "locked"} {
+			_, err = store.Stat("user", fileID)
+			if err != nil {
+				t.Errorf("Expected %s file to still exist, got %v", fileID, err)
+			}
+		}
+
+		_, err = metaStore.Get("user", "revoked")
+		if err != nil {
+			t.Errorf("Expected revoked metadata to be kept, got %v", err)
+		}
+	})
+}
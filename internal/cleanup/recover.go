@@ -0,0 +1,146 @@
+package cleanup
+
+import (
+	"errors"
+	"log/slog"
+
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+// lockUpload acquires the lock of an upload, returns false if another request or process holds it
+func lockUpload(locks lock.Locker, userID string, fileID string) (func(), bool) {
+	unlock, err := locks.TryLock(userID + "/" + fileID)
+	if errors.Is(err, lock.ErrLocked) {
+		slog.Info("Skipping upload locked by another request", "user id", userID, "file id", fileID)
+		return nil, false
+	}
+	if err != nil {
+		slog.Error("Failed locking upload", "user id", userID, "file id", fileID, "error", err)
+		return nil, false
+	}
+
+	return unlock, true
+}
+
+// getMetadata returns the current metadata of a transfer, and false if it has none
+func getMetadata(metaStore meta.Store, userID string, fileID string) (meta.Transfer, bool, error) {
+	t, err := metaStore.Get(userID, fileID)
+	if errors.Is(err, meta.ErrNotFound) {
+		return meta.Transfer{}, false, nil
+	}
+	if err != nil {
+		return meta.Transfer{}, false, err
+	}
+
+	return t, true, nil
+}
+
+// recoverStaged reconciles a single staged upload with its metadata, returns true if it was changed
+// The caller holds the lock of the upload
+func recoverStaged(store storage.Backend, stager storage.Stager, metaStore meta.Store, f storage.StagedFile) (bool, error) {
+	t, ok, err := getMetadata(metaStore, f.UserID, f.ID)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case !ok || t.State == meta.StateFailed || t.State == meta.StateCancelled || t.State == meta.StateRevoked || t.State == meta.StateExpired:
+		err = store.Delete(f.UserID, f.ID)
+		if err == nil {
+			slog.Info("Deleted staged upload that can't be resumed", "user id", f.UserID, "file id", f.ID, "state", t.State)
+		}
+	case t.State == meta.StateComplete:
+		err = store.Complete(f.UserID, f.ID)
+		if err == nil {
+			slog.Info("Completed staged upload", "user id", f.UserID, "file id", f.ID)
+		}
+	case f.Size > t.Size:
+		err = stager.Truncate(f.UserID, f.ID, t.Size)
+		if err == nil {
+			slog.Info("Truncated staged upload to its acknowledged size", "user id", f.UserID, "file id", f.ID, "size", f.Size, "acknowledged", t.Size)
+		}
+	case f.Size < t.Size:
+		// the upload resumes from the data that's there
+		slog.Warn("Staged upload is shorter than acknowledged", "user id", f.UserID, "file id", f.ID, "size", f.Size, "acknowledged", t.Size)
+		return false, nil
+	default:
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// RecoverStaged reconciles the uploads in the staging location of the storage with their metadata, after a crash
+// - staged data of transfers without metadata, or that can't be resumed, is deleted
+// - complete transfers are moved into place
+// - uploads in progress are truncated to the size stored in their metadata, data after it was never acknowledged
+// - uploads in progress written in place (before staging existed) are moved to the staging location
+//
+// Has to run before uploads are accepted by this process. Uploads locked by other processes sharing the state
+// directory are being written to, and are skipped. Returns the number of changed uploads
+func RecoverStaged(store storage.Backend, metaStore meta.Store, locks lock.Locker) (int, error) {
+	stager, ok := store.(storage.Stager)
+	if !ok {
+		return 0, nil
+	}
+
+	staged, err := stager.Staged()
+	if err != nil {
+		return 0, err
+	}
+
+	transfers, err := metaStore.All()
+	if err != nil {
+		return 0, err
+	}
+
+	inProgress := map[string]meta.Transfer{}
+	for _, t := range transfers {
+		if t.State == meta.StateInProgress {
+			inProgress[t.UserID+"/"+t.FileID] = t
+		}
+	}
+
+	changed := 0
+	for _, f := range staged {
+		delete(inProgress, f.UserID+"/"+f.ID)
+
+		unlock, ok := lockUpload(locks, f.UserID, f.ID)
+		if !ok {
+			continue
+		}
+		recovered, err := recoverStaged(store, stager, metaStore, f)
+		unlock()
+		if err != nil {
+			slog.Error("Failed recovering staged upload", "user id", f.UserID, "file id", f.ID, "error", err)
+			continue
+		}
+
+		if recovered {
+			changed++
+		}
+	}
+
+	for _, t := range inProgress {
+		unlock, ok := lockUpload(locks, t.UserID, t.FileID)
+		if !ok {
+			continue
+		}
+		err = stager.Stage(t.UserID, t.FileID)
+		unlock()
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed moving upload to staging", "user id", t.UserID, "file id", t.FileID, "error", err)
+			continue
+		}
+
+		slog.Info("Moved upload in progress to staging", "user id", t.UserID, "file id", t.FileID)
+		changed++
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,122 @@
+package cleanup_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"codeberg.org/filesender/filesender-next/internal/cleanup"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+func TestRecoverStaged(t *testing.T) {
+	tempDir := t.TempDir()
+	storageDir := filepath.Join(tempDir, "files")
+	err := os.Mkdir(storageDir, 0o700)
+	if err != nil {
+		t.Fatalf("Failed creating storage directory: %v", err)
+	}
+
+	store := storage.NewFilesystem(storageDir)
+	metaStore, err := meta.NewFileStore(filepath.Join(tempDir, "meta"))
+	if err != nil {
+		t.Fatalf("Failed creating metadata store: %v", err)
+	}
+
+	for _, transfer := range []meta.Transfer{
+		{UserID: "user", FileID: "acknowledged", State: meta.StateInProgress, Size: 4},
+		{UserID: "user", FileID: "unacknowledged", State: meta.StateInProgress, Size: 2},
+		{UserID: "user", FileID: "complete", State: meta.StateComplete, Size: 4},
+		{UserID: "user", FileID: "cancelled", State: meta.StateCancelled, Size: 4},
+		{UserID: "user", FileID: "orphan"},
+		{UserID: "user", FileID: "in-place", State: meta.StateInProgress, Size: 4},
+		{UserID: "user", FileID: "locked", State: meta.StateInProgress, Size: 2},
+	} {
+		_, err = store.Create(transfer.UserID, transfer.FileID, strings.NewReader("data"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		if transfer.FileID == "orphan" {
+			continue
+		}
+		err = metaStore.Put(transfer)
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+	}
+
+	// written in place before uploads were staged
+	err = store.Complete("user", "in-place")
+	if err != nil {
+		t.Fatalf("Failed completing file: %v", err)
+	}
+
+	// being written to by another process
+	locks := lock.NewMemory()
+	unlock, err := locks.TryLock("user/locked")
+	if err != nil {
+		t.Fatalf("Failed locking upload: %v", err)
+	}
+	defer unlock()
+
+	changed, err := cleanup.RecoverStaged(store, metaStore, locks)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if changed != 5 {
+		t.Errorf("Expected 5 changed uploads, got %d", changed)
+	}
+
+	staged, err := store.Staged()
+	if err != nil {
+		t.Fatalf("Failed listing staged files: %v", err)
+	}
+
+	sizes := map[string]int64{}
+	for _, f := range staged {
+		sizes[f.ID] = f.Size
+	}
+	expected := map[string]int64{"acknowledged": 4, "unacknowledged": 2, "in-place": 4, "locked": 4}
+	if len(sizes) != len(expected) {
+		t.Errorf("Expected staged files %v, got %v", expected, sizes)
+	}
+	for fileID, size := range expected {
+		if sizes[fileID] != size {
+			t.Errorf("Expected staged %s of %d bytes, got %d", fileID, size, sizes[fileID])
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(storageDir, "user", "complete"))
+	if err != nil {
+		t.Errorf("Expected complete file to be moved into place, got %v", err)
+	}
+
+	for _, fileID := range []string{"cancelled", "orphan"} {
+		_, err = store.Stat("user", fileID)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected %s file to be deleted, got %v", fileID, err)
+		}
+	}
+
+	changed, err = cleanup.RecoverStaged(store, metaStore, locks)
+	if err != nil || changed != 0 {
+		t.Errorf("Expected nothing to recover twice, got %d, %v", changed, err)
+	}
+}
+
+func TestRecoverStagedUnsupported(t *testing.T) {
+	metaStore, err := meta.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed creating metadata store: %v", err)
+	}
+
+	changed, err := cleanup.RecoverStaged(storage.NewMemory(), metaStore, lock.NewMemory())
+	if err != nil || changed != 0 {
+		t.Errorf("Expected nothing to recover, got %d, %v", changed, err)
+	}
+}
@@ -0,0 +1,102 @@
+// Package diskspace admits new upload data only while the storage keeps enough free space
+package diskspace
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ErrInsufficient is returned when storing more data would leave less free space than the reserve
+var ErrInsufficient = errors.New("insufficient storage space")
+
+// Reporter is implemented by storage backends that know how much free space they have left
+type Reporter interface {
+	FreeSpace() (int64, error)
+}
+
+// Status describes the free space of the storage
+type Status struct {
+	Supported bool  // false if the storage can't report its free space
+	Free      int64 // bytes free on the storage
+	Reserved  int64 // bytes admitted for uploads in progress, not written yet
+	Reserve   int64 // bytes that are always kept free
+}
+
+// Low checks if the free space not reserved for uploads has dropped below the reserve
+func (s Status) Low() bool {
+	return s.Supported && s.Free-s.Reserved < s.Reserve
+}
+
+// Guard keeps track of the data admitted for uploads, and rejects data that would use the reserved free space
+type Guard struct {
+	RetryAfter time.Duration // how long clients should wait before retrying a rejected upload
+
+	reporter Reporter // nil when the storage can't report its free space
+	reserve  int64
+
+	mu       sync.Mutex
+	reserved int64
+}
+
+// New creates a guard for `store` keeping `reserve` bytes free, storage that doesn't implement Reporter is never full
+func New(store any, reserve int64, retryAfter time.Duration) *Guard {
+	reporter, _ := store.(Reporter)
+	return &Guard{
+		RetryAfter: retryAfter,
+		reporter:   reporter,
+		reserve:    reserve,
+	}
+}
+
+// Status returns the current free space of the storage
+func (g *Guard) Status() (Status, error) {
+	g.mu.Lock()
+	status := Status{Reserved: g.reserved, Reserve: g.reserve}
+	g.mu.Unlock()
+
+	if g.reporter == nil {
+		return status, nil
+	}
+
+	free, err := g.reporter.FreeSpace()
+	if err != nil {
+		return status, err
+	}
+
+	status.Supported = true
+	status.Free = free
+	return status, nil
+}
+
+// Reserve admits `n` bytes of new data, returns a function releasing the reservation once the data is written
+// Returns ErrInsufficient if the data would use the reserve, uploads are admitted if the free space can't be read
+func (g *Guard) Reserve(n int64) (func(), error) {
+	if g.reporter == nil {
+		return func() {}, nil
+	}
+
+	free, err := g.reporter.FreeSpace()
+	if err != nil {
+		slog.Error("Failed reading free storage space", "error", err)
+		return func() {}, nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if free-g.reserved-n < g.reserve {
+		return nil, ErrInsufficient
+	}
+
+	g.reserved += n
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			g.reserved -= n
+			g.mu.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,99 @@
+package diskspace_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/diskspace"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+type freeSpace int64
+
+func (f freeSpace) FreeSpace() (int64, error) {
+	return int64(f), nil
+}
+
+type failingReporter struct{}
+
+func (failingReporter) FreeSpace() (int64, error) {
+	return 0, errors.New("statfs failed")
+}
+
+func TestReserve(t *testing.T) {
+	guard := diskspace.New(freeSpace(100), 40, time.Minute)
+
+	release, err := guard.Reserve(50)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	_, err = guard.Reserve(20)
+	if !errors.Is(err, diskspace.ErrInsufficient) {
+		t.Errorf("Expected insufficient space with 50 bytes reserved, got %v", err)
+	}
+
+	status, err := guard.Status()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !status.Supported || status.Free != 100 || status.Reserved != 50 || status.Reserve != 40 || status.Low() {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	release()
+	release()
+
+	_, err = guard.Reserve(60)
+	if err != nil {
+		t.Errorf("Expected space to be released, got %v", err)
+	}
+
+	_, err = guard.Reserve(1)
+	if !errors.Is(err, diskspace.ErrInsufficient) {
+		t.Errorf("Expected the reserve to be kept free, got %v", err)
+	}
+}
+
+func TestLow(t *testing.T) {
+	status, err := diskspace.New(freeSpace(10), 40, time.Minute).Status()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !status.Low() {
+		t.Errorf("Expected low free space, got %+v", status)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	for name, store := range map[string]any{
+		"No reporter":    storage.NewMemory(),
+		"Failing statfs": failingReporter{},
+		"Nothing at all": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			guard := diskspace.New(store, 1<<62, time.Minute)
+			_, err := guard.Reserve(1 << 40)
+			if err != nil {
+				t.Errorf("Expected uploads to be admitted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFilesystemFreeSpace(t *testing.T) {
+	var store any = storage.NewFilesystem(t.TempDir())
+	reporter, ok := store.(diskspace.Reporter)
+	if !ok {
+		t.Skip("Free space is not supported on this platform")
+	}
+
+	free, err := reporter.FreeSpace()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if free <= 0 {
+		t.Errorf("Expected free space, got %d", free)
+	}
+}
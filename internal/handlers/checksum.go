@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+// Checksum algorithms supported for the `Upload-Checksum` header of the tus checksum extension
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// Digest algorithms supported for the `Content-Digest` header, https://www.rfc-editor.org/rfc/rfc9530
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+var (
+	errUnsupportedChecksum = errors.New("unsupported checksum algorithm")
+	errChecksumMismatch    = errors.New("checksum mismatch")
+)
+
+// uploadChecksum is the checksum a chunk of data is expected to have
+type uploadChecksum struct {
+	newHash  func() hash.Hash
+	expected []byte
+}
+
+// parseUploadChecksum parses an `Upload-Checksum` header: `<algorithm> <base64 encoded checksum>`
+func parseUploadChecksum(value string) (uploadChecksum, error) {
+	algorithm, encoded, found := strings.Cut(value, " ")
+	if !found {
+		return uploadChecksum{}, fmt.Errorf("invalid checksum %q", value)
+	}
+
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return uploadChecksum{}, fmt.Errorf("%w: %s", errUnsupportedChecksum, algorithm)
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return uploadChecksum{}, fmt.Errorf("invalid checksum %q: %w", value, err)
+	}
+
+	return uploadChecksum{newHash: newHash, expected: expected}, nil
+}
+
+// parseContentDigest parses a `Content-Digest` header: comma separated `<algorithm>=:<base64 encoded digest>:`
+// The first digest with a supported algorithm is used, others are ignored
+func parseContentDigest(value string) (uploadChecksum, error) {
+	for _, member := range strings.Split(value, ",") {
+		member, _, _ = strings.Cut(member, ";") // parameters are not used
+		algorithm, encoded, found := strings.Cut(strings.TrimSpace(member), "=")
+		if !found {
+			return uploadChecksum{}, fmt.Errorf("invalid digest %q", member)
+		}
+
+		newHash, ok := digestAlgorithms[algorithm]
+		if !ok {
+			continue
+		}
+
+		encoded, ok = strings.CutPrefix(encoded, ":")
+		if !ok {
+			return uploadChecksum{}, fmt.Errorf("invalid digest %q", member)
+		}
+		encoded, ok = strings.CutSuffix(encoded, ":")
+		if !ok {
+			return uploadChecksum{}, fmt.Errorf("invalid digest %q", member)
+		}
+
+		expected, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return uploadChecksum{}, fmt.Errorf("invalid digest %q: %w", member, err)
+		}
+
+		return uploadChecksum{newHash: newHash, expected: expected}, nil
+	}
+
+	return uploadChecksum{}, fmt.Errorf("%w: %s", errUnsupportedChecksum, value)
+}
+
+// checkContentDigest verifies the request body against its `Content-Digest` header, if there is one
+// The body is verified while it is read: the returned check reads the rest of it and returns errChecksumMismatch if it
+// did not match, the data stored from it is then discarded by the caller. With a `spoolDir` the body is verified
+// before it is read instead, from a copy in that directory that the returned cleanup removes
+// Sends an error response and returns false if the body can't be verified
+func checkContentDigest(w http.ResponseWriter, r *http.Request, spoolDir string) (func() error, func(), bool) {
+	value := r.Header.Get("Content-Digest")
+	if value == "" {
+		return func() error { return nil }, func() {}, true
+	}
+
+	digest, err := parseContentDigest(value)
+	if err != nil {
+		slog.Info("Invalid content digest", "error", err)
+		w.Header().Set("Want-Content-Digest", "sha-256=1")
+		sendError(w, http.StatusBadRequest, "Invalid or unsupported content digest")
+		return nil, nil, false
+	}
+
+	body := digest.verify(r.Body)
+	if spoolDir == "" {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		return body.rest, func() {}, true
+	}
+
+	spooled, cleanup, err := spool(body, spoolDir)
+	switch {
+	case errors.Is(err, errChecksumMismatch):
+		slog.Info("Upload does not match its content digest")
+		sendError(w, http.StatusBadRequest, "Content digest mismatch")
+		return nil, nil, false
+	case isBodyTooLarge(err):
+		sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
+		return nil, nil, false
+	case err != nil:
+		slog.Error("Failed receiving upload", "error", err)
+		sendError(w, http.StatusInternalServerError, "Failed receiving upload")
+		return nil, nil, false
+	}
+
+	r.Body = io.NopCloser(spooled)
+	return func() error { return nil }, cleanup, true
+}
+
+// resumeDigest returns the running SHA-256 of an upload after its first `offset` bytes
+// Continues from the state stored in the metadata, data it does not cover is read back from storage. Backends that
+// can't read uploads in progress (S3) return storage.ErrInProgress then, and the upload can't be resumed
+func resumeDigest(store storage.Backend, userID string, fileID string, t meta.Transfer, offset int64) (hash.Hash, error) {
+	info, err := store.Stat(userID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size != offset {
+		return nil, fmt.Errorf("%w: offset %d, size %d", storage.ErrOffsetMismatch, offset, info.Size)
+	}
+
+	h := sha256.New()
+	var start int64
+	if len(t.DigestState) > 0 && t.DigestedSize <= offset {
+		err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(t.DigestState)
+		if err != nil {
+			slog.Error("Failed restoring digest state, reading the upload again", "error", err)
+			h.Reset()
+		} else {
+			start = t.DigestedSize
+		}
+	}
+
+	if start == offset {
+		return h, nil
+	}
+
+	r, err := store.OpenRange(userID, fileID, start, offset-start)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			slog.Error("Failed closing file", "error", err)
+		}
+	}()
+
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// recordDigest stores the running SHA-256 of an upload of `size` bytes in its metadata
+// Once the upload is complete only the final digest is kept
+func recordDigest(t *meta.Transfer, h hash.Hash, size int64, complete bool) {
+	if complete {
+		t.Checksum = base64.StdEncoding.EncodeToString(h.Sum(nil))
+		t.DigestState = nil
+		t.DigestedSize = 0
+		return
+	}
+
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		// the next chunk reads the data back from storage instead
+		slog.Error("Failed saving digest state", "error", err)
+		return
+	}
+
+	t.DigestState = state
+	t.DigestedSize = size
+}
+
+// setReprDigest adds the SHA-256 of a complete transfer as `Repr-Digest` header
+func setReprDigest(w http.ResponseWriter, t meta.Transfer) {
+	if t.Checksum != "" {
+		w.Header().Set("Repr-Digest", "sha-256=:"+t.Checksum+":")
+	}
+}
+
+// verifyingReader reads from r while computing its checksum, and fails with errChecksumMismatch instead of io.EOF if
+// the data does not match
+type verifyingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected []byte
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(v.h.Sum(nil), v.expected) {
+		return n, errChecksumMismatch
+	}
+
+	return n, err
+}
+
+// rest reads the data not read yet, and returns errChecksumMismatch if the data did not match
+func (v *verifyingReader) rest() error {
+	_, err := io.Copy(io.Discard, v)
+	return err
+}
+
+// verify returns a reader of r that is checked against the checksum at its end
+// Data read before the mismatch is detected is not verified, the caller discards it
+func (c uploadChecksum) verify(r io.Reader) *verifyingReader {
+	return &verifyingReader{r: r, h: c.newHash(), expected: c.expected}
+}
+
+// chunkSpoolDir returns the directory chunks with a checksum are verified in before they are appended
+// Storage that can discard the data appended from a chunk (storage.Stager) verifies it while it is written instead,
+// other storage (S3) may have committed that data before its end shows the chunk is corrupted
+func chunkSpoolDir(store storage.Backend, spoolDir string) string {
+	if _, ok := store.(storage.Stager); ok {
+		return ""
+	}
+
+	return spoolDir
+}
+
+// spool copies r into a temporary file in dir, the returned function closes & removes the file
+func spool(r io.Reader, dir string) (io.Reader, func(), error) {
+	f, err := os.CreateTemp(dir, "chunk-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cleanup := func() {
+		if err := f.Close(); err != nil {
+			slog.Error("Failed closing spooled chunk", "error", err)
+		}
+		if err := os.Remove(f.Name()); err != nil {
+			slog.Error("Failed removing spooled chunk", "error", err)
+		}
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return f, cleanup, nil
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/id"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+// statusRecorder remembers the status code of a response, how many body bytes were sent, and if sending failed
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	failed  bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.written += int64(n)
+	if err != nil {
+		s.failed = true
+	}
+	return n, err
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// downloadETag returns a strong entity tag of a stored file, based on its SHA-256 when known
+func downloadETag(t meta.Transfer, info storage.FileInfo) string {
+	if t.Checksum != "" {
+		return `"sha256-` + t.Checksum + `"`
+	}
+
+	return fmt.Sprintf(`"%x-%x"`, info.Size, info.ModTime.UnixNano())
+}
+
+// requestedBytes returns how many bytes of a file of `size` bytes a `Range` header requests at most
+// Without a valid header http.ServeContent sends the whole file, as it does when the ranges add up to more than the file
+func requestedBytes(rangeHeader string, size int64) int64 {
+	specs, found := strings.CutPrefix(rangeHeader, "bytes=")
+	if !found {
+		return size
+	}
+
+	var total int64
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		start, end, found := strings.Cut(spec, "-")
+		if !found {
+			return size
+		}
+
+		if start == "" {
+			// a suffix: the last `end` bytes
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return size
+			}
+			total += min(n, size)
+			continue
+		}
+
+		first, err := strconv.ParseInt(start, 10, 64)
+		if err != nil || first < 0 {
+			return size
+		}
+		last := size - 1
+		if end != "" {
+			last, err = strconv.ParseInt(end, 10, 64)
+			if err != nil || last < first {
+				return size
+			}
+			last = min(last, size-1)
+		}
+		if first < size {
+			total += last - first + 1
+		}
+	}
+
+	return min(total, size)
+}
+
+// errDownloadLimit is returned when a download would exceed the download limit of a transfer
+var errDownloadLimit = errors.New("download limit reached")
+
+// downloadLockTimeout is how long counting a download waits for other requests changing the transfer
+const downloadLockTimeout = 5 * time.Second
+
+// countDownload changes the bytes sent of a transfer of `size` bytes by `n`, failing with errDownloadLimit if more
+// than MaxDownloads times the size would be sent
+// The transfer is locked while counting, so processes sharing the metadata can't both pass the limit
+func countDownload(metaStore meta.Store, locks lock.Locker, userID string, fileID string, size int64, n int64) error {
+	unlock, err := lock.Wait(locks, userID+"/"+fileID, downloadLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = metaStore.Update(userID, fileID, func(t *meta.Transfer) error {
+		// transfers downloaded before bytes were counted
+		downloaded := max(t.DownloadedBytes, int64(t.Downloads)*size)
+		if n > 0 && t.MaxDownloads > 0 && downloaded+n > int64(t.MaxDownloads)*size {
+			return errDownloadLimit
+		}
+
+		t.DownloadedBytes = max(downloaded+n, 0)
+		t.Downloads = int(t.DownloadedBytes / size)
+		return nil
+	})
+	if errors.Is(err, meta.ErrNotFound) {
+		// transfers without metadata are not counted
+		return nil
+	}
+
+	return err
+}
+
+// DownloadAPI handles GET /download/{publicID} and GET /download/{userID}/{fileID}
+// Supports single and multiple `Range` requests, and `If-Range` with the `ETag` of the file
+// The content is always served as `application/octet-stream`, so browsers never render it
+// The requested bytes are counted before they are sent, so parallel and ranged requests can't download a transfer more
+// often than allowed, and a download resumed with ranges counts once. Bytes that could not be sent are not counted
+// Downloads aren't tracked as sessions: restarting an interrupted download from the start counts the bytes received
+// before again, so a one-time link can only be resumed with a `Range` request
+func DownloadAPI(store storage.Backend, metaStore meta.Store, locks lock.Locker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, fileID, ok := resolveTransfer(w, r, metaStore)
+		if !ok {
+			return
+		}
+
+		err := id.Validate(fileID)
+		if err != nil {
+			slog.Info("Invalid file ID", "file id", fileID, "error", err)
+			sendError(w, http.StatusNotFound, "File not found")
+			return
+		}
+
+		info, err := store.Stat(userID, fileID)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				// the data of revoked transfers has been deleted, their metadata is kept
+				transfer, err := metaStore.Get(userID, fileID)
+				if err == nil && sendUnavailable(w, transfer) {
+					return
+				}
+			}
+			if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidID) {
+				sendError(w, http.StatusNotFound, "File not found")
+				return
+			}
+
+			slog.Error("Failed getting file info", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed getting specified file")
+			return
+		}
+
+		transfer, err := getTransfer(metaStore, userID, fileID)
+		if err != nil {
+			slog.Error("Failed getting transfer metadata", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed getting specified file")
+			return
+		}
+
+		if sendUnavailable(w, transfer) {
+			return
+		}
+
+		etag := downloadETag(transfer, info)
+		// an empty file counts as one byte, so its downloads are counted too
+		size := max(info.Size, 1)
+		var reserved int64
+		if r.Method == http.MethodGet {
+			reserved = requestedBytes(r.Header.Get("Range"), size)
+			if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+				// the whole file is sent if the file changed
+				reserved = size
+			}
+
+			err = countDownload(metaStore, locks, userID, fileID, size, reserved)
+			if errors.Is(err, errDownloadLimit) {
+				sendError(w, http.StatusGone, "Download limit reached")
+				return
+			}
+			if errors.Is(err, lock.ErrLocked) {
+				slog.Info("Transfer is locked by another request", "file id", fileID)
+				w.Header().Set("Retry-After", "1")
+				sendError(w, http.StatusServiceUnavailable, "Transfer is busy")
+				return
+			}
+			if err != nil {
+				slog.Error("Failed recording download", "error", err)
+				sendError(w, http.StatusInternalServerError, "Failed getting specified file")
+				return
+			}
+		}
+
+		content := storage.NewReadSeeker(store, userID, fileID, info.Size)
+		defer func() {
+			if err := content.Close(); err != nil {
+				slog.Error("Failed closing file", "error", err)
+			}
+		}()
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("ETag", etag)
+		setReprDigest(w, transfer)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		http.ServeContent(recorder, r, fileID, info.ModTime, content)
+
+		if reserved == 0 {
+			return
+		}
+
+		// responses without content (e.g. 304 Not Modified or 416) and bytes that could not be sent are not counted
+		var unsent int64
+		switch {
+		case recorder.status != http.StatusOK && recorder.status != http.StatusPartialContent:
+			unsent = reserved
+		case recorder.failed:
+			unsent = max(reserved-recorder.written, 0)
+		}
+		if unsent > 0 {
+			err = countDownload(metaStore, locks, userID, fileID, size, -unsent)
+			if err != nil {
+				slog.Error("Failed recording download", "error", err)
+			}
+			return
+		}
+
+		slog.Info("File downloaded", "user id", userID, "file id", fileID, "range", r.Header.Get("Range"), "status", recorder.status)
+	}
+}
@@ -0,0 +1,560 @@
+package handlers_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/cleanup"
+	"codeberg.org/filesender/filesender-next/internal/handlers"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+// failingWriter is a response whose connection breaks after `remaining` bytes of the body
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	remaining int
+}
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	if len(b) > f.remaining {
+		n, _ := f.ResponseRecorder.Write(b[:f.remaining])
+		f.remaining = 0
+		return n, errors.New("connection reset")
+	}
+
+	f.remaining -= len(b)
+	return f.ResponseRecorder.Write(b)
+}
+
+// testUserID is a user ID as hashed from the subject of a user, for links by user & file ID
+const testUserID = "dXNlcl9fX19fX19fX19fX19fX19fX19fX19fX19fX18"
+
+func TestDownloadAPI(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed deleting temp dir: %v", err)
+		}
+	}()
+
+	const (
+		fileID    = "ZmlsZV9fX19fX19fX19fXw"
+		expiredID = "ZXhwaXJlZF9fX19fX19fXw"
+		partialID = "cGFydGlhbF9fX19fX19fXw"
+		missingID = "aGlfX19fX19fX19fX19fXw"
+	)
+
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	for _, fileID := range []string{fileID, expiredID, partialID} {
+		_, err = store.Create(testUserID, fileID, strings.NewReader("Hello, world!"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+	}
+
+	err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: expiredID, Expiry: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("Failed storing metadata: %v", err)
+	}
+
+	err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: partialID, State: meta.StateInProgress})
+	if err != nil {
+		t.Fatalf("Failed storing metadata: %v", err)
+	}
+
+	err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: fileID, State: meta.StateComplete})
+	if err != nil {
+		t.Fatalf("Failed storing metadata: %v", err)
+	}
+
+	locks := lock.NewMemory()
+	handler := handlers.DownloadAPI(store, metaStore, locks)
+
+	t.Run("File not exist", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+missingID, nil, map[string]string{
+			"userID": testUserID,
+			"fileID": missingID,
+		})
+
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
+		}
+	})
+
+	t.Run("Invalid ID", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/download/../"+fileID, nil, map[string]string{
+			"userID": "..",
+			"fileID": fileID,
+		})
+
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
+		}
+	})
+
+	t.Run("Invalid user ID", func(t *testing.T) {
+		// stored by the backend, but not a user ID any user can have
+		_, err := store.Create("user", fileID, strings.NewReader("Hello, world!"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		resp := mockRequest(handler, "GET", "/download/user/"+fileID, nil, map[string]string{
+			"userID": "user",
+			"fileID": fileID,
+		})
+
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
+		}
+	})
+
+	t.Run("Invalid file ID", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/file", nil, map[string]string{
+			"userID": testUserID,
+			"fileID": "file",
+		})
+
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+expiredID, nil, map[string]string{
+			"userID": testUserID,
+			"fileID": expiredID,
+		})
+
+		if resp.Code != http.StatusGone {
+			t.Errorf("Expected status %d, got %d", http.StatusGone, resp.Code)
+		}
+	})
+
+	t.Run("Upload not finished", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+partialID, nil, map[string]string{
+			"userID": testUserID,
+			"fileID": partialID,
+		})
+
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+fileID, nil, map[string]string{
+			"userID": testUserID,
+			"fileID": fileID,
+		})
+
+		if resp.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+
+		if b := resp.Body.String(); b != "Hello, world!" {
+			t.Errorf("Expected body to be \"Hello, world!\", got \"%s\"", b)
+		}
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+fileID, map[string]string{
+			"Range": "bytes=7-",
+		}, map[string]string{
+			"userID": testUserID,
+			"fileID": fileID,
+		})
+
+		if resp.Code != http.StatusPartialContent {
+			t.Errorf("Expected status %d, got %d", http.StatusPartialContent, resp.Code)
+		}
+
+		if b := resp.Body.String(); b != "world!" {
+			t.Errorf("Expected body to be \"world!\", got \"%s\"", b)
+		}
+	})
+	t.Run("Headers", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+fileID, nil, map[string]string{
+			"userID": testUserID,
+			"fileID": fileID,
+		})
+
+		for header, expected := range map[string]string{
+			"Cache-Control":          "no-store",
+			"Content-Type":           "application/octet-stream",
+			"X-Content-Type-Options": "nosniff",
+		} {
+			if value := resp.Header().Get(header); value != expected {
+				t.Errorf("Expected %s \"%s\", got \"%s\"", header, expected, value)
+			}
+		}
+		if resp.Header().Get("ETag") == "" {
+			t.Error("Expected an ETag")
+		}
+	})
+
+	t.Run("Multiple ranges", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+fileID, map[string]string{
+			"Range": "bytes=0-4,7-11",
+		}, map[string]string{
+			"userID": testUserID,
+			"fileID": fileID,
+		})
+
+		if resp.Code != http.StatusPartialContent {
+			t.Errorf("Expected status %d, got %d", http.StatusPartialContent, resp.Code)
+		}
+		if contentType := resp.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "multipart/byteranges") {
+			t.Errorf("Expected multipart/byteranges, got \"%s\"", contentType)
+		}
+		if b := resp.Body.String(); !strings.Contains(b, "Hello") || !strings.Contains(b, "world") {
+			t.Errorf("Expected both ranges in body, got \"%s\"", b)
+		}
+	})
+
+	t.Run("If-Range", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+fileID, nil, map[string]string{
+			"userID": testUserID,
+			"fileID": fileID,
+		})
+		etag := resp.Header().Get("ETag")
+
+		resp = mockRequest(handler, "GET", "/download/"+testUserID+"/"+fileID, map[string]string{
+			"Range":    "bytes=7-",
+			"If-Range": etag,
+		}, map[string]string{
+			"userID": testUserID,
+			"fileID": fileID,
+		})
+		if resp.Code != http.StatusPartialContent {
+			t.Errorf("Expected status %d, got %d", http.StatusPartialContent, resp.Code)
+		}
+
+		resp = mockRequest(handler, "GET", "/download/"+testUserID+"/"+fileID, map[string]string{
+			"Range":    "bytes=7-",
+			"If-Range": `"changed"`,
+		}, map[string]string{
+			"userID": testUserID,
+			"fileID": fileID,
+		})
+		if resp.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+		if b := resp.Body.String(); b != "Hello, world!" {
+			t.Errorf("Expected body to be \"Hello, world!\", got \"%s\"", b)
+		}
+	})
+
+	t.Run("Download recorded", func(t *testing.T) {
+		before, err := metaStore.Get(testUserID, fileID)
+		if err != nil {
+			t.Fatalf("Failed getting metadata: %v", err)
+		}
+
+		_ = mockRequest(handler, "GET", "/download/"+testUserID+"/"+fileID, nil, map[string]string{
+			"userID": testUserID,
+			"fileID": fileID,
+		})
+
+		after, err := metaStore.Get(testUserID, fileID)
+		if err != nil {
+			t.Fatalf("Failed getting metadata: %v", err)
+		}
+		if after.Downloads != before.Downloads+1 {
+			t.Errorf("Expected %d downloads, got %d", before.Downloads+1, after.Downloads)
+		}
+	})
+	t.Run("Download limit", func(t *testing.T) {
+		const limitedID = "bGltaXRlZF9fX19fX19fXw"
+		_, err := store.Create(testUserID, limitedID, strings.NewReader("Hello, world!"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: limitedID, State: meta.StateComplete, MaxDownloads: 1})
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+
+		// a download resumed with ranges is counted once
+		for _, r := range []string{"bytes=0-4", "bytes=5-"} {
+			resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+limitedID, map[string]string{"Range": r}, map[string]string{
+				"userID": testUserID,
+				"fileID": limitedID,
+			})
+
+			if resp.Code != http.StatusPartialContent {
+				t.Errorf("Expected status %d for %s, got %d", http.StatusPartialContent, r, resp.Code)
+			}
+		}
+
+		transfer, err := metaStore.Get(testUserID, limitedID)
+		if err != nil {
+			t.Fatalf("Failed getting metadata: %v", err)
+		}
+		if transfer.Downloads != 1 {
+			t.Errorf("Expected 1 download, got %d", transfer.Downloads)
+		}
+
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+limitedID, nil, map[string]string{
+			"userID": testUserID,
+			"fileID": limitedID,
+		})
+		if resp.Code != http.StatusGone {
+			t.Errorf("Expected status %d, got %d", http.StatusGone, resp.Code)
+		}
+		if b := resp.Body.String(); !strings.Contains(b, "Download limit reached") {
+			t.Errorf("Expected error to be \"Download limit reached\", got \"%s\"", b)
+		}
+	})
+
+	t.Run("Download limit ranges", func(t *testing.T) {
+		const limitedID = "cmFuZ2VzX19fX19fX19fXw"
+		_, err := store.Create(testUserID, limitedID, strings.NewReader("Hello, world!"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: limitedID, State: meta.StateComplete, MaxDownloads: 2})
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+
+		// ranges not reaching the end are counted as well: 5 times 5 bytes fit in 2 downloads of 13 bytes
+		for i := range 6 {
+			resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+limitedID, map[string]string{"Range": "bytes=0-4"}, map[string]string{
+				"userID": testUserID,
+				"fileID": limitedID,
+			})
+
+			expected := http.StatusPartialContent
+			if i == 5 {
+				expected = http.StatusGone
+			}
+			if resp.Code != expected {
+				t.Errorf("Expected status %d for request %d, got %d", expected, i+1, resp.Code)
+			}
+		}
+
+		transfer, err := metaStore.Get(testUserID, limitedID)
+		if err != nil {
+			t.Fatalf("Failed getting metadata: %v", err)
+		}
+		if transfer.Downloads != 1 || transfer.DownloadedBytes != 25 {
+			t.Errorf("Expected 1 download of 25 bytes, got %d of %d bytes", transfer.Downloads, transfer.DownloadedBytes)
+		}
+	})
+
+	t.Run("One-time link in parallel", func(t *testing.T) {
+		const limitedID = "cGFyYWxsZWxfX19fX19fXw"
+		_, err := store.Create(testUserID, limitedID, strings.NewReader("Hello, world!"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: limitedID, State: meta.StateComplete, MaxDownloads: 1})
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		codes := make([]int, 10)
+		for i := range codes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+limitedID, nil, map[string]string{
+					"userID": testUserID,
+					"fileID": limitedID,
+				})
+				codes[i] = resp.Code
+			}()
+		}
+		wg.Wait()
+
+		downloaded := 0
+		for _, code := range codes {
+			switch code {
+			case http.StatusOK:
+				downloaded++
+			case http.StatusGone:
+			default:
+				t.Errorf("Expected status %d or %d, got %d", http.StatusOK, http.StatusGone, code)
+			}
+		}
+		if downloaded != 1 {
+			t.Errorf("Expected 1 download, got %d", downloaded)
+		}
+	})
+
+	t.Run("One-time link in parallel processes", func(t *testing.T) {
+		const limitedID = "cHJvY2Vzc2VzX19fX19fXw"
+		_, err := store.Create(testUserID, limitedID, strings.NewReader("Hello, world!"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: limitedID, State: meta.StateComplete, MaxDownloads: 1})
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+
+		// every process has its own metadata store & locker on the shared state directory
+		processes := make([]http.HandlerFunc, 2)
+		for i := range processes {
+			locks, err := lock.NewFile(filepath.Join(tempDir, "locks"))
+			if err != nil {
+				t.Fatalf("Failed creating locker: %v", err)
+			}
+			processes[i] = handlers.DownloadAPI(store, newMetaStore(t, tempDir), locks)
+		}
+
+		var wg sync.WaitGroup
+		codes := make([]int, 10)
+		for i := range codes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp := mockRequest(processes[i%2], "GET", "/download/"+testUserID+"/"+limitedID, nil, map[string]string{
+					"userID": testUserID,
+					"fileID": limitedID,
+				})
+				codes[i] = resp.Code
+			}()
+		}
+		wg.Wait()
+
+		downloaded := 0
+		for _, code := range codes {
+			switch code {
+			case http.StatusOK:
+				downloaded++
+			case http.StatusGone:
+			default:
+				t.Errorf("Expected status %d or %d, got %d", http.StatusOK, http.StatusGone, code)
+			}
+		}
+		if downloaded != 1 {
+			t.Errorf("Expected 1 download, got %d", downloaded)
+		}
+	})
+
+	t.Run("One-time link restarted", func(t *testing.T) {
+		const limitedID = "cmVzdGFydGVkX19fX19fXw"
+		_, err := store.Create(testUserID, limitedID, strings.NewReader("Hello, world!"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: limitedID, State: meta.StateComplete, MaxDownloads: 1})
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+
+		req, _ := http.NewRequest("GET", "/download/"+testUserID+"/"+limitedID, nil)
+		req.SetPathValue("userID", testUserID)
+		req.SetPathValue("fileID", limitedID)
+		handler.ServeHTTP(&failingWriter{ResponseRecorder: httptest.NewRecorder(), remaining: 10}, req)
+
+		// downloads aren't sessions, the 10 bytes received count even if the download restarts from the start
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+limitedID, nil, map[string]string{
+			"userID": testUserID,
+			"fileID": limitedID,
+		})
+		if resp.Code != http.StatusGone {
+			t.Errorf("Expected status %d restarting the download, got %d", http.StatusGone, resp.Code)
+		}
+
+		resp = mockRequest(handler, "GET", "/download/"+testUserID+"/"+limitedID, map[string]string{"Range": "bytes=10-"}, map[string]string{
+			"userID": testUserID,
+			"fileID": limitedID,
+		})
+		if resp.Code != http.StatusPartialContent {
+			t.Errorf("Expected status %d resuming the download, got %d", http.StatusPartialContent, resp.Code)
+		}
+		if b := resp.Body.String(); b != "ld!" {
+			t.Errorf("Expected the rest of the file, got \"%s\"", b)
+		}
+	})
+
+	t.Run("Range not satisfiable", func(t *testing.T) {
+		before, err := metaStore.Get(testUserID, fileID)
+		if err != nil {
+			t.Fatalf("Failed getting metadata: %v", err)
+		}
+
+		resp := mockRequest(handler, "GET", "/download/"+testUserID+"/"+fileID, map[string]string{"Range": "bytes=100-"}, map[string]string{
+			"userID": testUserID,
+			"fileID": fileID,
+		})
+		if resp.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestedRangeNotSatisfiable, resp.Code)
+		}
+
+		after, err := metaStore.Get(testUserID, fileID)
+		if err != nil {
+			t.Fatalf("Failed getting metadata: %v", err)
+		}
+		if after.DownloadedBytes != before.DownloadedBytes {
+			t.Errorf("Expected a response without content not to be counted, got %d bytes instead of %d", after.DownloadedBytes, before.DownloadedBytes)
+		}
+	})
+}
+
+func TestExpiredLinks(t *testing.T) {
+	const (
+		fileID   = "ZXhwaXJlZF9fX19fX19fXw"
+		publicID = "cHVibGljX19fX19fX19fXw"
+	)
+
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, t.TempDir())
+	_, err := store.Create(testUserID, fileID, strings.NewReader("Hello, world!"))
+	if err != nil {
+		t.Fatalf("Failed creating file: %v", err)
+	}
+
+	err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: fileID, PublicID: publicID, State: meta.StateComplete, Expiry: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("Failed storing metadata: %v", err)
+	}
+
+	_, err = cleanup.DeleteExpired(store, metaStore, time.Now(), time.Hour)
+	if err != nil {
+		t.Fatalf("Failed deleting expired transfers: %v", err)
+	}
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"View":     handlers.GetDownloadTemplate("/", store, metaStore),
+		"Download": handlers.DownloadAPI(store, metaStore, lock.NewMemory()),
+	} {
+		for path, pathValues := range map[string]map[string]string{
+			"/" + publicID:                  {"publicID": publicID},
+			"/" + testUserID + "/" + fileID: {"userID": testUserID, "fileID": fileID},
+		} {
+			t.Run(name+" "+path, func(t *testing.T) {
+				resp := mockRequest(handler, "GET", path, nil, pathValues)
+
+				if resp.Code != http.StatusGone {
+					t.Errorf("Expected status %d, got %d", http.StatusGone, resp.Code)
+				}
+				if !strings.Contains(resp.Body.String(), "File has expired") {
+					t.Errorf("Expected error to be \"File has expired\", got %s", resp.Body.String())
+				}
+			})
+		}
+	}
+}
@@ -6,89 +6,51 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"io"
-	"log/slog"
-	"mime/multipart"
-	"os"
-	"path"
-	"path/filepath"
-)
-
-// FileUpload handles a new file uploaded
-func FileUpload(stateDir string, userID string, fileID string, file multipart.File) error {
-	// Create transfer folder for user if not exists
-	uploadDest := filepath.Join(stateDir, userID)
-	if _, err := os.Stat(uploadDest); os.IsNotExist(err) {
-		err = os.Mkdir(uploadDest, 0o700)
-		if err != nil {
-			slog.Error("Could not create new user directory", "error", err)
-			return err
-		}
 
-		slog.Info("First time upload for user", "user id", userID)
-	}
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
 
-	fileName := fileID
-	dst, err := os.OpenFile(path.Join(uploadDest, fileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err := dst.Close(); err != nil {
-			slog.Error("Failed closing file", "error", err)
-		}
-	}()
+// ErrTooLarge is returned when an upload would grow beyond its maximum size
+var ErrTooLarge = errors.New("upload exceeds the maximum size")
 
-	_, err = io.Copy(dst, file)
-	if err != nil {
-		slog.Error("Failed copying file contents", "error", err)
-		return err
-	}
-
-	return nil
+// sizeLimitedReader reads from r, failing with ErrTooLarge once more than `remaining` bytes are read
+type sizeLimitedReader struct {
+	r         io.Reader
+	remaining int64
 }
 
-// PartialFileUpload handles a chunk being uploaded
-func PartialFileUpload(stateDir string, userID string, fileID string, file multipart.File, offset int64) (int64, error) {
-	uploadDir := filepath.Join(stateDir, userID)
-	if _, err := os.Stat(uploadDir); os.IsNotExist(err) {
-		slog.Error("User upload directory does not exist", "path", uploadDir)
-		return 0, err
-	}
-
-	filePath := filepath.Join(uploadDir, fileID)
-	dst, err := os.OpenFile(filePath, os.O_WRONLY, 0o600)
-	if err != nil {
-		slog.Error("Failed opening destination file", "error", err)
-		return 0, err
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	// read one byte more than allowed, to tell apart data ending at the limit from data exceeding it
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
 	}
-	defer func() {
-		if err := dst.Close(); err != nil {
-			slog.Error("Failed closing file", "error", err)
-		}
-	}()
 
-	_, err = dst.Seek(offset, io.SeekStart)
-	if err != nil {
-		slog.Error("Failed seeking to offset", "offset", offset, "error", err)
-		return 0, err
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, ErrTooLarge
 	}
 
-	_, err = io.Copy(dst, file)
-	if err != nil {
-		slog.Error("Failed copying chunk data", "error", err)
-		return 0, err
-	}
+	l.remaining -= int64(n)
+	return n, err
+}
 
-	return getFileSize(filePath)
+// FileUpload handles a new file uploaded, streaming at most maxSize bytes from r into storage
+// Returns the size of the file
+func FileUpload(store storage.Backend, userID string, fileID string, r io.Reader, maxSize int64) (int64, error) {
+	return store.Create(userID, fileID, &sizeLimitedReader{r: r, remaining: maxSize})
 }
 
-func getFileSize(path string) (int64, error) {
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		slog.Error("Failed to get file info", "error", err)
-		return 0, err
+// PartialFileUpload handles a chunk being uploaded, the file can't grow beyond maxSize bytes in total
+// Returns the total size of the file
+func PartialFileUpload(store storage.Backend, userID string, fileID string, r io.Reader, offset int64, maxSize int64) (int64, error) {
+	if offset > maxSize {
+		return 0, fmt.Errorf("%w: offset %d, maximum is %d", ErrTooLarge, offset, maxSize)
 	}
 
-	return fileInfo.Size(), nil
+	return store.Append(userID, fileID, offset, &sizeLimitedReader{r: r, remaining: maxSize - offset})
 }
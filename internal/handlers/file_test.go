@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"codeberg.org/filesender/filesender-next/internal/handlers"
+	"codeberg.org/filesender/filesender-next/internal/storage"
 )
 
 func createMultipartFile(content string) (multipart.File, func(), error) {
@@ -64,7 +65,7 @@ func TestFileUploadHandler(t *testing.T) {
 		defer cleanup()
 
 		var pathErr *os.PathError
-		err = handlers.FileUpload("/hello/world", "user", "file", testFile)
+		_, err = handlers.FileUpload(storage.NewFilesystem("/hello/world"), "user", "file", testFile, 1024)
 		if err == nil {
 			t.Errorf("Expected file upload to result nil, got %v", err)
 		} else if !errors.As(err, &pathErr) {
@@ -80,17 +81,45 @@ func TestFileUploadHandler(t *testing.T) {
 		}
 		defer cleanup()
 
-		err = handlers.FileUpload(tempDir, "user456", "test123", testFile)
+		store := storage.NewFilesystem(tempDir)
+		_, err = handlers.FileUpload(store, "user456", "test123", testFile, 1024)
 		if err != nil {
 			t.Fatalf("Expected success, got error: %v", err)
 		}
 
+		stagingPath := filepath.Join(tempDir, ".staging", "user456", "test123")
+		if _, err := os.Stat(stagingPath); os.IsNotExist(err) {
+			t.Errorf("Expected file to be staged at %s", stagingPath)
+		}
+
 		expectedPath := filepath.Join(tempDir, "user456", "test123")
+		if _, err := os.Stat(expectedPath); !os.IsNotExist(err) {
+			t.Errorf("Expected no file at %s before the upload is complete, got %v", expectedPath, err)
+		}
+
+		err = store.Complete("user456", "test123")
+		if err != nil {
+			t.Fatalf("Expected success, got error: %v", err)
+		}
+
 		if _, err := os.Stat(expectedPath); os.IsNotExist(err) {
 			t.Errorf("Expected file to exist at %s", expectedPath)
 		}
 	})
 
+	t.Run("Exceeds maximum size", func(t *testing.T) {
+		testFile, cleanup, err := createMultipartFile("test test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+
+		_, err = handlers.FileUpload(storage.NewFilesystem(tempDir), "user456", "too_large", testFile, 4)
+		if !errors.Is(err, handlers.ErrTooLarge) {
+			t.Errorf("Expected too large error, got %v", err)
+		}
+	})
+
 	t.Run("Copy fail", func(t *testing.T) {
 		fakeFile, _, err := createMultipartFile("test")
 		if err != nil {
@@ -101,7 +130,7 @@ func TestFileUploadHandler(t *testing.T) {
 			t.Fatalf("Couldn't close file: %v", err)
 		}
 
-		err = handlers.FileUpload(tempDir, "user123", "testfail", fakeFile)
+		_, err = handlers.FileUpload(storage.NewFilesystem(tempDir), "user123", "testfail", fakeFile, 1024)
 		if err == nil {
 			t.Fatal("Expected error due to file copy failure, got nil")
 		} else if !strings.Contains(err.Error(), "file already closed") {
@@ -128,7 +157,7 @@ func TestPartialFileUpload(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer cleanup()
-	err = handlers.FileUpload(tempDir, "user", "file", testFile)
+	_, err = handlers.FileUpload(storage.NewFilesystem(tempDir), "user", "file", testFile, 1024)
 	if err != nil {
 		t.Fatalf("Failed uploading file: %v", err)
 	}
@@ -141,7 +170,7 @@ func TestPartialFileUpload(t *testing.T) {
 		defer cleanup()
 
 		var pathErr *os.PathError
-		_, err = handlers.PartialFileUpload("/hello/world", "user", "file", testFile, 0)
+		_, err = handlers.PartialFileUpload(storage.NewFilesystem("/hello/world"), "user", "file", testFile, 0, 1024)
 		if err == nil {
 			t.Errorf("Expected file upload to result nil, got %v", err)
 		} else if !errors.As(err, &pathErr) {
@@ -157,7 +186,7 @@ func TestPartialFileUpload(t *testing.T) {
 		defer cleanup()
 
 		var pathErr *os.PathError
-		_, err = handlers.PartialFileUpload(tempDir, "user", "file_fail", testFile, 0)
+		_, err = handlers.PartialFileUpload(storage.NewFilesystem(tempDir), "user", "file_fail", testFile, 0, 1024)
 		if err == nil {
 			t.Errorf("Expected file upload to error, got %v", err)
 		} else if !errors.As(err, &pathErr) {
@@ -175,7 +204,7 @@ func TestPartialFileUpload(t *testing.T) {
 			t.Fatalf("Couldn't close file: %v", err)
 		}
 
-		err = handlers.FileUpload(tempDir, "user", "file", fakeFile)
+		_, err = handlers.FileUpload(storage.NewFilesystem(tempDir), "user", "file", fakeFile, 1024)
 		if err == nil {
 			t.Fatal("Expected error due to file copy failure, got nil")
 		} else if !strings.Contains(err.Error(), "file already closed") {
@@ -190,7 +219,7 @@ func TestPartialFileUpload(t *testing.T) {
 		}
 		defer cleanup()
 
-		totalBytes, err := handlers.PartialFileUpload(tempDir, "user", "file", testFile, 0)
+		totalBytes, err := handlers.PartialFileUpload(storage.NewFilesystem(tempDir), "user", "file", testFile, 0, 1024)
 		if err != nil {
 			t.Errorf("Did not expect error, got %v", err)
 		}
@@ -206,7 +235,7 @@ func TestPartialFileUpload(t *testing.T) {
 		}
 		defer cleanup()
 
-		totalBytes, err := handlers.PartialFileUpload(tempDir, "user", "file", testFile, 13)
+		totalBytes, err := handlers.PartialFileUpload(storage.NewFilesystem(tempDir), "user", "file", testFile, 13, 1024)
 		if err != nil {
 			t.Errorf("Did not expect error, got %v", err)
 		}
@@ -214,4 +243,30 @@ func TestPartialFileUpload(t *testing.T) {
 			t.Errorf("Expected total bytes in file to be 26, got %d", totalBytes)
 		}
 	})
+
+	t.Run("Mismatching offset", func(t *testing.T) {
+		testFile, cleanup, err := createMultipartFile("Hello, world!")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+
+		_, err = handlers.PartialFileUpload(storage.NewFilesystem(tempDir), "user", "file", testFile, 13, 1024)
+		if !errors.Is(err, storage.ErrOffsetMismatch) {
+			t.Errorf("Expected offset mismatch error, got %v", err)
+		}
+	})
+
+	t.Run("Exceeds maximum size", func(t *testing.T) {
+		testFile, cleanup, err := createMultipartFile("Hello, world!")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanup()
+
+		_, err = handlers.PartialFileUpload(storage.NewFilesystem(tempDir), "user", "file", testFile, 26, 30)
+		if !errors.Is(err, handlers.ErrTooLarge) {
+			t.Errorf("Expected too large error, got %v", err)
+		}
+	})
 }
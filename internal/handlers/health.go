@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"codeberg.org/filesender/filesender-next/internal/diskspace"
+)
+
+// HealthAPI handles GET /health
+// Reports the free storage space, `status` is `low_disk_space` once it has dropped below the reserve
+// Low disk space is reported with 200, downloads are still served and space is freed by deletes and the cleanup. Only
+// failing to read the free space is 503 (Service Unavailable)
+func HealthAPI(space *diskspace.Guard) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		status, err := space.Status()
+		if err != nil {
+			slog.Error("Failed reading free storage space", "error", err)
+			sendJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "error"})
+			return
+		}
+
+		response := healthResponse{
+			Status: "ok",
+			Storage: storageHealth{
+				ReservedBytes: status.Reserved,
+				ReserveBytes:  status.Reserve,
+			},
+		}
+		if status.Supported {
+			response.Storage.FreeBytes = &status.Free
+		}
+
+		if status.Low() {
+			response.Status = "low_disk_space"
+		}
+
+		sendJSON(w, http.StatusOK, response)
+	}
+}
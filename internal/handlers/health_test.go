@@ -0,0 +1,63 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/diskspace"
+	"codeberg.org/filesender/filesender-next/internal/handlers"
+)
+
+func TestHealthAPI(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		store    any
+		code     int
+		status   string
+		freeSize *int64
+	}{
+		{"Enough free space", freeSpace(100), http.StatusOK, "ok", ptr(int64(100))},
+		{"Low free space", freeSpace(10), http.StatusOK, "low_disk_space", ptr(int64(10))},
+		{"Unsupported storage", nil, http.StatusOK, "ok", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := handlers.HealthAPI(diskspace.New(tc.store, 50, time.Minute))
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+
+			if resp.Code != tc.code {
+				t.Errorf("Expected status %d, got %d", tc.code, resp.Code)
+			}
+
+			var health struct {
+				Status  string `json:"status"`
+				Storage struct {
+					FreeBytes    *int64 `json:"free_bytes"`
+					ReserveBytes int64  `json:"reserve_bytes"`
+				} `json:"storage"`
+			}
+			err := json.NewDecoder(resp.Body).Decode(&health)
+			if err != nil {
+				t.Fatalf("Failed decoding response: %v", err)
+			}
+
+			if health.Status != tc.status {
+				t.Errorf("Expected status %q, got %q", tc.status, health.Status)
+			}
+			if health.Storage.ReserveBytes != 50 {
+				t.Errorf("Expected reserve of 50 bytes, got %d", health.Storage.ReserveBytes)
+			}
+			if (tc.freeSize == nil) != (health.Storage.FreeBytes == nil) || (tc.freeSize != nil && *tc.freeSize != *health.Storage.FreeBytes) {
+				t.Errorf("Expected free bytes %v, got %v", tc.freeSize, health.Storage.FreeBytes)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
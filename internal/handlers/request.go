@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"codeberg.org/filesender/filesender-next/internal/auth"
+	"codeberg.org/filesender/filesender-next/internal/diskspace"
+	"codeberg.org/filesender/filesender-next/internal/hash"
+)
+
+// Maximum length of a form field sent before the file
+const maxFieldLength = 8 * 1024
+
+var (
+	errMissingFile            = errors.New("request contains no file")
+	errUnsupportedContentType = errors.New("unsupported content type")
+)
+
+// Content types of request bodies containing only file data, instead of a multipart form
+// `application/offset+octet-stream` and `application/partial-upload` are used by resumable upload clients
+var rawUploadContentTypes = []string{
+	"application/offset+octet-stream",
+	"application/partial-upload",
+	"application/octet-stream",
+}
+
+// uploadRequest is an upload request of which the file data has not been read yet
+type uploadRequest struct {
+	// form fields sent before the file, or the query parameters for raw bodies
+	fields map[string]string
+	// the file data, streamed from the request body
+	file io.Reader
+}
+
+// readUploadRequest prepares an upload request for streaming the file data straight from the request body
+// Multipart forms are read up to the `file` part, form fields after it are ignored
+func readUploadRequest(r *http.Request) (uploadRequest, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return uploadRequest{}, fmt.Errorf("%w: %w", errUnsupportedContentType, err)
+	}
+
+	if mediaType == "multipart/form-data" {
+		return readMultipartUpload(r)
+	}
+
+	for _, contentType := range rawUploadContentTypes {
+		if mediaType == contentType {
+			query := r.URL.Query()
+			fields := map[string]string{}
+			for k := range query {
+				fields[k] = query.Get(k)
+			}
+
+			return uploadRequest{fields: fields, file: r.Body}, nil
+		}
+	}
+
+	return uploadRequest{}, fmt.Errorf("%w: %s", errUnsupportedContentType, mediaType)
+}
+
+func readMultipartUpload(r *http.Request) (uploadRequest, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return uploadRequest{}, err
+	}
+
+	fields := map[string]string{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return uploadRequest{}, errMissingFile
+		}
+		if err != nil {
+			return uploadRequest{}, err
+		}
+
+		if part.FormName() == "file" {
+			return uploadRequest{fields: fields, file: part}, nil
+		}
+
+		var value strings.Builder
+		n, err := io.Copy(&value, io.LimitReader(part, maxFieldLength+1))
+		if err != nil {
+			return uploadRequest{}, err
+		}
+		if n > maxFieldLength {
+			return uploadRequest{}, fmt.Errorf("form field %q too long", part.FormName())
+		}
+
+		fields[part.FormName()] = value.String()
+	}
+}
+
+// isBodyTooLarge checks if reading the request body failed because it exceeded the maximum size
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// authenticate authenticates the user, and returns their identity and the user ID hashed from its subject
+// Sends an error response and returns false if that fails, browsers are sent to the login page of interactive methods
+// Users authenticated with an API token also need its `scope`, requests changing state from other sites are rejected
+func authenticate(w http.ResponseWriter, r *http.Request, authModule auth.Auth, scope string) (auth.Identity, string, bool) {
+	if !auth.SameOrigin(r) {
+		slog.Info("Rejecting cross-site request", "origin", r.Header.Get("Origin"), "fetch site", r.Header.Get("Sec-Fetch-Site"))
+		sendError(w, http.StatusForbidden, "Cross-site request rejected")
+		return auth.Identity{}, "", false
+	}
+
+	identity, err := authModule.UserAuth(r)
+	if err != nil {
+		slog.Info("unable to authenticate user", "error", err)
+		if interactive, ok := authModule.(auth.Interactive); ok && wantsPage(r) {
+			_ = sendRedirect(w, http.StatusSeeOther, interactive.LoginURL(r.URL.RequestURI()), "")
+			return auth.Identity{}, "", false
+		}
+		sendError(w, http.StatusUnauthorized, "You're not authenticated")
+		return auth.Identity{}, "", false
+	}
+
+	if !identity.Allows(scope) {
+		slog.Info("API token lacks scope", "scope", scope)
+		sendError(w, http.StatusForbidden, "Your API token does not allow this")
+		return auth.Identity{}, "", false
+	}
+
+	userID, err := hash.ToBase64(identity.Subject)
+	if err != nil {
+		slog.Info("failed hashing user ID", "error", err)
+		sendError(w, http.StatusInternalServerError, "Failed creating user ID")
+		return auth.Identity{}, "", false
+	}
+
+	return identity, userID, true
+}
+
+// wantsPage checks if a request is a browser navigating to a page, which can be sent to a login page
+func wantsPage(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// reserveSpace reserves free space for `n` bytes about to be written, returns a function releasing the reservation
+// Sends a 507 (Insufficient Storage) response and returns false if the storage doesn't have enough free space
+func reserveSpace(w http.ResponseWriter, space *diskspace.Guard, n int64) (func(), bool) {
+	release, err := space.Reserve(max(n, 0))
+	if err != nil {
+		slog.Info("Not enough free storage space for upload", "bytes", n, "error", err)
+		sendInsufficientStorage(w, space.RetryAfter)
+		return nil, false
+	}
+
+	return release, true
+}
+
+// isNoSpace checks if writing data failed because the storage is full
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -2,12 +2,15 @@ package handlers
 
 import (
 	"embed"
+	"encoding/json"
+	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
 	"path"
 	"path/filepath"
 	"strconv"
+	"time"
 )
 
 var templatesFS embed.FS
@@ -33,12 +36,29 @@ func sendTemplate(w http.ResponseWriter, tmpl string, data any) {
 	}
 }
 
+// Send a JSON response
+func sendJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		slog.Error("Failed writing JSON response", "error", err)
+	}
+}
+
 // Send an error response
 func sendError(w http.ResponseWriter, status int, message string) {
 	slog.Error("Sending error to user", "status", status, "message", message)
 	http.Error(w, message, status)
 }
 
+// Send a 507 (Insufficient Storage) response, telling the client when to retry
+func sendInsufficientStorage(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter.Seconds()), 10))
+	sendError(w, http.StatusInsufficientStorage, "Insufficient storage space, try again later")
+}
+
 // Sends a redirect
 func sendRedirect(w http.ResponseWriter, status int, location string, body string) error {
 	w.Header().Add("Location", location)
@@ -53,12 +73,83 @@ func sendRedirect(w http.ResponseWriter, status int, location string, body strin
 	return nil
 }
 
+// Version of https://datatracker.ietf.org/doc/draft-ietf-httpbis-resumable-upload/ implemented by the upload handlers
+const uploadDraftInteropVersion = "7"
+
+// Reports if the `Upload-Complete` header marks the request as the last one of an upload
+// Accepts the structured field booleans of the draft (`?0`, `?1`) and plain `0` / `1`, a missing header means complete
+func isUploadComplete(r *http.Request) bool {
+	switch r.Header.Get("Upload-Complete") {
+	case "0", "?0":
+		return false
+	default:
+		return true
+	}
+}
+
+// Formats the limits as `Upload-Limit` structured field dictionary, e.g. `max-size=1000, max-append-size=100`
+func uploadLimitHeader(limits UploadLimits) string {
+	return fmt.Sprintf("max-size=%d, max-append-size=%d", limits.MaxSize, limits.MaxAppendSize)
+}
+
+// Parses the `Upload-Length` header, the total size of the upload declared by the client
+// Returns 0 if the header is missing
+func parseUploadLength(r *http.Request) (int64, error) {
+	value := r.Header.Get("Upload-Length")
+	if value == "" {
+		return 0, nil
+	}
+
+	length, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || length <= 0 {
+		return 0, fmt.Errorf("invalid upload length %q", value)
+	}
+
+	return length, nil
+}
+
+// Send a 104 (Upload Resumption Supported) interim response, if the client implements the same draft version
+// Tells the client where the upload can be resumed before the request body has been received
+func sendUploadResumptionSupported(w http.ResponseWriter, r *http.Request, appRoot string, fileID string) {
+	if r.Header.Get("Upload-Draft-Interop-Version") != uploadDraftInteropVersion {
+		return
+	}
+
+	w.Header().Set("Upload-Draft-Interop-Version", uploadDraftInteropVersion)
+	w.Header().Set("Location", filepath.Join(appRoot+"upload", fileID))
+	w.WriteHeader(104)
+
+	// headers of an interim response are kept for the final response, which sets its own location
+	w.Header().Del("Location")
+}
+
 // Send incomplete upload response
 // Based on https://datatracker.ietf.org/doc/draft-ietf-httpbis-resumable-upload/
-func sendIncompleteResponse(w http.ResponseWriter, appRoot string, fileID string, maxUploadSize int64, bytesReceived int64) {
-	w.Header().Add("Upload-Draft-Interop-Version", "7")
+func sendIncompleteResponse(w http.ResponseWriter, appRoot string, fileID string, limits UploadLimits, bytesReceived int64) {
+	w.Header().Set("Upload-Draft-Interop-Version", uploadDraftInteropVersion)
 	w.Header().Add("Location", filepath.Join(appRoot+"upload", fileID))
-	w.Header().Add("Upload-Limit", strconv.FormatInt(maxUploadSize, 10))
+	w.Header().Add("Upload-Limit", uploadLimitHeader(limits))
 	w.Header().Add("Upload-Offset", strconv.FormatInt(bytesReceived, 10))
 	w.WriteHeader(http.StatusAccepted)
 }
+
+// Send a conflict response for a request appending at the wrong offset
+// Based on the `mismatching-upload-offset` problem type of https://datatracker.ietf.org/doc/draft-ietf-httpbis-resumable-upload/
+func sendOffsetMismatch(w http.ResponseWriter, expectedOffset int64, providedOffset int64) {
+	slog.Info("Sending offset mismatch to user", "expected", expectedOffset, "provided", providedOffset)
+
+	w.Header().Set("Upload-Draft-Interop-Version", uploadDraftInteropVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(expectedOffset, 10))
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusConflict)
+
+	err := json.NewEncoder(w).Encode(map[string]any{
+		"type":            "https://iana.org/assignments/http-problem-types#mismatching-upload-offset",
+		"title":           "offset from request does not match offset of resource",
+		"expected-offset": expectedOffset,
+		"provided-offset": providedOffset,
+	})
+	if err != nil {
+		slog.Error("Failed writing offset mismatch response", "error", err)
+	}
+}
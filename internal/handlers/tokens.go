@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/auth"
+)
+
+const (
+	maxTokenExpiry     = 365 * 24 * time.Hour
+	maxTokenNameLength = 100
+)
+
+func newTokenItem(t auth.Token, now time.Time) tokenItem {
+	item := tokenItem{
+		ID:      t.ID,
+		Name:    t.Name,
+		Scopes:  t.Scopes,
+		Created: t.Created,
+		Expires: t.Expires,
+		Expired: t.Expired(now),
+	}
+	if !t.LastUsed.IsZero() {
+		item.LastUsed = &t.LastUsed
+	}
+
+	return item
+}
+
+func listTokens(tokens *auth.TokenStore, userID string) ([]tokenItem, error) {
+	list, err := tokens.List(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	items := []tokenItem{}
+	for _, t := range list {
+		items = append(items, newTokenItem(t, now))
+	}
+
+	return items, nil
+}
+
+// sendTokensTemplate renders the tokens page, showing `newToken` if one was just created
+func sendTokensTemplate(w http.ResponseWriter, appRoot string, tokens *auth.TokenStore, userID string, newToken string, newTokenName string) {
+	items, err := listTokens(tokens, userID)
+	if err != nil {
+		slog.Error("Failed listing API tokens", "error", err)
+		sendError(w, http.StatusInternalServerError, "Failed listing API tokens")
+		return
+	}
+
+	now := time.Now()
+	w.Header().Set("Cache-Control", "no-store")
+	sendTemplate(w, "tokens", tokensTemplate{
+		AppRoot:       appRoot,
+		Tokens:        items,
+		Scopes:        auth.TokenScopes,
+		NewToken:      newToken,
+		NewTokenName:  newTokenName,
+		MinExpiryDate: now.UTC().Format(expiryDateLayout),
+		MaxExpiryDate: now.Add(maxTokenExpiry).UTC().Format(expiryDateLayout),
+	})
+}
+
+// TokensTemplate handles GET /tokens
+func TokensTemplate(appRoot string, authModule auth.Auth, tokens *auth.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeTokens)
+		if !ok {
+			return
+		}
+
+		sendTokensTemplate(w, appRoot, tokens, userID, "", "")
+	}
+}
+
+// TokensAPI handles GET /api/tokens
+// Responds with a JSON array of the API tokens of the user, newest first, without the tokens themselves
+func TokensAPI(authModule auth.Auth, tokens *auth.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeTokens)
+		if !ok {
+			return
+		}
+
+		items, err := listTokens(tokens, userID)
+		if err != nil {
+			slog.Error("Failed listing API tokens", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed listing API tokens")
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		sendJSON(w, http.StatusOK, items)
+	}
+}
+
+// CreateTokenAPI handles POST /api/tokens
+// Expects `name`, one or more `scope` and optionally `expiry_date` in form data. The token is only shown in the
+// response, as JSON when the client accepts it, otherwise on the tokens page
+func CreateTokenAPI(appRoot string, authModule auth.Auth, tokens *auth.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, userID, ok := authenticate(w, r, authModule, auth.ScopeTokens)
+		if !ok {
+			return
+		}
+
+		// also parses multipart forms, e.g. from `curl -F`
+		name := strings.TrimSpace(r.PostFormValue("name"))
+		if name == "" || len(name) > maxTokenNameLength {
+			sendError(w, http.StatusBadRequest, "Invalid token name")
+			return
+		}
+
+		now := time.Now()
+		expires, err := parseExpiryDate(r.PostForm.Get("expiry_date"), now, maxTokenExpiry)
+		if err != nil {
+			slog.Info("Invalid expiry date", "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid expiry date")
+			return
+		}
+
+		t, secret, err := tokens.Create(identity, userID, name, r.PostForm["scope"], expires)
+		if err != nil {
+			slog.Info("Failed creating API token", "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid token scopes")
+			return
+		}
+
+		slog.Info("API token created", "user id", userID, "token id", t.ID, "scopes", t.Scopes)
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Cache-Control", "no-store")
+			sendJSON(w, http.StatusCreated, createdToken{tokenItem: newTokenItem(t, now), Token: secret})
+			return
+		}
+
+		sendTokensTemplate(w, appRoot, tokens, userID, secret, t.Name)
+	}
+}
+
+// RevokeTokenAPI handles DELETE /api/tokens/{tokenID} and POST /api/tokens/{tokenID}/revoke (for forms)
+func RevokeTokenAPI(appRoot string, authModule auth.Auth, tokens *auth.TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenID := r.PathValue("tokenID")
+
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeTokens)
+		if !ok {
+			return
+		}
+
+		err := tokens.Revoke(userID, tokenID)
+		if errors.Is(err, auth.ErrTokenNotFound) {
+			sendError(w, http.StatusNotFound, "API token not found")
+			return
+		}
+		if err != nil {
+			slog.Error("Failed revoking API token", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed revoking API token")
+			return
+		}
+
+		slog.Info("API token revoked", "user id", userID, "token id", tokenID)
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_ = sendRedirect(w, http.StatusSeeOther, appRoot+"tokens", "")
+	}
+}
@@ -0,0 +1,211 @@
+package handlers_test
+
+import (
+	"embed"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/assets"
+	"codeberg.org/filesender/filesender-next/internal/auth"
+	"codeberg.org/filesender/filesender-next/internal/handlers"
+	"codeberg.org/filesender/filesender-next/internal/hash"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+type createdToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Expires time.Time `json:"expires"`
+	Token   string    `json:"token"`
+}
+
+func TestTokens(t *testing.T) {
+	err := hash.Init(t.TempDir())
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	tokens, err := auth.NewTokenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed creating token store: %v", err)
+	}
+
+	authModule := auth.WithTokens(tokens, &auth.DummyAuth{})
+	create := handlers.CreateTokenAPI("/", authModule, tokens)
+	list := handlers.TokensAPI(authModule, tokens)
+	revoke := handlers.RevokeTokenAPI("/", authModule, tokens)
+	jsonHeaders := map[string]string{"Accept": "application/json"}
+
+	var token createdToken
+	t.Run("Create", func(t *testing.T) {
+		resp := mockFormRequest(create, "/api/tokens", url.Values{"name": {"laptop"}, "scope": {auth.ScopeRead}}, jsonHeaders, nil)
+
+		if resp.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, resp.Code, resp.Body.String())
+		}
+
+		err := json.Unmarshal(resp.Body.Bytes(), &token)
+		if err != nil {
+			t.Fatalf("Failed decoding response: %v", err)
+		}
+		if token.Name != "laptop" || token.Token == "" || len(token.Scopes) != 1 || token.Scopes[0] != auth.ScopeRead {
+			t.Errorf("Unexpected token %+v", token)
+		}
+		if token.Expires.Before(time.Now().Add(300 * 24 * time.Hour)) {
+			t.Errorf("Expected token to expire after a year by default, got %v", token.Expires)
+		}
+	})
+
+	t.Run("Create multipart", func(t *testing.T) {
+		body, writer := createMultipartBodyWithFields(map[string]string{"name": "curl", "scope": auth.ScopeUpload}, "")
+		err := writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockUploadRequest(create, body, writer, jsonHeaders)
+		if resp.Code != http.StatusCreated {
+			t.Errorf("Expected status %d, got %d: %s", http.StatusCreated, resp.Code, resp.Body.String())
+		}
+	})
+
+	for name, form := range map[string]url.Values{
+		"No name":      {"scope": {auth.ScopeRead}},
+		"No scope":     {"name": {"laptop"}},
+		"Tokens scope": {"name": {"laptop"}, "scope": {auth.ScopeTokens}},
+		"Expiry":       {"name": {"laptop"}, "scope": {auth.ScopeRead}, "expiry_date": {time.Now().Add(2 * 365 * 24 * time.Hour).Format("2006-01-02")}},
+	} {
+		t.Run("Create invalid "+strings.ToLower(name), func(t *testing.T) {
+			resp := mockFormRequest(create, "/api/tokens", form, jsonHeaders, nil)
+
+			if resp.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+			}
+		})
+	}
+
+	t.Run("Create cross-site", func(t *testing.T) {
+		for _, headers := range []map[string]string{{"Sec-Fetch-Site": "cross-site"}, {"Origin": "https://evil.example.org"}} {
+			resp := mockFormRequest(create, "/api/tokens", url.Values{"name": {"evil"}, "scope": {auth.ScopeRead}}, headers, nil)
+			if resp.Code != http.StatusForbidden {
+				t.Errorf("Expected status %d with %v, got %d", http.StatusForbidden, headers, resp.Code)
+			}
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		resp := mockRequest(list, "GET", "/api/tokens", nil, nil)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+		if strings.Contains(resp.Body.String(), token.Token) || !strings.Contains(resp.Body.String(), token.ID) {
+			t.Errorf("Expected token in list without the token itself, got %s", resp.Body.String())
+		}
+	})
+
+	bearer := map[string]string{"Authorization": "Bearer " + token.Token}
+
+	t.Run("Use token", func(t *testing.T) {
+		handler := handlers.TransfersAPI(authModule, storage.NewMemory(), newMetaStore(t, t.TempDir()))
+		resp := mockRequest(handler, "GET", "/api/transfers", bearer, nil)
+
+		if resp.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+	})
+
+	t.Run("Token without scope", func(t *testing.T) {
+		body, writer := createMultipartBody("Hello, world!")
+		err := writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		handler := handlers.UploadAPI("/", authModule, storage.NewMemory(), newMetaStore(t, t.TempDir()), noQuotas(), noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry)
+		resp := mockUploadRequest(handler, body, writer, bearer)
+
+		if resp.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d, got %d", http.StatusForbidden, resp.Code)
+		}
+	})
+
+	t.Run("Upload token managing transfers", func(t *testing.T) {
+		_, secret, err := tokens.Create(auth.Identity{Subject: "dev"}, "dev", "upload", []string{auth.ScopeUpload}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("Failed creating token: %v", err)
+		}
+
+		store := storage.NewMemory()
+		metaStore := newMetaStore(t, t.TempDir())
+		fileID := "ZmlsZV9fX19fX19fX19fXw"
+		headers := map[string]string{"Authorization": "Bearer " + secret}
+		pathValues := map[string]string{"fileID": fileID}
+
+		revokeTransfer := handlers.RevokeTransferAPI("/", authModule, store, metaStore, noQuotas(), lock.NewMemory())
+		resp := mockRequest(revokeTransfer, "DELETE", "/api/transfers/"+fileID, headers, pathValues)
+		if resp.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d revoking, got %d", http.StatusForbidden, resp.Code)
+		}
+
+		extend := handlers.ExtendTransferAPI("/", authModule, store, metaStore, maxExpiry)
+		resp = mockFormRequest(extend, "/api/transfers/"+fileID+"/expiry", url.Values{"expiry_date": {time.Now().Format("2006-01-02")}}, headers, pathValues)
+		if resp.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d extending, got %d", http.StatusForbidden, resp.Code)
+		}
+	})
+
+	t.Run("Token managing tokens", func(t *testing.T) {
+		resp := mockFormRequest(create, "/api/tokens", url.Values{"name": {"more"}, "scope": {auth.ScopeRead}}, bearer, nil)
+		if resp.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d, got %d", http.StatusForbidden, resp.Code)
+		}
+
+		resp = mockRequest(revoke, "DELETE", "/api/tokens/"+token.ID, bearer, map[string]string{"tokenID": token.ID})
+		if resp.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d, got %d", http.StatusForbidden, resp.Code)
+		}
+	})
+
+	t.Run("Page", func(t *testing.T) {
+		handlers.Init(assets.EmbeddedTemplateFiles)
+		defer handlers.Init(embed.FS{}) // other tests expect no templates
+
+		resp := mockFormRequest(create, "/api/tokens", url.Values{"name": {"script"}, "scope": {auth.ScopeUpload, auth.ScopeRead}}, nil, nil)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+		if !strings.Contains(resp.Body.String(), "fsn_") || !strings.Contains(resp.Body.String(), "/api/tokens/"+token.ID+"/revoke") {
+			t.Errorf("Expected new token and list of tokens in page, got %s", resp.Body.String())
+		}
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		resp := mockRequest(revoke, "POST", "/api/tokens/"+token.ID+"/revoke", map[string]string{"Sec-Fetch-Site": "cross-site"}, map[string]string{"tokenID": token.ID})
+		if resp.Code != http.StatusForbidden {
+			t.Fatalf("Expected status %d for cross-site revoke, got %d", http.StatusForbidden, resp.Code)
+		}
+
+		resp = mockRequest(revoke, "DELETE", "/api/tokens/"+token.ID, nil, map[string]string{"tokenID": token.ID})
+		if resp.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, resp.Code)
+		}
+
+		resp = mockRequest(revoke, "DELETE", "/api/tokens/"+token.ID, nil, map[string]string{"tokenID": token.ID})
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d for revoked token, got %d", http.StatusNotFound, resp.Code)
+		}
+
+		handler := handlers.TransfersAPI(authModule, storage.NewMemory(), newMetaStore(t, t.TempDir()))
+		resp = mockRequest(handler, "GET", "/api/transfers", bearer, nil)
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d for revoked token, got %d", http.StatusUnauthorized, resp.Code)
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/auth"
+	"codeberg.org/filesender/filesender-next/internal/id"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/quota"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+var (
+	// errTransferExpired is returned when changing a transfer that has already expired
+	errTransferExpired = errors.New("transfer has expired")
+	// errTransferRevoked is returned when changing a transfer that was revoked by its sender
+	errTransferRevoked = errors.New("transfer was revoked")
+)
+
+// newTransferItem describes a transfer for the list of transfers of its user
+func newTransferItem(t meta.Transfer, now time.Time) transferItem {
+	return transferItem{
+		FileID:       t.FileID,
+		Link:         viewPath(t),
+		State:        t.State,
+		Size:         t.Size,
+		Created:      t.Created,
+		Expiry:       t.Expiry,
+		Expired:      t.Expired(now),
+		Downloads:    t.Downloads,
+		MaxDownloads: t.MaxDownloads,
+		Message:      t.Message,
+	}
+}
+
+// listTransfers returns all transfers of a user, newest first
+// Files uploaded before metadata was stored are listed as complete transfers created at their modification time
+func listTransfers(store storage.Backend, metaStore meta.Store, userID string) ([]transferItem, error) {
+	transfers, err := metaStore.List(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := store.List(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	for _, file := range files {
+		sizes[file.ID] = file.Size
+	}
+
+	now := time.Now()
+	items := []transferItem{}
+	for _, t := range transfers {
+		item := newTransferItem(t, now)
+		if size, ok := sizes[t.FileID]; ok {
+			// unfinished uploads only have the size received so far in storage
+			item.Size = size
+			delete(sizes, t.FileID)
+		}
+
+		items = append(items, item)
+	}
+
+	for _, file := range files {
+		if _, ok := sizes[file.ID]; !ok {
+			continue
+		}
+
+		items = append(items, newTransferItem(meta.Transfer{
+			UserID:  userID,
+			FileID:  file.ID,
+			State:   meta.StateComplete,
+			Created: file.ModTime,
+			Size:    file.Size,
+		}, now))
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Created.After(items[j].Created)
+	})
+
+	return items, nil
+}
+
+// changeTransfer atomically changes the metadata of a transfer of the user
+// Files uploaded before metadata was stored get metadata describing a complete transfer
+func changeTransfer(store storage.Backend, metaStore meta.Store, userID string, fileID string, f func(t *meta.Transfer) error) (meta.Transfer, error) {
+	var transfer meta.Transfer
+	err := metaStore.Update(userID, fileID, func(t *meta.Transfer) error {
+		err := f(t)
+		transfer = *t
+		return err
+	})
+	if !errors.Is(err, meta.ErrNotFound) {
+		return transfer, err
+	}
+
+	info, err := store.Stat(userID, fileID)
+	if err != nil {
+		return meta.Transfer{}, err
+	}
+
+	transfer = meta.Transfer{
+		UserID:  userID,
+		FileID:  fileID,
+		State:   meta.StateComplete,
+		Created: info.ModTime,
+		Size:    info.Size,
+	}
+	err = f(&transfer)
+	if err != nil {
+		return meta.Transfer{}, err
+	}
+
+	return transfer, metaStore.Put(transfer)
+}
+
+// sendChangedTransfer responds to a change of a transfer, with the transfer as JSON when the client accepts it
+// Otherwise the browser is sent back to the transfers page
+func sendChangedTransfer(w http.ResponseWriter, r *http.Request, appRoot string, t meta.Transfer) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		sendJSON(w, http.StatusOK, newTransferItem(t, time.Now()))
+		return
+	}
+
+	_ = sendRedirect(w, http.StatusSeeOther, appRoot+"transfers", "")
+}
+
+// sendChangeError sends the error of a failed change of a transfer
+func sendChangeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, storage.ErrInvalidID):
+		sendError(w, http.StatusNotFound, "Transfer not found")
+	case errors.Is(err, errTransferExpired):
+		sendError(w, http.StatusConflict, "Transfer has expired")
+	case errors.Is(err, errTransferRevoked):
+		sendError(w, http.StatusConflict, "Transfer was revoked")
+	default:
+		slog.Error("Failed changing transfer", "error", err)
+		sendError(w, http.StatusInternalServerError, "Failed changing transfer")
+	}
+}
+
+// TransfersTemplate handles GET /transfers
+func TransfersTemplate(appRoot string, authModule auth.Auth, store storage.Backend, metaStore meta.Store, maxExpiry time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeRead)
+		if !ok {
+			return
+		}
+
+		transfers, err := listTransfers(store, metaStore, userID)
+		if err != nil {
+			slog.Error("Failed listing transfers", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed listing transfers")
+			return
+		}
+
+		now := time.Now()
+		sendTemplate(w, "transfers", transfersTemplate{
+			AppRoot:       appRoot,
+			Transfers:     transfers,
+			MinExpiryDate: now.UTC().Format(expiryDateLayout),
+			MaxExpiryDate: now.Add(maxExpiry).UTC().Format(expiryDateLayout),
+		})
+	}
+}
+
+// TransfersAPI handles GET /api/transfers
+// Responds with a JSON array of all transfers of the user, newest first
+func TransfersAPI(authModule auth.Auth, store storage.Backend, metaStore meta.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeRead)
+		if !ok {
+			return
+		}
+
+		transfers, err := listTransfers(store, metaStore, userID)
+		if err != nil {
+			slog.Error("Failed listing transfers", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed listing transfers")
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		sendJSON(w, http.StatusOK, transfers)
+	}
+}
+
+// RevokeTransferAPI handles DELETE /api/transfers/{fileID} and POST /api/transfers/{fileID}/revoke (for forms)
+// Deletes the data of a transfer, its metadata is kept as revoked so links show it was revoked by the sender
+func RevokeTransferAPI(appRoot string, authModule auth.Auth, store storage.Backend, metaStore meta.Store, quotas *quota.Quotas, locks lock.Locker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := r.PathValue("fileID")
+
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeManage)
+		if !ok {
+			return
+		}
+
+		if err := id.Validate(fileID); err != nil {
+			sendError(w, http.StatusNotFound, "Transfer not found")
+			return
+		}
+
+		unlock, err := locks.TryLock(userID + "/" + fileID)
+		if errors.Is(err, lock.ErrLocked) {
+			sendError(w, http.StatusConflict, "Transfer is locked by another request")
+			return
+		}
+		if err != nil {
+			slog.Error("Failed locking transfer", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed changing transfer")
+			return
+		}
+		defer unlock()
+
+		// the tombstone is stored first, so the transfer is never served once its deletion started
+		transfer, err := changeTransfer(store, metaStore, userID, fileID, func(t *meta.Transfer) error {
+			if t.State == meta.StateRevoked {
+				return errTransferRevoked
+			}
+			if t.State == meta.StateExpired {
+				return errTransferExpired
+			}
+
+			t.State = meta.StateRevoked
+			t.Updated = time.Now()
+			t.DigestState = nil
+			t.DigestedSize = 0
+			return nil
+		})
+		if err != nil {
+			sendChangeError(w, err)
+			return
+		}
+
+		err = store.Delete(userID, fileID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			slog.Error("Failed deleting transfer", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed deleting transfer")
+			return
+		}
+		quotas.Forget(userID)
+
+		slog.Info("Transfer revoked", "user id", userID, "file id", fileID)
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		sendChangedTransfer(w, r, appRoot, transfer)
+	}
+}
+
+// ExtendTransferAPI handles POST /api/transfers/{fileID}/expiry
+// Expects `expiry_date` in form data, limited to the maximum expiry from now; expired transfers can't be extended
+func ExtendTransferAPI(appRoot string, authModule auth.Auth, store storage.Backend, metaStore meta.Store, maxExpiry time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := r.PathValue("fileID")
+
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeManage)
+		if !ok {
+			return
+		}
+
+		if err := id.Validate(fileID); err != nil {
+			sendError(w, http.StatusNotFound, "Transfer not found")
+			return
+		}
+
+		now := time.Now()
+		expiry, err := parseExpiryDate(r.FormValue("expiry_date"), now, maxExpiry)
+		if err != nil {
+			slog.Info("Invalid expiry date", "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid expiry date")
+			return
+		}
+
+		transfer, err := changeTransfer(store, metaStore, userID, fileID, func(t *meta.Transfer) error {
+			if t.State == meta.StateRevoked {
+				return errTransferRevoked
+			}
+			if t.Expired(now) {
+				return errTransferExpired
+			}
+
+			t.Expiry = expiry
+			t.Updated = now
+			return nil
+		})
+		if err != nil {
+			sendChangeError(w, err)
+			return
+		}
+
+		slog.Info("Transfer expiry changed", "user id", userID, "file id", fileID, "expiry", expiry)
+		sendChangedTransfer(w, r, appRoot, transfer)
+	}
+}
@@ -0,0 +1,398 @@
+package handlers_test
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/assets"
+	"codeberg.org/filesender/filesender-next/internal/auth"
+	"codeberg.org/filesender/filesender-next/internal/handlers"
+	"codeberg.org/filesender/filesender-next/internal/hash"
+	"codeberg.org/filesender/filesender-next/internal/id"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+type transferItem struct {
+	FileID       string     `json:"file_id"`
+	Link         string     `json:"link"`
+	State        meta.State `json:"state"`
+	Size         int64      `json:"size"`
+	Created      time.Time  `json:"created"`
+	Expiry       time.Time  `json:"expiry"`
+	Expired      bool       `json:"expired"`
+	Downloads    int        `json:"downloads"`
+	MaxDownloads int        `json:"max_downloads"`
+}
+
+func mockFormRequest(handler http.HandlerFunc, url string, form url.Values, headers map[string]string, pathValues map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := httptest.NewRecorder()
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	for k, v := range pathValues {
+		req.SetPathValue(k, v)
+	}
+
+	handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestTransfers(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	}()
+
+	err = hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	hashedID, err := hash.ToBase64("dev")
+	if err != nil {
+		t.Fatalf("Failed hashing dummy user ID: %v", err)
+	}
+
+	fileIDs := map[string]string{}
+	for _, name := range []string{"partial", "complete", "legacy", "other"} {
+		fileIDs[name], err = id.New()
+		if err != nil {
+			t.Fatalf("Failed creating file ID: %v", err)
+		}
+	}
+
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	now := time.Now()
+	for _, name := range []string{"partial", "complete", "legacy"} {
+		_, err = store.Create(hashedID, fileIDs[name], strings.NewReader("Hello, "))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+	}
+	_, err = store.Create("someone-else", fileIDs["other"], strings.NewReader("Hello, "))
+	if err != nil {
+		t.Fatalf("Failed creating file: %v", err)
+	}
+
+	for _, transfer := range []meta.Transfer{
+		{UserID: hashedID, FileID: fileIDs["partial"], State: meta.StateInProgress, Created: now, Expiry: now.Add(time.Hour), DeclaredSize: 13},
+		{UserID: hashedID, FileID: fileIDs["complete"], PublicID: "public", State: meta.StateComplete, Created: now.Add(-time.Hour), Expiry: now.Add(time.Hour), Size: 7, Downloads: 1, MaxDownloads: 3},
+		{UserID: "someone-else", FileID: fileIDs["other"], State: meta.StateComplete, Created: now, Size: 7},
+	} {
+		err = metaStore.Put(transfer)
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+	}
+
+	t.Run("List", func(t *testing.T) {
+		handler := handlers.TransfersAPI(&auth.DummyAuth{}, store, metaStore)
+		resp := mockRequest(handler, "GET", "/api/transfers", nil, nil)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+		if resp.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("Expected JSON response, got %q", resp.Header().Get("Content-Type"))
+		}
+
+		var transfers []transferItem
+		err := json.Unmarshal(resp.Body.Bytes(), &transfers)
+		if err != nil {
+			t.Fatalf("Failed decoding response: %v", err)
+		}
+		if len(transfers) != 3 {
+			t.Fatalf("Expected 3 transfers, got %+v", transfers)
+		}
+
+		// newest first, the legacy file was created after the transfers with metadata
+		legacy, partial, complete := transfers[0], transfers[1], transfers[2]
+		if legacy.FileID != fileIDs["legacy"] || legacy.State != meta.StateComplete || legacy.Size != 7 || legacy.Link != "view/"+hashedID+"/"+fileIDs["legacy"] {
+			t.Errorf("Unexpected legacy transfer %+v", legacy)
+		}
+		if partial.FileID != fileIDs["partial"] || partial.State != meta.StateInProgress || partial.Size != 7 {
+			t.Errorf("Unexpected partial transfer %+v", partial)
+		}
+		if complete.FileID != fileIDs["complete"] || complete.Link != "view/public" || complete.Downloads != 1 || complete.MaxDownloads != 3 || complete.Expired {
+			t.Errorf("Unexpected complete transfer %+v", complete)
+		}
+	})
+
+	t.Run("Not authenticated", func(t *testing.T) {
+		handler := handlers.TransfersAPI(&auth.ProxyAuth{}, store, metaStore)
+		resp := mockRequest(handler, "GET", "/api/transfers", nil, nil)
+
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, resp.Code)
+		}
+	})
+
+	t.Run("Page", func(t *testing.T) {
+		handlers.Init(assets.EmbeddedTemplateFiles)
+		defer handlers.Init(embed.FS{}) // other tests expect no templates
+		handler := handlers.TransfersTemplate("/", &auth.DummyAuth{}, store, metaStore, maxExpiry)
+		resp := mockRequest(handler, "GET", "/transfers", nil, nil)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+
+		body := resp.Body.String()
+		if !strings.Contains(body, "/view/public") || !strings.Contains(body, "/api/transfers/"+fileIDs["complete"]+"/revoke") {
+			t.Errorf("Expected transfers in page, got %s", body)
+		}
+		if strings.Contains(body, fileIDs["other"]) {
+			t.Errorf("Expected transfers of other users not in page, got %s", body)
+		}
+	})
+
+	extend := handlers.ExtendTransferAPI("/", &auth.DummyAuth{}, store, metaStore, maxExpiry)
+	revoke := handlers.RevokeTransferAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), lock.NewMemory())
+	expiryDate := now.Add(maxExpiry).UTC().Format("2006-01-02")
+
+	t.Run("Extend", func(t *testing.T) {
+		resp := mockFormRequest(extend, "/api/transfers/"+fileIDs["complete"]+"/expiry", url.Values{"expiry_date": {expiryDate}}, map[string]string{"Accept": "application/json"}, map[string]string{"fileID": fileIDs["complete"]})
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+
+		transfer, err := metaStore.Get(hashedID, fileIDs["complete"])
+		if err != nil {
+			t.Fatalf("Failed getting transfer metadata: %v", err)
+		}
+		if transfer.Expiry.UTC().Format("2006-01-02") != now.Add(maxExpiry+24*time.Hour).UTC().Format("2006-01-02") {
+			t.Errorf("Expected expiry at the end of %s, got %v", expiryDate, transfer.Expiry)
+		}
+	})
+
+	t.Run("Extend invalid date", func(t *testing.T) {
+		resp := mockFormRequest(extend, "/api/transfers/"+fileIDs["complete"]+"/expiry", url.Values{"expiry_date": {"2000-01-01"}}, nil, map[string]string{"fileID": fileIDs["complete"]})
+
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+	})
+
+	t.Run("Extend legacy transfer", func(t *testing.T) {
+		resp := mockFormRequest(extend, "/api/transfers/"+fileIDs["legacy"]+"/expiry", url.Values{"expiry_date": {expiryDate}}, nil, map[string]string{"fileID": fileIDs["legacy"]})
+
+		if resp.Code != http.StatusSeeOther {
+			t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
+		}
+		if resp.Header().Get("Location") != "/transfers" {
+			t.Errorf("Expected redirect to transfers page, got %q", resp.Header().Get("Location"))
+		}
+
+		transfer, err := metaStore.Get(hashedID, fileIDs["legacy"])
+		if err != nil {
+			t.Fatalf("Expected transfer metadata, got error: %v", err)
+		}
+		if transfer.State != meta.StateComplete || transfer.Size != 7 || transfer.Expiry.IsZero() {
+			t.Errorf("Unexpected transfer %+v", transfer)
+		}
+	})
+
+	t.Run("Other user", func(t *testing.T) {
+		resp := mockFormRequest(revoke, "/api/transfers/"+fileIDs["other"]+"/revoke", nil, nil, map[string]string{"fileID": fileIDs["other"]})
+
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
+		}
+
+		transfer, err := metaStore.Get("someone-else", fileIDs["other"])
+		if err != nil {
+			t.Fatalf("Failed getting transfer metadata: %v", err)
+		}
+		if transfer.State != meta.StateComplete {
+			t.Errorf("Expected transfer of other user unchanged, got %+v", transfer)
+		}
+
+		_, err = store.Stat("someone-else", fileIDs["other"])
+		if err != nil {
+			t.Errorf("Expected file of other user to still exist, got %v", err)
+		}
+	})
+
+	t.Run("Invalid file ID", func(t *testing.T) {
+		resp := mockFormRequest(revoke, "/api/transfers/hi/revoke", nil, nil, map[string]string{"fileID": "hi"})
+
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
+		}
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		resp := mockFormRequest(revoke, "/api/transfers/"+fileIDs["complete"]+"/revoke", nil, map[string]string{"Accept": "application/json"}, map[string]string{"fileID": fileIDs["complete"]})
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+
+		var item transferItem
+		err := json.Unmarshal(resp.Body.Bytes(), &item)
+		if err != nil {
+			t.Fatalf("Failed decoding response: %v", err)
+		}
+		if item.State != meta.StateRevoked {
+			t.Errorf("Expected revoked transfer, got %+v", item)
+		}
+
+		_, err = store.Stat(hashedID, fileIDs["complete"])
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected file to be deleted, got %v", err)
+		}
+
+		resp = mockFormRequest(extend, "/api/transfers/"+fileIDs["complete"]+"/expiry", url.Values{"expiry_date": {expiryDate}}, nil, map[string]string{"fileID": fileIDs["complete"]})
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d when extending a revoked transfer, got %d", http.StatusConflict, resp.Code)
+		}
+	})
+}
+
+func TestRevokeTransferAPI(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	}()
+
+	err = hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	store := storage.NewFilesystem(tempDir)
+	metaStore := newMetaStore(t, tempDir)
+
+	body, writer := createMultipartBody("Hello, world!")
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("Failed closing writer: %v", err)
+	}
+
+	resp := mockUploadRequest(handlers.UploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry), body, writer, nil)
+	publicID := path.Base(resp.Header().Get("Location"))
+	transfer, err := metaStore.Resolve(publicID)
+	if err != nil {
+		t.Fatalf("Failed resolving public ID: %v", err)
+	}
+
+	locks := lock.NewMemory()
+	handler := handlers.RevokeTransferAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), locks)
+	pathValues := map[string]string{"fileID": transfer.FileID}
+
+	t.Run("Not authenticated", func(t *testing.T) {
+		handler := handlers.RevokeTransferAPI("/", &auth.ProxyAuth{}, store, metaStore, noQuotas(), locks)
+		resp := mockRequest(handler, "DELETE", "/api/transfers/"+transfer.FileID, nil, pathValues)
+
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, resp.Code)
+		}
+	})
+
+	t.Run("Cross-site", func(t *testing.T) {
+		resp := mockFormRequest(handler, "/api/transfers/"+transfer.FileID+"/revoke", nil, map[string]string{"Origin": "https://evil.example.org"}, pathValues)
+
+		if resp.Code != http.StatusForbidden {
+			t.Errorf("Expected status %d, got %d", http.StatusForbidden, resp.Code)
+		}
+	})
+
+	t.Run("Transfer not found", func(t *testing.T) {
+		missingID, err := id.New()
+		if err != nil {
+			t.Fatalf("Failed creating file ID: %v", err)
+		}
+
+		resp := mockRequest(handler, "DELETE", "/api/transfers/"+missingID, nil, map[string]string{"fileID": missingID})
+
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
+		}
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		unlock, err := locks.TryLock(transfer.UserID + "/" + transfer.FileID)
+		if err != nil {
+			t.Fatalf("Failed locking transfer: %v", err)
+		}
+		defer unlock()
+
+		resp := mockRequest(handler, "DELETE", "/api/transfers/"+transfer.FileID, nil, pathValues)
+
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		resp := mockRequest(handler, "DELETE", "/api/transfers/"+transfer.FileID, nil, pathValues)
+
+		if resp.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, resp.Code)
+		}
+
+		_, err := store.Stat(transfer.UserID, transfer.FileID)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected file to be deleted, got %v", err)
+		}
+
+		revoked, err := metaStore.Get(transfer.UserID, transfer.FileID)
+		if err != nil {
+			t.Fatalf("Expected transfer metadata to be kept, got error: %v", err)
+		}
+		if revoked.State != meta.StateRevoked || revoked.PublicID != publicID {
+			t.Errorf("Expected revoked transfer, got %+v", revoked)
+		}
+	})
+
+	t.Run("Already revoked", func(t *testing.T) {
+		resp := mockRequest(handler, "DELETE", "/api/transfers/"+transfer.FileID, nil, pathValues)
+
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+		}
+	})
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"View":     handlers.GetDownloadTemplate("/", store, metaStore),
+		"Download": handlers.DownloadAPI(store, metaStore, lock.NewMemory()),
+	} {
+		t.Run(name+" revoked", func(t *testing.T) {
+			resp := mockRequest(handler, "GET", "/"+publicID, nil, map[string]string{"publicID": publicID})
+
+			if resp.Code != http.StatusGone {
+				t.Errorf("Expected status %d, got %d", http.StatusGone, resp.Code)
+			}
+			if !strings.Contains(resp.Body.String(), "File was revoked by sender") {
+				t.Errorf("Expected error to be \"File was revoked by sender\", got %s", resp.Body.String())
+			}
+		})
+	}
+}
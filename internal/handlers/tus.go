@@ -0,0 +1,566 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/auth"
+	"codeberg.org/filesender/filesender-next/internal/diskspace"
+	"codeberg.org/filesender/filesender-next/internal/id"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/quota"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+// Implementation of the tus resumable upload protocol, https://tus.io/protocols/resumable-upload
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,expiration,checksum,termination"
+	tusContentType = "application/offset+octet-stream"
+
+	// status sent when the checksum of a chunk does not match `Upload-Checksum`
+	statusChecksumMismatch = 460
+)
+
+// checkTusResumable adds the `Tus-Resumable` header to the response, and checks if the client uses the same version
+// Sends 412 Precondition Failed and returns false if it does not
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		sendError(w, http.StatusPreconditionFailed, "Unsupported tus version")
+		return false
+	}
+
+	return true
+}
+
+// parseTusMetadata parses an `Upload-Metadata` header: comma separated keys with optional base64 encoded values
+func parseTusMetadata(value string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(value) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of metadata key %q: %w", key, err)
+		}
+
+		metadata[key] = string(decoded)
+	}
+
+	return metadata, nil
+}
+
+// setTusExpires adds the `Upload-Expires` header of the expiration extension for unfinished uploads
+// An unfinished upload is deleted when it expires, or when no data has been received within `idle`
+func setTusExpires(w http.ResponseWriter, t meta.Transfer, idle time.Duration) {
+	if t.State != meta.StateInProgress {
+		return
+	}
+
+	expires := t.Updated.Add(idle)
+	if t.Expiry.Before(expires) {
+		expires = t.Expiry
+	}
+
+	w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+}
+
+// getTusTransfer returns the transfer of a tus upload, sending an error response if it can't be resumed
+func getTusTransfer(w http.ResponseWriter, metaStore meta.Store, userID string, fileID string) (meta.Transfer, bool) {
+	transfer, err := metaStore.Get(userID, fileID)
+	switch {
+	case errors.Is(err, meta.ErrNotFound):
+		sendError(w, http.StatusNotFound, "Upload not found")
+		return meta.Transfer{}, false
+	case err != nil:
+		slog.Error("Failed getting transfer metadata", "error", err)
+		sendError(w, http.StatusInternalServerError, "Failed getting upload")
+		return meta.Transfer{}, false
+	case transfer.State == meta.StateCancelled || transfer.State == meta.StateRevoked || transfer.State == meta.StateExpired:
+		sendError(w, http.StatusGone, "Upload was terminated")
+		return meta.Transfer{}, false
+	}
+
+	return transfer, true
+}
+
+// TusOptionsAPI handles OPTIONS /tus/
+// Reports the protocol version, extensions and limits of the server
+func TusOptionsAPI(limits UploadLimits) http.HandlerFunc {
+	algorithms := []string{}
+	for algorithm := range checksumAlgorithms {
+		algorithms = append(algorithms, algorithm)
+	}
+	slices.Sort(algorithms)
+
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(limits.MaxSize, 10))
+		w.Header().Set("Tus-Checksum-Algorithm", strings.Join(algorithms, ","))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// TusCreateAPI handles POST /tus/
+// Creates an empty upload of `Upload-Length` bytes, `expiry_date`, `message` and `max_downloads` can be passed in `Upload-Metadata`
+func TusCreateAPI(appRoot string, authModule auth.Auth, store storage.Backend, metaStore meta.Store, quotas *quota.Quotas, space *diskspace.Guard, locks lock.Locker, limits UploadLimits, maxExpiry time.Duration, idle time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkTusResumable(w, r) {
+			return
+		}
+
+		identity, userID, ok := authenticate(w, r, authModule, auth.ScopeUpload)
+		if !ok {
+			return
+		}
+
+		if r.Header.Get("Upload-Defer-Length") != "" {
+			sendError(w, http.StatusBadRequest, "Deferred upload length is not supported")
+			return
+		}
+
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			slog.Info("Invalid upload length", "value", r.Header.Get("Upload-Length"))
+			sendError(w, http.StatusBadRequest, "Invalid upload length")
+			return
+		}
+		if length > limits.MaxSize {
+			sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
+			return
+		}
+
+		remaining, err := quotas.Remaining(identity.Subject, identity.Groups, userID)
+		if err != nil {
+			slog.Error("Failed getting storage usage", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
+			return
+		}
+		if remaining >= 0 && length > remaining {
+			slog.Info("Upload exceeds storage quota", "user id", userID, "remaining", remaining, "length", length)
+			sendError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded")
+			return
+		}
+
+		// only admits the upload, the data of every PATCH is reserved again
+		release, ok := reserveSpace(w, space, length)
+		if !ok {
+			return
+		}
+		release()
+
+		metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil {
+			slog.Info("Invalid upload metadata", "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid upload metadata")
+			return
+		}
+
+		now := time.Now()
+		expiry, err := parseExpiryDate(metadata["expiry_date"], now, maxExpiry)
+		if err != nil {
+			slog.Info("Invalid expiry date", "expiry_date", metadata["expiry_date"], "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid expiry date")
+			return
+		}
+
+		message := metadata["message"]
+		if len(message) > maxMessageLength {
+			sendError(w, http.StatusBadRequest, "Message too long")
+			return
+		}
+
+		maxDownloads, err := parseMaxDownloads(metadata["max_downloads"])
+		if err != nil {
+			slog.Info("Invalid maximum downloads", "max_downloads", metadata["max_downloads"], "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid maximum downloads")
+			return
+		}
+
+		fileID, err := id.New()
+		if err != nil {
+			slog.Error("Failed creating file ID", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed to create a random file ID!")
+			return
+		}
+
+		// locked until the metadata is stored, so the data isn't recovered as an orphan meanwhile
+		unlock, err := locks.TryLock(userID + "/" + fileID)
+		if err != nil {
+			slog.Error("Failed locking upload", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
+			return
+		}
+		defer unlock()
+
+		_, err = store.Create(userID, fileID, strings.NewReader(""))
+		if err != nil {
+			slog.Error("Failed creating upload", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
+			return
+		}
+
+		publicID, err := id.New()
+		if err != nil {
+			slog.Error("Failed creating public ID", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
+			return
+		}
+
+		transfer := meta.Transfer{
+			UserID:   userID,
+			FileID:   fileID,
+			PublicID: publicID,
+			State:    meta.StateInProgress,
+			Created:  now,
+			Updated:  now,
+			Expiry:   expiry,
+			Message:  message,
+
+			DeclaredSize: length,
+			MaxDownloads: maxDownloads,
+		}
+
+		if length == 0 {
+			recordDigest(&transfer, sha256.New(), 0, true)
+			transfer.State = meta.StateComplete
+			err = store.Complete(userID, fileID)
+			if err != nil {
+				slog.Error("Failed completing file upload", "error", err)
+				transfer.State = meta.StateFailed
+			}
+		}
+
+		err = metaStore.Put(transfer)
+		if err != nil {
+			slog.Error("Failed storing transfer metadata", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
+			return
+		}
+
+		if transfer.State == meta.StateFailed {
+			sendError(w, http.StatusInternalServerError, "Failed completing file upload")
+			return
+		}
+
+		setTusExpires(w, transfer, idle)
+		w.Header().Set("Location", appRoot+"tus/"+fileID)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// TusHeadAPI handles HEAD /tus/{fileID}
+// Reports the number of bytes received so far
+func TusHeadAPI(authModule auth.Auth, store storage.Backend, metaStore meta.Store, idle time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if !checkTusResumable(w, r) {
+			return
+		}
+
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeUpload)
+		if !ok {
+			return
+		}
+
+		fileID := r.PathValue("fileID")
+		transfer, ok := getTusTransfer(w, metaStore, userID, fileID)
+		if !ok {
+			return
+		}
+
+		info, err := store.Stat(userID, fileID)
+		if err != nil {
+			slog.Error("Failed getting file size", "error", err)
+			sendError(w, http.StatusNotFound, "Upload not found")
+			return
+		}
+
+		setTusExpires(w, transfer, idle)
+		setReprDigest(w, transfer)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(info.Size, 10))
+		if transfer.DeclaredSize != 0 || transfer.State == meta.StateComplete {
+			w.Header().Set("Upload-Length", strconv.FormatInt(max(transfer.DeclaredSize, info.Size), 10))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// TusPatchAPI handles PATCH /tus/{fileID}
+// Appends the request body at `Upload-Offset`, verifying `Upload-Checksum` if present
+// A chunk not matching its checksum is discarded, storage that can't discard it gets the chunk verified in `spoolDir`
+// The upload is complete once `Upload-Length` bytes have been received
+func TusPatchAPI(appRoot string, authModule auth.Auth, store storage.Backend, metaStore meta.Store, quotas *quota.Quotas, space *diskspace.Guard, spoolDir string, locks lock.Locker, limits UploadLimits, idle time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkTusResumable(w, r) {
+			return
+		}
+
+		identity, userID, ok := authenticate(w, r, authModule, auth.ScopeUpload)
+		if !ok {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != tusContentType {
+			sendError(w, http.StatusUnsupportedMediaType, "Unsupported content type")
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			slog.Info("Invalid upload offset", "offset", r.Header.Get("Upload-Offset"))
+			sendError(w, http.StatusBadRequest, "Invalid offset")
+			return
+		}
+
+		var checksum *uploadChecksum
+		if value := r.Header.Get("Upload-Checksum"); value != "" {
+			c, err := parseUploadChecksum(value)
+			if err != nil {
+				slog.Info("Invalid upload checksum", "error", err)
+				sendError(w, http.StatusBadRequest, "Invalid or unsupported checksum")
+				return
+			}
+			checksum = &c
+		}
+
+		if r.ContentLength > limits.MaxAppendSize {
+			sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxAppendSize)
+
+		fileID := r.PathValue("fileID")
+		unlock, err := locks.TryLock(userID + "/" + fileID)
+		if errors.Is(err, lock.ErrLocked) {
+			sendError(w, http.StatusConflict, "Upload is locked by another request")
+			return
+		}
+		if err != nil {
+			slog.Error("Failed locking upload", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+			return
+		}
+		defer unlock()
+
+		transfer, ok := getTusTransfer(w, metaStore, userID, fileID)
+		if !ok {
+			return
+		}
+		if transfer.State != meta.StateInProgress {
+			sendError(w, http.StatusConflict, "Upload is not in progress")
+			return
+		}
+
+		var body io.Reader = r.Body
+		checkBody := func() error { return nil }
+		if checksum != nil {
+			verified := checksum.verify(r.Body)
+			body, checkBody = verified, verified.rest
+		}
+		// storage that can't discard a corrupted chunk only gets verified data
+		if dir := chunkSpoolDir(store, spoolDir); checksum != nil && dir != "" {
+			spooled, cleanup, err := spool(body, dir)
+			switch {
+			case errors.Is(err, errChecksumMismatch):
+				sendError(w, statusChecksumMismatch, "Checksum mismatch")
+				return
+			case isBodyTooLarge(err):
+				sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
+				return
+			case err != nil:
+				slog.Error("Failed receiving chunk", "error", err)
+				sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+				return
+			}
+			defer cleanup()
+			body = spooled
+		}
+
+		// the length was within the quota when the upload was created, but other uploads may have used it since
+		remaining, releaseQuota, err := quotas.Reserve(identity.Subject, identity.Groups, userID, requestSize(r, transfer.DeclaredSize-offset))
+		if err != nil {
+			slog.Error("Failed getting storage usage", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+			return
+		}
+		defer releaseQuota()
+		maxSize := transfer.DeclaredSize
+		quotaLimited := remaining >= 0 && offset+remaining < maxSize
+		if quotaLimited {
+			maxSize = offset + remaining
+		}
+
+		reserved := transfer.DeclaredSize - offset
+		if r.ContentLength >= 0 {
+			reserved = min(reserved, r.ContentLength)
+		}
+		release, ok := reserveSpace(w, space, reserved)
+		if !ok {
+			return
+		}
+		defer release()
+
+		var size int64
+		digest, err := resumeDigest(store, userID, fileID, transfer, offset)
+		if err == nil {
+			size, err = PartialFileUpload(store, userID, fileID, io.TeeReader(body, digest), offset, maxSize)
+		}
+		if err == nil {
+			err = checkBody()
+		}
+		if errors.Is(err, ErrTooLarge) || isBodyTooLarge(err) || errors.Is(err, errChecksumMismatch) {
+			discardRejected(w, store, userID, fileID, offset)
+		}
+		if err != nil {
+			// data written before the failure may be kept, so the usage is computed again
+			quotas.Forget(userID)
+		}
+		switch {
+		case errors.Is(err, storage.ErrOffsetMismatch):
+			slog.Info("Upload offset does not match the received data", "file id", fileID, "offset", offset, "error", err)
+			sendError(w, http.StatusConflict, "Mismatching upload offset")
+			return
+		case isNoSpace(err):
+			slog.Error("Storage is full", "error", err)
+			sendInsufficientStorage(w, space.RetryAfter)
+			return
+		case errors.Is(err, errChecksumMismatch):
+			slog.Info("Chunk does not match its checksum", "file id", fileID)
+			sendError(w, statusChecksumMismatch, "Checksum mismatch")
+			return
+		case errors.Is(err, ErrTooLarge) && quotaLimited:
+			slog.Info("Upload exceeds storage quota", "user id", userID, "remaining", remaining)
+			sendError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded")
+			return
+		case errors.Is(err, ErrTooLarge) || isBodyTooLarge(err):
+			slog.Info("Upload exceeds its length", "file id", fileID, "error", err)
+			sendError(w, http.StatusRequestEntityTooLarge, "Upload exceeds its length")
+			return
+		case err != nil:
+			slog.Error("Failed handling file upload", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+			return
+		}
+		quotas.Add(userID, size-offset)
+
+		state := meta.StateInProgress
+		if size == transfer.DeclaredSize {
+			state = meta.StateComplete
+			err = store.Complete(userID, fileID)
+			if err != nil {
+				slog.Error("Failed completing file upload", "error", err)
+				state = meta.StateFailed
+			}
+		}
+
+		err = metaStore.Update(userID, fileID, func(t *meta.Transfer) error {
+			t.Size = size
+			t.Updated = time.Now()
+			t.State = state
+			recordDigest(t, digest, size, state == meta.StateComplete)
+			transfer = *t
+			return nil
+		})
+		if err != nil {
+			slog.Error("Failed updating transfer metadata", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+			return
+		}
+
+		if state == meta.StateFailed {
+			sendError(w, http.StatusInternalServerError, "Failed completing file upload")
+			return
+		}
+
+		if state == meta.StateComplete {
+			setReprDigest(w, transfer)
+			// not part of tus, tells the client where the transfer can be found
+			w.Header().Set("Content-Location", appRoot+viewPath(transfer))
+		}
+		setTusExpires(w, transfer, idle)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// TusDeleteAPI handles DELETE /tus/{fileID}
+// Terminates an unfinished upload, the received data is deleted and the transfer is kept as cancelled
+func TusDeleteAPI(authModule auth.Auth, store storage.Backend, metaStore meta.Store, quotas *quota.Quotas, locks lock.Locker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkTusResumable(w, r) {
+			return
+		}
+
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeUpload)
+		if !ok {
+			return
+		}
+
+		fileID := r.PathValue("fileID")
+		unlock, err := locks.TryLock(userID + "/" + fileID)
+		if errors.Is(err, lock.ErrLocked) {
+			sendError(w, http.StatusConflict, "Upload is locked by another request")
+			return
+		}
+		if err != nil {
+			slog.Error("Failed locking upload", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed terminating upload")
+			return
+		}
+		defer unlock()
+
+		transfer, ok := getTusTransfer(w, metaStore, userID, fileID)
+		if !ok {
+			return
+		}
+		if transfer.State != meta.StateInProgress {
+			sendError(w, http.StatusConflict, "Upload is not in progress")
+			return
+		}
+
+		err = store.Delete(userID, fileID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			slog.Error("Failed deleting upload", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed terminating upload")
+			return
+		}
+		quotas.Forget(userID)
+
+		err = metaStore.Update(userID, fileID, func(t *meta.Transfer) error {
+			t.Updated = time.Now()
+			t.State = meta.StateCancelled
+			return nil
+		})
+		if err != nil {
+			slog.Error("Failed updating transfer metadata", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed terminating upload")
+			return
+		}
+
+		slog.Info("Upload terminated", "user id", userID, "file id", fileID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,334 @@
+package handlers_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/auth"
+	"codeberg.org/filesender/filesender-next/internal/handlers"
+	"codeberg.org/filesender/filesender-next/internal/hash"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/quota"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+func newTusRouter(t *testing.T) *http.ServeMux {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	})
+
+	err = hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	locks := lock.NewMemory()
+	quotas := quota.New(quota.Limits{}, store, time.Minute)
+	authModule := &auth.DummyAuth{}
+
+	router := http.NewServeMux()
+	router.Handle("OPTIONS /tus/", handlers.TusOptionsAPI(uploadLimits))
+	router.Handle("POST /tus/{$}", handlers.TusCreateAPI("/", authModule, store, metaStore, quotas, noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry, time.Hour))
+	router.Handle("HEAD /tus/{fileID}", handlers.TusHeadAPI(authModule, store, metaStore, time.Hour))
+	router.Handle("PATCH /tus/{fileID}", handlers.TusPatchAPI("/", authModule, store, metaStore, quotas, noSpaceLimit(), tempDir, locks, uploadLimits, time.Hour))
+	router.Handle("DELETE /tus/{fileID}", handlers.TusDeleteAPI(authModule, store, metaStore, quotas, locks))
+	router.Handle("GET /download/{publicID}", handlers.DownloadAPI(store, metaStore, locks))
+	return router
+}
+
+func tusRequest(router http.Handler, method string, url string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func createTusUpload(t *testing.T, router http.Handler, length string) string {
+	resp := tusRequest(router, "POST", "/tus/", "", map[string]string{
+		"Upload-Length":   length,
+		"Upload-Metadata": "message " + base64.StdEncoding.EncodeToString([]byte("Hi!")) + ",filename",
+	})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+
+	loc := resp.Header().Get("Location")
+	if !strings.HasPrefix(loc, "/tus/") {
+		t.Fatalf("Expected location to start with \"/tus/\", got \"%s\"", loc)
+	}
+
+	return loc
+}
+
+func TestTusOptionsAPI(t *testing.T) {
+	router := newTusRouter(t)
+
+	req, _ := http.NewRequest("OPTIONS", "/tus/", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, resp.Code)
+	}
+	if version := resp.Header().Get("Tus-Version"); version != "1.0.0" {
+		t.Errorf("Expected version \"1.0.0\", got \"%s\"", version)
+	}
+	if extensions := resp.Header().Get("Tus-Extension"); extensions != "creation,expiration,checksum,termination" {
+		t.Errorf("Unexpected extensions \"%s\"", extensions)
+	}
+	if algorithms := resp.Header().Get("Tus-Checksum-Algorithm"); algorithms != "md5,sha1,sha256" {
+		t.Errorf("Unexpected checksum algorithms \"%s\"", algorithms)
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	router := newTusRouter(t)
+
+	t.Run("Unsupported version", func(t *testing.T) {
+		resp := tusRequest(router, "POST", "/tus/", "", map[string]string{
+			"Tus-Resumable": "0.2.2",
+			"Upload-Length": "13",
+		})
+
+		if resp.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, resp.Code)
+		}
+		if version := resp.Header().Get("Tus-Version"); version != "1.0.0" {
+			t.Errorf("Expected version \"1.0.0\", got \"%s\"", version)
+		}
+	})
+
+	t.Run("Missing upload length", func(t *testing.T) {
+		resp := tusRequest(router, "POST", "/tus/", "", nil)
+
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+	})
+
+	t.Run("Upload length too large", func(t *testing.T) {
+		resp := tusRequest(router, "POST", "/tus/", "", map[string]string{"Upload-Length": "10485761"})
+
+		if resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.Code)
+		}
+	})
+
+	t.Run("Invalid metadata", func(t *testing.T) {
+		resp := tusRequest(router, "POST", "/tus/", "", map[string]string{
+			"Upload-Length":   "13",
+			"Upload-Metadata": "message !!!",
+		})
+
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+	})
+
+	t.Run("Full upload", func(t *testing.T) {
+		loc := createTusUpload(t, router, "13")
+
+		resp := tusRequest(router, "HEAD", loc, "", nil)
+		if resp.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+		if offset := resp.Header().Get("Upload-Offset"); offset != "0" {
+			t.Errorf("Expected upload offset 0, got \"%s\"", offset)
+		}
+		if length := resp.Header().Get("Upload-Length"); length != "13" {
+			t.Errorf("Expected upload length 13, got \"%s\"", length)
+		}
+		if resp.Header().Get("Upload-Expires") == "" {
+			t.Error("Expected an upload expiry")
+		}
+
+		resp = tusRequest(router, "PATCH", loc, "Hello, ", map[string]string{"Upload-Offset": "0"})
+		if resp.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d: %s", http.StatusNoContent, resp.Code, resp.Body.String())
+		}
+		if offset := resp.Header().Get("Upload-Offset"); offset != "7" {
+			t.Errorf("Expected upload offset 7, got \"%s\"", offset)
+		}
+
+		resp = tusRequest(router, "PATCH", loc, "world!", map[string]string{"Upload-Offset": "0"})
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+		}
+
+		sum := sha256.Sum256([]byte("world!"))
+		resp = tusRequest(router, "PATCH", loc, "world!", map[string]string{
+			"Upload-Offset":   "7",
+			"Upload-Checksum": "sha256 " + base64.StdEncoding.EncodeToString(sum[:]),
+		})
+		if resp.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d: %s", http.StatusNoContent, resp.Code, resp.Body.String())
+		}
+		if offset := resp.Header().Get("Upload-Offset"); offset != "13" {
+			t.Errorf("Expected upload offset 13, got \"%s\"", offset)
+		}
+
+		full := sha256.Sum256([]byte("Hello, world!"))
+		if digest := resp.Header().Get("Repr-Digest"); digest != "sha-256=:"+base64.StdEncoding.EncodeToString(full[:])+":" {
+			t.Errorf("Unexpected Repr-Digest \"%s\"", digest)
+		}
+
+		view := resp.Header().Get("Content-Location")
+		if !strings.HasPrefix(view, "/view/") {
+			t.Fatalf("Expected content location to start with \"/view/\", got \"%s\"", view)
+		}
+
+		req, _ := http.NewRequest("GET", strings.Replace(view, "/view/", "/download/", 1), nil)
+		download := httptest.NewRecorder()
+		router.ServeHTTP(download, req)
+		if download.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, download.Code)
+		}
+		b, _ := io.ReadAll(download.Body)
+		if string(b) != "Hello, world!" {
+			t.Errorf("Expected \"Hello, world!\", got \"%s\"", b)
+		}
+
+		resp = tusRequest(router, "PATCH", loc, "!", map[string]string{"Upload-Offset": "13"})
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+		}
+	})
+
+	t.Run("Upload locked", func(t *testing.T) {
+		loc := createTusUpload(t, router, "13")
+
+		// the first request holds the lock while it is receiving its data
+		pr, pw := io.Pipe()
+		req, _ := http.NewRequest("PATCH", loc, pr)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		first := make(chan *httptest.ResponseRecorder)
+		go func() {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+			first <- resp
+		}()
+		_, err := pw.Write([]byte("Hello, "))
+		if err != nil {
+			t.Fatalf("Failed writing upload data: %v", err)
+		}
+
+		resp := tusRequest(router, "PATCH", loc, "world!", map[string]string{"Upload-Offset": "7"})
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+		}
+		if offset := resp.Header().Get("Upload-Offset"); offset != "" {
+			t.Errorf("Expected no upload offset while another request appends, got \"%s\"", offset)
+		}
+
+		_ = pw.Close()
+		resp = <-first
+		if resp.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d: %s", http.StatusNoContent, resp.Code, resp.Body.String())
+		}
+		if offset := resp.Header().Get("Upload-Offset"); offset != "7" {
+			t.Errorf("Expected upload offset 7, got \"%s\"", offset)
+		}
+	})
+
+	t.Run("Exceeds upload length", func(t *testing.T) {
+		loc := createTusUpload(t, router, "5")
+
+		resp := tusRequest(router, "PATCH", loc, "Hello, world!", map[string]string{"Upload-Offset": "0"})
+		if resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.Code)
+		}
+	})
+
+	t.Run("Checksum mismatch", func(t *testing.T) {
+		loc := createTusUpload(t, router, "13")
+
+		sum := sha256.Sum256([]byte("Goodbye"))
+		resp := tusRequest(router, "PATCH", loc, "Hello, ", map[string]string{
+			"Upload-Offset":   "0",
+			"Upload-Checksum": "sha256 " + base64.StdEncoding.EncodeToString(sum[:]),
+		})
+		if resp.Code != 460 {
+			t.Errorf("Expected status 460, got %d", resp.Code)
+		}
+
+		resp = tusRequest(router, "HEAD", loc, "", nil)
+		if offset := resp.Header().Get("Upload-Offset"); offset != "0" {
+			t.Errorf("Expected upload offset 0, got \"%s\"", offset)
+		}
+	})
+
+	t.Run("Unsupported checksum algorithm", func(t *testing.T) {
+		loc := createTusUpload(t, router, "13")
+
+		resp := tusRequest(router, "PATCH", loc, "Hello, ", map[string]string{
+			"Upload-Offset":   "0",
+			"Upload-Checksum": "crc32 AAAAAA==",
+		})
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+	})
+
+	t.Run("Wrong content type", func(t *testing.T) {
+		loc := createTusUpload(t, router, "13")
+
+		resp := tusRequest(router, "PATCH", loc, "Hello, ", map[string]string{
+			"Upload-Offset": "0",
+			"Content-Type":  "text/plain",
+		})
+		if resp.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected status %d, got %d", http.StatusUnsupportedMediaType, resp.Code)
+		}
+	})
+
+	t.Run("Termination", func(t *testing.T) {
+		loc := createTusUpload(t, router, "13")
+
+		resp := tusRequest(router, "DELETE", loc, "", nil)
+		if resp.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d", http.StatusNoContent, resp.Code)
+		}
+
+		resp = tusRequest(router, "HEAD", loc, "", nil)
+		if resp.Code != http.StatusGone {
+			t.Errorf("Expected status %d, got %d", http.StatusGone, resp.Code)
+		}
+
+		resp = tusRequest(router, "PATCH", loc, "Hello, ", map[string]string{"Upload-Offset": "0"})
+		if resp.Code != http.StatusGone {
+			t.Errorf("Expected status %d, got %d", http.StatusGone, resp.Code)
+		}
+	})
+
+	t.Run("Upload not found", func(t *testing.T) {
+		resp := tusRequest(router, "HEAD", "/tus/hi", "", nil)
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
+		}
+	})
+}
@@ -1,12 +1,93 @@
 package handlers
 
+import (
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/meta"
+)
+
+// UploadLimits are the size limits applied to uploads
+type UploadLimits struct {
+	MaxSize       int64 // maximum total size of a transfer
+	MaxAppendSize int64 // maximum size of the data sent in a single request
+}
+
 type uploadTemplate struct {
-	AppRoot string
+	AppRoot       string
+	MinExpiryDate string
+	MaxExpiryDate string
+	QuotaUsed     int64 // bytes stored by the user
+	QuotaLimit    int64 // 0 means unlimited
+	UserName      string
+	UserEmail     string // first email address of the user, can be empty
 }
 
 type downloadTemplate struct {
-	AppRoot  string
-	ByteSize int64
-	UserID   string
-	FileID   string
+	AppRoot      string
+	ByteSize     int64
+	DownloadPath string // path of the file relative to the app root
+	Expiry       time.Time
+	Message      string
+	Checksum     string // base64 encoded SHA-256, empty for transfers uploaded before it was computed
+
+	DownloadsLeft int // 0 means unlimited
+}
+
+type transfersTemplate struct {
+	AppRoot       string
+	Transfers     []transferItem
+	MinExpiryDate string
+	MaxExpiryDate string
+}
+
+// transferItem describes a transfer in the list of transfers of a user
+type transferItem struct {
+	FileID       string     `json:"file_id"`
+	Link         string     `json:"link"` // path of the download page relative to the app root
+	State        meta.State `json:"state"`
+	Size         int64      `json:"size"`
+	Created      time.Time  `json:"created"`
+	Expiry       time.Time  `json:"expiry"`
+	Expired      bool       `json:"expired"`
+	Downloads    int        `json:"downloads"`
+	MaxDownloads int        `json:"max_downloads"` // 0 means unlimited
+	Message      string     `json:"message,omitempty"`
+}
+
+type healthResponse struct {
+	Status  string        `json:"status"` // `ok`, `low_disk_space` or `error`
+	Storage storageHealth `json:"storage"`
+}
+
+type storageHealth struct {
+	FreeBytes     *int64 `json:"free_bytes,omitempty"` // missing if the storage can't report its free space
+	ReservedBytes int64  `json:"reserved_bytes"`       // admitted for uploads in progress
+	ReserveBytes  int64  `json:"reserve_bytes"`        // kept free
+}
+
+type tokensTemplate struct {
+	AppRoot       string
+	Tokens        []tokenItem
+	Scopes        []string // scopes that can be granted
+	NewToken      string   // the token just created, only shown once
+	NewTokenName  string
+	MinExpiryDate string
+	MaxExpiryDate string
+}
+
+// tokenItem describes an API token in the list of tokens of a user
+type tokenItem struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  time.Time  `json:"expires"`
+	Expired  bool       `json:"expired"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// createdToken is the response to creating an API token, the only time the token is shown
+type createdToken struct {
+	tokenItem
+	Token string `json:"token"`
 }
@@ -1,76 +1,337 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 
 	"codeberg.org/filesender/filesender-next/internal/auth"
-	"codeberg.org/filesender/filesender-next/internal/hash"
+	"codeberg.org/filesender/filesender-next/internal/diskspace"
 	"codeberg.org/filesender/filesender-next/internal/id"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/quota"
+	"codeberg.org/filesender/filesender-next/internal/storage"
 )
 
+const (
+	expiryDateLayout = "2006-01-02"
+	maxMessageLength = 2000
+)
+
+// parseExpiryDate parses an `expiry_date` (YYYY-MM-DD), the transfer expires at the end of that day (UTC)
+// When no date is given, the transfer expires after `maxExpiry`
+func parseExpiryDate(value string, now time.Time, maxExpiry time.Duration) (time.Time, error) {
+	if value == "" {
+		return now.Add(maxExpiry), nil
+	}
+
+	date, err := time.Parse(expiryDateLayout, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	lastDay := now.Add(maxExpiry).UTC().Truncate(24 * time.Hour)
+	if date.Before(today) {
+		return time.Time{}, errors.New("expiry date is in the past")
+	}
+	if date.After(lastDay) {
+		return time.Time{}, errors.New("expiry date is too far in the future")
+	}
+
+	return date.Add(24 * time.Hour), nil
+}
+
+// parseMaxDownloads parses `max_downloads`, the number of times a transfer can be downloaded
+// When no number is given, the number of downloads is unlimited (0)
+func parseMaxDownloads(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	maxDownloads, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if maxDownloads < 0 {
+		return 0, errors.New("maximum downloads is negative")
+	}
+
+	return maxDownloads, nil
+}
+
+// updateTransfer updates the metadata of a transfer after data was received
+// Transfers uploaded before metadata was stored get new metadata
+func updateTransfer(metaStore meta.Store, userID string, fileID string, f func(t *meta.Transfer)) error {
+	err := metaStore.Update(userID, fileID, func(t *meta.Transfer) error {
+		f(t)
+		return nil
+	})
+	if !errors.Is(err, meta.ErrNotFound) {
+		return err
+	}
+
+	t := meta.Transfer{
+		UserID:  userID,
+		FileID:  fileID,
+		State:   meta.StateInProgress,
+		Created: time.Now(),
+	}
+	f(&t)
+	return metaStore.Put(t)
+}
+
+// validUploadLength checks if `size` bytes received so far are consistent with the declared length
+// A declared length of 0 means the client did not declare one
+func validUploadLength(declaredSize int64, size int64, complete bool) bool {
+	if declaredSize == 0 {
+		return true
+	}
+	if complete {
+		return size == declaredSize
+	}
+
+	return size <= declaredSize
+}
+
+// requestSize returns the most data the request can add, at most `maxSize` bytes
+func requestSize(r *http.Request, maxSize int64) int64 {
+	if r.ContentLength >= 0 {
+		return min(r.ContentLength, maxSize)
+	}
+
+	return maxSize
+}
+
 // UploadAPI handles POST /upload
-// Expects `expiry_date` in form data
-func UploadAPI(appRoot string, authModule auth.Auth, stateDir string, maxUploadSize int64) http.HandlerFunc {
+// Expects `expiry_date` and optionally `message` and `max_downloads` in form data before the `file`, or as query parameters with a raw body
+// The file data is streamed into storage, the total size can be declared with `Upload-Length`
+// The upload can't grow beyond the storage quota left to the user, and is only accepted while the storage has free space
+// The upload is locked while its data is written, so it can't be appended to and isn't recovered as an orphan meanwhile
+func UploadAPI(appRoot string, authModule auth.Auth, store storage.Backend, metaStore meta.Store, quotas *quota.Quotas, space *diskspace.Guard, locks lock.Locker, limits UploadLimits, maxExpiry time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userID, err := authModule.UserAuth(r)
+		identity, userID, ok := authenticate(w, r, authModule, auth.ScopeUpload)
+		if !ok {
+			return
+		}
+
+		fileID, err := id.New()
+		if err != nil {
+			slog.Error("Failed creating file ID", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed to create a random file ID!")
+			return
+		}
+
+		unlock, err := locks.TryLock(userID + "/" + fileID)
 		if err != nil {
-			slog.Info("unable to authenticate user", "error", err)
-			sendError(w, http.StatusUnauthorized, "You're not authenticated")
+			slog.Error("Failed locking upload", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
 			return
 		}
+		defer unlock()
 
-		userID, err = hash.ToBase64(userID)
+		declaredSize, err := parseUploadLength(r)
 		if err != nil {
-			slog.Info("failed hashing user ID", "error", err)
-			sendError(w, http.StatusInternalServerError, "Failed creating user ID")
+			slog.Info("Invalid upload length", "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid upload length")
+			return
+		}
+		if declaredSize > limits.MaxSize {
+			sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
 			return
 		}
 
-		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		if r.ContentLength > limits.MaxAppendSize {
 			sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
 			return
 		}
 
-		file, fileHeader, err := r.FormFile("file")
+		maxSize := limits.MaxSize
+		if declaredSize != 0 {
+			maxSize = declaredSize
+		}
+
+		// the quota for the data of this request is reserved, so concurrent uploads can't exceed it together
+		remaining, releaseQuota, err := quotas.Reserve(identity.Subject, identity.Groups, userID, requestSize(r, maxSize))
 		if err != nil {
-			slog.Error("Failed opening file", "error", err)
+			slog.Error("Failed getting storage usage", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
+			return
+		}
+		defer releaseQuota()
+		if remaining == 0 || (remaining > 0 && declaredSize > remaining) {
+			slog.Info("Upload exceeds storage quota", "user id", userID, "remaining", remaining, "declared", declaredSize)
+			sendError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded")
+			return
+		}
 
-			if err == http.ErrMissingFile {
-				sendError(w, http.StatusBadRequest, "No file")
-			} else {
-				sendError(w, http.StatusInternalServerError, "Lost the file")
-			}
+		// the declared length is reserved for the whole upload, otherwise only the data of this request
+		reserved := declaredSize
+		if reserved == 0 {
+			reserved = r.ContentLength
+		}
+		release, ok := reserveSpace(w, space, reserved)
+		if !ok {
+			return
+		}
+		defer release()
+
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxAppendSize)
+		// the data of a new upload is deleted if it does not match, so it is verified while it is stored
+		checkBody, _, ok := checkContentDigest(w, r, "")
+		if !ok {
 			return
 		}
-		defer func() {
-			if err := file.Close(); err != nil {
-				slog.Error("Failed closing file", "error", err)
+
+		upload, err := readUploadRequest(r)
+		switch {
+		case errors.Is(err, errMissingFile):
+			sendError(w, http.StatusBadRequest, "No file")
+			return
+		case errors.Is(err, errChecksumMismatch):
+			slog.Info("Upload does not match its content digest")
+			sendError(w, http.StatusBadRequest, "Content digest mismatch")
+			return
+		case errors.Is(err, errUnsupportedContentType):
+			slog.Info("Unsupported upload content type", "error", err)
+			sendError(w, http.StatusUnsupportedMediaType, "Unsupported content type")
+			return
+		case isBodyTooLarge(err):
+			sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
+			return
+		case err != nil:
+			slog.Error("Failed reading upload request", "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid upload request")
+			return
+		}
+
+		now := time.Now()
+		expiry, err := parseExpiryDate(upload.fields["expiry_date"], now, maxExpiry)
+		if err != nil {
+			slog.Info("Invalid expiry date", "expiry_date", upload.fields["expiry_date"], "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid expiry date")
+			return
+		}
+
+		message := upload.fields["message"]
+		if len(message) > maxMessageLength {
+			sendError(w, http.StatusBadRequest, "Message too long")
+			return
+		}
+
+		maxDownloads, err := parseMaxDownloads(upload.fields["max_downloads"])
+		if err != nil {
+			slog.Info("Invalid maximum downloads", "max_downloads", upload.fields["max_downloads"], "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid maximum downloads")
+			return
+		}
+
+		// only once the upload is accepted, its data is stored from here on and can be resumed
+		sendUploadResumptionSupported(w, r, appRoot, fileID)
+
+		quotaLimited := remaining >= 0 && remaining < maxSize
+		if quotaLimited {
+			maxSize = remaining
+		}
+
+		digest := sha256.New()
+		size, err := FileUpload(store, userID, fileID, io.TeeReader(upload.file, digest), maxSize)
+		if err == nil {
+			err = checkBody()
+		}
+		if err == nil && !validUploadLength(declaredSize, size, isUploadComplete(r)) {
+			err = fmt.Errorf("%w: received %d bytes, declared %d", ErrTooLarge, size, declaredSize)
+		}
+		if err != nil {
+			// nothing refers to the data of a failed new upload, so don't keep it
+			if err := store.Delete(userID, fileID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				slog.Error("Failed deleting failed upload", "error", err)
 			}
-		}()
 
-		fileID, err := id.New()
+			switch {
+			case isNoSpace(err):
+				slog.Error("Storage is full", "error", err)
+				sendInsufficientStorage(w, space.RetryAfter)
+			case errors.Is(err, errChecksumMismatch):
+				slog.Info("Upload does not match its content digest")
+				sendError(w, http.StatusBadRequest, "Content digest mismatch")
+			case errors.Is(err, ErrTooLarge) && declaredSize != 0:
+				slog.Info("Upload does not match declared length", "error", err)
+				sendError(w, http.StatusBadRequest, "Inconsistent upload length")
+			case errors.Is(err, ErrTooLarge) && quotaLimited:
+				slog.Info("Upload exceeds storage quota", "user id", userID, "remaining", remaining)
+				sendError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded")
+			case errors.Is(err, ErrTooLarge) || isBodyTooLarge(err):
+				sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
+			default:
+				slog.Error("Failed handling file upload", "error", err)
+				sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
+			}
+			return
+		}
+		quotas.Add(userID, size)
+
+		publicID, err := id.New()
 		if err != nil {
-			slog.Error("Failed creating file ID", "error", err)
-			sendError(w, http.StatusInternalServerError, "Failed to create a random file ID!")
+			slog.Error("Failed creating public ID", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
+			return
+		}
+
+		transfer := meta.Transfer{
+			UserID:   userID,
+			FileID:   fileID,
+			PublicID: publicID,
+			State:    meta.StateInProgress,
+			Created:  now,
+			Updated:  now,
+			Expiry:   expiry,
+			Size:     size,
+			Message:  message,
+
+			DeclaredSize: declaredSize,
+			MaxDownloads: maxDownloads,
+		}
+
+		recordDigest(&transfer, digest, size, isUploadComplete(r))
+		if !isUploadComplete(r) {
+			err = metaStore.Put(transfer)
+			if err != nil {
+				slog.Error("Failed storing transfer metadata", "error", err)
+				sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
+				return
+			}
+
+			sendIncompleteResponse(w, appRoot, fileID, limits, size)
 			return
 		}
 
-		err = FileUpload(stateDir, userID, fileID, file)
+		transfer.State = meta.StateComplete
+		err = store.Complete(userID, fileID)
 		if err != nil {
-			slog.Error("Failed handling file upload", "error", err)
+			slog.Error("Failed completing file upload", "error", err)
+			transfer.State = meta.StateFailed
+		}
+
+		if err := metaStore.Put(transfer); err != nil {
+			slog.Error("Failed storing transfer metadata", "error", err)
 			sendError(w, http.StatusInternalServerError, "Failed handling new file upload")
 			return
 		}
 
-		if completed := r.Header.Get("Upload-Complete"); completed == "0" {
-			sendIncompleteResponse(w, appRoot, fileID, maxUploadSize, fileHeader.Size)
+		if transfer.State == meta.StateFailed {
+			sendError(w, http.StatusInternalServerError, "Failed completing file upload")
 			return
 		}
 
-		err = sendRedirect(w, http.StatusSeeOther, appRoot+"view/"+userID+"/"+fileID, "") // Redirect to `/view/<user_id>/<file_id>`
+		setReprDigest(w, transfer)
+		err = sendRedirect(w, http.StatusSeeOther, appRoot+viewPath(transfer), "") // Redirect to `/view/<public_id>`
 		if err != nil {
 			sendError(w, http.StatusInternalServerError, "Failed sending redirect")
 		}
@@ -78,7 +339,11 @@ func UploadAPI(appRoot string, authModule auth.Auth, stateDir string, maxUploadS
 }
 
 // ChunkedUploadAPI handles PATCH /upload/{fileID}
-func ChunkedUploadAPI(appRoot string, authModule auth.Auth, stateDir string, maxUploadSize int64) http.HandlerFunc {
+// Only one request can append to an upload at a time, the data has to start at the number of bytes received so far
+// The upload can't grow beyond the maximum size, or the length declared with `Upload-Length`
+// Accepts a multipart form with a `file` or a raw body, which is streamed into storage
+// A chunk not matching its `Content-Digest` is discarded, storage that can't discard it gets the chunk verified in `spoolDir`
+func ChunkedUploadAPI(appRoot string, authModule auth.Auth, store storage.Backend, metaStore meta.Store, quotas *quota.Quotas, space *diskspace.Guard, spoolDir string, locks lock.Locker, limits UploadLimits) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		fileID := r.PathValue("fileID")
 		if fileID == "" {
@@ -87,29 +352,24 @@ func ChunkedUploadAPI(appRoot string, authModule auth.Auth, stateDir string, max
 			return
 		}
 
-		userID, err := authModule.UserAuth(r)
-		if err != nil {
-			slog.Info("unable to authenticate user", "error", err)
-			sendError(w, http.StatusUnauthorized, "You're not authenticated")
-			return
-		}
-
-		userID, err = hash.ToBase64(userID)
-		if err != nil {
-			slog.Info("failed hashing user ID", "error", err)
-			sendError(w, http.StatusInternalServerError, "Failed creating user ID")
+		identity, userID, ok := authenticate(w, r, authModule, auth.ScopeUpload)
+		if !ok {
 			return
 		}
 
-		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		if r.ContentLength > limits.MaxAppendSize {
 			sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
 			return
 		}
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxAppendSize)
+
+		uploadComplete := isUploadComplete(r)
 
-		uploadComplete := true
-		if completed := r.Header.Get("Upload-Complete"); completed == "0" {
-			uploadComplete = false
+		declaredSize, err := parseUploadLength(r)
+		if err != nil {
+			slog.Info("Invalid upload length", "error", err)
+			sendError(w, http.StatusBadRequest, "Invalid upload length")
+			return
 		}
 
 		offsetStr := r.Header.Get("Upload-Offset")
@@ -120,38 +380,375 @@ func ChunkedUploadAPI(appRoot string, authModule auth.Auth, stateDir string, max
 		}
 
 		uploadOffset, err := strconv.ParseInt(offsetStr, 10, 64)
-		if err != nil || uploadOffset == 0 {
+		if err != nil || uploadOffset < 0 {
 			slog.Info("Invalid upload offset", "offset", offsetStr)
 			sendError(w, http.StatusBadRequest, "Invalid offset")
 			return
 		}
 
-		file, _, err := r.FormFile("file")
+		unlock, err := locks.TryLock(userID + "/" + fileID)
+		if errors.Is(err, lock.ErrLocked) {
+			// the data received so far is still growing, so no offset is sent, the client asks for it once the other request ended
+			slog.Info("Upload is locked by another request", "file id", fileID)
+			sendError(w, http.StatusConflict, "Upload is locked by another request")
+			return
+		}
 		if err != nil {
+			slog.Error("Failed locking upload", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+			return
+		}
+		defer unlock()
+
+		transfer, err := metaStore.Get(userID, fileID)
+		switch {
+		case errors.Is(err, meta.ErrNotFound):
+			// uploads started before metadata was stored
+		case err != nil:
+			slog.Error("Failed getting transfer metadata", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+			return
+		case transfer.State != meta.StateInProgress:
+			slog.Info("Upload is not in progress", "file id", fileID, "state", transfer.State)
+			sendError(w, http.StatusConflict, "Upload is not in progress")
+			return
+		}
+
+		switch {
+		case declaredSize == 0:
+			declaredSize = transfer.DeclaredSize
+		case declaredSize > limits.MaxSize:
+			sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
+			return
+		case transfer.DeclaredSize != 0 && declaredSize != transfer.DeclaredSize:
+			slog.Info("Upload length changed", "declared", transfer.DeclaredSize, "new", declaredSize)
+			sendError(w, http.StatusBadRequest, "Inconsistent upload length")
+			return
+		}
+
+		maxSize := limits.MaxSize
+		if declaredSize != 0 {
+			maxSize = declaredSize
+		}
+
+		checkBody, cleanup, ok := checkContentDigest(w, r, chunkSpoolDir(store, spoolDir))
+		if !ok {
+			return
+		}
+		defer cleanup()
+
+		upload, err := readUploadRequest(r)
+		switch {
+		case errors.Is(err, errChecksumMismatch):
+			slog.Info("Upload does not match its content digest")
+			sendError(w, http.StatusBadRequest, "Content digest mismatch")
+			return
+		case errors.Is(err, errUnsupportedContentType):
+			slog.Info("Unsupported upload content type", "error", err)
+			sendError(w, http.StatusUnsupportedMediaType, "Unsupported content type")
+			return
+		case isBodyTooLarge(err):
+			sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
+			return
+		case err != nil:
 			slog.Error("Failed opening file", "error", err)
 			sendError(w, http.StatusInternalServerError, "Lost the file")
 			return
 		}
-		defer func() {
-			if err := file.Close(); err != nil {
-				slog.Error("Failed closing file", "error", err)
-			}
-		}()
 
-		totalFileSize, err := PartialFileUpload(stateDir, userID, fileID, file, uploadOffset)
+		digest, err := resumeDigest(store, userID, fileID, transfer, uploadOffset)
+		if errors.Is(err, storage.ErrOffsetMismatch) {
+			slog.Info("Upload offset does not match the received data", "file id", fileID, "offset", uploadOffset, "error", err)
+			sendCurrentOffset(w, store, userID, fileID, uploadOffset)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed resuming upload digest", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+			return
+		}
+
+		// the data received so far is part of the usage, only the rest of the upload has to fit in the quota
+		remaining, releaseQuota, err := quotas.Reserve(identity.Subject, identity.Groups, userID, requestSize(r, maxSize-uploadOffset))
+		if err != nil {
+			slog.Error("Failed getting storage usage", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+			return
+		}
+		defer releaseQuota()
+		if remaining >= 0 && declaredSize-uploadOffset > remaining {
+			slog.Info("Upload exceeds storage quota", "user id", userID, "remaining", remaining, "declared", declaredSize)
+			sendError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded")
+			return
+		}
+		quotaLimited := remaining >= 0 && uploadOffset+remaining < maxSize
+		if quotaLimited {
+			maxSize = uploadOffset + remaining
+		}
+
+		reserved := r.ContentLength
+		if declaredSize != 0 {
+			reserved = declaredSize - uploadOffset
+		}
+		release, ok := reserveSpace(w, space, reserved)
+		if !ok {
+			return
+		}
+		defer release()
+
+		totalFileSize, err := PartialFileUpload(store, userID, fileID, io.TeeReader(upload.file, digest), uploadOffset, maxSize)
+		if err == nil {
+			err = checkBody()
+		}
+		if errors.Is(err, ErrTooLarge) || isBodyTooLarge(err) || errors.Is(err, errChecksumMismatch) {
+			discardRejected(w, store, userID, fileID, uploadOffset)
+		}
+		if err != nil {
+			// data written before the failure may be kept, so the usage is computed again
+			quotas.Forget(userID)
+		}
+		if errors.Is(err, errChecksumMismatch) {
+			slog.Info("Upload does not match its content digest", "file id", fileID)
+			sendError(w, http.StatusBadRequest, "Content digest mismatch")
+			return
+		}
+		if errors.Is(err, ErrTooLarge) && declaredSize != 0 {
+			slog.Info("Upload exceeds the declared length", "file id", fileID, "error", err)
+			sendError(w, http.StatusBadRequest, "Inconsistent upload length")
+			return
+		}
+		if errors.Is(err, ErrTooLarge) && quotaLimited {
+			slog.Info("Upload exceeds storage quota", "user id", userID, "remaining", remaining)
+			sendError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded")
+			return
+		}
+		if errors.Is(err, ErrTooLarge) || isBodyTooLarge(err) {
+			slog.Info("Upload exceeds the maximum size", "file id", fileID, "error", err)
+			sendError(w, http.StatusRequestEntityTooLarge, "Upload file size too large")
+			return
+		}
+		if errors.Is(err, storage.ErrOffsetMismatch) {
+			slog.Info("Upload offset does not match the received data", "file id", fileID, "offset", uploadOffset, "error", err)
+			sendCurrentOffset(w, store, userID, fileID, uploadOffset)
+			return
+		}
+		if isNoSpace(err) {
+			// the data written before the storage was full is kept, the client can resume after it
+			slog.Error("Storage is full", "error", err)
+			sendInsufficientStorage(w, space.RetryAfter)
+			return
+		}
 		if err != nil {
 			slog.Error("Failed handling file upload", "error", err)
 			sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
 			return
 		}
+		quotas.Add(userID, totalFileSize-uploadOffset)
+
+		// a final chunk that leaves the upload shorter than declared is kept, the client can still send the rest
+		lengthMismatch := !validUploadLength(declaredSize, totalFileSize, uploadComplete)
+
+		// transfers started before public IDs existed get one now
+		publicID := transfer.PublicID
+		if publicID == "" {
+			publicID, err = id.New()
+			if err != nil {
+				slog.Error("Failed creating public ID", "error", err)
+				sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+				return
+			}
+		}
+
+		state := meta.StateInProgress
+		if uploadComplete && !lengthMismatch {
+			state = meta.StateComplete
+			err = store.Complete(userID, fileID)
+			if err != nil {
+				slog.Error("Failed completing file upload", "error", err)
+				state = meta.StateFailed
+			}
+		}
+
+		err = updateTransfer(metaStore, userID, fileID, func(t *meta.Transfer) {
+			t.Size = totalFileSize
+			t.DeclaredSize = declaredSize
+			t.Updated = time.Now()
+			t.State = state
+			if t.PublicID == "" {
+				t.PublicID = publicID
+			}
+			recordDigest(t, digest, totalFileSize, state == meta.StateComplete)
+			transfer = *t
+		})
+		if err != nil {
+			slog.Error("Failed updating transfer metadata", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+			return
+		}
+
+		if state == meta.StateFailed {
+			sendError(w, http.StatusInternalServerError, "Failed completing file upload")
+			return
+		}
+
+		if lengthMismatch {
+			slog.Info("Upload does not match declared length", "declared", declaredSize, "size", totalFileSize)
+			sendError(w, http.StatusBadRequest, "Inconsistent upload length")
+			return
+		}
 
 		if uploadComplete {
-			err = sendRedirect(w, http.StatusSeeOther, appRoot+"view/"+userID+"/"+fileID, "")
+			setReprDigest(w, transfer)
+			err = sendRedirect(w, http.StatusSeeOther, appRoot+viewPath(transfer), "")
 			if err != nil {
 				sendError(w, http.StatusInternalServerError, "Failed sending redirect")
 			}
 		} else {
-			sendIncompleteResponse(w, appRoot, fileID, maxUploadSize, totalFileSize)
+			sendIncompleteResponse(w, appRoot, fileID, limits, totalFileSize)
+		}
+	}
+}
+
+// discardRejected drops the data a rejected request appended before it exceeded a limit, so the upload continues
+// from the offset the client sent
+// Storage that can't truncate keeps that data, its size is then reported in `Upload-Offset`
+func discardRejected(w http.ResponseWriter, store storage.Backend, userID string, fileID string, offset int64) {
+	stager, ok := store.(storage.Stager)
+	if ok {
+		err := stager.Truncate(userID, fileID, offset)
+		if err == nil {
+			return
+		}
+		slog.Error("Failed discarding rejected upload data", "file id", fileID, "error", err)
+	}
+
+	info, err := store.Stat(userID, fileID)
+	if err != nil {
+		slog.Error("Failed getting file size", "error", err)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Size, 10))
+}
+
+// sendCurrentOffset sends a conflict response carrying the number of bytes of the upload received so far
+func sendCurrentOffset(w http.ResponseWriter, store storage.Backend, userID string, fileID string, providedOffset int64) {
+	info, err := store.Stat(userID, fileID)
+	if err != nil {
+		slog.Error("Failed getting file size", "error", err)
+		sendError(w, http.StatusInternalServerError, "Failed handling existing file upload")
+		return
+	}
+
+	sendOffsetMismatch(w, info.Size, providedOffset)
+}
+
+// UploadOffsetAPI handles HEAD /upload/{fileID}
+// Reports the number of bytes received so far, so clients can resume an interrupted upload
+func UploadOffsetAPI(authModule auth.Auth, store storage.Backend, metaStore meta.Store, limits UploadLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := r.PathValue("fileID")
+
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeUpload)
+		if !ok {
+			return
+		}
+
+		transfer, err := metaStore.Get(userID, fileID)
+		if err != nil && !errors.Is(err, meta.ErrNotFound) {
+			// uploads started before metadata was stored have no metadata
+			slog.Error("Failed getting transfer metadata", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed getting upload")
+			return
+		}
+
+		info, err := store.Stat(userID, fileID)
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidID) {
+			sendError(w, http.StatusNotFound, "Upload not found")
+			return
+		}
+		if err != nil {
+			slog.Error("Failed getting file size", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed getting upload")
+			return
+		}
+
+		w.Header().Set("Upload-Draft-Interop-Version", uploadDraftInteropVersion)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(info.Size, 10))
+		w.Header().Set("Upload-Limit", uploadLimitHeader(limits))
+		w.Header().Set("Cache-Control", "no-store")
+		if transfer.DeclaredSize != 0 {
+			w.Header().Set("Upload-Length", strconv.FormatInt(transfer.DeclaredSize, 10))
+		}
+		if transfer.State == meta.StateComplete {
+			setReprDigest(w, transfer)
+			w.Header().Set("Upload-Complete", "?1")
+		} else {
+			w.Header().Set("Upload-Complete", "?0")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// CancelUploadAPI handles DELETE /upload/{fileID}
+// Deletes the data of an unfinished upload, the transfer is kept as cancelled
+func CancelUploadAPI(authModule auth.Auth, store storage.Backend, metaStore meta.Store, quotas *quota.Quotas, locks lock.Locker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := r.PathValue("fileID")
+
+		_, userID, ok := authenticate(w, r, authModule, auth.ScopeUpload)
+		if !ok {
+			return
+		}
+
+		unlock, err := locks.TryLock(userID + "/" + fileID)
+		if errors.Is(err, lock.ErrLocked) {
+			sendError(w, http.StatusConflict, "Upload is locked by another request")
+			return
+		}
+		if err != nil {
+			slog.Error("Failed locking upload", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed cancelling upload")
+			return
+		}
+		defer unlock()
+
+		transfer, err := metaStore.Get(userID, fileID)
+		switch {
+		case errors.Is(err, meta.ErrNotFound):
+			// uploads started before metadata was stored
+		case err != nil:
+			slog.Error("Failed getting transfer metadata", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed cancelling upload")
+			return
+		case transfer.State != meta.StateInProgress:
+			slog.Info("Upload is not in progress", "file id", fileID, "state", transfer.State)
+			sendError(w, http.StatusConflict, "Upload is not in progress")
+			return
+		}
+
+		err = store.Delete(userID, fileID)
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidID) {
+			sendError(w, http.StatusNotFound, "Upload not found")
+			return
 		}
+		if err != nil {
+			slog.Error("Failed deleting upload", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed cancelling upload")
+			return
+		}
+		quotas.Forget(userID)
+
+		err = updateTransfer(metaStore, userID, fileID, func(t *meta.Transfer) {
+			t.Updated = time.Now()
+			t.State = meta.StateCancelled
+		})
+		if err != nil {
+			slog.Error("Failed updating transfer metadata", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed cancelling upload")
+			return
+		}
+
+		slog.Info("Upload cancelled", "user id", userID, "file id", fileID)
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -2,19 +2,32 @@ package handlers_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"codeberg.org/filesender/filesender-next/internal/auth"
+	"codeberg.org/filesender/filesender-next/internal/diskspace"
 	"codeberg.org/filesender/filesender-next/internal/handlers"
 	"codeberg.org/filesender/filesender-next/internal/hash"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/quota"
+	"codeberg.org/filesender/filesender-next/internal/storage"
 )
 
 func createMultipartBody(fileBody string) (*bytes.Buffer, *multipart.Writer) {
@@ -25,6 +38,17 @@ func createMultipartBody(fileBody string) (*bytes.Buffer, *multipart.Writer) {
 	return body, writer
 }
 
+func createMultipartBodyWithFields(fields map[string]string, fileBody string) (*bytes.Buffer, *multipart.Writer) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		_ = writer.WriteField(k, v)
+	}
+	part, _ := writer.CreateFormFile("file", "testfile.txt")
+	_, _ = part.Write([]byte(fileBody))
+	return body, writer
+}
+
 func mockUploadRequest(handler http.HandlerFunc, body *bytes.Buffer, writer *multipart.Writer, headers map[string]string) *httptest.ResponseRecorder {
 	req, _ := http.NewRequest("POST", "/upload", body)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
@@ -52,6 +76,35 @@ func mockPartialUploadRequest(handler http.HandlerFunc, fileID string, body *byt
 	return resp
 }
 
+const maxExpiry = 7 * 24 * time.Hour
+
+// 10 MB limit
+var uploadLimits = handlers.UploadLimits{MaxSize: 10 * 1024 * 1024, MaxAppendSize: 10 * 1024 * 1024}
+
+func newMetaStore(t *testing.T, dir string) *meta.FileStore {
+	metaStore, err := meta.NewFileStore(filepath.Join(dir, "meta"))
+	if err != nil {
+		t.Fatalf("Failed creating metadata store: %v", err)
+	}
+
+	return metaStore
+}
+
+// noQuotas returns quotas that don't limit any user
+func noQuotas() *quota.Quotas {
+	return quota.New(quota.Limits{}, storage.NewMemory(), time.Minute)
+}
+
+// noSpaceLimit returns a guard admitting all uploads, for storage that can't report its free space
+func noSpaceLimit() *diskspace.Guard {
+	return diskspace.New(nil, 0, time.Minute)
+}
+
+// stagingDir returns the directory the filesystem storage writes the uploads in progress of a user to
+func stagingDir(dir string, userID string) string {
+	return filepath.Join(dir, ".staging", userID)
+}
+
 func clearFolder(dir string) error {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -101,7 +154,7 @@ func TestUploadAPIHandler(t *testing.T) {
 		}
 	}()
 
-	handler := handlers.UploadAPI("/", &auth.DummyAuth{}, tempDir, 10*1024*1024) // 10 MB limit
+	handler := handlers.UploadAPI("/", &auth.DummyAuth{}, storage.NewFilesystem(tempDir), newMetaStore(t, tempDir), noQuotas(), noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry)
 	err = hash.Init(tempDir)
 	if err != nil {
 		t.Fatalf("Could not initialise hashing package: %v", err)
@@ -114,7 +167,7 @@ func TestUploadAPIHandler(t *testing.T) {
 	}
 
 	t.Run("Fail authentication", func(t *testing.T) {
-		handler := handlers.UploadAPI("/", &auth.ProxyAuth{}, tempDir, 10*1024*1024)
+		handler := handlers.UploadAPI("/", &auth.ProxyAuth{}, storage.NewFilesystem(tempDir), newMetaStore(t, tempDir), noQuotas(), noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry)
 		body, writer := createMultipartBody("")
 		err = writer.Close()
 		if err != nil {
@@ -159,7 +212,7 @@ func TestUploadAPIHandler(t *testing.T) {
 	})
 
 	t.Run("Too big file size", func(t *testing.T) {
-		handler := handlers.UploadAPI("/", &auth.DummyAuth{}, tempDir, 10)
+		handler := handlers.UploadAPI("/", &auth.DummyAuth{}, storage.NewFilesystem(tempDir), newMetaStore(t, tempDir), noQuotas(), noSpaceLimit(), lock.NewMemory(), handlers.UploadLimits{MaxSize: 10, MaxAppendSize: 10}, maxExpiry)
 		body, writer := createMultipartBody("Hello, world!")
 		err = writer.Close()
 		if err != nil {
@@ -193,6 +246,103 @@ func TestUploadAPIHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("Invalid expiry date", func(t *testing.T) {
+		for _, date := range []string{"tomorrow", "2000-01-01", time.Now().Add(maxExpiry + 48*time.Hour).Format("2006-01-02")} {
+			body, writer := createMultipartBodyWithFields(map[string]string{"expiry_date": date}, "Hello, world!")
+			err = writer.Close()
+			if err != nil {
+				t.Fatalf("Failed closing writer: %v", err)
+			}
+
+			resp := mockUploadRequest(handler, body, writer, nil)
+			if resp.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, date, resp.Code)
+			}
+
+			b := resp.Body.Bytes()
+			if !strings.Contains(string(b), "Invalid expiry date") {
+				t.Errorf("Expected error to be \"Invalid expiry date\", got %s", b)
+			}
+		}
+	})
+
+	t.Run("Upload with expiry date", func(t *testing.T) {
+		defer func() {
+			err = clearFolder(filepath.Join(tempDir, hashedID))
+			if err != nil {
+				t.Fatalf("Failed clearing folder: %v", err)
+			}
+		}()
+
+		date := time.Now().Add(24 * time.Hour).UTC().Format("2006-01-02")
+		body, writer := createMultipartBodyWithFields(map[string]string{"expiry_date": date, "message": "Hi!", "max_downloads": "1"}, "Hello, world!")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockUploadRequest(handler, body, writer, nil)
+		if resp.Code != http.StatusSeeOther {
+			t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
+		}
+
+		publicID := path.Base(resp.Header().Get("Location"))
+		transfer, err := newMetaStore(t, tempDir).Resolve(publicID)
+		if err != nil {
+			t.Fatalf("Expected transfer metadata, got error: %v", err)
+		}
+
+		expected, _ := time.Parse("2006-01-02", date)
+		expected = expected.Add(24 * time.Hour)
+		if !transfer.Expiry.Equal(expected) {
+			t.Errorf("Expected expiry to be %s, got %s", expected, transfer.Expiry)
+		}
+		if transfer.State != meta.StateComplete || transfer.Size != 13 || transfer.Message != "Hi!" {
+			t.Errorf("Expected complete transfer of 13 bytes with message, got %+v", transfer)
+		}
+		if transfer.MaxDownloads != 1 {
+			t.Errorf("Expected maximum downloads to be 1, got %d", transfer.MaxDownloads)
+		}
+	})
+
+	t.Run("Invalid maximum downloads", func(t *testing.T) {
+		for _, maxDownloads := range []string{"once", "-1"} {
+			body, writer := createMultipartBodyWithFields(map[string]string{"max_downloads": maxDownloads}, "Hello, world!")
+			err = writer.Close()
+			if err != nil {
+				t.Fatalf("Failed closing writer: %v", err)
+			}
+
+			resp := mockUploadRequest(handler, body, writer, nil)
+			if resp.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, maxDownloads, resp.Code)
+			}
+
+			b := resp.Body.Bytes()
+			if !strings.Contains(string(b), "Invalid maximum downloads") {
+				t.Errorf("Expected error to be \"Invalid maximum downloads\", got %s", b)
+			}
+		}
+	})
+
+	t.Run("Message too long", func(t *testing.T) {
+		body, writer := createMultipartBodyWithFields(map[string]string{"message": strings.Repeat("a", 2001)}, "Hello, world!")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockUploadRequest(handler, body, writer, nil)
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+
+		b := resp.Body.Bytes()
+		if !strings.Contains(string(b), "Message too long") {
+			t.Errorf("Expected error to be \"Message too long\", got %s", b)
+		}
+	})
+
 	t.Run("Successful file upload", func(t *testing.T) {
 		defer func() {
 			err = clearFolder(filepath.Join(tempDir, hashedID))
@@ -224,10 +374,10 @@ func TestUploadAPIHandler(t *testing.T) {
 		switch {
 		case locationHeader == "":
 			t.Errorf("There was no location header in response!")
-		case !strings.Contains(locationHeader, hashedID):
-			t.Errorf("Expected location header to contain \"%s\", got \"%s\"", hashedID, locationHeader)
-		case strings.Count(locationHeader, "/") != 3:
-			t.Errorf("Expected location header to contain 3 `/`, instead got %d: \"%s\"", strings.Count(locationHeader, "/"), locationHeader)
+		case strings.Contains(locationHeader, hashedID):
+			t.Errorf("Expected location header to not reveal the user ID, got \"%s\"", locationHeader)
+		case strings.Count(locationHeader, "/") != 2:
+			t.Errorf("Expected location header to contain 2 `/`, instead got %d: \"%s\"", strings.Count(locationHeader, "/"), locationHeader)
 		case !strings.Contains(locationHeader, "/view/"):
 			t.Errorf("Expected location header to contain \"/view/\", instead got \"%s\"", locationHeader)
 		}
@@ -236,7 +386,7 @@ func TestUploadAPIHandler(t *testing.T) {
 
 	t.Run("Successful partial file upload", func(t *testing.T) {
 		defer func() {
-			err = clearFolder(filepath.Join(tempDir, hashedID))
+			err = clearFolder(stagingDir(tempDir, hashedID))
 			if err != nil {
 				t.Fatalf("Failed clearing folder: %v", err)
 			}
@@ -255,7 +405,7 @@ func TestUploadAPIHandler(t *testing.T) {
 			t.Errorf("Expected status %d, got %d", http.StatusAccepted, resp.Code)
 		}
 
-		files, err := os.ReadDir(path.Join(tempDir, hashedID))
+		files, err := os.ReadDir(stagingDir(tempDir, hashedID))
 		if err != nil {
 			t.Fatalf("Failed to read directory: %v", err)
 		}
@@ -272,10 +422,15 @@ func TestUploadAPIHandler(t *testing.T) {
 		case strings.Count(locationHeader, "/") != 2:
 			t.Errorf("Expected location header to contain 2 `/`, instead got %d: \"%s\"", strings.Count(locationHeader, "/"), locationHeader)
 		}
+
+		limit := resp.Header().Get("Upload-Limit")
+		if limit != "max-size=10485760, max-append-size=10485760" {
+			t.Errorf("Expected upload limit with total and append size, got \"%s\"", limit)
+		}
 	})
 }
 
-func TestChunkedUploadAPIHandler(t *testing.T) {
+func TestUploadLength(t *testing.T) {
 	tempDir, err := os.MkdirTemp("", "test_uploads")
 	if err != nil {
 		t.Fatalf("Failed to create temporary directory: %v", err)
@@ -286,282 +441,1407 @@ func TestChunkedUploadAPIHandler(t *testing.T) {
 		}
 	}()
 
-	handler := handlers.ChunkedUploadAPI("/", &auth.DummyAuth{}, tempDir, 10*1024*1024) // 10 MB limit
 	err = hash.Init(tempDir)
 	if err != nil {
 		t.Fatalf("Could not initialise hashing package: %v", err)
 	}
 
-	// Hash "dev" for test use
 	hashedID, err := hash.ToBase64("dev")
 	if err != nil {
 		t.Fatalf("Failed hashing dummy user ID: %v", err)
 	}
 
-	t.Run("No file ID", func(t *testing.T) {
-		body, writer := createMultipartBody("")
-		err = writer.Close()
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	limits := handlers.UploadLimits{MaxSize: 20, MaxAppendSize: 1024}
+	uploadHandler := handlers.UploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), lock.NewMemory(), limits, maxExpiry)
+	chunkHandler := handlers.ChunkedUploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), "", lock.NewMemory(), limits)
+
+	startUpload := func(t *testing.T, headers map[string]string) string {
+		body, writer := createMultipartBody("Hello, ")
+		err := writer.Close()
 		if err != nil {
 			t.Fatalf("Failed closing writer: %v", err)
 		}
 
-		resp := mockPartialUploadRequest(handler, "", body, writer, nil)
-		if resp.Code != http.StatusBadRequest {
-			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		headers["Upload-Complete"] = "0"
+		resp := mockUploadRequest(uploadHandler, body, writer, headers)
+		if resp.Code != http.StatusAccepted {
+			t.Fatalf("Expected status %d, got %d", http.StatusAccepted, resp.Code)
 		}
 
-		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "File ID expected") {
-			t.Errorf("Expected error to be \"File ID expected\", got \"%s\"", b)
-		}
-	})
+		return strings.TrimPrefix(resp.Header().Get("Location"), "/upload/")
+	}
 
-	t.Run("Fail authentication", func(t *testing.T) {
-		handler := handlers.ChunkedUploadAPI("/", &auth.ProxyAuth{}, tempDir, 10*1024*1024)
-		body, writer := createMultipartBody("")
-		err = writer.Close()
+	appendChunk := func(fileID string, data string, headers map[string]string) *httptest.ResponseRecorder {
+		body, writer := createMultipartBody(data)
+		_ = writer.Close()
+
+		headers["Upload-Offset"] = "7"
+		return mockPartialUploadRequest(chunkHandler, fileID, body, writer, headers)
+	}
+
+	t.Run("Declared length too large", func(t *testing.T) {
+		body, writer := createMultipartBody("Hello, ")
+		err := writer.Close()
 		if err != nil {
 			t.Fatalf("Failed closing writer: %v", err)
 		}
 
-		resp := mockPartialUploadRequest(handler, "id", body, writer, nil)
-		if resp.Code != http.StatusUnauthorized {
-			t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, resp.Code)
-		}
-
-		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "You're not authenticated") {
-			t.Errorf("Expected error to be \"You're not authenticated\", got \"%s\"", b)
+		resp := mockUploadRequest(uploadHandler, body, writer, map[string]string{"Upload-Length": "21"})
+		if resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.Code)
 		}
 	})
 
-	t.Run("Fail hashing user ID", func(t *testing.T) {
-		hash.ResetKeyForTest()
-		defer func() {
-			err = hash.Init(tempDir)
-			if err != nil {
-				t.Fatalf("Failed initialising hashing package: %v", err)
-			}
-		}()
-
-		body, writer := createMultipartBody("")
-		err = writer.Close()
+	t.Run("Invalid declared length", func(t *testing.T) {
+		body, writer := createMultipartBody("Hello, ")
+		err := writer.Close()
 		if err != nil {
 			t.Fatalf("Failed closing writer: %v", err)
 		}
 
-		resp := mockPartialUploadRequest(handler, "id", body, writer, nil)
-		if resp.Code != http.StatusInternalServerError {
-			t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
-		}
-
-		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "Failed creating user ID") {
-			t.Errorf("Expected error to be \"Failed creating user ID\", got %s", b)
+		resp := mockUploadRequest(uploadHandler, body, writer, map[string]string{"Upload-Length": "-1"})
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
 		}
 	})
 
-	t.Run("Too big file size", func(t *testing.T) {
-		handler := handlers.ChunkedUploadAPI("/", &auth.DummyAuth{}, tempDir, 10)
-		body, writer := createMultipartBody("Hello, world!")
-		err = writer.Close()
+	t.Run("Complete upload shorter than declared", func(t *testing.T) {
+		body, writer := createMultipartBody("Hello, ")
+		err := writer.Close()
 		if err != nil {
 			t.Fatalf("Failed closing writer: %v", err)
 		}
 
-		resp := mockPartialUploadRequest(handler, "id", body, writer, nil)
+		resp := mockUploadRequest(uploadHandler, body, writer, map[string]string{"Upload-Length": "13"})
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+	})
+
+	t.Run("Exceeds maximum size", func(t *testing.T) {
+		fileID := startUpload(t, map[string]string{})
+
+		resp := appendChunk(fileID, "world, hello!!", map[string]string{"Upload-Complete": "0"})
 		if resp.Code != http.StatusRequestEntityTooLarge {
 			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.Code)
 		}
 
-		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "Upload file size too large") {
-			t.Errorf("Expected error to be \"Upload file size too large\", got %s", b)
+		info, err := store.Stat(hashedID, fileID)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if info.Size != 7 {
+			t.Errorf("Expected upload to be unchanged, got %d bytes", info.Size)
 		}
 	})
 
-	t.Run("Missing upload offset", func(t *testing.T) {
-		body, writer := createMultipartBody("Hello, world!")
-		err = writer.Close()
+	t.Run("Exceeds declared length", func(t *testing.T) {
+		fileID := startUpload(t, map[string]string{"Upload-Length": "10"})
+
+		transfer, err := metaStore.Get(hashedID, fileID)
 		if err != nil {
-			t.Fatalf("Failed closing writer: %v", err)
+			t.Fatalf("Expected transfer metadata, got error: %v", err)
+		}
+		if transfer.DeclaredSize != 10 {
+			t.Errorf("Expected declared size 10, got %d", transfer.DeclaredSize)
 		}
 
-		resp := mockPartialUploadRequest(handler, "id", body, writer, nil)
+		resp := appendChunk(fileID, "world!", map[string]string{"Upload-Complete": "0"})
 		if resp.Code != http.StatusBadRequest {
 			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
 		}
-
-		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "Missing offset") {
-			t.Errorf("Expected error to be \"Missing offset\", got %s", b)
-		}
 	})
 
-	t.Run("Invalid upload offset", func(t *testing.T) {
-		body, writer := createMultipartBody("Hello, world!")
-		err = writer.Close()
-		if err != nil {
-			t.Fatalf("Failed closing writer: %v", err)
-		}
+	t.Run("Changed declared length", func(t *testing.T) {
+		fileID := startUpload(t, map[string]string{"Upload-Length": "13"})
 
-		resp := mockPartialUploadRequest(handler, "id", body, writer, map[string]string{
-			"Upload-Offset": "fail lol",
-		})
+		resp := appendChunk(fileID, "world!", map[string]string{"Upload-Length": "14"})
 		if resp.Code != http.StatusBadRequest {
 			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
 		}
-
-		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "Invalid offset") {
-			t.Errorf("Expected error to be \"Invalid offset\", got %s", b)
-		}
 	})
 
-	t.Run("Upload with no file", func(t *testing.T) {
-		body := &bytes.Buffer{}
-		writer := multipart.NewWriter(body)
-		_ = writer.Close()
-
-		resp := mockPartialUploadRequest(handler, "id", body, writer, map[string]string{
-			"Upload-Offset": "1",
-		})
-		if resp.Code != http.StatusInternalServerError {
-			t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
-		}
+	t.Run("Matches declared length", func(t *testing.T) {
+		fileID := startUpload(t, map[string]string{"Upload-Length": "13"})
 
-		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "Lost the file") {
-			t.Errorf("Expected error to be \"Lost the file\", got %s", b)
+		resp := appendChunk(fileID, "world!", map[string]string{})
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
 		}
 	})
+}
 
-	t.Run("File does not exist", func(t *testing.T) {
-		body, writer := createMultipartBody("Hello, world!")
-		err = writer.Close()
-		if err != nil {
-			t.Fatalf("Failed closing writer: %v", err)
+func TestUploadQuota(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
 		}
+	}()
 
-		resp := mockPartialUploadRequest(handler, "id", body, writer, map[string]string{
-			"Upload-Offset": "1",
-		})
-		if resp.Code != http.StatusInternalServerError {
-			t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
-		}
+	err = hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
 
-		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "Failed handling existing file upload") {
-			t.Errorf("Expected error to be \"Failed handling existing file upload\", got %s", b)
-		}
-	})
+	hashedID, err := hash.ToBase64("dev")
+	if err != nil {
+		t.Fatalf("Failed hashing dummy user ID: %v", err)
+	}
 
-	t.Run("Success partial upload", func(t *testing.T) {
-		defer func() {
-			err = clearFolder(filepath.Join(tempDir, hashedID))
-			if err != nil {
-				t.Fatalf("Failed clearing folder: %v", err)
-			}
-		}()
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	quotas := quota.New(quota.Limits{Default: 1000, Users: map[string]int64{"dev": 20}}, store, time.Hour)
+	uploadHandler := handlers.UploadAPI("/", &auth.DummyAuth{}, store, metaStore, quotas, noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry)
+	chunkHandler := handlers.ChunkedUploadAPI("/", &auth.DummyAuth{}, store, metaStore, quotas, noSpaceLimit(), "", lock.NewMemory(), uploadLimits)
 
-		err = createFile(t, filepath.Join(tempDir, hashedID, "file_id"), "Hello, ")
-		body, writer := createMultipartBody("world!")
-		err = writer.Close()
+	upload := func(data string, headers map[string]string) *httptest.ResponseRecorder {
+		body, writer := createMultipartBody(data)
+		_ = writer.Close()
+		return mockUploadRequest(uploadHandler, body, writer, headers)
+	}
+
+	usage := func(t *testing.T) int64 {
+		files, err := store.List(hashedID)
 		if err != nil {
-			t.Fatalf("Failed closing writer: %v", err)
+			t.Fatalf("Failed listing files: %v", err)
 		}
 
-		resp := mockPartialUploadRequest(handler, "file_id", body, writer, map[string]string{
-			"Upload-Offset": "7",
-		})
+		var used int64
+		for _, file := range files {
+			used += file.Size
+		}
+		return used
+	}
+
+	t.Run("Within quota", func(t *testing.T) {
+		resp := upload("Hello, world!", nil)
 		if resp.Code != http.StatusSeeOther {
 			t.Errorf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
+		}
+	})
 
-			b := resp.Body.Bytes()
-			t.Errorf("Response bytes: %s", b)
+	t.Run("Declared length exceeds quota", func(t *testing.T) {
+		resp := upload("Hello, ", map[string]string{"Upload-Length": "8"})
+		if resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.Code)
 		}
+		if !strings.Contains(resp.Body.String(), "Storage quota exceeded") {
+			t.Errorf("Expected error to be \"Storage quota exceeded\", got %s", resp.Body.String())
+		}
+	})
 
-		files, err := os.ReadDir(path.Join(tempDir, hashedID))
+	t.Run("Upload exceeds quota", func(t *testing.T) {
+		resp := upload("Hello, world!", nil)
+		if resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.Code)
+		}
+		if used := usage(t); used != 13 {
+			t.Errorf("Expected nothing stored beyond the first upload, got %d bytes", used)
+		}
+	})
+
+	var partialID string
+	t.Run("Chunk exceeds quota", func(t *testing.T) {
+		resp := upload("Hello, ", map[string]string{"Upload-Complete": "0"})
+		if resp.Code != http.StatusAccepted {
+			t.Fatalf("Expected status %d, got %d", http.StatusAccepted, resp.Code)
+		}
+		fileID := strings.TrimPrefix(resp.Header().Get("Location"), "/upload/")
+
+		body, writer := createMultipartBody("world!")
+		_ = writer.Close()
+		resp = mockPartialUploadRequest(chunkHandler, fileID, body, writer, map[string]string{"Upload-Offset": "7"})
+		if resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.Code)
+		}
+		if !strings.Contains(resp.Body.String(), "Storage quota exceeded") {
+			t.Errorf("Expected error to be \"Storage quota exceeded\", got %s", resp.Body.String())
+		}
+		if used := usage(t); used > 20 {
+			t.Errorf("Expected at most 20 bytes stored, got %d", used)
+		}
+		partialID = fileID
+	})
+
+	t.Run("Quota used", func(t *testing.T) {
+		resp := upload("", map[string]string{"Upload-Length": "1"})
+		if resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.Code)
+		}
+	})
+
+	t.Run("Cancelled upload frees quota", func(t *testing.T) {
+		cancelHandler := handlers.CancelUploadAPI(&auth.DummyAuth{}, store, metaStore, quotas, lock.NewMemory())
+		resp := mockRequest(cancelHandler, "DELETE", "/upload/"+partialID, nil, map[string]string{"fileID": partialID})
+		if resp.Code != http.StatusNoContent {
+			t.Fatalf("Expected status %d, got %d", http.StatusNoContent, resp.Code)
+		}
+
+		resp = upload("Hello, ", map[string]string{"Upload-Length": "7"})
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("Expected status %d, got %d: %s", http.StatusSeeOther, resp.Code, resp.Body.String())
+		}
+	})
+
+	t.Run("Concurrent uploads", func(t *testing.T) {
+		store := storage.NewMemory()
+		quotas := quota.New(quota.Limits{Default: 20}, store, time.Hour)
+		handler := handlers.UploadAPI("/", &auth.DummyAuth{}, store, metaStore, quotas, noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry)
+
+		rawUpload := func(body io.Reader) *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("POST", "/upload", body)
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Upload-Length", "15")
+			req.ContentLength = 15
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+			return resp
+		}
+
+		// the first upload is still receiving its data, the quota it declared is reserved
+		pr, pw := io.Pipe()
+		first := make(chan *httptest.ResponseRecorder)
+		go func() {
+			first <- rawUpload(pr)
+		}()
+		_, err := pw.Write([]byte("Hello, "))
 		if err != nil {
-			t.Fatalf("Failed to read directory: %v", err)
+			t.Fatalf("Failed writing upload data: %v", err)
 		}
-		if len(files) != 1 {
-			t.Errorf("Expected 1 file in directory, found %d", len(files))
+
+		resp := rawUpload(strings.NewReader("Hello, world!!!"))
+		if resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.Code)
 		}
 
-		locationHeader := resp.Header().Get("Location")
-		switch {
-		case locationHeader == "":
-			t.Errorf("There was no location header in response!")
-		case !strings.Contains(locationHeader, hashedID):
-			t.Errorf("Expected location header to contain \"%s\", got \"%s\"", hashedID, locationHeader)
-		case strings.Count(locationHeader, "/") != 3:
-			t.Errorf("Expected location header to contain 3 `/`, instead got %d: \"%s\"", strings.Count(locationHeader, "/"), locationHeader)
-		case !strings.Contains(locationHeader, "/view/"):
-			t.Errorf("Expected location header to contain \"/view/\", instead got \"%s\"", locationHeader)
+		_, _ = pw.Write([]byte("world!!!"))
+		_ = pw.Close()
+		resp = <-first
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("Expected status %d, got %d: %s", http.StatusSeeOther, resp.Code, resp.Body.String())
+		}
+	})
+}
+
+// freeSpace is storage reporting a fixed amount of free space
+type freeSpace int64
+
+func (f freeSpace) FreeSpace() (int64, error) {
+	return int64(f), nil
+}
+
+func TestUploadInsufficientStorage(t *testing.T) {
+	tempDir := t.TempDir()
+	err := hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	space := diskspace.New(freeSpace(100), 80, 5*time.Minute)
+	handler := handlers.UploadAPI("/", &auth.DummyAuth{}, storage.NewMemory(), newMetaStore(t, tempDir), noQuotas(), space, lock.NewMemory(), uploadLimits, maxExpiry)
+
+	t.Run("Within free space", func(t *testing.T) {
+		body, writer := createMultipartBody("Hello, world!")
+		_ = writer.Close()
+		resp := mockUploadRequest(handler, body, writer, map[string]string{"Upload-Length": "13"})
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
 		}
+	})
 
-		b, err := os.ReadFile(filepath.Join(tempDir, hashedID, files[0].Name()))
+	t.Run("Declared length exceeds free space", func(t *testing.T) {
+		body, writer := createMultipartBody("Hello, world!")
+		_ = writer.Close()
+		resp := mockUploadRequest(handler, body, writer, map[string]string{"Upload-Length": "21"})
+		if resp.Code != http.StatusInsufficientStorage {
+			t.Errorf("Expected status %d, got %d", http.StatusInsufficientStorage, resp.Code)
+		}
+		if retryAfter := resp.Header().Get("Retry-After"); retryAfter != "300" {
+			t.Errorf("Expected Retry-After to be 300, got %q", retryAfter)
+		}
+	})
+
+	t.Run("Reservation released", func(t *testing.T) {
+		status, err := space.Status()
 		if err != nil {
-			t.Fatalf("Failed opening file! %v", err)
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if status.Reserved != 0 {
+			t.Errorf("Expected no space reserved after uploads, got %d", status.Reserved)
 		}
+	})
+}
 
-		if string(b) != "Hello, world!" {
-			t.Errorf("Expected file contents to be \"Hello, world!\", got \"%s\"", b)
+func TestChunkedUploadAPIHandler(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	}()
+
+	locks := lock.NewMemory()
+	handler := handlers.ChunkedUploadAPI("/", &auth.DummyAuth{}, storage.NewFilesystem(tempDir), newMetaStore(t, tempDir), noQuotas(), noSpaceLimit(), "", locks, uploadLimits)
+	err = hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	// Hash "dev" for test use
+	hashedID, err := hash.ToBase64("dev")
+	if err != nil {
+		t.Fatalf("Failed hashing dummy user ID: %v", err)
+	}
+
+	t.Run("No file ID", func(t *testing.T) {
+		body, writer := createMultipartBody("")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockPartialUploadRequest(handler, "", body, writer, nil)
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+
+		b := resp.Body.Bytes()
+		if !strings.Contains(string(b), "File ID expected") {
+			t.Errorf("Expected error to be \"File ID expected\", got \"%s\"", b)
 		}
 	})
 
-	t.Run("Success partial upload, non complete", func(t *testing.T) {
+	t.Run("Fail authentication", func(t *testing.T) {
+		handler := handlers.ChunkedUploadAPI("/", &auth.ProxyAuth{}, storage.NewFilesystem(tempDir), newMetaStore(t, tempDir), noQuotas(), noSpaceLimit(), "", lock.NewMemory(), uploadLimits)
+		body, writer := createMultipartBody("")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockPartialUploadRequest(handler, "id", body, writer, nil)
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, resp.Code)
+		}
+
+		b := resp.Body.Bytes()
+		if !strings.Contains(string(b), "You're not authenticated") {
+			t.Errorf("Expected error to be \"You're not authenticated\", got \"%s\"", b)
+		}
+	})
+
+	t.Run("Fail hashing user ID", func(t *testing.T) {
+		hash.ResetKeyForTest()
 		defer func() {
-			err = clearFolder(filepath.Join(tempDir, hashedID))
+			err = hash.Init(tempDir)
 			if err != nil {
-				t.Fatalf("Failed clearing folder: %v", err)
+				t.Fatalf("Failed initialising hashing package: %v", err)
 			}
 		}()
 
-		err = createFile(t, filepath.Join(tempDir, hashedID, "file_id"), "Hello, ")
-		body, writer := createMultipartBody("world!")
+		body, writer := createMultipartBody("")
 		err = writer.Close()
 		if err != nil {
 			t.Fatalf("Failed closing writer: %v", err)
 		}
 
-		resp := mockPartialUploadRequest(handler, "file_id", body, writer, map[string]string{
-			"Upload-Offset":   "7",
-			"Upload-Complete": "0",
-		})
-		if resp.Code != http.StatusAccepted {
-			t.Errorf("Expected status %d, got %d", http.StatusAccepted, resp.Code)
+		resp := mockPartialUploadRequest(handler, "id", body, writer, nil)
+		if resp.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
+		}
 
-			b := resp.Body.Bytes()
-			t.Errorf("Response bytes: %s", b)
+		b := resp.Body.Bytes()
+		if !strings.Contains(string(b), "Failed creating user ID") {
+			t.Errorf("Expected error to be \"Failed creating user ID\", got %s", b)
 		}
+	})
 
-		files, err := os.ReadDir(path.Join(tempDir, hashedID))
+	t.Run("Too big file size", func(t *testing.T) {
+		handler := handlers.ChunkedUploadAPI("/", &auth.DummyAuth{}, storage.NewFilesystem(tempDir), newMetaStore(t, tempDir), noQuotas(), noSpaceLimit(), "", lock.NewMemory(), handlers.UploadLimits{MaxSize: 10, MaxAppendSize: 10})
+		body, writer := createMultipartBody("Hello, world!")
+		err = writer.Close()
 		if err != nil {
-			t.Fatalf("Failed to read directory: %v", err)
+			t.Fatalf("Failed closing writer: %v", err)
 		}
-		if len(files) != 1 {
-			t.Errorf("Expected 1 file in directory, found %d", len(files))
+
+		resp := mockPartialUploadRequest(handler, "id", body, writer, nil)
+		if resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.Code)
 		}
 
-		locationHeader := resp.Header().Get("Location")
-		switch {
-		case locationHeader == "":
-			t.Errorf("There was no location header in response!")
-		case !strings.Contains(locationHeader, "/upload/"):
-			t.Errorf("Expected location header to contain \"/upload/\", got \"%s\"", locationHeader)
-		case strings.Count(locationHeader, "/") != 2:
-			t.Errorf("Expected location header to contain 2 `/`, instead got %d: \"%s\"", strings.Count(locationHeader, "/"), locationHeader)
+		b := resp.Body.Bytes()
+		if !strings.Contains(string(b), "Upload file size too large") {
+			t.Errorf("Expected error to be \"Upload file size too large\", got %s", b)
 		}
+	})
 
-		b, err := os.ReadFile(filepath.Join(tempDir, hashedID, files[0].Name()))
+	t.Run("Missing upload offset", func(t *testing.T) {
+		body, writer := createMultipartBody("Hello, world!")
+		err = writer.Close()
 		if err != nil {
-			t.Fatalf("Failed opening file! %v", err)
+			t.Fatalf("Failed closing writer: %v", err)
 		}
 
-		if string(b) != "Hello, world!" {
-			t.Errorf("Expected file contents to be \"Hello, world!\", got \"%s\"", b)
+		resp := mockPartialUploadRequest(handler, "id", body, writer, nil)
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+
+		b := resp.Body.Bytes()
+		if !strings.Contains(string(b), "Missing offset") {
+			t.Errorf("Expected error to be \"Missing offset\", got %s", b)
+		}
+	})
+
+	t.Run("Invalid upload offset", func(t *testing.T) {
+		body, writer := createMultipartBody("Hello, world!")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockPartialUploadRequest(handler, "id", body, writer, map[string]string{
+			"Upload-Offset": "fail lol",
+		})
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+
+		b := resp.Body.Bytes()
+		if !strings.Contains(string(b), "Invalid offset") {
+			t.Errorf("Expected error to be \"Invalid offset\", got %s", b)
+		}
+	})
+
+	t.Run("Upload with no file", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		_ = writer.Close()
+
+		resp := mockPartialUploadRequest(handler, "id", body, writer, map[string]string{
+			"Upload-Offset": "1",
+		})
+		if resp.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
+		}
+
+		b := resp.Body.Bytes()
+		if !strings.Contains(string(b), "Lost the file") {
+			t.Errorf("Expected error to be \"Lost the file\", got %s", b)
+		}
+	})
+
+	t.Run("File does not exist", func(t *testing.T) {
+		body, writer := createMultipartBody("Hello, world!")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockPartialUploadRequest(handler, "id", body, writer, map[string]string{
+			"Upload-Offset": "1",
+		})
+		if resp.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
+		}
+
+		b := resp.Body.Bytes()
+		if !strings.Contains(string(b), "Failed handling existing file upload") {
+			t.Errorf("Expected error to be \"Failed handling existing file upload\", got %s", b)
 		}
 	})
+
+	t.Run("Success partial upload", func(t *testing.T) {
+		defer func() {
+			err = clearFolder(filepath.Join(tempDir, hashedID))
+			if err != nil {
+				t.Fatalf("Failed clearing folder: %v", err)
+			}
+
+			err = newMetaStore(t, tempDir).Delete(hashedID, "file_id")
+			if err != nil {
+				t.Fatalf("Failed deleting transfer metadata: %v", err)
+			}
+		}()
+
+		err = createFile(t, filepath.Join(stagingDir(tempDir, hashedID), "file_id"), "Hello, ")
+		body, writer := createMultipartBody("world!")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockPartialUploadRequest(handler, "file_id", body, writer, map[string]string{
+			"Upload-Offset": "7",
+		})
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
+
+			b := resp.Body.Bytes()
+			t.Errorf("Response bytes: %s", b)
+		}
+
+		files, err := os.ReadDir(path.Join(tempDir, hashedID))
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+		if len(files) != 1 {
+			t.Errorf("Expected 1 file in directory, found %d", len(files))
+		}
+
+		locationHeader := resp.Header().Get("Location")
+		switch {
+		case locationHeader == "":
+			t.Errorf("There was no location header in response!")
+		case strings.Contains(locationHeader, hashedID):
+			t.Errorf("Expected location header to not reveal the user ID, got \"%s\"", locationHeader)
+		case strings.Count(locationHeader, "/") != 2:
+			t.Errorf("Expected location header to contain 2 `/`, instead got %d: \"%s\"", strings.Count(locationHeader, "/"), locationHeader)
+		case !strings.Contains(locationHeader, "/view/"):
+			t.Errorf("Expected location header to contain \"/view/\", instead got \"%s\"", locationHeader)
+		}
+
+		b, err := os.ReadFile(filepath.Join(tempDir, hashedID, files[0].Name()))
+		if err != nil {
+			t.Fatalf("Failed opening file! %v", err)
+		}
+
+		if string(b) != "Hello, world!" {
+			t.Errorf("Expected file contents to be \"Hello, world!\", got \"%s\"", b)
+		}
+
+		transfer, err := newMetaStore(t, tempDir).Get(hashedID, "file_id")
+		if err != nil {
+			t.Fatalf("Expected transfer metadata, got error: %v", err)
+		}
+		if transfer.State != meta.StateComplete || transfer.Size != 13 {
+			t.Errorf("Expected complete transfer of 13 bytes, got %+v", transfer)
+		}
+	})
+
+	t.Run("Success partial upload, non complete", func(t *testing.T) {
+		defer func() {
+			err = clearFolder(stagingDir(tempDir, hashedID))
+			if err != nil {
+				t.Fatalf("Failed clearing folder: %v", err)
+			}
+		}()
+
+		err = createFile(t, filepath.Join(stagingDir(tempDir, hashedID), "file_id"), "Hello, ")
+		body, writer := createMultipartBody("world!")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockPartialUploadRequest(handler, "file_id", body, writer, map[string]string{
+			"Upload-Offset":   "7",
+			"Upload-Complete": "0",
+		})
+		if resp.Code != http.StatusAccepted {
+			t.Errorf("Expected status %d, got %d", http.StatusAccepted, resp.Code)
+
+			b := resp.Body.Bytes()
+			t.Errorf("Response bytes: %s", b)
+		}
+
+		files, err := os.ReadDir(stagingDir(tempDir, hashedID))
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+		if len(files) != 1 {
+			t.Errorf("Expected 1 file in directory, found %d", len(files))
+		}
+
+		locationHeader := resp.Header().Get("Location")
+		switch {
+		case locationHeader == "":
+			t.Errorf("There was no location header in response!")
+		case !strings.Contains(locationHeader, "/upload/"):
+			t.Errorf("Expected location header to contain \"/upload/\", got \"%s\"", locationHeader)
+		case strings.Count(locationHeader, "/") != 2:
+			t.Errorf("Expected location header to contain 2 `/`, instead got %d: \"%s\"", strings.Count(locationHeader, "/"), locationHeader)
+		}
+
+		b, err := os.ReadFile(filepath.Join(stagingDir(tempDir, hashedID), files[0].Name()))
+		if err != nil {
+			t.Fatalf("Failed opening file! %v", err)
+		}
+
+		if string(b) != "Hello, world!" {
+			t.Errorf("Expected file contents to be \"Hello, world!\", got \"%s\"", b)
+		}
+	})
+
+	t.Run("Mismatching upload offset", func(t *testing.T) {
+		defer func() {
+			err = clearFolder(stagingDir(tempDir, hashedID))
+			if err != nil {
+				t.Fatalf("Failed clearing folder: %v", err)
+			}
+		}()
+
+		err = createFile(t, filepath.Join(stagingDir(tempDir, hashedID), "mismatch_id"), "Hello, ")
+		body, writer := createMultipartBody("world!")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockPartialUploadRequest(handler, "mismatch_id", body, writer, map[string]string{
+			"Upload-Offset": "3",
+		})
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+		}
+		if offset := resp.Header().Get("Upload-Offset"); offset != "7" {
+			t.Errorf("Expected upload offset 7, got \"%s\"", offset)
+		}
+		if b := resp.Body.String(); !strings.Contains(b, "\"expected-offset\":7") {
+			t.Errorf("Expected problem details with expected offset, got \"%s\"", b)
+		}
+
+		b, err := os.ReadFile(filepath.Join(stagingDir(tempDir, hashedID), "mismatch_id"))
+		if err != nil {
+			t.Fatalf("Failed opening file! %v", err)
+		}
+		if string(b) != "Hello, " {
+			t.Errorf("Expected file to be unchanged, got \"%s\"", b)
+		}
+	})
+
+	t.Run("Chunk exceeds declared length", func(t *testing.T) {
+		defer func() {
+			err = clearFolder(stagingDir(tempDir, hashedID))
+			if err != nil {
+				t.Fatalf("Failed clearing folder: %v", err)
+			}
+		}()
+
+		err = createFile(t, filepath.Join(stagingDir(tempDir, hashedID), "long_id"), "Hello, ")
+		body, writer := createMultipartBody("world!")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockPartialUploadRequest(handler, "long_id", body, writer, map[string]string{
+			"Upload-Offset": "7",
+			"Upload-Length": "10",
+		})
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+
+		b, err := os.ReadFile(filepath.Join(stagingDir(tempDir, hashedID), "long_id"))
+		if err != nil {
+			t.Fatalf("Failed opening file! %v", err)
+		}
+		if string(b) != "Hello, " {
+			t.Errorf("Expected the rejected chunk to be discarded, got \"%s\"", b)
+		}
+	})
+
+	t.Run("Upload locked", func(t *testing.T) {
+		defer func() {
+			err = clearFolder(stagingDir(tempDir, hashedID))
+			if err != nil {
+				t.Fatalf("Failed clearing folder: %v", err)
+			}
+		}()
+
+		unlock, err := locks.TryLock(hashedID + "/locked_id")
+		if err != nil {
+			t.Fatalf("Failed locking upload: %v", err)
+		}
+		defer unlock()
+
+		err = createFile(t, filepath.Join(stagingDir(tempDir, hashedID), "locked_id"), "Hello, ")
+		body, writer := createMultipartBody("world!")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockPartialUploadRequest(handler, "locked_id", body, writer, map[string]string{
+			"Upload-Offset": "7",
+		})
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+		}
+		if offset := resp.Header().Get("Upload-Offset"); offset != "" {
+			t.Errorf("Expected no upload offset while another request appends, got \"%s\"", offset)
+		}
+	})
+
+	t.Run("Upload already complete", func(t *testing.T) {
+		defer func() {
+			err = clearFolder(filepath.Join(tempDir, hashedID))
+			if err != nil {
+				t.Fatalf("Failed clearing folder: %v", err)
+			}
+		}()
+
+		err = createFile(t, filepath.Join(tempDir, hashedID, "complete_id"), "Hello, ")
+		err = newMetaStore(t, tempDir).Put(meta.Transfer{UserID: hashedID, FileID: "complete_id", State: meta.StateComplete, Size: 7})
+		if err != nil {
+			t.Fatalf("Failed storing transfer metadata: %v", err)
+		}
+
+		body, writer := createMultipartBody("world!")
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		resp := mockPartialUploadRequest(handler, "complete_id", body, writer, map[string]string{
+			"Upload-Offset": "7",
+		})
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+		}
+
+		b, err := os.ReadFile(filepath.Join(tempDir, hashedID, "complete_id"))
+		if err != nil {
+			t.Fatalf("Failed opening file! %v", err)
+		}
+		if string(b) != "Hello, " {
+			t.Errorf("Expected file to be unchanged, got \"%s\"", b)
+		}
+	})
+}
+
+func TestUploadResumptionSupported(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	}()
+
+	err = hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	server := httptest.NewServer(handlers.UploadAPI("/", &auth.DummyAuth{}, storage.NewMemory(), newMetaStore(t, tempDir), noQuotas(), noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry))
+	defer server.Close()
+
+	send := func(t *testing.T, fields map[string]string) (*http.Response, string) {
+		body, writer := createMultipartBodyWithFields(fields, "Hello, world!")
+		err := writer.Close()
+		if err != nil {
+			t.Fatalf("Failed closing writer: %v", err)
+		}
+
+		interimLocation := ""
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == 104 {
+					interimLocation = header.Get("Location")
+				}
+				return nil
+			},
+		}
+
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "POST", server.URL+"/upload", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Upload-Draft-Interop-Version", "7")
+		req.Header.Set("Upload-Complete", "?0")
+
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Failed sending request: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+
+		return resp, interimLocation
+	}
+
+	t.Run("Accepted", func(t *testing.T) {
+		resp, interimLocation := send(t, map[string]string{})
+
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("Expected status %d, got %d", http.StatusAccepted, resp.StatusCode)
+		}
+		if !strings.HasPrefix(interimLocation, "/upload/") {
+			t.Errorf("Expected 104 response with upload location, got \"%s\"", interimLocation)
+		}
+		if location := resp.Header.Get("Location"); location != interimLocation {
+			t.Errorf("Expected final location \"%s\", got \"%s\"", interimLocation, location)
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		resp, interimLocation := send(t, map[string]string{"expiry_date": "tomorrow"})
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+		}
+		if interimLocation != "" {
+			t.Errorf("Expected no 104 response for a rejected upload, got location \"%s\"", interimLocation)
+		}
+	})
+}
+
+func TestUploadOffsetAPI(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	}()
+
+	err = hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	hashedID, err := hash.ToBase64("dev")
+	if err != nil {
+		t.Fatalf("Failed hashing dummy user ID: %v", err)
+	}
+
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	for fileID, state := range map[string]meta.State{"partial": meta.StateInProgress, "complete": meta.StateComplete} {
+		_, err = store.Create(hashedID, fileID, strings.NewReader("Hello, "))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		err = metaStore.Put(meta.Transfer{UserID: hashedID, FileID: fileID, State: state, Size: 7})
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+	}
+
+	handler := handlers.UploadOffsetAPI(&auth.DummyAuth{}, store, metaStore, uploadLimits)
+
+	t.Run("Fail authentication", func(t *testing.T) {
+		handler := handlers.UploadOffsetAPI(&auth.ProxyAuth{}, store, metaStore, uploadLimits)
+		resp := mockRequest(handler, "HEAD", "/upload/partial", nil, map[string]string{"fileID": "partial"})
+
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, resp.Code)
+		}
+	})
+
+	t.Run("Upload not found", func(t *testing.T) {
+		resp := mockRequest(handler, "HEAD", "/upload/hi", nil, map[string]string{"fileID": "hi"})
+
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
+		}
+	})
+
+	t.Run("Upload in progress", func(t *testing.T) {
+		resp := mockRequest(handler, "HEAD", "/upload/partial", nil, map[string]string{"fileID": "partial"})
+
+		if resp.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d", http.StatusNoContent, resp.Code)
+		}
+		if offset := resp.Header().Get("Upload-Offset"); offset != "7" {
+			t.Errorf("Expected upload offset 7, got \"%s\"", offset)
+		}
+		if complete := resp.Header().Get("Upload-Complete"); complete != "?0" {
+			t.Errorf("Expected upload to be incomplete, got \"%s\"", complete)
+		}
+		if cache := resp.Header().Get("Cache-Control"); cache != "no-store" {
+			t.Errorf("Expected Cache-Control \"no-store\", got \"%s\"", cache)
+		}
+	})
+
+	t.Run("Upload complete", func(t *testing.T) {
+		resp := mockRequest(handler, "HEAD", "/upload/complete", nil, map[string]string{"fileID": "complete"})
+
+		if resp.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d", http.StatusNoContent, resp.Code)
+		}
+		if complete := resp.Header().Get("Upload-Complete"); complete != "?1" {
+			t.Errorf("Expected upload to be complete, got \"%s\"", complete)
+		}
+	})
+}
+
+func TestCancelUploadAPI(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	}()
+
+	err = hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	hashedID, err := hash.ToBase64("dev")
+	if err != nil {
+		t.Fatalf("Failed hashing dummy user ID: %v", err)
+	}
+
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	for fileID, state := range map[string]meta.State{"partial": meta.StateInProgress, "complete": meta.StateComplete} {
+		_, err = store.Create(hashedID, fileID, strings.NewReader("Hello, "))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		err = metaStore.Put(meta.Transfer{UserID: hashedID, FileID: fileID, State: state, Size: 7})
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+	}
+
+	handler := handlers.CancelUploadAPI(&auth.DummyAuth{}, store, metaStore, noQuotas(), lock.NewMemory())
+
+	t.Run("Upload not found", func(t *testing.T) {
+		resp := mockRequest(handler, "DELETE", "/upload/hi", nil, map[string]string{"fileID": "hi"})
+
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
+		}
+	})
+
+	t.Run("Upload complete", func(t *testing.T) {
+		resp := mockRequest(handler, "DELETE", "/upload/complete", nil, map[string]string{"fileID": "complete"})
+
+		if resp.Code != http.StatusConflict {
+			t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+		}
+
+		_, err := store.Stat(hashedID, "complete")
+		if err != nil {
+			t.Errorf("Expected complete file to still exist, got %v", err)
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		resp := mockRequest(handler, "DELETE", "/upload/partial", nil, map[string]string{"fileID": "partial"})
+
+		if resp.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, got %d", http.StatusNoContent, resp.Code)
+		}
+
+		_, err := store.Stat(hashedID, "partial")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected file to be deleted, got %v", err)
+		}
+
+		transfer, err := metaStore.Get(hashedID, "partial")
+		if err != nil {
+			t.Fatalf("Expected transfer metadata, got error: %v", err)
+		}
+		if transfer.State != meta.StateCancelled {
+			t.Errorf("Expected cancelled transfer, got %+v", transfer)
+		}
+	})
+}
+
+func TestRawUpload(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	}()
+
+	err = hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	hashedID, err := hash.ToBase64("dev")
+	if err != nil {
+		t.Fatalf("Failed hashing dummy user ID: %v", err)
+	}
+
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	uploadHandler := handlers.UploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry)
+	chunkHandler := handlers.ChunkedUploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), "", lock.NewMemory(), uploadLimits)
+
+	t.Run("Unsupported content type", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/upload", strings.NewReader("Hello, world!"))
+		req.Header.Set("Content-Type", "text/plain")
+		resp := httptest.NewRecorder()
+		uploadHandler.ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected status %d, got %d", http.StatusUnsupportedMediaType, resp.Code)
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/upload?message=Hi", strings.NewReader("Hello, "))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Upload-Complete", "?0")
+		resp := httptest.NewRecorder()
+		uploadHandler.ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusAccepted {
+			t.Fatalf("Expected status %d, got %d", http.StatusAccepted, resp.Code)
+		}
+		fileID := strings.TrimPrefix(resp.Header().Get("Location"), "/upload/")
+
+		req, _ = http.NewRequest("PATCH", "/upload/"+fileID, strings.NewReader("world!"))
+		req.SetPathValue("fileID", fileID)
+		req.Header.Set("Content-Type", "application/partial-upload")
+		req.Header.Set("Upload-Offset", "7")
+		req.Header.Set("Upload-Complete", "?1")
+		resp = httptest.NewRecorder()
+		chunkHandler.ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
+		}
+
+		rc, err := store.OpenRange(hashedID, fileID, 0, -1)
+		if err != nil {
+			t.Fatalf("Failed opening file: %v", err)
+		}
+		b, _ := io.ReadAll(rc)
+		_ = rc.Close()
+		if string(b) != "Hello, world!" {
+			t.Errorf("Expected file contents to be \"Hello, world!\", got \"%s\"", b)
+		}
+
+		transfer, err := metaStore.Get(hashedID, fileID)
+		if err != nil {
+			t.Fatalf("Expected transfer metadata, got error: %v", err)
+		}
+		if transfer.State != meta.StateComplete || transfer.Message != "Hi" {
+			t.Errorf("Expected complete transfer with message, got %+v", transfer)
+		}
+	})
+}
+
+// parseMultipartFormUpload is how uploads were handled before they were streamed, as a baseline for the benchmarks
+func contentDigest(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func TestContentDigest(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	}()
+
+	err = hash.Init(tempDir)
+	if err != nil {
+		t.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	hashedID, err := hash.ToBase64("dev")
+	if err != nil {
+		t.Fatalf("Failed hashing dummy user ID: %v", err)
+	}
+
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	uploadHandler := handlers.UploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry)
+	chunkHandler := handlers.ChunkedUploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), "", lock.NewMemory(), uploadLimits)
+
+	upload := func(body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/upload", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		uploadHandler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	appendChunk := func(fileID string, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PATCH", "/upload/"+fileID, strings.NewReader(body))
+		req.SetPathValue("fileID", fileID)
+		req.Header.Set("Content-Type", "application/partial-upload")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		chunkHandler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	t.Run("Matching digest", func(t *testing.T) {
+		resp := upload("Hello, world!", map[string]string{"Content-Digest": contentDigest("Hello, world!")})
+
+		if resp.Code != http.StatusSeeOther {
+			t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
+		}
+		if digest := resp.Header().Get("Repr-Digest"); digest != contentDigest("Hello, world!") {
+			t.Errorf("Expected Repr-Digest \"%s\", got \"%s\"", contentDigest("Hello, world!"), digest)
+		}
+	})
+
+	t.Run("Mismatching digest", func(t *testing.T) {
+		resp := upload("Hello, world!", map[string]string{"Content-Digest": contentDigest("Goodbye")})
+
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+		if b := resp.Body.String(); !strings.Contains(b, "Content digest mismatch") {
+			t.Errorf("Expected error to be \"Content digest mismatch\", got %s", b)
+		}
+	})
+
+	t.Run("Unsupported algorithm", func(t *testing.T) {
+		resp := upload("Hello, world!", map[string]string{"Content-Digest": "md5=:7Qdih1MuhjZehB6Sv8UNjA==:"})
+
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+		if want := resp.Header().Get("Want-Content-Digest"); want != "sha-256=1" {
+			t.Errorf("Expected Want-Content-Digest \"sha-256=1\", got \"%s\"", want)
+		}
+	})
+
+	t.Run("Running digest", func(t *testing.T) {
+		resp := upload("Hello, ", map[string]string{"Upload-Complete": "?0"})
+		if resp.Code != http.StatusAccepted {
+			t.Fatalf("Expected status %d, got %d", http.StatusAccepted, resp.Code)
+		}
+		fileID := strings.TrimPrefix(resp.Header().Get("Location"), "/upload/")
+
+		resp = appendChunk(fileID, "world", map[string]string{
+			"Upload-Offset":   "7",
+			"Upload-Complete": "?0",
+			"Content-Digest":  contentDigest("Goodbye"),
+		})
+		if resp.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+		}
+
+		resp = appendChunk(fileID, "world", map[string]string{
+			"Upload-Offset":   "7",
+			"Upload-Complete": "?0",
+			"Content-Digest":  contentDigest("world"),
+		})
+		if resp.Code != http.StatusAccepted {
+			t.Fatalf("Expected status %d, got %d", http.StatusAccepted, resp.Code)
+		}
+
+		// data the stored state does not cover is read back from storage
+		err := metaStore.Update(hashedID, fileID, func(t *meta.Transfer) error {
+			t.DigestState = nil
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed updating metadata: %v", err)
+		}
+
+		resp = appendChunk(fileID, "!", map[string]string{
+			"Upload-Offset":   "12",
+			"Upload-Complete": "?1",
+		})
+		if resp.Code != http.StatusSeeOther {
+			t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
+		}
+		if digest := resp.Header().Get("Repr-Digest"); digest != contentDigest("Hello, world!") {
+			t.Errorf("Expected Repr-Digest \"%s\", got \"%s\"", contentDigest("Hello, world!"), digest)
+		}
+
+		transfer, err := metaStore.Get(hashedID, fileID)
+		if err != nil {
+			t.Fatalf("Expected transfer metadata, got error: %v", err)
+		}
+		if transfer.DigestState != nil {
+			t.Errorf("Expected digest state to be removed once complete")
+		}
+
+		download := handlers.DownloadAPI(store, metaStore, lock.NewMemory())
+		resp = mockRequest(download, "GET", "/download/"+hashedID+"/"+fileID, map[string]string{"Range": "bytes=0-4"}, map[string]string{
+			"userID": hashedID,
+			"fileID": fileID,
+		})
+		if digest := resp.Header().Get("Repr-Digest"); digest != contentDigest("Hello, world!") {
+			t.Errorf("Expected Repr-Digest \"%s\", got \"%s\"", contentDigest("Hello, world!"), digest)
+		}
+	})
+
+	t.Run("Mismatching chunk discarded", func(t *testing.T) {
+		for name, newStore := range map[string]func() (storage.Backend, string){
+			// verified while it is written, and truncated
+			"Staged": func() (storage.Backend, string) { return storage.NewFilesystem(t.TempDir()), "" },
+			// verified in the spool directory before it is written
+			"Spooled": func() (storage.Backend, string) { return storage.NewMemory(), t.TempDir() },
+		} {
+			t.Run(name, func(t *testing.T) {
+				store, spoolDir := newStore()
+				uploadHandler := handlers.UploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry)
+				chunkHandler := handlers.ChunkedUploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), spoolDir, lock.NewMemory(), uploadLimits)
+
+				req, _ := http.NewRequest("POST", "/upload", strings.NewReader("Hello, "))
+				req.Header.Set("Content-Type", "application/octet-stream")
+				req.Header.Set("Upload-Complete", "?0")
+				resp := httptest.NewRecorder()
+				uploadHandler.ServeHTTP(resp, req)
+				if resp.Code != http.StatusAccepted {
+					t.Fatalf("Expected status %d, got %d", http.StatusAccepted, resp.Code)
+				}
+				fileID := strings.TrimPrefix(resp.Header().Get("Location"), "/upload/")
+
+				// a raw chunk fails while it is stored, a form only once the rest of the body after the file is read
+				body, writer := createMultipartBody("world")
+				_ = writer.Close()
+				multipartChunk := mockPartialUploadRequest(chunkHandler, fileID, body, writer, map[string]string{
+					"Upload-Offset":   "7",
+					"Upload-Complete": "?0",
+					"Content-Digest":  contentDigest("Goodbye"),
+				})
+
+				req, _ = http.NewRequest("PATCH", "/upload/"+fileID, strings.NewReader("world"))
+				req.SetPathValue("fileID", fileID)
+				req.Header.Set("Content-Type", "application/partial-upload")
+				req.Header.Set("Upload-Offset", "7")
+				req.Header.Set("Upload-Complete", "?0")
+				req.Header.Set("Content-Digest", contentDigest("Goodbye"))
+				rawChunk := httptest.NewRecorder()
+				chunkHandler.ServeHTTP(rawChunk, req)
+
+				for _, resp := range []*httptest.ResponseRecorder{multipartChunk, rawChunk} {
+					if resp.Code != http.StatusBadRequest {
+						t.Errorf("Expected status %d, got %d", http.StatusBadRequest, resp.Code)
+					}
+					if b := resp.Body.String(); !strings.Contains(b, "Content digest mismatch") {
+						t.Errorf("Expected error to be \"Content digest mismatch\", got %s", b)
+					}
+				}
+
+				info, err := store.Stat(hashedID, fileID)
+				if err != nil {
+					t.Fatalf("Failed getting file info: %v", err)
+				}
+				if info.Size != 7 {
+					t.Errorf("Expected the chunks to be discarded, got %d bytes", info.Size)
+				}
+
+				if spoolDir != "" {
+					files, err := os.ReadDir(spoolDir)
+					if err != nil || len(files) != 0 {
+						t.Errorf("Expected no spooled chunks left, got %d, %v", len(files), err)
+					}
+				}
+			})
+		}
+	})
+}
+
+func parseMultipartFormUpload(store storage.Backend, maxUploadSize int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		defer func() {
+			_ = r.MultipartForm.RemoveAll()
+		}()
+
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+
+		_, err = store.Create("user", "file", file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusSeeOther)
+	}
+}
+
+func BenchmarkUpload(b *testing.B) {
+	tempDir, err := os.MkdirTemp("", "bench_uploads")
+	if err != nil {
+		b.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			b.Errorf("Failed deleting temp dir: %v", err)
+		}
+	}()
+
+	err = hash.Init(tempDir)
+	if err != nil {
+		b.Fatalf("Could not initialise hashing package: %v", err)
+	}
+
+	metaStore, err := meta.NewFileStore(filepath.Join(tempDir, "meta"))
+	if err != nil {
+		b.Fatalf("Failed creating metadata store: %v", err)
+	}
+
+	store := storage.NewFilesystem(tempDir)
+	limits := handlers.UploadLimits{MaxSize: 1024 * 1024 * 1024, MaxAppendSize: 1024 * 1024 * 1024}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024*1024/16) // 64 MiB, larger than the in-memory part of ParseMultipartForm
+
+	multipartBody, writer := createMultipartBody(string(data))
+	_ = writer.Close()
+
+	benchmarks := []struct {
+		name        string
+		handler     http.HandlerFunc
+		body        []byte
+		contentType string
+	}{
+		{"ParseMultipartForm", parseMultipartFormUpload(store, limits.MaxAppendSize), multipartBody.Bytes(), writer.FormDataContentType()},
+		{"Multipart", handlers.UploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), lock.NewMemory(), limits, maxExpiry), multipartBody.Bytes(), writer.FormDataContentType()},
+		{"Raw", handlers.UploadAPI("/", &auth.DummyAuth{}, store, metaStore, noQuotas(), noSpaceLimit(), lock.NewMemory(), limits, maxExpiry), data, "application/octet-stream"},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(bm.body))
+				req.Header.Set("Content-Type", bm.contentType)
+				resp := httptest.NewRecorder()
+				bm.handler.ServeHTTP(resp, req)
+
+				if resp.Code != http.StatusSeeOther {
+					b.Fatalf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
+				}
+			}
+		})
+	}
 }
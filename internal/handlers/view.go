@@ -1,20 +1,133 @@
 package handlers
 
 import (
+	"errors"
 	"log/slog"
 	"net/http"
-	"path/filepath"
+	"time"
 
 	"codeberg.org/filesender/filesender-next/internal/auth"
+	"codeberg.org/filesender/filesender-next/internal/hash"
+	"codeberg.org/filesender/filesender-next/internal/id"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/quota"
+	"codeberg.org/filesender/filesender-next/internal/storage"
 )
 
-// GetDownloadTemplate handles GET /view/{userID}/{fileID}
-func GetDownloadTemplate(appRoot string, stateDir string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// getTransfer returns the metadata of a transfer, files uploaded before metadata was stored are complete and never expire
+func getTransfer(metaStore meta.Store, userID string, fileID string) (meta.Transfer, error) {
+	t, err := metaStore.Get(userID, fileID)
+	if errors.Is(err, meta.ErrNotFound) {
+		return meta.Transfer{UserID: userID, FileID: fileID, State: meta.StateComplete}, nil
+	}
+
+	return t, err
+}
+
+// viewPath returns the path of the download page of a transfer, relative to the app root
+// Transfers uploaded before public IDs existed keep their `view/<user_id>/<file_id>` path
+func viewPath(t meta.Transfer) string {
+	if t.PublicID != "" {
+		return "view/" + t.PublicID
+	}
+
+	return "view/" + t.UserID + "/" + t.FileID
+}
+
+// resolveTransfer returns the user & file ID a link refers to, either by `{publicID}` or `{userID}/{fileID}`
+// Sends an error response and returns false if there is no transfer with the public ID, or the IDs are invalid
+func resolveTransfer(w http.ResponseWriter, r *http.Request, metaStore meta.Store) (string, string, bool) {
+	publicID := r.PathValue("publicID")
+	if publicID == "" {
 		userID, fileID := r.PathValue("userID"), r.PathValue("fileID")
+		err := hash.Validate(userID)
+		if err == nil {
+			err = id.Validate(fileID)
+		}
+		if err != nil {
+			slog.Info("Invalid link", "user id", userID, "file id", fileID, "error", err)
+			sendError(w, http.StatusNotFound, "File not found")
+			return "", "", false
+		}
+
+		return userID, fileID, true
+	}
+
+	err := id.Validate(publicID)
+	if err != nil {
+		slog.Info("Invalid public ID", "public id", publicID, "error", err)
+		sendError(w, http.StatusNotFound, "File not found")
+		return "", "", false
+	}
+
+	t, err := metaStore.Resolve(publicID)
+	if errors.Is(err, meta.ErrNotFound) {
+		sendError(w, http.StatusNotFound, "File not found")
+		return "", "", false
+	}
+	if err != nil {
+		slog.Error("Failed resolving public ID", "error", err)
+		sendError(w, http.StatusInternalServerError, "Failed getting specified file")
+		return "", "", false
+	}
+
+	return t.UserID, t.FileID, true
+}
+
+// sendUnavailable sends an error if a transfer can't be downloaded, returns true if an error was sent
+func sendUnavailable(w http.ResponseWriter, t meta.Transfer) bool {
+	if t.State == meta.StateRevoked {
+		sendError(w, http.StatusGone, "File was revoked by sender")
+		return true
+	}
+	if t.Expired(time.Now()) {
+		sendError(w, http.StatusGone, "File has expired")
+		return true
+	}
+	if t.DownloadLimitReached() {
+		sendError(w, http.StatusGone, "Download limit reached")
+		return true
+	}
 
-		filePath := filepath.Join(stateDir, userID, fileID)
-		byteSize, err := getFileSize(filePath)
+	switch t.State {
+	case meta.StateComplete:
+		return false
+	case meta.StateFailed:
+		sendError(w, http.StatusConflict, "Upload not finished: the upload failed")
+	case meta.StateCancelled:
+		sendError(w, http.StatusConflict, "Upload not finished: the upload was cancelled")
+	default:
+		sendError(w, http.StatusConflict, "Upload not finished")
+	}
+
+	return true
+}
+
+// GetDownloadTemplate handles GET /view/{publicID} and GET /view/{userID}/{fileID}
+func GetDownloadTemplate(appRoot string, store storage.Backend, metaStore meta.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, fileID, ok := resolveTransfer(w, r, metaStore)
+		if !ok {
+			return
+		}
+
+		transfer, err := getTransfer(metaStore, userID, fileID)
+		if err != nil {
+			slog.Error("Failed getting transfer metadata", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed getting specified file")
+			return
+		}
+
+		if sendUnavailable(w, transfer) {
+			return
+		}
+
+		// the metadata of revoked and expired transfers was checked above, their data has been deleted
+		info, err := store.Stat(userID, fileID)
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidID) {
+			sendError(w, http.StatusNotFound, "File not found")
+			return
+		}
 		if err != nil {
 			slog.Error("Failed getting file size", "error", err)
 			sendError(w, http.StatusInternalServerError, "Failed getting specified file")
@@ -22,10 +135,18 @@ func GetDownloadTemplate(appRoot string, stateDir string) http.HandlerFunc {
 		}
 
 		data := downloadTemplate{
-			AppRoot:  appRoot,
-			ByteSize: byteSize,
-			UserID:   userID,
-			FileID:   fileID,
+			AppRoot:      appRoot,
+			ByteSize:     info.Size,
+			DownloadPath: "download/" + userID + "/" + fileID,
+			Expiry:       transfer.Expiry,
+			Message:      transfer.Message,
+			Checksum:     transfer.Checksum,
+		}
+		if transfer.PublicID != "" {
+			data.DownloadPath = "download/" + transfer.PublicID
+		}
+		if transfer.MaxDownloads > 0 {
+			data.DownloadsLeft = transfer.MaxDownloads - transfer.Downloads
 		}
 
 		sendTemplate(w, "download", data)
@@ -33,17 +154,35 @@ func GetDownloadTemplate(appRoot string, stateDir string) http.HandlerFunc {
 }
 
 // UploadTemplate handles GET /{$}
-func UploadTemplate(appRoot string, authModule auth.Auth) http.HandlerFunc {
+// Shows who is signed in, the storage used by the user, and their quota
+func UploadTemplate(appRoot string, authModule auth.Auth, quotas *quota.Quotas, maxExpiry time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		_, err := authModule.UserAuth(r)
+		identity, userID, ok := authenticate(w, r, authModule, auth.ScopeRead)
+		if !ok {
+			return
+		}
+
+		used, err := quotas.Usage(userID)
 		if err != nil {
-			slog.Info("unable to authenticate user", "error", err)
-			sendError(w, http.StatusUnauthorized, "You're not authenticated")
+			slog.Error("Failed getting storage usage", "error", err)
+			sendError(w, http.StatusInternalServerError, "Failed getting storage usage")
 			return
 		}
 
+		var email string
+		if len(identity.Emails) > 0 {
+			email = identity.Emails[0]
+		}
+
+		now := time.Now()
 		sendTemplate(w, "upload", uploadTemplate{
-			AppRoot: appRoot,
+			AppRoot:       appRoot,
+			MinExpiryDate: now.UTC().Format(expiryDateLayout),
+			MaxExpiryDate: now.Add(maxExpiry).UTC().Format(expiryDateLayout),
+			QuotaUsed:     used,
+			QuotaLimit:    quotas.Limits.For(identity.Subject, identity.Groups),
+			UserName:      identity.Name(),
+			UserEmail:     email,
 		})
 	}
 }
@@ -1,17 +1,25 @@
 package handlers_test
 
 import (
+	"embed"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"codeberg.org/filesender/filesender-next/internal/assets"
 	"codeberg.org/filesender/filesender-next/internal/auth"
 	"codeberg.org/filesender/filesender-next/internal/handlers"
 	"codeberg.org/filesender/filesender-next/internal/hash"
+	"codeberg.org/filesender/filesender-next/internal/id"
+	"codeberg.org/filesender/filesender-next/internal/lock"
+	"codeberg.org/filesender/filesender-next/internal/meta"
+	"codeberg.org/filesender/filesender-next/internal/quota"
+	"codeberg.org/filesender/filesender-next/internal/storage"
 )
 
 func mockRequest(handler http.HandlerFunc, method string, url string, headers map[string]string, pathValues map[string]string) *httptest.ResponseRecorder {
@@ -41,7 +49,7 @@ func TestGetDownloadTemplate(t *testing.T) {
 		}
 	}()
 
-	handler := handlers.UploadAPI("/", &auth.DummyAuth{}, tempDir, 10*1024*1024) // 10 MB limit
+	handler := handlers.UploadAPI("/", &auth.DummyAuth{}, storage.NewFilesystem(tempDir), newMetaStore(t, tempDir), noQuotas(), noSpaceLimit(), lock.NewMemory(), uploadLimits, maxExpiry)
 	err = hash.Init(tempDir)
 	if err != nil {
 		t.Fatalf("Could not initialise hashing package: %v", err)
@@ -56,10 +64,13 @@ func TestGetDownloadTemplate(t *testing.T) {
 	resp := mockUploadRequest(handler, body, writer, nil)
 	loc := resp.Header().Get("Location")
 
-	handler = handlers.GetDownloadTemplate("/", tempDir)
-	locSplits := strings.Split(loc, "/")
-	userID, fileID := locSplits[2], locSplits[3]
-	println(userID, fileID)
+	handler = handlers.GetDownloadTemplate("/", storage.NewFilesystem(tempDir), newMetaStore(t, tempDir))
+	publicID := path.Base(loc)
+	transfer, err := newMetaStore(t, tempDir).Resolve(publicID)
+	if err != nil {
+		t.Fatalf("Failed resolving public ID: %v", err)
+	}
+	userID, fileID := transfer.UserID, transfer.FileID
 
 	t.Run("User not exist", func(t *testing.T) {
 		resp := mockRequest(handler, "GET", fmt.Sprintf("/view/hi/%s", fileID), nil, map[string]string{
@@ -67,13 +78,13 @@ func TestGetDownloadTemplate(t *testing.T) {
 			"fileID": fileID,
 		})
 
-		if resp.Code != http.StatusInternalServerError {
-			t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
 		}
 
 		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "Failed getting specified file") {
-			t.Errorf("Expected error to be \"Failed getting specified file\", got %s", b)
+		if !strings.Contains(string(b), "File not found") {
+			t.Errorf("Expected error to be \"File not found\", got %s", b)
 		}
 	})
 
@@ -83,13 +94,13 @@ func TestGetDownloadTemplate(t *testing.T) {
 			"fileID": "hi",
 		})
 
-		if resp.Code != http.StatusInternalServerError {
-			t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
 		}
 
 		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "Failed getting specified file") {
-			t.Errorf("Expected error to be \"Failed getting specified file\", got %s", b)
+		if !strings.Contains(string(b), "File not found") {
+			t.Errorf("Expected error to be \"File not found\", got %s", b)
 		}
 	})
 
@@ -99,13 +110,13 @@ func TestGetDownloadTemplate(t *testing.T) {
 			"fileID": "hi",
 		})
 
-		if resp.Code != http.StatusInternalServerError {
-			t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.Code)
 		}
 
 		b := resp.Body.Bytes()
-		if !strings.Contains(string(b), "Failed getting specified file") {
-			t.Errorf("Expected error to be \"Failed getting specified file\", got %s", b)
+		if !strings.Contains(string(b), "File not found") {
+			t.Errorf("Expected error to be \"File not found\", got %s", b)
 		}
 	})
 
@@ -142,11 +153,131 @@ func TestGetDownloadTemplate(t *testing.T) {
 			t.Errorf("Expected response to contain \"1 file (13 bytes)\", got \"%s\"", b)
 		}
 	})
+
+	t.Run("Public ID", func(t *testing.T) {
+		resp := mockRequest(handler, "GET", "/view/"+publicID, nil, map[string]string{
+			"publicID": publicID,
+		})
+
+		if resp.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+
+		b := resp.Body.String()
+		if !strings.Contains(b, "/download/"+publicID) {
+			t.Errorf("Expected download link with the public ID, got \"%s\"", b)
+		}
+		if strings.Contains(b, userID) {
+			t.Errorf("Expected page to not reveal the user ID, got \"%s\"", b)
+		}
+	})
+
+	t.Run("Public ID not found", func(t *testing.T) {
+		for _, publicID := range []string{"hi", "aGlfX19fX19fX19fX19fXw"} {
+			resp := mockRequest(handler, "GET", "/view/"+publicID, nil, map[string]string{
+				"publicID": publicID,
+			})
+
+			if resp.Code != http.StatusNotFound {
+				t.Errorf("Expected status %d for %s, got %d", http.StatusNotFound, publicID, resp.Code)
+			}
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		err := newMetaStore(t, tempDir).Put(meta.Transfer{UserID: userID, FileID: fileID, Expiry: time.Now().Add(-time.Minute)})
+		if err != nil {
+			t.Fatalf("Failed storing metadata: %v", err)
+		}
+
+		resp := mockRequest(handler, "GET", fmt.Sprintf("/view/%s/%s", userID, fileID), nil, map[string]string{
+			"userID": userID,
+			"fileID": fileID,
+		})
+
+		if resp.Code != http.StatusGone {
+			t.Errorf("Expected status %d, got %d", http.StatusGone, resp.Code)
+		}
+
+		b := resp.Body.Bytes()
+		if !strings.Contains(string(b), "File has expired") {
+			t.Errorf("Expected error to be \"File has expired\", got \"%s\"", b)
+		}
+	})
+}
+
+func TestGetDownloadTemplateState(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	}()
+
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	handler := handlers.GetDownloadTemplate("/", store, metaStore)
+
+	tests := []struct {
+		state   meta.State
+		message string
+	}{
+		{meta.StateInProgress, "Upload not finished"},
+		{meta.StateFailed, "Upload not finished: the upload failed"},
+		{meta.StateCancelled, "Upload not finished: the upload was cancelled"},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.state), func(t *testing.T) {
+			fileID, err := id.New()
+			if err != nil {
+				t.Fatalf("Failed creating file ID: %v", err)
+			}
+
+			_, err = store.Create(testUserID, fileID, strings.NewReader("Hello"))
+			if err != nil {
+				t.Fatalf("Failed creating file: %v", err)
+			}
+
+			err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: fileID, State: test.state})
+			if err != nil {
+				t.Fatalf("Failed storing metadata: %v", err)
+			}
+
+			resp := mockRequest(handler, "GET", "/view/"+testUserID+"/"+fileID, nil, map[string]string{
+				"userID": testUserID,
+				"fileID": fileID,
+			})
+
+			if resp.Code != http.StatusConflict {
+				t.Errorf("Expected status %d, got %d", http.StatusConflict, resp.Code)
+			}
+
+			b := resp.Body.Bytes()
+			if !strings.Contains(string(b), test.message) {
+				t.Errorf("Expected error to be \"%s\", got \"%s\"", test.message, b)
+			}
+		})
+	}
+}
+
+// loginAuth is an interactive authentication method where no user is logged in
+type loginAuth struct{}
+
+func (loginAuth) UserAuth(*http.Request) (auth.Identity, error) {
+	return auth.Identity{}, auth.ErrNoSession
+}
+
+func (loginAuth) LoginURL(returnTo string) string {
+	return "/login?return_to=" + returnTo
 }
 
 func TestUploadTemplate(t *testing.T) {
 	t.Run("Not authenticated", func(t *testing.T) {
-		handler := handlers.UploadTemplate("/", &auth.ProxyAuth{})
+		handler := handlers.UploadTemplate("/", &auth.ProxyAuth{}, noQuotas(), maxExpiry)
 		resp := mockRequest(handler, "GET", "/", nil, nil)
 
 		if resp.Code != http.StatusUnauthorized {
@@ -159,12 +290,126 @@ func TestUploadTemplate(t *testing.T) {
 		}
 	})
 
+	t.Run("Login redirect", func(t *testing.T) {
+		handler := handlers.UploadTemplate("/", loginAuth{}, noQuotas(), maxExpiry)
+		resp := mockRequest(handler, "GET", "/?x=1", map[string]string{"Accept": "text/html,*/*"}, nil)
+
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("Expected status %d, got %d", http.StatusSeeOther, resp.Code)
+		}
+		if location := resp.Header().Get("Location"); location != "/login?return_to=/?x=1" {
+			t.Errorf("Expected redirect to login, got %q", location)
+		}
+
+		// API clients still get an error
+		resp = mockRequest(handler, "GET", "/", nil, nil)
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, resp.Code)
+		}
+	})
+
 	t.Run("Success", func(t *testing.T) {
-		handler := handlers.UploadTemplate("/", &auth.DummyAuth{})
+		handler := handlers.UploadTemplate("/", &auth.DummyAuth{}, noQuotas(), maxExpiry)
 		resp := mockRequest(handler, "GET", "/", nil, nil)
 
 		if resp.Code != http.StatusOK {
 			t.Errorf("Expected status %d, got %d", http.StatusOK, resp.Code)
 		}
 	})
+
+	t.Run("Quota", func(t *testing.T) {
+		tempDir := t.TempDir()
+		err := hash.Init(tempDir)
+		if err != nil {
+			t.Fatalf("Could not initialise hashing package: %v", err)
+		}
+
+		hashedID, err := hash.ToBase64("dev")
+		if err != nil {
+			t.Fatalf("Failed hashing dummy user ID: %v", err)
+		}
+
+		store := storage.NewMemory()
+		_, err = store.Create(hashedID, "file", strings.NewReader("Hello"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+
+		handlers.Init(assets.EmbeddedTemplateFiles)
+		defer handlers.Init(embed.FS{}) // other tests expect no templates
+		handler := handlers.UploadTemplate("/", &auth.DummyAuth{}, quota.New(quota.Limits{Default: 100}, store, time.Minute), maxExpiry)
+		resp := mockRequest(handler, "GET", "/", nil, nil)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+		if !strings.Contains(resp.Body.String(), "Storage used: 5 of 100 bytes") {
+			t.Errorf("Expected storage usage in page, got %s", resp.Body.String())
+		}
+	})
+
+	t.Run("Identity", func(t *testing.T) {
+		err := hash.Init(t.TempDir())
+		if err != nil {
+			t.Fatalf("Could not initialise hashing package: %v", err)
+		}
+
+		handlers.Init(assets.EmbeddedTemplateFiles)
+		defer handlers.Init(embed.FS{}) // other tests expect no templates
+		authModule := &auth.DummyAuth{Identity: auth.Identity{
+			Subject:     "alice",
+			DisplayName: "Alice",
+			Emails:      []string{"alice@example.org"},
+			Groups:      []string{"staff"},
+		}}
+		limits := quota.Limits{Default: 100, Groups: map[string]int64{"staff": 1000}}
+		handler := handlers.UploadTemplate("/", authModule, quota.New(limits, storage.NewMemory(), time.Minute), maxExpiry)
+		resp := mockRequest(handler, "GET", "/", nil, nil)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+		if !strings.Contains(resp.Body.String(), "Signed in as Alice (alice@example.org)") {
+			t.Errorf("Expected user in page, got %s", resp.Body.String())
+		}
+		if !strings.Contains(resp.Body.String(), "Storage used: 0 of 1000 bytes") {
+			t.Errorf("Expected the quota of the group of the user, got %s", resp.Body.String())
+		}
+	})
+}
+
+func TestGetDownloadTemplateDownloadLimit(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_uploads")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed closing file %v", err)
+		}
+	}()
+
+	store := storage.NewMemory()
+	metaStore := newMetaStore(t, tempDir)
+	handler := handlers.GetDownloadTemplate("/", store, metaStore)
+
+	const fileID = "ZmlsZV9fX19fX19fX19fXw"
+	_, err = store.Create(testUserID, fileID, strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatalf("Failed creating file: %v", err)
+	}
+
+	err = metaStore.Put(meta.Transfer{UserID: testUserID, FileID: fileID, State: meta.StateComplete, Downloads: 1, MaxDownloads: 1})
+	if err != nil {
+		t.Fatalf("Failed storing metadata: %v", err)
+	}
+
+	resp := mockRequest(handler, "GET", "/view/"+testUserID+"/"+fileID, nil, map[string]string{
+		"userID": testUserID,
+		"fileID": fileID,
+	})
+
+	if resp.Code != http.StatusGone {
+		t.Errorf("Expected status %d, got %d", http.StatusGone, resp.Code)
+	}
 }
@@ -67,6 +67,34 @@ func ToBase64(s string) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(sum), nil
 }
 
+// Validate checks that `encoded` is a hash as returned by ToBase64, e.g. a user ID
+func Validate(encoded string) error {
+	sum, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid format: %v", err)
+	}
+	if len(sum) != sha256.Size {
+		return fmt.Errorf("invalid length: %d", len(sum))
+	}
+
+	return nil
+}
+
+// DeriveKey returns a 32 byte key for `purpose`, derived from the hashing key so it survives restarts
+func DeriveKey(purpose string) ([]byte, error) {
+	if len(hmacKey) != 32 {
+		return nil, fmt.Errorf("key not here: expected 32 bytes, got %d bytes", len(hmacKey))
+	}
+
+	mac := hmac.New(sha256.New, hmacKey)
+	_, err := mac.Write([]byte("filesender key derivation: " + purpose))
+	if err != nil {
+		return nil, err
+	}
+
+	return mac.Sum(nil), nil
+}
+
 // ResetKeyForTest is a test-only helper
 func ResetKeyForTest() {
 	hmacKey = nil
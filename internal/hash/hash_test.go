@@ -90,3 +90,52 @@ func TestToBase64(t *testing.T) {
 		}
 	})
 }
+
+func TestValidate(t *testing.T) {
+	err := hash.Init(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed initialising hashing package: %v", err)
+	}
+
+	h, err := hash.ToBase64("Hello, world!")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	err = hash.Validate(h)
+	if err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	for _, s := range []string{"", "user", "..", "ZmlsZV9fX19fX19fX19fXw", h + "="} {
+		if hash.Validate(s) == nil {
+			t.Errorf("Expected error for %q, got none", s)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	hash.ResetKeyForTest()
+	_, err := hash.DeriveKey("session")
+	if err == nil {
+		t.Errorf("Expected error without key, got none")
+	}
+
+	err = hash.Init(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed initialising hashing package: %v", err)
+	}
+
+	session, err := hash.DeriveKey("session")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	other, err := hash.DeriveKey("other")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(session) != 32 || string(session) == string(other) {
+		t.Errorf("Expected distinct 32 byte keys, got %x and %x", session, other)
+	}
+}
@@ -0,0 +1,44 @@
+package lock
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// File holds locks both within the current process and using lock files in a directory: `<dir>/<key>.lock`
+// Processes sharing the directory can't hold the same lock at the same time
+type File struct {
+	dir    string
+	memory *Memory
+}
+
+// NewFile creates a locker keeping lock files in dir
+func NewFile(dir string) (*File, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("create lock directory: %w", err)
+	}
+
+	return &File{dir: dir, memory: NewMemory()}, nil
+}
+
+// TryLock acquires the lock for key without waiting
+func (f *File) TryLock(key string) (func(), error) {
+	unlockMemory, err := f.memory.TryLock(key)
+	if err != nil {
+		return nil, err
+	}
+
+	unlockFile, err := tryLockFile(filepath.Join(f.dir, url.PathEscape(key)+".lock"))
+	if err != nil {
+		unlockMemory()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile()
+		unlockMemory()
+	}, nil
+}
@@ -0,0 +1,8 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package lock
+
+// tryLockFile is a no-op on platforms without flock, only the in-process lock is held
+func tryLockFile(_ string) (func(), error) {
+	return func() {}, nil
+}
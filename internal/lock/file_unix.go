@@ -0,0 +1,49 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package lock
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes an exclusive flock on the file at path, the file is removed again on unlock
+func tryLockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	// the holder before us may have removed the file after we opened it, in which case someone else can
+	// lock the new file at path
+	opened, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	current, err := os.Stat(path)
+	if err != nil || !os.SameFile(opened, current) {
+		_ = f.Close()
+		return nil, ErrLocked
+	}
+
+	return func() {
+		if err := os.Remove(path); err != nil {
+			slog.Error("Failed removing lock file", "path", path, "error", err)
+		}
+		if err := f.Close(); err != nil {
+			slog.Error("Failed closing lock file", "path", path, "error", err)
+		}
+	}, nil
+}
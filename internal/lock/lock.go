@@ -0,0 +1,64 @@
+// Package lock contains the locks (as an interface) serialising changes to a single upload
+package lock
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrLocked is returned when a lock is already held by someone else
+var ErrLocked = errors.New("locked")
+
+// Locker is an interface for acquiring exclusive locks identified by a key
+type Locker interface {
+	// TryLock acquires the lock for key without waiting, returns ErrLocked if it is already held
+	// The returned function releases the lock
+	TryLock(key string) (func(), error)
+}
+
+// retryInterval is how long Wait sleeps between attempts
+const retryInterval = 10 * time.Millisecond
+
+// Wait acquires the lock for key, retrying while it is held until `timeout` passed, for locks that are only held
+// briefly. Returns ErrLocked if the lock was not released in time
+func Wait(l Locker, key string, timeout time.Duration) (func(), error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		unlock, err := l.TryLock(key)
+		if !errors.Is(err, ErrLocked) || time.Now().After(deadline) {
+			return unlock, err
+		}
+
+		time.Sleep(retryInterval)
+	}
+}
+
+// Memory holds locks within the current process
+type Memory struct {
+	mu   sync.Mutex
+	held map[string]struct{}
+}
+
+// NewMemory creates an in-process locker
+func NewMemory() *Memory {
+	return &Memory{held: map[string]struct{}{}}
+}
+
+// TryLock acquires the lock for key without waiting
+func (m *Memory) TryLock(key string) (func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.held[key]; ok {
+		return nil, ErrLocked
+	}
+	m.held[key] = struct{}{}
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		delete(m.held, key)
+	}, nil
+}
@@ -0,0 +1,112 @@
+package lock_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/lock"
+)
+
+func testLocker(t *testing.T, l lock.Locker) {
+	unlock, err := l.TryLock("user/file")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	_, err = l.TryLock("user/file")
+	if !errors.Is(err, lock.ErrLocked) {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+
+	unlockOther, err := l.TryLock("user/other")
+	if err != nil {
+		t.Fatalf("Expected other key to be unlocked, got %v", err)
+	}
+	unlockOther()
+
+	unlock()
+
+	unlock, err = l.TryLock("user/file")
+	if err != nil {
+		t.Fatalf("Expected lock to be released, got %v", err)
+	}
+	unlock()
+}
+
+func TestWait(t *testing.T) {
+	l := lock.NewMemory()
+	unlock, err := l.TryLock("user/file")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	_, err = lock.Wait(l, "user/file", 20*time.Millisecond)
+	if !errors.Is(err, lock.ErrLocked) {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+
+	time.AfterFunc(20*time.Millisecond, unlock)
+	unlock, err = lock.Wait(l, "user/file", time.Second)
+	if err != nil {
+		t.Fatalf("Expected the lock once it was released, got %v", err)
+	}
+	unlock()
+}
+
+func TestMemory(t *testing.T) {
+	testLocker(t, lock.NewMemory())
+}
+
+func TestFile(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_locks")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed deleting temp dir: %v", err)
+		}
+	}()
+
+	l, err := lock.NewFile(tempDir)
+	if err != nil {
+		t.Fatalf("Failed creating locker: %v", err)
+	}
+	testLocker(t, l)
+
+	t.Run("Shared directory", func(t *testing.T) {
+		// a second locker on the same directory behaves like another process
+		other, err := lock.NewFile(tempDir)
+		if err != nil {
+			t.Fatalf("Failed creating locker: %v", err)
+		}
+
+		unlock, err := l.TryLock("user/file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		_, err = other.TryLock("user/file")
+		if !errors.Is(err, lock.ErrLocked) {
+			t.Errorf("Expected ErrLocked, got %v", err)
+		}
+
+		unlock()
+
+		unlock, err = other.TryLock("user/file")
+		if err != nil {
+			t.Fatalf("Expected lock to be released, got %v", err)
+		}
+		unlock()
+
+		entries, err := os.ReadDir(tempDir)
+		if err != nil {
+			t.Fatalf("Failed reading lock directory: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("Expected lock files to be removed, found %d", len(entries))
+		}
+	})
+}
@@ -0,0 +1,268 @@
+package meta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+var (
+	transfersBucket = []byte("transfers")
+	publicIDsBucket = []byte("public_ids")
+)
+
+// BoltStore stores metadata in an embedded bbolt database
+// Every user has a nested bucket in the "transfers" bucket, containing JSON encoded transfers keyed by file ID
+// The "public_ids" bucket maps public IDs to `<userID>/<fileID>`
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (or creates) the database at path
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(transfersBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(publicIDsBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("create bucket: %w", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func userBucket(tx *bolt.Tx, userID string, create bool) (*bolt.Bucket, error) {
+	root := tx.Bucket(transfersBucket)
+	if !create {
+		return root.Bucket([]byte(userID)), nil
+	}
+
+	return root.CreateBucketIfNotExists([]byte(userID))
+}
+
+func getTransfer(b *bolt.Bucket, fileID string) (Transfer, error) {
+	if b == nil {
+		return Transfer{}, ErrNotFound
+	}
+
+	data := b.Get([]byte(fileID))
+	if data == nil {
+		return Transfer{}, ErrNotFound
+	}
+
+	var t Transfer
+	err := json.Unmarshal(data, &t)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("invalid metadata for %s: %w", fileID, err)
+	}
+
+	return t, nil
+}
+
+// putTransfer stores a transfer in its user bucket, replacing `old` and its public ID
+func putTransfer(tx *bolt.Tx, b *bolt.Bucket, old Transfer, t Transfer) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	publicIDs := tx.Bucket(publicIDsBucket)
+	if old.PublicID != "" && old.PublicID != t.PublicID {
+		err = publicIDs.Delete([]byte(old.PublicID))
+		if err != nil {
+			return err
+		}
+	}
+	if t.PublicID != "" {
+		err = publicIDs.Put([]byte(t.PublicID), []byte(t.UserID+"/"+t.FileID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.Put([]byte(t.FileID), data)
+}
+
+// Put stores the metadata of a transfer, replacing existing metadata
+func (s *BoltStore) Put(t Transfer) error {
+	if !storage.ValidID(t.UserID) || !storage.ValidID(t.FileID) {
+		return fmt.Errorf("invalid ID: %q/%q", t.UserID, t.FileID)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := userBucket(tx, t.UserID, true)
+		if err != nil {
+			return err
+		}
+
+		old, err := getTransfer(b, t.FileID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		return putTransfer(tx, b, old, t)
+	})
+}
+
+// Get returns the metadata of a transfer
+func (s *BoltStore) Get(userID string, fileID string) (Transfer, error) {
+	var t Transfer
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := userBucket(tx, userID, false)
+		if err != nil {
+			return err
+		}
+
+		t, err = getTransfer(b, fileID)
+		return err
+	})
+
+	return t, err
+}
+
+// Resolve returns the metadata of the transfer with a public ID
+func (s *BoltStore) Resolve(publicID string) (Transfer, error) {
+	var t Transfer
+	err := s.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(publicIDsBucket).Get([]byte(publicID))
+		if key == nil {
+			return ErrNotFound
+		}
+
+		userID, fileID, found := strings.Cut(string(key), "/")
+		if !found {
+			return fmt.Errorf("invalid public ID index for %s", publicID)
+		}
+
+		b, err := userBucket(tx, userID, false)
+		if err != nil {
+			return err
+		}
+
+		t, err = getTransfer(b, fileID)
+		return err
+	})
+
+	return t, err
+}
+
+// Update changes the metadata of an existing transfer in a single transaction
+func (s *BoltStore) Update(userID string, fileID string, f func(t *Transfer) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := userBucket(tx, userID, false)
+		if err != nil {
+			return err
+		}
+
+		old, err := getTransfer(b, fileID)
+		if err != nil {
+			return err
+		}
+
+		t := old
+		err = f(&t)
+		if err != nil {
+			return err
+		}
+
+		return putTransfer(tx, b, old, t)
+	})
+}
+
+// Delete removes the metadata of a transfer
+func (s *BoltStore) Delete(userID string, fileID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := userBucket(tx, userID, false)
+		if err != nil {
+			return err
+		}
+		t, err := getTransfer(b, fileID)
+		if errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil && t.PublicID != "" {
+			err = tx.Bucket(publicIDsBucket).Delete([]byte(t.PublicID))
+			if err != nil {
+				return err
+			}
+		}
+
+		return b.Delete([]byte(fileID))
+	})
+}
+
+func listBucket(b *bolt.Bucket) ([]Transfer, error) {
+	transfers := []Transfer{}
+	if b == nil {
+		return transfers, nil
+	}
+
+	err := b.ForEach(func(k []byte, _ []byte) error {
+		t, err := getTransfer(b, string(k))
+		if err != nil {
+			return err
+		}
+
+		transfers = append(transfers, t)
+		return nil
+	})
+
+	return transfers, err
+}
+
+// List returns the metadata of all transfers of a user
+func (s *BoltStore) List(userID string) ([]Transfer, error) {
+	var transfers []Transfer
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := userBucket(tx, userID, false)
+		if err != nil {
+			return err
+		}
+
+		transfers, err = listBucket(b)
+		return err
+	})
+
+	return transfers, err
+}
+
+// All returns the metadata of all transfers
+func (s *BoltStore) All() ([]Transfer, error) {
+	transfers := []Transfer{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(transfersBucket)
+		return root.ForEachBucket(func(k []byte) error {
+			userTransfers, err := listBucket(root.Bucket(k))
+			if err != nil {
+				return err
+			}
+
+			transfers = append(transfers, userTransfers...)
+			return nil
+		})
+	})
+
+	return transfers, err
+}
+
+// Close closes the database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,283 @@
+package meta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+// Directory of the public ID index, can't clash with a user ID as those never start with a dot
+const publicIndexDir = ".public"
+
+// FileStore stores metadata as JSON files: `<dir>/<userID>/<fileID>.json`
+// Public IDs are indexed as `<dir>/.public/<publicID>` files containing `<userID>/<fileID>`
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore creates a file based metadata store in dir
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("create metadata directory: %w", err)
+	}
+
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(userID string, fileID string) (string, error) {
+	if !storage.ValidID(userID) || !storage.ValidID(fileID) {
+		return "", fmt.Errorf("invalid ID: %q/%q", userID, fileID)
+	}
+
+	return filepath.Join(s.dir, userID, fileID+".json"), nil
+}
+
+func (s *FileStore) publicPath(publicID string) (string, error) {
+	if !storage.ValidID(publicID) {
+		return "", fmt.Errorf("invalid public ID: %q", publicID)
+	}
+
+	return filepath.Join(s.dir, publicIndexDir, publicID), nil
+}
+
+// Put stores the metadata of a transfer, replacing existing metadata
+func (s *FileStore) Put(t Transfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(t)
+}
+
+func (s *FileStore) put(t Transfer) error {
+	path, err := s.path(t.UserID, t.FileID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	if t.PublicID != "" {
+		publicPath, err := s.publicPath(t.PublicID)
+		if err != nil {
+			return err
+		}
+
+		err = writeFile(publicPath, []byte(t.UserID+"/"+t.FileID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFile(path, data)
+}
+
+// writeFile replaces a file atomically, creating its directory if needed
+func writeFile(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so readers never see half written metadata
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			slog.Error("Failed removing temporary metadata file", "error", err)
+		}
+	}()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		// the size of an upload is only acknowledged once its metadata is on disk
+		err = tmp.Sync()
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get returns the metadata of a transfer
+func (s *FileStore) Get(userID string, fileID string) (Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(userID, fileID)
+}
+
+func (s *FileStore) get(userID string, fileID string) (Transfer, error) {
+	path, err := s.path(userID, fileID)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Transfer{}, ErrNotFound
+	}
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	var t Transfer
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("invalid metadata %s: %w", path, err)
+	}
+
+	return t, nil
+}
+
+// Resolve returns the metadata of the transfer with a public ID
+func (s *FileStore) Resolve(publicID string) (Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.publicPath(publicID)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Transfer{}, ErrNotFound
+	}
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	userID, fileID, found := strings.Cut(string(data), "/")
+	if !found {
+		return Transfer{}, fmt.Errorf("invalid public ID index %s", path)
+	}
+
+	t, err := s.get(userID, fileID)
+	if err != nil {
+		return Transfer{}, err
+	}
+	if t.PublicID != publicID {
+		// the index outlived the public ID
+		return Transfer{}, ErrNotFound
+	}
+
+	return t, nil
+}
+
+// Update changes the metadata of an existing transfer
+func (s *FileStore) Update(userID string, fileID string, f func(t *Transfer) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.get(userID, fileID)
+	if err != nil {
+		return err
+	}
+
+	err = f(&t)
+	if err != nil {
+		return err
+	}
+
+	return s.put(t)
+}
+
+// Delete removes the metadata of a transfer
+func (s *FileStore) Delete(userID string, fileID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.get(userID, fileID)
+	if errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err != nil {
+		// still remove unreadable metadata
+		slog.Error("Failed reading metadata", "user id", userID, "file id", fileID, "error", err)
+	}
+
+	if t.PublicID != "" {
+		publicPath, err := s.publicPath(t.PublicID)
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(publicPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	path, err := s.path(userID, fileID)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// List returns the metadata of all transfers of a user
+func (s *FileStore) List(userID string) ([]Transfer, error) {
+	if !storage.ValidID(userID) {
+		return nil, fmt.Errorf("invalid ID: %q", userID)
+	}
+
+	return s.glob(filepath.Join(s.dir, userID, "*.json"))
+}
+
+// All returns the metadata of all transfers
+func (s *FileStore) All() ([]Transfer, error) {
+	return s.glob(filepath.Join(s.dir, "*", "*.json"))
+}
+
+func (s *FileStore) glob(pattern string) ([]Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	transfers := []Transfer{}
+	for _, path := range paths {
+		userID := filepath.Base(filepath.Dir(path))
+		fileID := strings.TrimSuffix(filepath.Base(path), ".json")
+
+		t, err := s.get(userID, fileID)
+		if err != nil {
+			slog.Error("Failed reading metadata", "path", path, "error", err)
+			continue
+		}
+
+		transfers = append(transfers, t)
+	}
+
+	return transfers, nil
+}
+
+// Close is a no-op, files are not kept open
+func (s *FileStore) Close() error {
+	return nil
+}
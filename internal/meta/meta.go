@@ -0,0 +1,77 @@
+// Package meta contains the metadata stored for every transfer, and the stores (as an interface) keeping it
+package meta
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned when no metadata exists for a transfer
+var ErrNotFound = errors.New("transfer not found")
+
+// State is the upload state of a transfer
+type State string
+
+// Upload states
+const (
+	StateInProgress State = "in-progress" // data is still being uploaded
+	StateComplete   State = "complete"    // all data has been received, the transfer can be downloaded
+	StateFailed     State = "failed"      // the upload could not be finalised
+	StateCancelled  State = "cancelled"   // the upload was cancelled by the uploader
+	StateRevoked    State = "revoked"     // the data was deleted by the uploader, the metadata is kept for its links
+	StateExpired    State = "expired"     // the data was deleted after the expiry, the metadata is kept for its links
+)
+
+// Transfer contains the metadata of a single transfer
+type Transfer struct {
+	UserID       string    `json:"user_id"`
+	FileID       string    `json:"file_id"`
+	PublicID     string    `json:"public_id,omitempty"` // used in links instead of the user & file ID
+	State        State     `json:"state"`
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+	Expiry       time.Time `json:"expiry"`
+	Size         int64     `json:"size"`
+	DeclaredSize int64     `json:"declared_size,omitempty"`
+	Checksum     string    `json:"checksum,omitempty"`      // base64 encoded SHA-256 of the complete data
+	Downloads    int       `json:"downloads"`               // number of completed downloads
+	MaxDownloads int       `json:"max_downloads,omitempty"` // 0 means unlimited
+	Message      string    `json:"message,omitempty"`
+
+	// bytes sent to downloaders, Downloads is the number of times all of the data has been sent
+	DownloadedBytes int64 `json:"downloaded_bytes,omitempty"`
+
+	// running SHA-256 of an unfinished upload, after the first DigestedSize bytes
+	DigestState  []byte `json:"digest_state,omitempty"`
+	DigestedSize int64  `json:"digested_size,omitempty"`
+}
+
+// Expired checks if the transfer has expired at the given time
+func (t Transfer) Expired(now time.Time) bool {
+	return !t.Expiry.IsZero() && !now.Before(t.Expiry)
+}
+
+// DownloadLimitReached checks if the transfer has been downloaded as often as allowed
+func (t Transfer) DownloadLimitReached() bool {
+	return t.MaxDownloads > 0 && t.Downloads >= t.MaxDownloads
+}
+
+// Store is an interface containing the operations on stored transfer metadata
+type Store interface {
+	// Put stores the metadata of a transfer, replacing existing metadata
+	Put(t Transfer) error
+	// Get returns the metadata of a transfer
+	Get(userID string, fileID string) (Transfer, error)
+	// Resolve returns the metadata of the transfer with a public ID
+	Resolve(publicID string) (Transfer, error)
+	// Update atomically changes the metadata of an existing transfer, nothing is stored if `f` returns an error
+	Update(userID string, fileID string, f func(t *Transfer) error) error
+	// Delete removes the metadata of a transfer
+	Delete(userID string, fileID string) error
+	// List returns the metadata of all transfers of a user
+	List(userID string) ([]Transfer, error)
+	// All returns the metadata of all transfers
+	All() ([]Transfer, error)
+	// Close releases resources held by the store
+	Close() error
+}
@@ -0,0 +1,222 @@
+package meta_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/meta"
+)
+
+// testStore runs the same tests against every store implementation
+func testStore(t *testing.T, s meta.Store) {
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	t.Run("Not found", func(t *testing.T) {
+		_, err := s.Get("user", "file")
+		if !errors.Is(err, meta.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+
+		err = s.Update("user", "file", func(_ *meta.Transfer) error { return nil })
+		if !errors.Is(err, meta.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Invalid ID", func(t *testing.T) {
+		err := s.Put(meta.Transfer{UserID: "..", FileID: "file"})
+		if err == nil {
+			t.Errorf("Expected error, got nil")
+		}
+	})
+
+	t.Run("Put & get", func(t *testing.T) {
+		err := s.Put(meta.Transfer{UserID: "user", FileID: "file", State: meta.StateInProgress, Expiry: expiry})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		transfer, err := s.Get("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !transfer.Expiry.Equal(expiry) || transfer.State != meta.StateInProgress {
+			t.Errorf("Expected stored transfer, got %+v", transfer)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		err := s.Update("user", "file", func(t *meta.Transfer) error {
+			t.Size = 13
+			t.State = meta.StateComplete
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		failed := errors.New("failed")
+		err = s.Update("user", "file", func(t *meta.Transfer) error {
+			t.Size = 0
+			return failed
+		})
+		if !errors.Is(err, failed) {
+			t.Errorf("Expected error to be returned, got %v", err)
+		}
+
+		transfer, err := s.Get("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if transfer.Size != 13 || transfer.State != meta.StateComplete {
+			t.Errorf("Expected updated transfer, got %+v", transfer)
+		}
+	})
+
+	t.Run("List & all", func(t *testing.T) {
+		err := s.Put(meta.Transfer{UserID: "other", FileID: "file"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		transfers, err := s.List("user")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(transfers) != 1 || transfers[0].UserID != "user" || transfers[0].FileID != "file" {
+			t.Errorf("Expected one transfer, got %+v", transfers)
+		}
+
+		transfers, err = s.List("nobody")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(transfers) != 0 {
+			t.Errorf("Expected no transfers, got %+v", transfers)
+		}
+
+		transfers, err = s.All()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(transfers) != 2 {
+			t.Errorf("Expected two transfers, got %+v", transfers)
+		}
+	})
+
+	t.Run("Resolve", func(t *testing.T) {
+		err := s.Put(meta.Transfer{UserID: "user", FileID: "shared", PublicID: "public"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		transfer, err := s.Resolve("public")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if transfer.UserID != "user" || transfer.FileID != "shared" {
+			t.Errorf("Expected resolved transfer, got %+v", transfer)
+		}
+
+		err = s.Update("user", "shared", func(t *meta.Transfer) error {
+			t.PublicID = "changed"
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		_, err = s.Resolve("public")
+		if !errors.Is(err, meta.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for the old public ID, got %v", err)
+		}
+
+		err = s.Delete("user", "shared")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		_, err = s.Resolve("changed")
+		if !errors.Is(err, meta.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		err := s.Delete("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		err = s.Delete("user", "file")
+		if !errors.Is(err, meta.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func createTempDir(t *testing.T) string {
+	tempDir, err := os.MkdirTemp("", "test_meta")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed deleting temp dir: %v", err)
+		}
+	})
+
+	return tempDir
+}
+
+func TestFileStore(t *testing.T) {
+	s, err := meta.NewFileStore(createTempDir(t))
+	if err != nil {
+		t.Fatalf("Failed creating store: %v", err)
+	}
+
+	testStore(t, s)
+}
+
+func TestBoltStore(t *testing.T) {
+	s, err := meta.NewBoltStore(filepath.Join(createTempDir(t), "meta.db"))
+	if err != nil {
+		t.Fatalf("Failed creating store: %v", err)
+	}
+	defer func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("Failed closing store: %v", err)
+		}
+	}()
+
+	testStore(t, s)
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+
+	if (meta.Transfer{}).Expired(now) {
+		t.Errorf("Expected transfer without expiry to never expire")
+	}
+	if (meta.Transfer{Expiry: now.Add(time.Second)}).Expired(now) {
+		t.Errorf("Expected transfer to not be expired yet")
+	}
+	if !(meta.Transfer{Expiry: now}).Expired(now) {
+		t.Errorf("Expected transfer to be expired")
+	}
+}
+
+func TestDownloadLimitReached(t *testing.T) {
+	if (meta.Transfer{Downloads: 10}).DownloadLimitReached() {
+		t.Errorf("Expected transfer without maximum downloads to never reach its limit")
+	}
+	if (meta.Transfer{Downloads: 1, MaxDownloads: 2}).DownloadLimitReached() {
+		t.Errorf("Expected transfer to not reach its limit yet")
+	}
+	if !(meta.Transfer{Downloads: 1, MaxDownloads: 1}).DownloadLimitReached() {
+		t.Errorf("Expected transfer to reach its limit")
+	}
+}
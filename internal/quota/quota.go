@@ -0,0 +1,210 @@
+// Package quota contains the storage quotas of users, and the accounting of the storage they use
+package quota
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+// Limits are the storage quotas in bytes, 0 means unlimited
+type Limits struct {
+	Default int64
+	Users   map[string]int64 // by user name, replaces the default and group quotas
+	Groups  map[string]int64 // by group, the largest quota of the groups of a user replaces the default
+}
+
+// For returns the quota of a user
+func (l Limits) For(username string, groups []string) int64 {
+	if limit, ok := l.Users[username]; ok {
+		return limit
+	}
+
+	limit, found := int64(0), false
+	for _, group := range groups {
+		groupLimit, ok := l.Groups[group]
+		if !ok {
+			continue
+		}
+		if groupLimit == 0 {
+			return 0
+		}
+
+		limit, found = max(limit, groupLimit), true
+	}
+	if found {
+		return limit
+	}
+
+	return l.Default
+}
+
+// ParseOverrides parses quotas of users or groups, e.g. `alice=1073741824,staff=0`
+func ParseOverrides(s string) (map[string]int64, error) {
+	overrides := map[string]int64{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid quota %q, expected <name>=<bytes>", entry)
+		}
+
+		limit, err := strconv.ParseUint(strings.TrimSpace(value), 10, 63)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota of %q: %w", name, err)
+		}
+
+		overrides[name] = int64(limit)
+	}
+
+	return overrides, nil
+}
+
+type usage struct {
+	bytes   int64
+	updated time.Time
+}
+
+// Quotas keeps the limits, and the storage used by every user
+// The usage is the size of all files stored for a user, cached for `ttl` and updated when data is added or deleted
+// Data that uploads in progress are writing is reserved, so concurrent uploads can't exceed the quota together
+type Quotas struct {
+	Limits Limits
+
+	store storage.Backend
+	ttl   time.Duration
+
+	mu       sync.Mutex
+	usage    map[string]usage
+	reserved map[string]int64
+}
+
+// New creates quotas with usage computed from the files in store
+func New(limits Limits, store storage.Backend, ttl time.Duration) *Quotas {
+	return &Quotas{
+		Limits:   limits,
+		store:    store,
+		ttl:      ttl,
+		usage:    map[string]usage{},
+		reserved: map[string]int64{},
+	}
+}
+
+// Usage returns the number of bytes stored for a user
+func (q *Quotas) Usage(userID string) (int64, error) {
+	q.mu.Lock()
+	cached, ok := q.usage[userID]
+	q.mu.Unlock()
+	if ok && time.Since(cached.updated) < q.ttl {
+		return cached.bytes, nil
+	}
+
+	files, err := q.store.List(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var bytes int64
+	for _, file := range files {
+		bytes += file.Size
+	}
+
+	q.mu.Lock()
+	q.usage[userID] = usage{bytes: bytes, updated: time.Now()}
+	q.mu.Unlock()
+
+	return bytes, nil
+}
+
+// Add counts `n` bytes stored for a user since the usage was computed
+func (q *Quotas) Add(userID string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cached, ok := q.usage[userID]
+	if !ok {
+		return
+	}
+
+	cached.bytes += n
+	q.usage[userID] = cached
+}
+
+// Forget drops the cached usage of a user, so it is computed again after their files were deleted or changed
+func (q *Quotas) Forget(userID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.usage, userID)
+}
+
+// ForgetAll drops the cached usage of every user
+func (q *Quotas) ForgetAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	clear(q.usage)
+}
+
+// Remaining returns the number of bytes a user can still store, or -1 if their quota is unlimited
+// Data reserved by uploads in progress isn't available
+func (q *Quotas) Remaining(username string, groups []string, userID string) (int64, error) {
+	remaining, release, err := q.Reserve(username, groups, userID, 0)
+	if err != nil {
+		return 0, err
+	}
+	release()
+
+	return remaining, nil
+}
+
+// Reserve checks the bytes a user can still store, and reserves up to `n` of them for an upload in progress
+// Returns the bytes that were available before the reservation, or -1 if the quota is unlimited
+// The caller counts the data written with Add before calling release
+func (q *Quotas) Reserve(username string, groups []string, userID string, n int64) (int64, func(), error) {
+	limit := q.Limits.For(username, groups)
+	if limit == 0 {
+		return -1, func() {}, nil
+	}
+
+	used, err := q.Usage(userID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// data may have been added since the usage was computed
+	if cached, ok := q.usage[userID]; ok {
+		used = cached.bytes
+	}
+
+	remaining := max(limit-used-q.reserved[userID], 0)
+	n = max(min(n, remaining), 0)
+	q.reserved[userID] += n
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			q.reserved[userID] -= n
+			if q.reserved[userID] == 0 {
+				delete(q.reserved, userID)
+			}
+		})
+	}
+
+	return remaining, release, nil
+}
@@ -0,0 +1,197 @@
+package quota_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/quota"
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+func TestLimitsFor(t *testing.T) {
+	limits := quota.Limits{
+		Default: 100,
+		Users:   map[string]int64{"alice": 10, "bob": 0},
+		Groups:  map[string]int64{"staff": 1000, "students": 50, "admins": 0},
+	}
+
+	for _, tc := range []struct {
+		username string
+		groups   []string
+		expected int64
+	}{
+		{"carol", nil, 100},
+		{"alice", []string{"staff"}, 10},
+		{"bob", nil, 0},
+		{"carol", []string{"students"}, 50},
+		{"carol", []string{"students", "staff"}, 1000},
+		{"carol", []string{"staff", "admins"}, 0},
+		{"carol", []string{"unknown"}, 100},
+	} {
+		limit := limits.For(tc.username, tc.groups)
+		if limit != tc.expected {
+			t.Errorf("Expected quota %d for %s %v, got %d", tc.expected, tc.username, tc.groups, limit)
+		}
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	overrides, err := quota.ParseOverrides(" alice=10, bob = 0,")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(overrides) != 2 || overrides["alice"] != 10 || overrides["bob"] != 0 {
+		t.Errorf("Unexpected overrides %v", overrides)
+	}
+
+	overrides, err = quota.ParseOverrides("")
+	if err != nil || len(overrides) != 0 {
+		t.Errorf("Expected no overrides, got %v, %v", overrides, err)
+	}
+
+	for _, s := range []string{"alice", "=10", "alice=-1", "alice=ten"} {
+		_, err := quota.ParseOverrides(s)
+		if err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	store := storage.NewMemory()
+	for _, fileID := range []string{"a", "b"} {
+		_, err := store.Create("user", fileID, strings.NewReader("12345"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+	}
+
+	quotas := quota.New(quota.Limits{Default: 25, Users: map[string]int64{"unlimited": 0}}, store, time.Hour)
+
+	t.Run("Usage", func(t *testing.T) {
+		used, err := quotas.Usage("user")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if used != 10 {
+			t.Errorf("Expected usage 10, got %d", used)
+		}
+
+		used, err = quotas.Usage("nobody")
+		if err != nil || used != 0 {
+			t.Errorf("Expected usage 0 of user without files, got %d, %v", used, err)
+		}
+	})
+
+	t.Run("Cached", func(t *testing.T) {
+		_, err := store.Create("user", "c", strings.NewReader("12345"))
+		if err != nil {
+			t.Fatalf("Failed creating file: %v", err)
+		}
+		quotas.Add("user", 5)
+
+		remaining, err := quotas.Remaining("someone", nil, "user")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if remaining != 10 {
+			t.Errorf("Expected 10 bytes remaining, got %d", remaining)
+		}
+	})
+
+	t.Run("Expired cache", func(t *testing.T) {
+		quotas := quota.New(quota.Limits{Default: 10}, store, 0)
+		quotas.Add("user", 100)
+
+		remaining, err := quotas.Remaining("someone", nil, "user")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if remaining != 0 {
+			t.Errorf("Expected no bytes remaining, got %d", remaining)
+		}
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		remaining, err := quotas.Remaining("unlimited", nil, "user")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if remaining != -1 {
+			t.Errorf("Expected unlimited quota, got %d", remaining)
+		}
+	})
+	t.Run("Forget", func(t *testing.T) {
+		err := store.Delete("user", "c")
+		if err != nil {
+			t.Fatalf("Failed deleting file: %v", err)
+		}
+		quotas.Forget("user")
+
+		remaining, err := quotas.Remaining("someone", nil, "user")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if remaining != 15 {
+			t.Errorf("Expected 15 bytes remaining, got %d", remaining)
+		}
+	})
+}
+
+func TestReserve(t *testing.T) {
+	quotas := quota.New(quota.Limits{Default: 100}, storage.NewMemory(), time.Hour)
+
+	// every upload sees only what the others left
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var admitted int64
+	releases := []func(){}
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			remaining, release, err := quotas.Reserve("someone", nil, "user", 30)
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			admitted += min(remaining, 30)
+			releases = append(releases, release)
+		}()
+	}
+	wg.Wait()
+
+	if admitted != 100 {
+		t.Errorf("Expected 100 bytes admitted, got %d", admitted)
+	}
+
+	remaining, err := quotas.Remaining("someone", nil, "user")
+	if err != nil || remaining != 0 {
+		t.Errorf("Expected no bytes remaining while reserved, got %d, %v", remaining, err)
+	}
+
+	// the written data is counted before the reservations are released
+	quotas.Add("user", 40)
+	for _, release := range releases {
+		release()
+		release()
+	}
+
+	remaining, err = quotas.Remaining("someone", nil, "user")
+	if err != nil || remaining != 60 {
+		t.Errorf("Expected 60 bytes remaining, got %d, %v", remaining, err)
+	}
+
+	quotas.Limits.Users = map[string]int64{"unlimited": 0}
+	remaining, release, err := quotas.Reserve("unlimited", nil, "user", 1000)
+	if err != nil || remaining != -1 {
+		t.Errorf("Expected unlimited quota, got %d, %v", remaining, err)
+	}
+	release()
+}
@@ -0,0 +1,461 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// stagingDir is the directory in root unfinished uploads are written to
+const stagingDir = ".staging"
+
+// Filesystem stores files in a flat directory layout: `<root>/<userID>/<fileID>`
+//
+// Unfinished uploads are written to `<root>/.staging/<userID>/<fileID>` and synced to disk before every write returns,
+// `Complete` atomically renames them into place. So a file at its final path is always complete, even after a crash.
+type Filesystem struct {
+	root string
+}
+
+// NewFilesystem creates a filesystem backend storing files in root
+func NewFilesystem(root string) *Filesystem {
+	return &Filesystem{root: root}
+}
+
+func (fs *Filesystem) userDir(userID string) (string, error) {
+	if !ValidID(userID) {
+		return "", ErrInvalidID
+	}
+
+	return filepath.Join(fs.root, userID), nil
+}
+
+func (fs *Filesystem) filePath(userID string, fileID string) (string, error) {
+	dir, err := fs.userDir(userID)
+	if err != nil {
+		return "", err
+	}
+	if !ValidID(fileID) {
+		return "", ErrInvalidID
+	}
+
+	return filepath.Join(dir, fileID), nil
+}
+
+func (fs *Filesystem) stagingPath(userID string, fileID string) (string, error) {
+	if !ValidID(userID) || !ValidID(fileID) {
+		return "", ErrInvalidID
+	}
+
+	return filepath.Join(fs.root, stagingDir, userID, fileID), nil
+}
+
+// wrapNotExist marks "does not exist" errors with ErrNotFound, keeping the original error
+func wrapNotExist(err error) error {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+
+	return err
+}
+
+// makeStagingDir creates the staging directory of a user, the root directory has to exist
+func (fs *Filesystem) makeStagingDir(userID string) error {
+	dir := filepath.Join(fs.root, stagingDir)
+	for _, d := range []string{dir, filepath.Join(dir, userID)} {
+		err := os.Mkdir(d, 0o700)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncDir syncs a directory to disk, so files created in or renamed into it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// writeSynced copies r to the end of dst and syncs it to disk
+// Data written before a failure is synced as well, so it can be resumed after
+func writeSynced(dst *os.File, r io.Reader) (int64, error) {
+	n, err := io.Copy(dst, r)
+
+	syncErr := dst.Sync()
+	if err == nil {
+		err = syncErr
+	}
+
+	return n, err
+}
+
+// Create creates a new file for user in the staging directory, replacing a file with the same ID
+func (fs *Filesystem) Create(userID string, fileID string, r io.Reader) (int64, error) {
+	stagingPath, err := fs.stagingPath(userID, fileID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = fs.makeStagingDir(userID)
+	if err != nil {
+		slog.Error("Could not create staging directory", "error", err)
+		return 0, err
+	}
+
+	filePath, err := fs.filePath(userID, fileID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	dst, err := os.OpenFile(stagingPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dst.Close(); err != nil {
+			slog.Error("Failed closing file", "error", err)
+		}
+	}()
+
+	n, err := writeSynced(dst, r)
+	if err != nil {
+		slog.Error("Failed copying file contents", "error", err)
+		return 0, err
+	}
+
+	err = syncDir(filepath.Dir(stagingPath))
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Append writes data at the end of an unfinished upload, offset has to match the current file size
+// The data is synced to disk before returning, so the returned size is durable
+func (fs *Filesystem) Append(userID string, fileID string, offset int64, r io.Reader) (int64, error) {
+	stagingPath, err := fs.stagingPath(userID, fileID)
+	if err != nil {
+		return 0, err
+	}
+
+	dst, err := os.OpenFile(stagingPath, os.O_WRONLY, 0o600)
+	if err != nil {
+		slog.Error("Failed opening destination file", "error", err)
+		return 0, wrapNotExist(err)
+	}
+	defer func() {
+		if err := dst.Close(); err != nil {
+			slog.Error("Failed closing file", "error", err)
+		}
+	}()
+
+	info, err := dst.Stat()
+	if err != nil {
+		slog.Error("Failed to get file info", "error", err)
+		return 0, err
+	}
+	if offset != info.Size() {
+		return 0, fmt.Errorf("%w: offset %d, size %d", ErrOffsetMismatch, offset, info.Size())
+	}
+
+	_, err = dst.Seek(offset, io.SeekStart)
+	if err != nil {
+		slog.Error("Failed seeking to offset", "offset", offset, "error", err)
+		return 0, err
+	}
+
+	_, err = writeSynced(dst, r)
+	if err != nil {
+		slog.Error("Failed copying chunk data", "error", err)
+		return 0, err
+	}
+
+	info, err = dst.Stat()
+	if err != nil {
+		slog.Error("Failed to get file info", "error", err)
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// Complete atomically moves a staged upload into place, creating the user directory if it does not exist yet
+func (fs *Filesystem) Complete(userID string, fileID string) error {
+	stagingPath, err := fs.stagingPath(userID, fileID)
+	if err != nil {
+		return err
+	}
+
+	filePath, err := fs.filePath(userID, fileID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(stagingPath); os.IsNotExist(err) {
+		// already completed
+		_, err = fs.Stat(userID, fileID)
+		return err
+	}
+
+	uploadDest := filepath.Dir(filePath)
+	if _, err := os.Stat(uploadDest); os.IsNotExist(err) {
+		err = os.Mkdir(uploadDest, 0o700)
+		if err != nil {
+			slog.Error("Could not create new user directory", "error", err)
+			return err
+		}
+
+		slog.Info("First time upload for user", "user id", userID)
+	}
+
+	err = os.Rename(stagingPath, filePath)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(uploadDest)
+}
+
+// Stat returns information about a complete file, or an upload in progress
+func (fs *Filesystem) Stat(userID string, fileID string) (FileInfo, error) {
+	filePath, err := fs.filePath(userID, fileID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		stagingPath, _ := fs.stagingPath(userID, fileID)
+		fileInfo, err = os.Stat(stagingPath)
+	}
+	if err != nil {
+		return FileInfo{}, wrapNotExist(err)
+	}
+	if fileInfo.IsDir() {
+		return FileInfo{}, ErrNotFound
+	}
+
+	return FileInfo{
+		ID:      fileID,
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+	}, nil
+}
+
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// OpenRange opens a complete file or an upload in progress for reading starting at offset
+func (fs *Filesystem) OpenRange(userID string, fileID string, offset int64, length int64) (io.ReadCloser, error) {
+	filePath, err := fs.filePath(userID, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		stagingPath, _ := fs.stagingPath(userID, fileID)
+		f, err = os.Open(stagingPath)
+	}
+	if err != nil {
+		return nil, wrapNotExist(err)
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		if err := f.Close(); err != nil {
+			slog.Error("Failed closing file", "error", err)
+		}
+		return nil, err
+	}
+
+	if length < 0 {
+		return f, nil
+	}
+
+	return limitedFile{
+		Reader: io.LimitReader(f, length),
+		Closer: f,
+	}, nil
+}
+
+// Delete removes a file, or an upload in progress
+func (fs *Filesystem) Delete(userID string, fileID string) error {
+	filePath, err := fs.filePath(userID, fileID)
+	if err != nil {
+		return err
+	}
+
+	stagingPath, err := fs.stagingPath(userID, fileID)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, path := range []string{stagingPath, filePath} {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		found = true
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// readFiles returns the regular files in dir, a missing directory has no files
+func readFiles(dir string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []FileInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := []FileInfo{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, FileInfo{
+			ID:      entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return files, nil
+}
+
+// List returns all files of a user, including uploads in progress
+func (fs *Filesystem) List(userID string) ([]FileInfo, error) {
+	uploadDir, err := fs.userDir(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := readFiles(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	staged, err := readFiles(filepath.Join(fs.root, stagingDir, userID))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(files, staged...), nil
+}
+
+// Staged returns all uploads in progress
+func (fs *Filesystem) Staged() ([]StagedFile, error) {
+	entries, err := os.ReadDir(filepath.Join(fs.root, stagingDir))
+	if os.IsNotExist(err) {
+		return []StagedFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	staged := []StagedFile{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !ValidID(entry.Name()) {
+			continue
+		}
+
+		files, err := readFiles(filepath.Join(fs.root, stagingDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			staged = append(staged, StagedFile{UserID: entry.Name(), FileInfo: file})
+		}
+	}
+
+	return staged, nil
+}
+
+// Truncate shortens an upload in progress to `size` bytes
+func (fs *Filesystem) Truncate(userID string, fileID string, size int64) error {
+	stagingPath, err := fs.stagingPath(userID, fileID)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(stagingPath, os.O_WRONLY, 0o600)
+	if err != nil {
+		return wrapNotExist(err)
+	}
+
+	err = f.Truncate(size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Stage moves a file back to the staging directory, for uploads in progress that were written in place
+func (fs *Filesystem) Stage(userID string, fileID string) error {
+	filePath, err := fs.filePath(userID, fileID)
+	if err != nil {
+		return err
+	}
+
+	stagingPath, err := fs.stagingPath(userID, fileID)
+	if err != nil {
+		return err
+	}
+
+	err = fs.makeStagingDir(userID)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(filePath, stagingPath)
+	if err != nil {
+		return wrapNotExist(err)
+	}
+
+	return syncDir(filepath.Dir(stagingPath))
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// Memory stores files in memory, useful for testing
+type Memory struct {
+	mu    sync.Mutex
+	files map[string]map[string]*memoryFile
+}
+
+// NewMemory creates an empty in-memory backend
+func NewMemory() *Memory {
+	return &Memory{files: map[string]map[string]*memoryFile{}}
+}
+
+func (m *Memory) get(userID string, fileID string) (*memoryFile, error) {
+	if !ValidID(userID) || !ValidID(fileID) {
+		return nil, ErrInvalidID
+	}
+
+	f, ok := m.files[userID][fileID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return f, nil
+}
+
+// Create creates a new file for user
+func (m *Memory) Create(userID string, fileID string, r io.Reader) (int64, error) {
+	if !ValidID(userID) || !ValidID(fileID) {
+		return 0, ErrInvalidID
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.files[userID] == nil {
+		m.files[userID] = map[string]*memoryFile{}
+	}
+	m.files[userID][fileID] = &memoryFile{data: data, modTime: time.Now()}
+
+	return int64(len(data)), nil
+}
+
+// Append writes data at the end of an existing file, offset has to match the current file size
+func (m *Memory) Append(userID string, fileID string, offset int64, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := m.get(userID, fileID)
+	if err != nil {
+		return 0, err
+	}
+
+	if offset != int64(len(f.data)) {
+		return 0, fmt.Errorf("%w: offset %d, size %d", ErrOffsetMismatch, offset, len(f.data))
+	}
+
+	f.data = append(f.data, data...)
+	f.modTime = time.Now()
+
+	return int64(len(f.data)), nil
+}
+
+// Complete is a no-op, files are written in place
+func (m *Memory) Complete(userID string, fileID string) error {
+	_, err := m.Stat(userID, fileID)
+	return err
+}
+
+// Stat returns information about a file
+func (m *Memory) Stat(userID string, fileID string) (FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := m.get(userID, fileID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{ID: fileID, Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+// OpenRange opens a file for reading starting at offset
+func (m *Memory) OpenRange(userID string, fileID string, offset int64, length int64) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := m.get(userID, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(len(f.data))
+	offset = min(offset, size)
+	end := size
+	if length >= 0 {
+		end = min(offset+length, size)
+	}
+
+	// copy, so later appends don't change what's being read
+	data := bytes.Clone(f.data[offset:end])
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Delete removes a file
+func (m *Memory) Delete(userID string, fileID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.get(userID, fileID); err != nil {
+		return err
+	}
+
+	delete(m.files[userID], fileID)
+	return nil
+}
+
+// List returns all files of a user
+func (m *Memory) List(userID string) ([]FileInfo, error) {
+	if !ValidID(userID) {
+		return nil, ErrInvalidID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files := []FileInfo{}
+	for id, f := range m.files[userID] {
+		files = append(files, FileInfo{ID: id, Size: int64(len(f.data)), ModTime: f.modTime})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ID < files[j].ID
+	})
+
+	return files, nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+type readSeeker struct {
+	backend Backend
+	userID  string
+	fileID  string
+	size    int64
+
+	pos int64
+	rc  io.ReadCloser
+}
+
+// NewReadSeeker returns a io.ReadSeekCloser for a stored file of the given size
+// Readers are opened lazily using `OpenRange`, so seeking itself does not touch the backend
+func NewReadSeeker(backend Backend, userID string, fileID string, size int64) io.ReadSeekCloser {
+	return &readSeeker{
+		backend: backend,
+		userID:  userID,
+		fileID:  fileID,
+		size:    size,
+	}
+}
+
+func (rs *readSeeker) Read(p []byte) (int, error) {
+	if rs.pos >= rs.size {
+		return 0, io.EOF
+	}
+
+	if rs.rc == nil {
+		rc, err := rs.backend.OpenRange(rs.userID, rs.fileID, rs.pos, rs.size-rs.pos)
+		if err != nil {
+			return 0, err
+		}
+		rs.rc = rc
+	}
+
+	n, err := rs.rc.Read(p)
+	rs.pos += int64(n)
+	return n, err
+}
+
+func (rs *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = rs.pos + offset
+	case io.SeekEnd:
+		pos = rs.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if pos != rs.pos {
+		err := rs.Close()
+		if err != nil {
+			return 0, err
+		}
+		rs.pos = pos
+	}
+
+	return pos, nil
+}
+
+func (rs *readSeeker) Close() error {
+	if rs.rc == nil {
+		return nil
+	}
+
+	err := rs.rc.Close()
+	rs.rc = nil
+	return err
+}
@@ -0,0 +1,648 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3MinPartSize is the smallest part size S3 accepts for all but the last part of a multipart upload
+const S3MinPartSize = 5 * 1024 * 1024
+
+// S3Config contains the settings for the S3 backend
+type S3Config struct {
+	Endpoint        string // e.g. `https://s3.eu-central-1.amazonaws.com`, buckets are addressed path-style
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Prefix          string // prepended to every object key
+	PartSize        int64  // size of the multipart upload parts, defaults to S3MinPartSize
+	Client          *http.Client
+}
+
+// S3 stores files in an S3 compatible object store
+//
+// Files are written using multipart uploads: every `Create` starts a multipart upload, `Append` uploads parts and
+// `Complete` finishes the multipart upload. As parts (except the last) have to be at least 5 MiB, chunks that don't fill a
+// complete part are kept in a "pending" object until enough data was received. The upload state is stored as a JSON
+// object next to it, so no local state is needed.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+type s3Part struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+type s3Upload struct {
+	UploadID string    `json:"upload_id"`
+	Parts    []s3Part  `json:"parts"`
+	Size     int64     `json:"size"`
+	Pending  int64     `json:"pending"`
+	Updated  time.Time `json:"updated"`
+}
+
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *s3Error) Is(target error) bool {
+	return target == ErrNotFound && (e.Status == http.StatusNotFound || e.Code == "NoSuchKey" || e.Code == "NoSuchUpload")
+}
+
+// NewS3 creates a S3 backend
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("S3 endpoint and bucket are required")
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = S3MinPartSize
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &S3{cfg: cfg, endpoint: endpoint, client: client}, nil
+}
+
+func (s *S3) fileKey(userID string, fileID string) string {
+	return s.cfg.Prefix + "files/" + userID + "/" + fileID
+}
+
+func (s *S3) stateKey(userID string, fileID string) string {
+	return s.cfg.Prefix + "uploads/" + userID + "/" + fileID + ".json"
+}
+
+func (s *S3) pendingKey(userID string, fileID string) string {
+	return s.cfg.Prefix + "uploads/" + userID + "/" + fileID + ".pending"
+}
+
+// do sends a signed request, responses with a status >= 300 are turned into a *s3Error
+func (s *S3) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	p := strings.TrimSuffix(s.endpoint.Path, "/") + "/" + s.cfg.Bucket
+	if key != "" {
+		p += "/" + key
+	}
+
+	u := *s.endpoint
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	signV4(req, s.cfg.AccessKeyID, s.cfg.SecretAccessKey, s.cfg.Region, sha256Hex(body), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer closeBody(resp)
+
+		s3Err := &s3Error{Status: resp.StatusCode}
+		data, err := io.ReadAll(resp.Body)
+		if err == nil && len(data) > 0 {
+			_ = xml.Unmarshal(data, s3Err)
+		}
+		return nil, s3Err
+	}
+
+	return resp, nil
+}
+
+func closeBody(resp *http.Response) {
+	if err := resp.Body.Close(); err != nil {
+		slog.Error("Failed closing S3 response body", "error", err)
+	}
+}
+
+func (s *S3) getObject(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3) putObject(key string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, nil, nil, data)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+
+	return nil
+}
+
+func (s *S3) deleteObject(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+
+	return nil
+}
+
+func (s *S3) loadUpload(userID string, fileID string) (*s3Upload, error) {
+	data, err := s.getObject(s.stateKey(userID, fileID))
+	if err != nil {
+		return nil, err
+	}
+
+	var state s3Upload
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload state: %w", err)
+	}
+
+	return &state, nil
+}
+
+func (s *S3) saveUpload(userID string, fileID string, state *s3Upload) error {
+	state.Updated = time.Now()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.putObject(s.stateKey(userID, fileID), data)
+}
+
+func (s *S3) uploadPart(key string, state *s3Upload, data []byte) error {
+	number := len(state.Parts) + 1
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {state.UploadID},
+	}
+
+	resp, err := s.do(http.MethodPut, key, query, nil, data)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+
+	state.Parts = append(state.Parts, s3Part{
+		Number: number,
+		ETag:   resp.Header.Get("ETag"),
+		Size:   int64(len(data)),
+	})
+	return nil
+}
+
+// write reads all data from r, uploads every full part and stores what's left as the pending object
+func (s *S3) write(userID string, fileID string, state *s3Upload, r io.Reader) error {
+	key := s.fileKey(userID, fileID)
+	buf := make([]byte, 0, s.cfg.PartSize)
+
+	if state.Pending > 0 {
+		pending, err := s.getObject(s.pendingKey(userID, fileID))
+		if err != nil {
+			return err
+		}
+		buf = append(buf, pending...)
+	}
+
+	for {
+		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if len(buf) == cap(buf) {
+			err := s.uploadPart(key, state, buf)
+			if err != nil {
+				return err
+			}
+
+			state.Size += int64(len(buf)) - state.Pending
+			state.Pending = 0
+			buf = buf[:0]
+
+			// save after every part, so the committed size survives failures later on
+			err = s.saveUpload(userID, fileID, state)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(buf) > 0 || state.Pending > 0 {
+		err := s.putObject(s.pendingKey(userID, fileID), buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	state.Size += int64(len(buf)) - state.Pending
+	state.Pending = int64(len(buf))
+	return s.saveUpload(userID, fileID, state)
+}
+
+// Create starts a new multipart upload and writes data from r into it
+func (s *S3) Create(userID string, fileID string, r io.Reader) (int64, error) {
+	if !ValidID(userID) || !ValidID(fileID) {
+		return 0, ErrInvalidID
+	}
+
+	err := s.Delete(userID, fileID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return 0, err
+	}
+
+	resp, err := s.do(http.MethodPost, s.fileKey(userID, fileID), url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		slog.Error("Failed creating multipart upload", "error", err)
+		return 0, err
+	}
+	defer closeBody(resp)
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return 0, fmt.Errorf("invalid multipart upload response: %w", err)
+	}
+
+	state := &s3Upload{UploadID: result.UploadID}
+	err = s.write(userID, fileID, state, r)
+	if err != nil {
+		slog.Error("Failed writing file contents", "error", err)
+		return 0, err
+	}
+
+	return state.Size, nil
+}
+
+// Append adds data to an upload in progress, S3 only allows appending at the end of the file
+func (s *S3) Append(userID string, fileID string, offset int64, r io.Reader) (int64, error) {
+	if !ValidID(userID) || !ValidID(fileID) {
+		return 0, ErrInvalidID
+	}
+
+	state, err := s.loadUpload(userID, fileID)
+	if err != nil {
+		return 0, err
+	}
+
+	if offset != state.Size {
+		return 0, fmt.Errorf("%w: got %d, expected %d", ErrOffsetMismatch, offset, state.Size)
+	}
+
+	err = s.write(userID, fileID, state, r)
+	if err != nil {
+		slog.Error("Failed writing chunk data", "error", err)
+		return 0, err
+	}
+
+	return state.Size, nil
+}
+
+// Complete finishes the multipart upload, after which the file can be read
+func (s *S3) Complete(userID string, fileID string) error {
+	if !ValidID(userID) || !ValidID(fileID) {
+		return ErrInvalidID
+	}
+
+	state, err := s.loadUpload(userID, fileID)
+	if errors.Is(err, ErrNotFound) {
+		// already completed
+		_, err = s.Stat(userID, fileID)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	key := s.fileKey(userID, fileID)
+	pending := []byte{}
+	if state.Pending > 0 {
+		pending, err = s.getObject(s.pendingKey(userID, fileID))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(state.Parts) == 0 {
+		// small file, a plain object is cheaper than a multipart upload of a single part
+		err = s.putObject(key, pending)
+		if err != nil {
+			return err
+		}
+
+		err = s.abortUpload(key, state)
+	} else {
+		if len(pending) > 0 {
+			err = s.uploadPart(key, state, pending)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.completeUpload(key, state)
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.deleteUploadState(userID, fileID)
+}
+
+func (s *S3) completeUpload(key string, state *s3Upload) error {
+	type completePart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	type completeMultipartUpload struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}
+
+	body := completeMultipartUpload{}
+	for _, p := range state.Parts {
+		body.Parts = append(body.Parts, completePart{PartNumber: p.Number, ETag: p.ETag})
+	}
+
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploadId": {state.UploadID}}, http.Header{"Content-Type": {"application/xml"}}, data)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+
+	// S3 can report an error with a 200 status, after the response headers were sent
+	respData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(respData, []byte("<Error>")) {
+		s3Err := &s3Error{Status: resp.StatusCode}
+		_ = xml.Unmarshal(respData, s3Err)
+		return s3Err
+	}
+
+	return nil
+}
+
+func (s *S3) abortUpload(key string, state *s3Upload) error {
+	resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {state.UploadID}}, nil, nil)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if resp != nil {
+		closeBody(resp)
+	}
+
+	return nil
+}
+
+func (s *S3) deleteUploadState(userID string, fileID string) error {
+	err := s.deleteObject(s.pendingKey(userID, fileID))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	return s.deleteObject(s.stateKey(userID, fileID))
+}
+
+// Stat returns information about a complete file, or an upload in progress
+func (s *S3) Stat(userID string, fileID string) (FileInfo, error) {
+	if !ValidID(userID) || !ValidID(fileID) {
+		return FileInfo{}, ErrInvalidID
+	}
+
+	resp, err := s.do(http.MethodHead, s.fileKey(userID, fileID), nil, nil, nil)
+	if err == nil {
+		closeBody(resp)
+
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return FileInfo{ID: fileID, Size: resp.ContentLength, ModTime: modTime}, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return FileInfo{}, err
+	}
+
+	state, err := s.loadUpload(userID, fileID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{ID: fileID, Size: state.Size, ModTime: state.Updated}, nil
+}
+
+// OpenRange opens a ranged reader of a complete file
+// The parts of a multipart upload can't be read before it's completed, uploads in progress return ErrInProgress
+func (s *S3) OpenRange(userID string, fileID string, offset int64, length int64) (io.ReadCloser, error) {
+	if !ValidID(userID) || !ValidID(fileID) {
+		return nil, ErrInvalidID
+	}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	rangeHeader := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rangeHeader += strconv.FormatInt(offset+length-1, 10)
+	}
+
+	resp, err := s.do(http.MethodGet, s.fileKey(userID, fileID), nil, http.Header{"Range": {rangeHeader}}, nil)
+	if err != nil {
+		var s3Err *s3Error
+		if errors.As(err, &s3Err) && s3Err.Status == http.StatusRequestedRangeNotSatisfiable {
+			// reading at the end of the file
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+
+		_, stateErr := s.loadUpload(userID, fileID)
+		if stateErr == nil {
+			return nil, ErrInProgress
+		}
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Delete removes a file, or aborts an upload in progress
+func (s *S3) Delete(userID string, fileID string) error {
+	if !ValidID(userID) || !ValidID(fileID) {
+		return ErrInvalidID
+	}
+
+	found := false
+
+	state, err := s.loadUpload(userID, fileID)
+	switch {
+	case err == nil:
+		found = true
+		err = s.abortUpload(s.fileKey(userID, fileID), state)
+		if err != nil {
+			return err
+		}
+
+		err = s.deleteUploadState(userID, fileID)
+		if err != nil {
+			return err
+		}
+	case !errors.Is(err, ErrNotFound):
+		return err
+	}
+
+	_, err = s.Stat(userID, fileID)
+	switch {
+	case err == nil:
+		found = true
+		err = s.deleteObject(s.fileKey(userID, fileID))
+		if err != nil {
+			return err
+		}
+	case !errors.Is(err, ErrNotFound):
+		return err
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+func (s *S3) listObjects(prefix string) ([]s3Object, error) {
+	objects := []s3Object{}
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		closeBody(resp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid list response: %w", err)
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// List returns all files of a user, including uploads in progress
+func (s *S3) List(userID string) ([]FileInfo, error) {
+	if !ValidID(userID) {
+		return nil, ErrInvalidID
+	}
+
+	filesPrefix := s.fileKey(userID, "")
+	objects, err := s.listObjects(filesPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []FileInfo{}
+	for _, o := range objects {
+		files = append(files, FileInfo{
+			ID:      strings.TrimPrefix(o.Key, filesPrefix),
+			Size:    o.Size,
+			ModTime: o.LastModified,
+		})
+	}
+
+	uploadsPrefix := s.cfg.Prefix + "uploads/" + userID + "/"
+	objects, err = s.listObjects(uploadsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range objects {
+		fileID, ok := strings.CutSuffix(strings.TrimPrefix(o.Key, uploadsPrefix), ".json")
+		if !ok {
+			continue
+		}
+
+		state, err := s.loadUpload(userID, fileID)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, FileInfo{ID: fileID, Size: state.Size, ModTime: state.Updated})
+	}
+
+	return files, nil
+}
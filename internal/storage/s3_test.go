@@ -0,0 +1,284 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+// fakeS3 is a minimal in-process S3 server, implementing just enough of the API for the S3 backend
+type fakeS3 struct {
+	mu          sync.Mutex
+	minPartSize int
+	objects     map[string][]byte
+	uploads     map[string]map[int][]byte
+	nextID      int
+}
+
+func newFakeS3(minPartSize int) *fakeS3 {
+	return &fakeS3{
+		minPartSize: minPartSize,
+		objects:     map[string][]byte{},
+		uploads:     map[string]map[int][]byte{},
+	}
+}
+
+func (f *fakeS3) sendError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") || r.Header.Get("X-Amz-Date") == "" {
+		f.sendError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "bucket" {
+		f.sendError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, query.Get("prefix"))
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		uploadID := strconv.Itoa(f.nextID)
+		f.uploads[uploadID] = map[int][]byte{}
+		_, _ = fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.sendError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.complete(w, key, query.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			f.sendError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.sendError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, key string, uploadID string, body []byte) {
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		f.sendError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	var req struct {
+		Parts []struct {
+			PartNumber int `xml:"PartNumber"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		f.sendError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	data := []byte{}
+	for i, p := range req.Parts {
+		part, ok := parts[p.PartNumber]
+		if !ok {
+			f.sendError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		if i < len(req.Parts)-1 && len(part) < f.minPartSize {
+			f.sendError(w, http.StatusBadRequest, "EntityTooSmall")
+			return
+		}
+		data = append(data, part...)
+	}
+
+	f.objects[key] = data
+	delete(f.uploads, uploadID)
+	_, _ = fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	keys := []string{}
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	_, _ = fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>", k, len(f.objects[k]), time.Now().UTC().Format(time.RFC3339))
+	}
+	_, _ = fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func newTestS3(t *testing.T, partSize int) (*storage.S3, *fakeS3) {
+	fake := newFakeS3(partSize)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	s3, err := storage.NewS3(storage.S3Config{
+		Endpoint:        server.URL,
+		Bucket:          "bucket",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		Prefix:          "fs/",
+		PartSize:        int64(partSize),
+	})
+	if err != nil {
+		t.Fatalf("Failed creating S3 backend: %v", err)
+	}
+
+	return s3, fake
+}
+
+func TestS3(t *testing.T) {
+	s3, _ := newTestS3(t, 5)
+	testBackend(t, s3)
+}
+
+func TestS3Multipart(t *testing.T) {
+	s3, fake := newTestS3(t, 5)
+
+	t.Run("Parts and pending data", func(t *testing.T) {
+		_, err := s3.Create("user", "file", strings.NewReader("Hel"))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		size, err := s3.Append("user", "file", 3, strings.NewReader("lo, world"))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if size != 12 {
+			t.Errorf("Expected size 12, got %d", size)
+		}
+
+		info, err := s3.Stat("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if info.Size != 12 {
+			t.Errorf("Expected in progress size 12, got %d", info.Size)
+		}
+
+		_, err = s3.Append("user", "file", 12, strings.NewReader("!"))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		err = s3.Complete("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if s := string(fake.objects["fs/files/user/file"]); s != "Hello, world!" {
+			t.Errorf("Expected object to be \"Hello, world!\", got \"%s\"", s)
+		}
+
+		for k := range fake.objects {
+			if strings.HasPrefix(k, "fs/uploads/") {
+				t.Errorf("Expected upload state to be removed, found \"%s\"", k)
+			}
+		}
+		if len(fake.uploads) != 0 {
+			t.Errorf("Expected no multipart uploads in progress, got %d", len(fake.uploads))
+		}
+	})
+
+	t.Run("Offset mismatch", func(t *testing.T) {
+		_, err := s3.Create("user", "mismatch", strings.NewReader("Hello"))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		_, err = s3.Append("user", "mismatch", 3, strings.NewReader("world"))
+		if !errors.Is(err, storage.ErrOffsetMismatch) {
+			t.Errorf("Expected offset mismatch error, got %v", err)
+		}
+	})
+
+	t.Run("List includes uploads in progress", func(t *testing.T) {
+		files, err := s3.List("user")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if len(files) != 2 || files[0].ID != "file" || files[1].ID != "mismatch" || files[1].Size != 5 {
+			t.Errorf("Expected \"file\" and \"mismatch\", got %+v", files)
+		}
+	})
+
+	t.Run("Read upload in progress", func(t *testing.T) {
+		_, err := s3.Create("user", "partial", strings.NewReader("Hello, world"))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		for _, length := range []int64{5, 12, -1} {
+			_, err = s3.OpenRange("user", "partial", 0, length)
+			if !errors.Is(err, storage.ErrInProgress) {
+				t.Errorf("Expected in progress error reading %d bytes, got %v", length, err)
+			}
+		}
+
+		_, err = s3.OpenRange("user", "missing", 0, 5)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected not found error, got %v", err)
+		}
+
+		err = s3.Delete("user", "partial")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	})
+
+	t.Run("Delete upload in progress", func(t *testing.T) {
+		err := s3.Delete("user", "mismatch")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if len(fake.uploads) != 0 {
+			t.Errorf("Expected multipart upload to be aborted, got %d uploads", len(fake.uploads))
+		}
+	})
+}
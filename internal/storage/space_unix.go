@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || linux
+
+package storage
+
+import "syscall"
+
+// FreeSpace returns the number of bytes available to unprivileged processes on the filesystem of the root directory
+// The types of the statfs fields differ between platforms, hence the conversions
+func (fs *Filesystem) FreeSpace() (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(fs.root, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
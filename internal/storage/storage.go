@@ -0,0 +1,79 @@
+// Package storage contains the storage backends (as an interface) used to store uploaded files
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when the requested file does not exist
+var ErrNotFound = errors.New("file not found")
+
+// ErrInvalidID is returned when a user or file ID can't be used as a storage key
+var ErrInvalidID = errors.New("invalid ID")
+
+// ErrOffsetMismatch is returned when data is appended at an offset other than the end of the file
+var ErrOffsetMismatch = errors.New("offset does not match file size")
+
+// ErrInProgress is returned when a backend can only read the data of an upload once it is complete
+var ErrInProgress = errors.New("upload in progress can't be read")
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend is an interface containing the operations needed to store and retrieve uploaded files
+type Backend interface {
+	// Create creates a new file (replacing an existing one) and writes all data from r into it
+	Create(userID string, fileID string, r io.Reader) (int64, error)
+	// Append writes data from r at the end of an existing file, returns the new file size
+	// Returns ErrOffsetMismatch if offset is not the current file size
+	Append(userID string, fileID string, offset int64, r io.Reader) (int64, error)
+	// Complete is called once all data of a file has been received, backends that stage data finalise the file here
+	Complete(userID string, fileID string) error
+	// Stat returns information about a stored file
+	Stat(userID string, fileID string) (FileInfo, error)
+	// OpenRange opens a reader returning `length` bytes starting at `offset`, a negative length reads until the end
+	// Returns ErrInProgress if the backend can't read the data of an upload before it is complete
+	OpenRange(userID string, fileID string, offset int64, length int64) (io.ReadCloser, error)
+	// Delete removes a stored file
+	Delete(userID string, fileID string) error
+	// List returns all files stored for a user
+	List(userID string) ([]FileInfo, error)
+}
+
+// StagedFile is an upload in progress of a user
+type StagedFile struct {
+	UserID string
+	FileInfo
+}
+
+// Stager is implemented by backends that write uploads in progress to a staging location, so they can be reconciled
+// with the metadata after a crash
+type Stager interface {
+	// Staged returns all uploads in progress
+	Staged() ([]StagedFile, error)
+	// Truncate shortens an upload in progress to `size` bytes
+	Truncate(userID string, fileID string, size int64) error
+	// Stage moves a file written in place back to the staging location
+	Stage(userID string, fileID string) error
+}
+
+// ValidID checks if an ID can safely be used as a single path segment / storage key
+func ValidID(s string) bool {
+	if s == "" || s == "." || s == ".." {
+		return false
+	}
+
+	for _, c := range s {
+		if c == '/' || c == '\\' || c == 0 {
+			return false
+		}
+	}
+
+	return true
+}
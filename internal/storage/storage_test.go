@@ -0,0 +1,292 @@
+package storage_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"codeberg.org/filesender/filesender-next/internal/storage"
+)
+
+func readRange(t *testing.T, b storage.Backend, offset int64, length int64) string {
+	rc, err := b.OpenRange("user", "file", offset, length)
+	if err != nil {
+		t.Fatalf("Failed opening range: %v", err)
+	}
+	defer func() {
+		if err := rc.Close(); err != nil {
+			t.Errorf("Failed closing reader: %v", err)
+		}
+	}()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Failed reading range: %v", err)
+	}
+
+	return string(data)
+}
+
+// testBackend runs the same tests against every backend implementation
+func testBackend(t *testing.T, b storage.Backend) {
+	t.Run("Invalid ID", func(t *testing.T) {
+		_, err := b.Create("user", "../file", strings.NewReader(""))
+		if !errors.Is(err, storage.ErrInvalidID) {
+			t.Errorf("Expected ErrInvalidID, got %v", err)
+		}
+
+		_, err = b.Stat("..", "file")
+		if !errors.Is(err, storage.ErrInvalidID) {
+			t.Errorf("Expected ErrInvalidID, got %v", err)
+		}
+	})
+
+	t.Run("File does not exist", func(t *testing.T) {
+		_, err := b.Stat("user", "file")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+
+		_, err = b.Append("user", "file", 0, strings.NewReader("data"))
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Create & append", func(t *testing.T) {
+		n, err := b.Create("user", "file", strings.NewReader("Hello, "))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if n != 7 {
+			t.Errorf("Expected 7 bytes written, got %d", n)
+		}
+
+		size, err := b.Append("user", "file", 7, strings.NewReader("world!"))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if size != 13 {
+			t.Errorf("Expected size 13, got %d", size)
+		}
+
+		_, err = b.Append("user", "file", 3, strings.NewReader("world!"))
+		if !errors.Is(err, storage.ErrOffsetMismatch) {
+			t.Errorf("Expected ErrOffsetMismatch, got %v", err)
+		}
+
+		err = b.Complete("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		info, err := b.Stat("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if info.ID != "file" || info.Size != 13 {
+			t.Errorf("Expected file of 13 bytes, got %+v", info)
+		}
+	})
+
+	t.Run("Open range", func(t *testing.T) {
+		if s := readRange(t, b, 0, -1); s != "Hello, world!" {
+			t.Errorf("Expected \"Hello, world!\", got \"%s\"", s)
+		}
+
+		if s := readRange(t, b, 7, 5); s != "world" {
+			t.Errorf("Expected \"world\", got \"%s\"", s)
+		}
+	})
+
+	t.Run("Read seeker", func(t *testing.T) {
+		rs := storage.NewReadSeeker(b, "user", "file", 13)
+		defer func() {
+			if err := rs.Close(); err != nil {
+				t.Errorf("Failed closing reader: %v", err)
+			}
+		}()
+
+		_, err := rs.Seek(-6, io.SeekEnd)
+		if err != nil {
+			t.Fatalf("Failed seeking: %v", err)
+		}
+
+		data, err := io.ReadAll(rs)
+		if err != nil {
+			t.Fatalf("Failed reading: %v", err)
+		}
+		if string(data) != "world!" {
+			t.Errorf("Expected \"world!\", got \"%s\"", data)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		files, err := b.List("user")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(files) != 1 || files[0].ID != "file" {
+			t.Errorf("Expected only \"file\", got %+v", files)
+		}
+
+		files, err = b.List("nobody")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(files) != 0 {
+			t.Errorf("Expected no files, got %+v", files)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		err := b.Delete("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		_, err = b.Stat("user", "file")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+
+		err = b.Delete("user", "file")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+func TestFilesystem(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_storage")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			t.Errorf("Failed deleting temp dir: %v", err)
+		}
+	}()
+
+	testBackend(t, storage.NewFilesystem(tempDir))
+}
+
+func TestMemory(t *testing.T) {
+	testBackend(t, storage.NewMemory())
+}
+
+func TestFilesystemStaging(t *testing.T) {
+	root := t.TempDir()
+	fs := storage.NewFilesystem(root)
+	stagingPath := filepath.Join(root, ".staging", "user", "file")
+	filePath := filepath.Join(root, "user", "file")
+
+	_, err := fs.Create("user", "file", strings.NewReader("Hello, "))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = fs.Append("user", "file", 7, strings.NewReader("world!"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("Expected no file in place before completing, got %v", err)
+	}
+
+	staged, err := fs.Staged()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(staged) != 1 || staged[0].UserID != "user" || staged[0].ID != "file" || staged[0].Size != 13 {
+		t.Errorf("Expected staged file of 13 bytes, got %+v", staged)
+	}
+
+	files, err := fs.List("user")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(files) != 1 || files[0].Size != 13 {
+		t.Errorf("Expected the upload in progress to be listed, got %+v", files)
+	}
+
+	t.Run("Truncate", func(t *testing.T) {
+		err := fs.Truncate("user", "file", 5)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		info, err := fs.Stat("user", "file")
+		if err != nil || info.Size != 5 {
+			t.Errorf("Expected staged file of 5 bytes, got %+v, %v", info, err)
+		}
+
+		_, err = fs.Append("user", "file", 5, strings.NewReader(", world!"))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	})
+
+	t.Run("Complete", func(t *testing.T) {
+		err := fs.Complete("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if _, err := os.Stat(stagingPath); !os.IsNotExist(err) {
+			t.Errorf("Expected staged file to be moved, got %v", err)
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil || string(data) != "Hello, world!" {
+			t.Errorf("Expected \"Hello, world!\" in place, got %q, %v", data, err)
+		}
+
+		err = fs.Complete("user", "file")
+		if err != nil {
+			t.Errorf("Expected completing twice to succeed, got %v", err)
+		}
+
+		_, err = fs.Append("user", "file", 13, strings.NewReader("!"))
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected complete files not to be appended to, got %v", err)
+		}
+	})
+
+	t.Run("Stage", func(t *testing.T) {
+		err := fs.Stage("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if _, err := os.Stat(stagingPath); err != nil {
+			t.Errorf("Expected file to be staged, got %v", err)
+		}
+
+		err = fs.Stage("user", "missing")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Create replaces a complete file", func(t *testing.T) {
+		err := fs.Complete("user", "file")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		_, err = fs.Create("user", "file", strings.NewReader("new"))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+			t.Errorf("Expected the old file to be removed, got %v", err)
+		}
+		if s := readRange(t, fs, 0, -1); s != "new" {
+			t.Errorf("Expected staged data \"new\", got \"%s\"", s)
+		}
+	})
+}